@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/badjware/gitlabfs/gitlab"
+	"github.com/badjware/gitlabfs/utils"
+)
+
+// checkConfig implements the check subcommand
+// It validates the config file and its access to gitlab, and prints every problem found
+func checkConfig(args []string) error {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	configPath := flags.String("config", findConfig(), "The config file")
+	profile := flags.String("profile", "", "The profile of the config file to apply")
+	flags.Usage = func() {
+		fmt.Println("USAGE:")
+		fmt.Printf("    %s check [-config CONFIG]\n\n", os.Args[0])
+		fmt.Println("OPTIONS:")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *configPath == "" {
+		flags.Usage()
+		return errors.New("the config file is required, none was found in the default locations")
+	}
+
+	var problems []string
+	report := func(format string, a ...interface{}) {
+		problem := utils.Redact(fmt.Sprintf(format, a...))
+		fmt.Println("error: " + problem)
+		problems = append(problems, problem)
+	}
+
+	// Report the settings that are misspelled or misplaced, they would be silently ignored otherwise
+	content, err := readConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	unknown, err := unknownSettings(content)
+	if err != nil {
+		return fmt.Errorf("failed to parse config file: %v", err)
+	}
+	for _, err := range unknown {
+		report("%v", err)
+	}
+	if len(problems) > 0 {
+		// The settings are not loaded while there are unknown ones
+		return fmt.Errorf("found %v problems in %v", len(problems), *configPath)
+	}
+
+	config, err := loadConfig(*configPath, *profile)
+	if err != nil {
+		return err
+	}
+	for _, err := range validateConfig(config) {
+		report("%v", err)
+	}
+
+	gitlabClientParam, err := makeGitlabConfig(config)
+	if err == nil {
+		for _, err := range checkGitlab(context.Background(), config, *gitlabClientParam) {
+			report("%v", err)
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("found %v problems in %v", len(problems), *configPath)
+	}
+	fmt.Printf("%v is valid\n", *configPath)
+	return nil
+}
+
+// validateConfig returns the invalid settings of config, without contacting gitlab
+func validateConfig(config *Config) []error {
+	var errs []error
+	check := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if _, err := utils.ParseLogLevel(config.Log.Level); err != nil {
+		check(fmt.Errorf("log.level: %v", err))
+	}
+	for subsystem, level := range config.Log.Levels {
+		if _, err := utils.ParseLogLevel(level); err != nil {
+			check(fmt.Errorf("log.levels.%v: %v", subsystem, err))
+		}
+	}
+	check(checkEnum("log.format", config.Log.Format, utils.LogFormatText, utils.LogFormatJSON))
+	if config.Log.Output != logOutputDefault && config.Log.Output != logOutputSyslog && config.Log.Output != logOutputJournald {
+		check(fmt.Errorf("log.output must be either \"%v\" or \"%v\", or empty to write the logs to file or stdout", logOutputSyslog, logOutputJournald))
+	}
+
+	_, err := makeLayoutConfig(config)
+	check(err)
+	_, err = makeProjectMode(config)
+	check(err)
+	_, _, err = makeOwnerConfig(config)
+	check(err)
+	_, err = makeGitlabConfig(config)
+	check(err)
+	_, err = makeMaxStoreSize(config)
+	check(err)
+	if config.Git.Ephemeral {
+		_, err = makeEphemeralDir(config)
+		check(err)
+	}
+	_, err = makeEncryptedStore(config)
+	check(err)
+
+	mounts, err := makeMounts(config, "", "")
+	check(err)
+	if err == nil && len(mounts) == 0 {
+		fmt.Println("warning: no mountpoint is configured, it must be passed on the command-line")
+	}
+	pinned := map[string]bool{}
+	for _, m := range mounts {
+		check(checkScope(m, len(config.Mounts) > 0))
+		check(checkMountoptions(m, len(config.Mounts) > 0))
+		_, err := makeGitConfig(m.config)
+		check(err)
+		_, err = makeCloneTrigger(m.config)
+		check(err)
+		_, err = makePins(m.config, pinned)
+		check(err)
+		if _, err := os.Stat(m.mountpoint); os.IsNotExist(err) && !config.FS.CreateMountpoint {
+			check(fmt.Errorf("mountpoint %v does not exist, create it or enable fs.create_mountpoint", m.mountpoint))
+		}
+	}
+	return errs
+}
+
+// checkGitlab returns the problems preventing gitlabfs from fetching the groups and users of config from gitlab
+func checkGitlab(ctx context.Context, config *Config, p gitlab.GitlabClientParam) []error {
+	client, err := gitlab.NewClient(config.Gitlab.URL, config.Gitlab.Token, p)
+	if err != nil {
+		return []error{err}
+	}
+
+	// Fetch the current user to validate each token, even if it's not mounted
+	// The tokens are checked one by one, the client would fail over to the next one otherwise
+	keys, tokens := []string{"gitlab.token"}, []string{config.Gitlab.Token}
+	for i, token := range config.Gitlab.FallbackTokens {
+		keys = append(keys, fmt.Sprintf("gitlab.fallback_tokens[%v]", i))
+		tokens = append(tokens, token)
+	}
+	var errs []error
+	for i, token := range tokens {
+		if token == "" {
+			continue
+		}
+		tokenParam := p
+		tokenParam.IncludeCurrentUser = true
+		tokenParam.FallbackTokens = nil
+		tokenClient, err := gitlab.NewClient(config.Gitlab.URL, token, tokenParam)
+		if err != nil {
+			return []error{err}
+		}
+		_, err = tokenClient.FetchCurrentUser(ctx)
+		switch status := gitlab.StatusCode(err); {
+		case err == nil:
+		case status == 0:
+			// Nothing else can be checked if gitlab cannot be reached
+			return []error{fmt.Errorf("gitlab is unreachable at %v, check gitlab.url: %v", config.Gitlab.URL, err)}
+		case status == http.StatusUnauthorized:
+			errs = append(errs, fmt.Errorf("gitlab rejected the token, it is invalid, revoked or expired, check %v", keys[i]))
+		case status == http.StatusForbidden:
+			errs = append(errs, fmt.Errorf("the token is not allowed to use the api, it requires the read_api scope, check %v", keys[i]))
+		default:
+			errs = append(errs, err)
+		}
+	}
+
+	groupIDs := config.Gitlab.GroupIDs.IDs()
+	userIDs := append([]int{}, config.Gitlab.UserIDs...)
+	for _, m := range config.Mounts {
+		groupIDs = append(groupIDs, m.GroupIDs.IDs()...)
+		userIDs = append(userIDs, m.UserIDs...)
+	}
+	for _, gid := range groupIDs {
+		_, err := client.FetchGroup(ctx, gid)
+		switch status := gitlab.StatusCode(err); {
+		case err == nil:
+		case status == 0:
+			return append(errs, fmt.Errorf("gitlab is unreachable at %v, check gitlab.url: %v", config.Gitlab.URL, err))
+		case status == http.StatusNotFound:
+			errs = append(errs, fmt.Errorf("group %v does not exist, or is not visible with its configured token", gid))
+		default:
+			errs = append(errs, err)
+		}
+	}
+	for _, uid := range userIDs {
+		_, err := client.FetchUser(ctx, uid)
+		switch status := gitlab.StatusCode(err); {
+		case err == nil:
+		case status == 0:
+			return append(errs, fmt.Errorf("gitlab is unreachable at %v, check gitlab.url: %v", config.Gitlab.URL, err))
+		case status == http.StatusNotFound:
+			errs = append(errs, fmt.Errorf("user %v does not exist", uid))
+		default:
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Name of the files opened to refresh a folder and to pull a project
+const (
+	refreshFileName = ".refresh"
+	pullFileName    = ".pull"
+)
+
+// mountedFlags are the flags shared by the subcommands acting on a mounted filesystem
+type mountedFlags struct {
+	flags      *flag.FlagSet
+	configPath *string
+	profile    *string
+}
+
+func newMountedFlags(name string, usage string) *mountedFlags {
+	f := &mountedFlags{flags: flag.NewFlagSet(name, flag.ExitOnError)}
+	f.configPath = f.flags.String("config", findConfig(), "The config file. Used to find the mountpoints when none are passed")
+	f.profile = f.flags.String("profile", "", "The profile of the config file to apply")
+	f.flags.Usage = func() {
+		fmt.Println("USAGE:")
+		fmt.Printf("    %s %s %s\n\n", os.Args[0], name, usage)
+		fmt.Println("OPTIONS:")
+		f.flags.PrintDefaults()
+	}
+	return f
+}
+
+// mountpoints returns the mountpoints passed as argument, or the mountpoints of the config file if there are none
+func (f *mountedFlags) mountpoints(config *Config) ([]string, error) {
+	if f.flags.NArg() > 0 {
+		return f.flags.Args(), nil
+	}
+	mounts, err := makeMounts(config, "", "")
+	if err != nil {
+		return nil, err
+	}
+	if len(mounts) == 0 {
+		f.flags.Usage()
+		return nil, errors.New("mountpoint is not configured in config file and missing from command-line arguments")
+	}
+	mountpoints := make([]string, 0, len(mounts))
+	for _, m := range mounts {
+		mountpoints = append(mountpoints, m.mountpoint)
+	}
+	return mountpoints, nil
+}
+
+// unmountFilesystem implements the umount subcommand
+func unmountFilesystem(args []string) error {
+	f := newMountedFlags("umount", "[-config CONFIG] [MOUNTPOINT...]")
+	f.flags.Parse(args)
+
+	config, err := loadConfig(*f.configPath, *f.profile)
+	if err != nil {
+		return err
+	}
+	mountpoints, err := f.mountpoints(config)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, mountpoint := range mountpoints {
+		if err := unmount(mountpoint, unmountCommands); err != nil {
+			logger.Error("failed to unmount", "mountpoint", mountpoint, "error", err)
+			failed++
+			continue
+		}
+		logger.Info("unmounted", "mountpoint", mountpoint)
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to unmount %v of %v filesystems", failed, len(mountpoints))
+	}
+	return nil
+}
+
+// printStatus implements the status subcommand
+// It prints the stats and the git queue of the mounted filesystems, as exposed in the admin folder
+func printStatus(args []string) error {
+	f := newMountedFlags("status", "[-config CONFIG] [MOUNTPOINT...]")
+	f.flags.Parse(args)
+
+	config, err := loadConfig(*f.configPath, *f.profile)
+	if err != nil {
+		return err
+	}
+	if config.FS.Layout.Admin == "" {
+		return errors.New("the status is read from the admin folder, it must not be disabled in layout.admin")
+	}
+	mountpoints, err := f.mountpoints(config)
+	if err != nil {
+		return err
+	}
+
+	for i, mountpoint := range mountpoints {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("%v:\n", mountpoint)
+		for _, name := range []string{"stats", "queue"} {
+			content, err := ioutil.ReadFile(filepath.Join(mountpoint, config.FS.Layout.Admin, name))
+			if err != nil {
+				return fmt.Errorf("failed to read the status of %v, is it mounted?: %v", mountpoint, err)
+			}
+			fmt.Printf("%v:\n%s", name, content)
+		}
+	}
+	return nil
+}
+
+// refreshFilesystem implements the refresh subcommand
+// It refreshes the folders passed as argument, or the whole filesystem if there are none
+func refreshFilesystem(args []string) error {
+	f := newMountedFlags("refresh", "[-config CONFIG] [PATH...]")
+	f.flags.Parse(args)
+
+	config, err := loadConfig(*f.configPath, *f.profile)
+	if err != nil {
+		return err
+	}
+
+	var refreshFiles []string
+	if f.flags.NArg() > 0 {
+		for _, path := range f.flags.Args() {
+			refreshFiles = append(refreshFiles, filepath.Join(path, refreshFileName))
+		}
+	} else {
+		if config.FS.Layout.Admin == "" {
+			return errors.New("the filesystem is refreshed through the admin folder, pass the folders to refresh or enable layout.admin")
+		}
+		mountpoints, err := f.mountpoints(config)
+		if err != nil {
+			return err
+		}
+		for _, mountpoint := range mountpoints {
+			refreshFiles = append(refreshFiles, filepath.Join(mountpoint, config.FS.Layout.Admin, "refresh"))
+		}
+	}
+
+	for _, refreshFile := range refreshFiles {
+		if err := touch(refreshFile); err != nil {
+			return fmt.Errorf("failed to refresh %v: %v", filepath.Dir(refreshFile), err)
+		}
+	}
+	return nil
+}
+
+// prefetchProjects implements the prefetch subcommand
+// It queues the clone of every project under the folders passed as argument, or of the whole filesystem if there are none
+func prefetchProjects(args []string) error {
+	f := newMountedFlags("prefetch", "[-config CONFIG] [PATH...]")
+	f.flags.Parse(args)
+
+	config, err := loadConfig(*f.configPath, *f.profile)
+	if err != nil {
+		return err
+	}
+	mountpoints, err := f.mountpoints(config)
+	if err != nil {
+		return err
+	}
+
+	// The folders of the layout listing projects found elsewhere already, or no project at all
+	skip := map[string]bool{}
+	mounts, err := makeMounts(config, "", "")
+	if err != nil {
+		return err
+	}
+	for _, m := range mounts {
+		for _, name := range []string{config.FS.Layout.Admin, config.FS.Layout.All, config.FS.Layout.ByID} {
+			if name != "" {
+				skip[filepath.Join(m.mountpoint, name)] = true
+			}
+		}
+	}
+
+	count := 0
+	for _, root := range mountpoints {
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			switch {
+			case d.Type()&fs.ModeSymlink != 0:
+				// In symlink mode, reading the link of a project clones it
+				if _, err := os.Readlink(path); err != nil {
+					return err
+				}
+				count++
+			case d.IsDir() && skip[path]:
+				return filepath.SkipDir
+			case d.IsDir():
+				// In directory mode, the folder of a project is pulled through its pull file, which clones it if there is no local copy yet
+				if _, err := os.Stat(filepath.Join(path, pullFileName)); err == nil {
+					if err := touch(filepath.Join(path, pullFileName)); err != nil {
+						return err
+					}
+					count++
+					return filepath.SkipDir
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to prefetch %v: %v", root, err)
+		}
+	}
+	logger.Info("queued the clone of the projects", "count", count)
+	return nil
+}
+
+// resolveProject implements the path subcommand
+// It prints the location of a project in the mounted filesystems, given its full path or its url
+func resolveProject(args []string) error {
+	f := newMountedFlags("path", "[-config CONFIG] PROJECT")
+	f.flags.Parse(args)
+
+	if f.flags.NArg() != 1 {
+		f.flags.Usage()
+		return errors.New("the path or the url of the project is required")
+	}
+	config, err := loadConfig(*f.configPath, *f.profile)
+	if err != nil {
+		return err
+	}
+	mounts, err := makeMounts(config, "", "")
+	if err != nil {
+		return err
+	}
+	if len(mounts) == 0 {
+		return errors.New("mountpoint is not configured in config file")
+	}
+
+	projectPath := projectPathOf(f.flags.Arg(0), config.Gitlab.URL)
+	for _, m := range mounts {
+		if location, ok := locateProject(m, projectPath); ok {
+			fmt.Println(location)
+			return nil
+		}
+	}
+	return fmt.Errorf("project %v was not found in the mounted filesystems", projectPath)
+}
+
+// projectPathOf returns the full path of the project given its full path or its url, eg: gitlab-org/gitlab for https://gitlab.com/gitlab-org/gitlab/-/tree/master
+func projectPathOf(arg string, gitlabURL string) string {
+	p := arg
+	if u, err := url.Parse(arg); err == nil && u.Scheme != "" {
+		p = strings.Trim(u.Path, "/")
+		// Gitlab may be served under a path, eg: https://example.com/gitlab
+		if g, err := url.Parse(gitlabURL); err == nil && u.Host == g.Host {
+			p = strings.TrimPrefix(p, strings.Trim(g.Path, "/")+"/")
+		}
+	} else if i := strings.Index(arg, ":"); i != -1 {
+		// The scp-like syntax of the ssh urls, eg: git@gitlab.com:gitlab-org/gitlab.git
+		p = arg[i+1:]
+	}
+	// The pages of a project, eg: its files or its merge requests
+	if i := strings.Index(p, "/-/"); i != -1 {
+		p = p[:i]
+	}
+	return strings.TrimSuffix(strings.Trim(p, "/"), ".git")
+}
+
+// locateProject returns where the project at projectPath is in the filesystem of m, and whether it was found
+// The groups along the way are fetched by the filesystem if they are not cached yet
+func locateProject(m *mount, projectPath string) (string, bool) {
+	var candidates []string
+	layout := m.config.FS.Layout
+	if layout.Groups != "" {
+		groupsDir := filepath.Join(m.mountpoint, layout.Groups)
+		entries, _ := os.ReadDir(groupsDir)
+		for _, entry := range entries {
+			fullPath := rootGroupPath(filepath.Join(groupsDir, entry.Name()))
+			if fullPath == "" || !strings.HasPrefix(projectPath, fullPath+"/") {
+				continue
+			}
+			candidates = append(candidates, filepath.Join(groupsDir, entry.Name(), strings.TrimPrefix(projectPath, fullPath+"/")))
+		}
+		// The closest root group first, a subgroup may also be a root group
+		sort.Slice(candidates, func(i, j int) bool { return len(candidates[i]) < len(candidates[j]) })
+	}
+	if layout.Users != "" {
+		// The users are named after their username, their projects are directly in their folder
+		candidates = append(candidates, filepath.Join(m.mountpoint, layout.Users, projectPath))
+	}
+
+	for _, candidate := range candidates {
+		if _, err := os.Lstat(candidate); err == nil {
+			return candidate, true
+		}
+		// The archived projects may be hidden
+		hidden := filepath.Join(filepath.Dir(candidate), "."+filepath.Base(candidate))
+		if _, err := os.Lstat(hidden); err == nil {
+			return hidden, true
+		}
+	}
+	return "", false
+}
+
+// rootGroupPath returns the full path of the group of the folder, read from its .group.json file, or an empty string if it cannot be read
+func rootGroupPath(dir string) string {
+	content, err := ioutil.ReadFile(filepath.Join(dir, ".group.json"))
+	if err != nil {
+		return ""
+	}
+	var info struct {
+		FullPath string `json:"full_path"`
+	}
+	if err := json.Unmarshal(content, &info); err != nil {
+		return ""
+	}
+	return info.FullPath
+}
+
+// touch opens path, which triggers the action of the special files of the filesystem
+func touch(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/badjware/gitlabfs/fs"
+	"gopkg.in/yaml.v2"
+)
+
+// controlServer serves the control api of the running instance on a unix socket, used by the ctl subcommand
+type controlServer struct {
+	health *healthChecker
+	// The params of each mount, in the same order as the mounts of health
+	params []*fs.FSParam
+	// The absolute mountpoint of each mount
+	mountpoints []string
+}
+
+func makeControlSocketPath(config *Config) (string, error) {
+	if config.HTTP.ControlSocket != "" {
+		return config.HTTP.ControlSocket, nil
+	}
+
+	// Default to a socket next to the local clones of the gitlab instance
+	parsedGitlabURL, err := url.Parse(config.Gitlab.URL)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(config.Git.CloneLocation, parsedGitlabURL.Hostname()+profileSuffix(config)+".sock"), nil
+}
+
+// startControlServer serves the control api on the unix socket at path, until the returned listener is closed
+func startControlServer(path string, health *healthChecker, params []*fs.FSParam) (io.Closer, error) {
+	s := &controlServer{
+		health: health,
+		params: params,
+	}
+	for _, m := range health.mounts {
+		mountpoint, err := filepath.Abs(m.mountpoint)
+		if err != nil {
+			return nil, err
+		}
+		s.mountpoints = append(s.mountpoints, mountpoint)
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("another instance of gitlabfs is listening on control socket %v", path)
+		}
+		// Left by an instance which did not exit cleanly
+		os.Remove(path)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create control socket directory: %v", err)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on control socket: %v", err)
+	}
+	// Only the owner of the filesystem can control it
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to restrict access to control socket: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", s.serveStatus)
+	mux.HandleFunc("/queue", s.serveQueue)
+	mux.HandleFunc("/refresh", s.serveAction("path", s.refresh))
+	mux.HandleFunc("/pull", s.serveAction("path", s.pull))
+	mux.HandleFunc("/unmount", s.serveAction("mount", s.unmount))
+
+	go func() {
+		logger.Info("serving control api", "socket", path)
+		if err := http.Serve(listener, mux); err != nil && !errors.Is(err, net.ErrClosed) {
+			logger.Error("control api listener failed", "socket", path, "error", err)
+		}
+	}()
+	return listener, nil
+}
+
+func (s *controlServer) serveStatus(w http.ResponseWriter, r *http.Request) {
+	type mountStatus struct {
+		Name       string        `yaml:"name"`
+		Mountpoint string        `yaml:"mountpoint"`
+		Mounted    bool          `yaml:"mounted"`
+		Stats      yaml.MapSlice `yaml:"stats,omitempty"`
+	}
+	status := make([]mountStatus, 0, len(s.params))
+	for i, param := range s.params {
+		m := mountStatus{
+			Name:       s.health.mounts[i].name,
+			Mountpoint: s.mountpoints[i],
+			Mounted:    s.health.mounts[i].mounted.Load(),
+		}
+		if stats, err := param.Stats(r.Context()); err == nil {
+			// Keep the order of the stats file
+			yaml.Unmarshal(stats, &m.Stats)
+		}
+		status = append(status, m)
+	}
+	writeYAML(w, status)
+}
+
+func (s *controlServer) serveQueue(w http.ResponseWriter, r *http.Request) {
+	type mountQueue struct {
+		Name       string      `yaml:"name"`
+		Mountpoint string      `yaml:"mountpoint"`
+		Queue      interface{} `yaml:"queue"`
+	}
+	queues := make([]mountQueue, 0, len(s.health.mounts))
+	for i, m := range s.health.mounts {
+		queue := m.git.Status()
+		// The errors are exposed in the admin folder
+		queue.RecentErrors = nil
+		queues = append(queues, mountQueue{
+			Name:       m.name,
+			Mountpoint: s.mountpoints[i],
+			Queue:      queue,
+		})
+	}
+	writeYAML(w, queues)
+}
+
+// serveAction serves an action applied to each of the values of the parameter param of the request
+// action is called once with an empty value if there are none
+func (s *controlServer) serveAction(param string, action func(value string) (string, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		values := r.URL.Query()[param]
+		if len(values) == 0 {
+			values = []string{""}
+		}
+		var out strings.Builder
+		for _, value := range values {
+			msg, err := action(value)
+			if err != nil {
+				http.Error(w, out.String()+err.Error(), http.StatusBadRequest)
+				return
+			}
+			fmt.Fprintln(&out, msg)
+		}
+		io.WriteString(w, out.String())
+	}
+}
+
+// resolve returns the index of the mount containing the absolute path
+func (s *controlServer) resolve(path string) (int, error) {
+	found := -1
+	for i, mountpoint := range s.mountpoints {
+		if path != mountpoint && !strings.HasPrefix(path, mountpoint+"/") {
+			continue
+		}
+		// Mounts can be nested, the innermost one serves the path
+		if found == -1 || len(mountpoint) > len(s.mountpoints[found]) {
+			found = i
+		}
+	}
+	if found == -1 {
+		return -1, fmt.Errorf("%v is not in any filesystem of this instance", path)
+	}
+	return found, nil
+}
+
+func (s *controlServer) refresh(path string) (string, error) {
+	if path == "" {
+		for _, param := range s.params {
+			if err := param.Refresh(); err != nil && !errors.Is(err, fs.ErrNotMounted) {
+				return "", err
+			}
+		}
+		return "refreshed every filesystem", nil
+	}
+
+	i, err := s.resolve(path)
+	if err != nil {
+		return "", err
+	}
+	if path == s.mountpoints[i] {
+		if err := s.params[i].Refresh(); err != nil {
+			return "", err
+		}
+	} else if err := touch(filepath.Join(path, refreshFileName)); os.IsNotExist(err) {
+		return "", fmt.Errorf("%v cannot be refreshed, it is not a group or a user", path)
+	} else if err != nil {
+		return "", fmt.Errorf("failed to refresh %v: %v", path, err)
+	}
+	return "refreshed " + path, nil
+}
+
+func (s *controlServer) pull(path string) (string, error) {
+	if path == "" {
+		return "", errors.New("the projects to pull are required")
+	}
+	i, err := s.resolve(path)
+	if err != nil {
+		return "", err
+	}
+	if s.params[i].ProjectMode == fs.ProjectModeSymlink {
+		return "", fmt.Errorf("pulling a project requires project_mode to be %v or %v", fs.ProjectModeDirectory, fs.ProjectModeBrowse)
+	}
+	if err := touch(filepath.Join(path, pullFileName)); os.IsNotExist(err) {
+		return "", fmt.Errorf("%v cannot be pulled, it is not a project", path)
+	} else if err != nil {
+		return "", fmt.Errorf("failed to pull %v: %v", path, err)
+	}
+	return "queued the pull of " + path, nil
+}
+
+// unmount unmounts the mount named or mounted on name, or every mount if name is empty
+// gitlabfs exits once every filesystem is unmounted
+func (s *controlServer) unmount(name string) (string, error) {
+	var unmounted []string
+	for i, m := range s.health.mounts {
+		if name != "" && name != m.name && name != s.mountpoints[i] {
+			continue
+		}
+		if !m.mounted.Load() {
+			if name != "" {
+				return "", fmt.Errorf("%v is not mounted", name)
+			}
+			continue
+		}
+		if err := unmount(s.mountpoints[i], unmountCommands); err != nil {
+			return "", fmt.Errorf("failed to unmount %v: %v", s.mountpoints[i], err)
+		}
+		unmounted = append(unmounted, s.mountpoints[i])
+	}
+	if name != "" && len(unmounted) == 0 {
+		return "", fmt.Errorf("%v is not a filesystem of this instance", name)
+	} else if len(unmounted) == 0 {
+		return "", errors.New("no filesystem is mounted")
+	}
+	return "unmounted " + strings.Join(unmounted, ", "), nil
+}
+
+func writeYAML(w http.ResponseWriter, v interface{}) {
+	out, err := yaml.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(out)
+}
+
+// controlInstance implements the ctl subcommand
+// It sends a command to the running instance through its control socket
+func controlInstance(args []string) error {
+	flags := flag.NewFlagSet("ctl", flag.ExitOnError)
+	configPath := flags.String("config", findConfig(), "The config file of the running instance. Used to find its control socket")
+	profile := flags.String("profile", "", "The profile of the config file applied by the running instance")
+	socketPath := flags.String("socket", "", "The control socket of the running instance. Default to the control socket of the config file")
+	flags.Usage = func() {
+		fmt.Println("USAGE:")
+		fmt.Printf("    %s ctl [-config CONFIG] status\n", os.Args[0])
+		fmt.Printf("    %s ctl [-config CONFIG] queue\n", os.Args[0])
+		fmt.Printf("    %s ctl [-config CONFIG] refresh [PATH...]\n", os.Args[0])
+		fmt.Printf("    %s ctl [-config CONFIG] pull PATH...\n", os.Args[0])
+		fmt.Printf("    %s ctl [-config CONFIG] unmount [MOUNT...]\n\n", os.Args[0])
+		fmt.Println("OPTIONS:")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("the command is required")
+	}
+	if *socketPath == "" {
+		config, err := loadConfig(*configPath, *profile)
+		if err != nil {
+			return err
+		}
+		*socketPath, err = makeControlSocketPath(config)
+		if err != nil {
+			return err
+		}
+	}
+
+	command, commandArgs := flags.Arg(0), flags.Args()[1:]
+	query := url.Values{}
+	method := http.MethodPost
+	switch command {
+	case "status", "queue":
+		method = http.MethodGet
+	case "refresh", "pull":
+		// The paths are resolved by the instance, which may run in another working directory
+		for _, path := range commandArgs {
+			path, err := filepath.Abs(path)
+			if err != nil {
+				return err
+			}
+			query.Add("path", path)
+		}
+	case "unmount":
+		for _, name := range commandArgs {
+			if strings.Contains(name, "/") {
+				// A mountpoint rather than the name of a mount
+				if abs, err := filepath.Abs(name); err == nil {
+					name = abs
+				}
+			}
+			query.Add("mount", name)
+		}
+	default:
+		flags.Usage()
+		return fmt.Errorf("unknown command %v", command)
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", *socketPath)
+			},
+		},
+		// Unmounting waits for the pending fuse requests
+		Timeout: time.Minute,
+	}
+	req, err := http.NewRequest(method, (&url.URL{Scheme: "http", Host: "gitlabfs", Path: "/" + command, RawQuery: query.Encode()}).String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to connect to the running instance on %v, is it running?: %v", *socketPath, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(strings.TrimSpace(string(body)))
+	}
+	fmt.Print(string(body))
+	return nil
+}
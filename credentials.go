@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Name of the credential holding the gitlab token, passed by systemd with LoadCredential. See systemd.exec(5)
+const tokenCredential = "gitlab-token"
+
+// loadCredentials sets the secrets missing from config from the credentials passed by systemd, if any
+// This keeps the token out of the config file and the environment of the unit
+func loadCredentials(config *Config) error {
+	dir := os.Getenv("CREDENTIALS_DIRECTORY")
+	if dir == "" || config.Gitlab.Token != "" {
+		return nil
+	}
+	token, err := ioutil.ReadFile(filepath.Join(dir, tokenCredential))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read credential %v: %v", tokenCredential, err)
+	}
+	config.Gitlab.Token = strings.TrimSpace(string(token))
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+const (
+	// Set in the environment of the background process started by --daemon
+	daemonEnv = "_GITLABFS_DAEMON"
+
+	// Message sent by the background process to report the filesystem is mounted
+	daemonReadyMsg = "ready"
+)
+
+// The arguments gitlabfs is started again with in the background, the ones of the command-line when nil
+// The mount helper sets them, as it's started again under the name of the executable rather than mount.gitlabfs
+var daemonArgs []string
+
+// isDaemonChild returns true if we are the background process started by --daemon
+func isDaemonChild() bool {
+	return os.Getenv(daemonEnv) != ""
+}
+
+// daemonize starts gitlabfs again in the background and waits for the filesystem to be mounted
+// The output of the background process is appended to logPath
+func daemonize(logPath string) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate the gitlabfs executable: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(logPath), 0755); err != nil {
+		return fmt.Errorf("failed to create log directory: %v", err)
+	}
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %v", err)
+	}
+	defer logFile.Close()
+
+	// The background process reports it is ready through this pipe
+	r, w, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("failed to create pipe: %v", err)
+	}
+	defer r.Close()
+
+	args := os.Args[1:]
+	if daemonArgs != nil {
+		args = daemonArgs
+	}
+	cmd := exec.Command(executable, args...)
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.ExtraFiles = []*os.File{w}
+	// Detach from the terminal
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		w.Close()
+		return fmt.Errorf("failed to start gitlabfs in the background: %v", err)
+	}
+	w.Close()
+
+	// Blocks until the background process reports it is ready, or exits
+	msg, _ := ioutil.ReadAll(r)
+	if string(msg) != daemonReadyMsg {
+		cmd.Wait()
+		return fmt.Errorf("gitlabfs failed to start in the background, see %v", logPath)
+	}
+	logger.Info("gitlabfs started in the background", "pid", cmd.Process.Pid)
+	return cmd.Process.Release()
+}
+
+// notifyDaemonReady reports to the foreground process that the filesystem is mounted
+func notifyDaemonReady() {
+	// The pipe is the first of the extra files of the process
+	ready := os.NewFile(3, "ready")
+	if ready == nil {
+		return
+	}
+	ready.Write([]byte(daemonReadyMsg))
+	ready.Close()
+}
+
+func writePIDFile(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create pidfile directory: %v", err)
+	}
+	if err := ioutil.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to write pidfile: %v", err)
+	}
+	return nil
+}
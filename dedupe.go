@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/badjware/gitlabfs/git"
+	"github.com/badjware/gitlabfs/gitlab"
+)
+
+// dedupeLocalCopies implements the dedupe subcommand
+// It shares the objects of the local copies of forks through the pools of the clone location, and reports the space saved
+// The forks are found from gitlab, the local copies of the same fork network share a pool
+func dedupeLocalCopies(args []string) error {
+	flags := flag.NewFlagSet("dedupe", flag.ExitOnError)
+	configPath := flags.String("config", findConfig(), "The config file")
+	profile := flags.String("profile", "", "The profile of the config file to apply")
+	dryRunFlag := flags.Bool("dry-run", false, "Print the local copies that would be deduplicated, without deduplicating them")
+	flags.Usage = func() {
+		fmt.Println("USAGE:")
+		fmt.Printf("    %s dedupe [-config CONFIG] [-dry-run]\n\n", os.Args[0])
+		fmt.Println("OPTIONS:")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *configPath == "" {
+		flags.Usage()
+		return errors.New("the config file is required, none was found in the default locations")
+	}
+	config, err := loadConfig(*configPath, *profile)
+	if err != nil {
+		return err
+	}
+
+	gitlabClientParam, err := makeGitlabConfig(config)
+	if err != nil {
+		return err
+	}
+	gitlabClient, err := gitlab.NewClient(config.Gitlab.URL, config.Gitlab.Token, *gitlabClientParam)
+	if err != nil {
+		return err
+	}
+
+	lockEncryptedStore, err := unlockEncryptedStore(config)
+	if err != nil {
+		return err
+	}
+	defer lockEncryptedStore()
+
+	// The clone location is shared by every mount, so is the git client
+	gitClientParam, err := makeGitConfig(config)
+	if err != nil {
+		return err
+	}
+	// Leave the history to the running instance
+	gitClientParam.HistoryFile = ""
+	gitClient, err := git.NewClient(*gitClientParam)
+	if err != nil {
+		return err
+	}
+	defer gitClient.Close()
+
+	pids, err := gitClient.LocalCopies()
+	if err != nil {
+		return err
+	}
+	report, err := gitClient.Dedupe(forkNetworks(context.Background(), gitlabClient, pids), *dryRunFlag)
+	if err != nil {
+		return err
+	}
+	if *dryRunFlag {
+		for _, planned := range report.Planned {
+			fmt.Printf("would deduplicate %v with %v\n", planned.Repo, planned.Pool)
+		}
+		fmt.Printf("found %v groups of forks, %v local copies to deduplicate, %v left out, their objects use %v\n", report.Networks, report.Deduplicated, report.Skipped, formatSize(report.SizeBefore))
+		return nil
+	}
+	fmt.Printf("deduplicated %v local copies in %v groups of forks, %v left out: saved %v, from %v to %v\n", report.Deduplicated, report.Networks, report.Skipped, formatSize(report.SizeBefore-report.SizeAfter), formatSize(report.SizeBefore), formatSize(report.SizeAfter))
+	return nil
+}
+
+// forkNetworks returns the fork network of each of the projects with the ids pids, as the id of the project at the root of their forks
+// The projects which can't be fetched are left out. A fork of a project which is not visible is rooted at that project
+func forkNetworks(ctx context.Context, fetcher gitlab.ProjectFetcher, pids []int) map[int]int {
+	// The project each project is forked from, the forks of a network share their parents
+	forkedFrom := map[int]int{}
+	parent := func(pid int) (int, error) {
+		if id, ok := forkedFrom[pid]; ok {
+			return id, nil
+		}
+		project, err := fetcher.FetchProject(ctx, pid)
+		if err != nil {
+			return 0, err
+		}
+		forkedFrom[pid] = project.ForkedFromID
+		return project.ForkedFromID, nil
+	}
+
+	networks := map[int]int{}
+	for _, pid := range pids {
+		root := pid
+		// Guard against a cycle, should gitlab ever report one
+		seen := map[int]bool{}
+		for !seen[root] {
+			seen[root] = true
+			id, err := parent(root)
+			if err != nil {
+				if root == pid {
+					logger.Warn("not deduplicating local copy, failed to fetch its project", "pid", pid, "error", err)
+					root = 0
+				}
+				break
+			}
+			if id == 0 {
+				break
+			}
+			root = id
+		}
+		if root != 0 {
+			networks[pid] = root
+		}
+	}
+	return networks
+}
+
+// formatSize returns size in bytes in the binary units of max_store_size, eg: 1.5G
+func formatSize(size int64) string {
+	if size < 0 {
+		return "-" + formatSize(-size)
+	}
+	value, unit := float64(size), ""
+	for _, u := range []string{"K", "M", "G", "T", "P"} {
+		if value < 1024 {
+			break
+		}
+		value, unit = value/1024, u
+	}
+	if unit == "" {
+		return fmt.Sprintf("%vB", size)
+	}
+	return fmt.Sprintf("%.1f%v", value, unit)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/badjware/gitlabfs/gitlab"
+)
+
+// fakeProjectFetcher returns the projects it holds, by id
+type fakeProjectFetcher map[int]*gitlab.Project
+
+func (f fakeProjectFetcher) FetchProject(ctx context.Context, pid int) (*gitlab.Project, error) {
+	if project, ok := f[pid]; ok {
+		return project, nil
+	}
+	return nil, errors.New("404 Not Found")
+}
+
+func (f fakeProjectFetcher) FetchProjectByPath(ctx context.Context, projectPath string) (*gitlab.Project, error) {
+	return nil, errors.New("404 Not Found")
+}
+
+func TestForkNetworks(t *testing.T) {
+	tests := []struct {
+		name     string
+		projects fakeProjectFetcher
+		pids     []int
+		networks map[int]int
+	}{
+		{
+			name:     "not forks",
+			projects: fakeProjectFetcher{1: {ID: 1}, 2: {ID: 2}},
+			pids:     []int{1, 2},
+			networks: map[int]int{1: 1, 2: 2},
+		},
+		{
+			name:     "forks of forks",
+			projects: fakeProjectFetcher{1: {ID: 1}, 2: {ID: 2, ForkedFromID: 1}, 3: {ID: 3, ForkedFromID: 2}},
+			pids:     []int{3, 2, 1},
+			networks: map[int]int{1: 1, 2: 1, 3: 1},
+		},
+		{
+			name:     "fork of a project which is not visible",
+			projects: fakeProjectFetcher{2: {ID: 2, ForkedFromID: 1}, 3: {ID: 3, ForkedFromID: 1}},
+			pids:     []int{2, 3},
+			networks: map[int]int{2: 1, 3: 1},
+		},
+		{
+			name:     "project which is not visible",
+			projects: fakeProjectFetcher{1: {ID: 1}},
+			pids:     []int{1, 2},
+			networks: map[int]int{1: 1},
+		},
+		{
+			name:     "cycle",
+			projects: fakeProjectFetcher{1: {ID: 1, ForkedFromID: 2}, 2: {ID: 2, ForkedFromID: 1}},
+			pids:     []int{1},
+			networks: map[int]int{1: 1},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			networks := forkNetworks(context.Background(), test.projects, test.pids)
+			if !reflect.DeepEqual(networks, test.networks) {
+				t.Errorf("expected %v, got %v", test.networks, networks)
+			}
+		})
+	}
+}
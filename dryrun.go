@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/badjware/gitlabfs/fs"
+	"github.com/badjware/gitlabfs/git"
+	"github.com/badjware/gitlabfs/gitlab"
+)
+
+// dryRunCounts is the number of nodes that would be mounted
+type dryRunCounts struct {
+	groups   int
+	users    int
+	projects int
+}
+
+// dryRunPrinter prints the tree of a mount, as resolved from gitlab
+type dryRunPrinter struct {
+	w      io.Writer
+	gitlab gitlab.GitlabFetcher
+	git    git.GitClientParam
+	counts dryRunCounts
+}
+
+// dryRun prints the tree that would be mounted on every mount, along with the location of the local copy of each project
+// Nothing is mounted and the clone location is left untouched
+func dryRun(ctx context.Context, w io.Writer, mounts []*mount, gitlabClient gitlab.GitlabFetcher, layout *fs.LayoutParam) error {
+	for _, m := range mounts {
+		gitClientParam, err := makeGitConfig(m.config)
+		if err != nil {
+			return err
+		}
+		p := &dryRunPrinter{
+			w:      w,
+			gitlab: gitlabClient,
+			git:    *gitClientParam,
+		}
+
+		fmt.Fprintf(w, "%v (archived projects: %v)\n", m.mountpoint, m.config.Gitlab.ArchivedProjectHandling)
+		groupsIndent := 1
+		if layout.GroupsDir != "" {
+			fmt.Fprintf(w, "  %v/\n", layout.GroupsDir)
+			groupsIndent = 2
+		}
+		for _, gid := range m.config.Gitlab.GroupIDs.IDs() {
+			group, err := gitlabClient.FetchGroup(ctx, gid)
+			if err != nil {
+				fmt.Fprintf(w, "%v<group %v: %v>\n", indent(groupsIndent), gid, err)
+				continue
+			}
+			p.printGroup(ctx, group, group.Name, groupsIndent)
+		}
+
+		usersIndent := 1
+		if layout.UsersDir != "" {
+			fmt.Fprintf(w, "  %v/\n", layout.UsersDir)
+			usersIndent = 2
+		}
+		currentUser, err := gitlabClient.FetchCurrentUser(ctx)
+		if err == nil {
+			p.printUser(ctx, currentUser, usersIndent)
+		}
+		for _, uid := range m.config.Gitlab.UserIDs {
+			if currentUser != nil && currentUser.ID == uid {
+				continue
+			}
+			user, err := gitlabClient.FetchUser(ctx, uid)
+			if err != nil {
+				fmt.Fprintf(w, "%v<user %v: %v>\n", indent(usersIndent), uid, err)
+				continue
+			}
+			p.printUser(ctx, user, usersIndent)
+		}
+
+		fmt.Fprintf(w, "%v groups, %v users, %v projects\n\n", p.counts.groups, p.counts.users, p.counts.projects)
+	}
+	return nil
+}
+
+func (p *dryRunPrinter) printGroup(ctx context.Context, group *gitlab.Group, name string, depth int) {
+	p.counts.groups++
+	fmt.Fprintf(p.w, "%v%v/ (group %v)\n", indent(depth), name, group.ID)
+	content, err := p.gitlab.FetchGroupContent(ctx, group)
+	if err != nil {
+		fmt.Fprintf(p.w, "%v<%v>\n", indent(depth+1), err)
+		return
+	}
+	names := make([]string, 0, len(content.Groups))
+	for name := range content.Groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p.printGroup(ctx, content.Groups[name], name, depth+1)
+	}
+	p.printProjects(content.Projects, depth+1)
+}
+
+func (p *dryRunPrinter) printUser(ctx context.Context, user *gitlab.User, depth int) {
+	p.counts.users++
+	fmt.Fprintf(p.w, "%v%v/ (user %v)\n", indent(depth), user.Name, user.ID)
+	content, err := p.gitlab.FetchUserContent(ctx, user)
+	if err != nil {
+		fmt.Fprintf(p.w, "%v<%v>\n", indent(depth+1), err)
+		return
+	}
+	p.printProjects(content.Projects, depth+1)
+}
+
+func (p *dryRunPrinter) printProjects(projects map[string]*gitlab.Project, depth int) {
+	names := make([]string, 0, len(projects))
+	for name := range projects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p.counts.projects++
+		fmt.Fprintf(p.w, "%v%v -> %v\n", indent(depth), name, git.LocalRepoLoc(p.git, projects[name].ID))
+	}
+}
+
+func indent(depth int) string {
+	return strings.Repeat("  ", depth)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+)
+
+// encryptedStore is a gocryptfs folder holding the local copies encrypted, unlocked on the clone location
+type encryptedStore struct {
+	cipherDir     string
+	cloneLocation string
+	// Arguments of gocryptfs reading the password
+	passArgs []string
+}
+
+// makeEncryptedStore returns the encrypted store of config, or nil if the local copies are not encrypted
+func makeEncryptedStore(config *Config) (*encryptedStore, error) {
+	c := config.Git
+	if c.EncryptedStore == "" {
+		return nil, nil
+	}
+	if c.Ephemeral {
+		return nil, errors.New("git.encrypted_store and git.ephemeral cannot be both set")
+	}
+	if c.EncryptedStore == c.CloneLocation {
+		return nil, errors.New("git.encrypted_store must be another folder than git.clone_location, where it is unlocked")
+	}
+	var passArgs []string
+	switch {
+	case c.EncryptionPassfile != "" && c.EncryptionExtpass != "":
+		return nil, errors.New("git.encryption_passfile and git.encryption_extpass cannot be both set")
+	case c.EncryptionPassfile != "":
+		passArgs = []string{"-passfile", c.EncryptionPassfile}
+	case c.EncryptionExtpass != "":
+		passArgs = []string{"-extpass", c.EncryptionExtpass}
+	default:
+		return nil, errors.New("git.encrypted_store requires git.encryption_passfile or git.encryption_extpass, gitlabfs can't prompt for the password")
+	}
+	if _, err := exec.LookPath("gocryptfs"); err != nil {
+		return nil, fmt.Errorf("git.encrypted_store requires gocryptfs: %v", err)
+	}
+	return &encryptedStore{
+		cipherDir:     c.EncryptedStore,
+		cloneLocation: c.CloneLocation,
+		passArgs:      passArgs,
+	}, nil
+}
+
+// unlock mounts the decrypted view of the store on the clone location, and returns whether it was locked
+// The store is created on first use
+func (s *encryptedStore) unlock() (bool, error) {
+	_, err := os.Stat(s.cloneLocation)
+	if errors.Is(err, syscall.ENOTCONN) {
+		// Left by a gocryptfs which did not exit cleanly
+		logger.Warn("found a stale mount, unmounting it", "mountpoint", s.cloneLocation)
+		if err := unmountStale(s.cloneLocation); err != nil {
+			return false, err
+		}
+	} else if err == nil {
+		if unlocked, err := s.unlocked(); err != nil || unlocked {
+			return false, err
+		}
+	}
+
+	if err := os.MkdirAll(s.cloneLocation, 0700); err != nil {
+		return false, fmt.Errorf("failed to create clone location: %v", err)
+	}
+	if entries, err := os.ReadDir(s.cloneLocation); err != nil {
+		return false, fmt.Errorf("failed to read clone location: %v", err)
+	} else if len(entries) > 0 {
+		// The store would hide them, still in plaintext on the disk
+		return false, fmt.Errorf("clone location %v is not empty, move its content to the unlocked store or remove it before enabling git.encrypted_store", s.cloneLocation)
+	}
+
+	if _, err := os.Stat(filepath.Join(s.cipherDir, "gocryptfs.conf")); os.IsNotExist(err) {
+		logger.Info("creating the encrypted store", "encrypted_store", s.cipherDir)
+		if err := os.MkdirAll(s.cipherDir, 0700); err != nil {
+			return false, fmt.Errorf("failed to create the encrypted store: %v", err)
+		}
+		args := append([]string{"-init", "-q"}, s.passArgs...)
+		if err := runGocryptfs(append(args, "--", s.cipherDir)...); err != nil {
+			return false, fmt.Errorf("failed to create the encrypted store %v: %v", s.cipherDir, err)
+		}
+	}
+
+	logger.Info("unlocking the encrypted store", "encrypted_store", s.cipherDir, "clone_location", s.cloneLocation)
+	args := append([]string{"-q"}, s.passArgs...)
+	if err := runGocryptfs(append(args, "--", s.cipherDir, s.cloneLocation)...); err != nil {
+		return false, fmt.Errorf("failed to unlock the encrypted store %v: %v", s.cipherDir, err)
+	}
+	return true, nil
+}
+
+// runGocryptfs runs gocryptfs with args, its errors, eg: a wrong password, are written to our stderr
+// gocryptfs serves the store from the background once it's mounted, so its output is not read through a pipe which it would keep open
+func runGocryptfs(args ...string) error {
+	cmd := exec.Command("gocryptfs", args...)
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// lock unmounts the decrypted view of the store from the clone location
+func (s *encryptedStore) lock() error {
+	if unlocked, err := s.unlocked(); err != nil || !unlocked {
+		// Not ours to unmount
+		return nil
+	}
+	logger.Info("locking the encrypted store", "encrypted_store", s.cipherDir)
+	if err := unmount(s.cloneLocation, unmountCommands); err != nil {
+		return fmt.Errorf("failed to lock the encrypted store, the local copies are still readable in %v: %v", s.cloneLocation, err)
+	}
+	return nil
+}
+
+// unlockEncryptedStore unlocks the encrypted store of config for a subcommand, and returns the function locking it again if it was locked
+// A store unlocked by a running instance is left unlocked
+func unlockEncryptedStore(config *Config) (func(), error) {
+	store, err := makeEncryptedStore(config)
+	if err != nil || store == nil {
+		return func() {}, err
+	}
+	unlocked, err := store.unlock()
+	if err != nil || !unlocked {
+		return func() {}, err
+	}
+	return func() {
+		if err := store.lock(); err != nil {
+			logger.Error(err.Error())
+		}
+	}, nil
+}
+
+// The type of the filesystems mounted by gocryptfs, as found in the mountinfo
+const gocryptfsType = "fuse.gocryptfs"
+
+// unlocked returns whether the store is unlocked on the clone location
+// It returns an error if another filesystem is mounted there, the local copies would be written to it in plaintext
+func (s *encryptedStore) unlocked() (bool, error) {
+	fsType, source, mounted := mountedFilesystem(s.cloneLocation)
+	if !mounted {
+		return false, nil
+	}
+	if fsType == "" {
+		// The filesystem can't be told on this platform
+		return true, nil
+	}
+	cipherDir, err := filepath.Abs(s.cipherDir)
+	if err == nil {
+		if resolved, err := filepath.EvalSymlinks(cipherDir); err == nil {
+			cipherDir = resolved
+		}
+	}
+	if fsType != gocryptfsType || filepath.Clean(source) != cipherDir {
+		return false, fmt.Errorf("clone location %v is not the unlocked encrypted store %v, %v of %v is mounted on it", s.cloneLocation, s.cipherDir, fsType, source)
+	}
+	return true, nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Prefix of the environment variables overriding the settings of the config file
+const envPrefix = "GITLABFS_"
+
+// expandEnv replaces the ${VAR} references to environment variables in the settings of config that commonly differ between machines
+// This lets a single config file be shared across machines, and the token be kept out of it
+func expandEnv(config *Config) error {
+	settings := []struct {
+		key   string
+		value *string
+	}{
+		{"gitlab.url", &config.Gitlab.URL},
+		{"gitlab.token", &config.Gitlab.Token},
+		{"git.clone_location", &config.Git.CloneLocation},
+		{"git.history_file", &config.Git.HistoryFile},
+		{"git.ignore_file", &config.Git.IgnoreFile},
+		{"git.ephemeral_dir", &config.Git.EphemeralDir},
+		{"git.encrypted_store", &config.Git.EncryptedStore},
+		{"git.encryption_passfile", &config.Git.EncryptionPassfile},
+		{"fs.mountpoint", &config.FS.Mountpoint},
+		{"fs.inode_table", &config.FS.InodeTable},
+		{"fs.metadata_db", &config.FS.MetadataDB},
+		{"fs.audit_log", &config.FS.AuditLog},
+		{"fs.pidfile", &config.FS.PIDFile},
+		{"fs.daemon_log", &config.FS.DaemonLog},
+		{"log.file", &config.Log.File},
+		{"http.control_socket", &config.HTTP.ControlSocket},
+		{"tracing.endpoint", &config.Tracing.Endpoint},
+	}
+	for _, setting := range settings {
+		expanded, err := expandEnvValue(*setting.value)
+		if err != nil {
+			return fmt.Errorf("%v: %v", setting.key, err)
+		}
+		*setting.value = expanded
+	}
+	for i := range config.Gitlab.FallbackTokens {
+		expanded, err := expandEnvValue(config.Gitlab.FallbackTokens[i])
+		if err != nil {
+			return fmt.Errorf("gitlab.fallback_tokens[%v]: %v", i, err)
+		}
+		config.Gitlab.FallbackTokens[i] = expanded
+	}
+	for groupPath, deployToken := range config.Gitlab.DeployTokens {
+		expanded, err := expandEnvValue(deployToken.Token)
+		if err != nil {
+			return fmt.Errorf("gitlab.deploy_tokens[%v].token: %v", groupPath, err)
+		}
+		deployToken.Token = expanded
+		config.Gitlab.DeployTokens[groupPath] = deployToken
+	}
+	if err := expandGroupTokens("gitlab.group_ids", config.Gitlab.GroupIDs); err != nil {
+		return err
+	}
+	for i := range config.Mounts {
+		expanded, err := expandEnvValue(config.Mounts[i].Mountpoint)
+		if err != nil {
+			return fmt.Errorf("mounts[%v].mountpoint: %v", i, err)
+		}
+		config.Mounts[i].Mountpoint = expanded
+		if err := expandGroupTokens(fmt.Sprintf("mounts[%v].group_ids", i), config.Mounts[i].GroupIDs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expandGroupTokens replaces the ${VAR} references in the token of each group of groups
+func expandGroupTokens(key string, groups GroupList) error {
+	for i := range groups {
+		expanded, err := expandEnvValue(groups[i].Token)
+		if err != nil {
+			return fmt.Errorf("%v[%v].token: %v", key, i, err)
+		}
+		groups[i].Token = expanded
+	}
+	return nil
+}
+
+// expandEnvValue replaces the ${VAR} references in s with the value of the environment variables
+// Unlike os.ExpandEnv, a $ which is not followed by a brace is kept as is, and a variable which is not set is an error
+func expandEnvValue(s string) (string, error) {
+	var b strings.Builder
+	for {
+		start := strings.Index(s, "${")
+		if start == -1 {
+			b.WriteString(s)
+			return b.String(), nil
+		}
+		end := strings.IndexByte(s[start:], '}')
+		if end == -1 {
+			return "", fmt.Errorf("unterminated reference to an environment variable in \"%v\"", s)
+		}
+		name := s[start+2 : start+end]
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %v is not set", name)
+		}
+		b.WriteString(s[:start])
+		b.WriteString(value)
+		s = s[start+end+1:]
+	}
+}
+
+// applyEnvOverrides applies the settings of the GITLABFS_* environment variables on top of config
+// The variable of a setting is its path in the config file in uppercase, eg: GITLABFS_GIT_CLONE_LOCATION for git.clone_location
+func applyEnvOverrides(config *Config) error {
+	known := map[string]bool{}
+	var walk func(v reflect.Value, name string) error
+	walk = func(v reflect.Value, name string) error {
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			key := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+			fieldName := name + strings.ToUpper(key)
+			field := v.Field(i)
+			if field.Kind() == reflect.Struct {
+				if err := walk(field, fieldName+"_"); err != nil {
+					return err
+				}
+				continue
+			}
+			known[fieldName] = true
+			value, ok := os.LookupEnv(fieldName)
+			if !ok {
+				continue
+			}
+			if err := setFromEnv(field, value); err != nil {
+				return fmt.Errorf("%v: %v", fieldName, err)
+			}
+		}
+		return nil
+	}
+	if err := walk(reflect.ValueOf(config).Elem(), envPrefix); err != nil {
+		return err
+	}
+
+	// A misspelled variable would be silently ignored otherwise
+	for _, env := range os.Environ() {
+		name := strings.SplitN(env, "=", 2)[0]
+		if strings.HasPrefix(name, envPrefix) && !known[name] {
+			logger.Warn("ignoring environment variable which does not match any setting", "name", name)
+		}
+	}
+	return nil
+}
+
+// setFromEnv sets field to the value of an environment variable
+// The strings are taken as is, the other values are parsed as yaml, eg: "true", "10m" or "[123, 456]"
+func setFromEnv(field reflect.Value, value string) error {
+	if field.Kind() == reflect.String {
+		field.SetString(value)
+		return nil
+	}
+	if field.Kind() == reflect.Slice && !strings.HasPrefix(strings.TrimSpace(value), "[") {
+		// Also accept a comma-separated list, eg: "123,456"
+		value = "[" + value + "]"
+	}
+	// Replace rather than merge with the value of the config file
+	field.Set(reflect.Zero(field.Type()))
+	return yaml.UnmarshalStrict([]byte(value), field.Addr().Interface())
+}
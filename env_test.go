@@ -0,0 +1,130 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpandEnvValue(t *testing.T) {
+	t.Setenv("GITLABFS_TEST_HOME", "/home/user")
+	t.Setenv("GITLABFS_TEST_EMPTY", "")
+
+	tests := []struct {
+		name  string
+		value string
+		out   string
+		err   string
+	}{
+		{name: "no reference", value: "/tmp/clones", out: "/tmp/clones"},
+		{name: "reference", value: "${GITLABFS_TEST_HOME}/clones", out: "/home/user/clones"},
+		{name: "several references", value: "${GITLABFS_TEST_HOME}:${GITLABFS_TEST_HOME}", out: "/home/user:/home/user"},
+		{name: "empty variable", value: "a${GITLABFS_TEST_EMPTY}b", out: "ab"},
+		{name: "dollar without brace", value: "pa$$word", out: "pa$$word"},
+		{name: "unset variable", value: "${GITLABFS_TEST_UNSET}", err: "environment variable GITLABFS_TEST_UNSET is not set"},
+		{name: "unterminated reference", value: "${GITLABFS_TEST_HOME", err: "unterminated reference"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out, err := expandEnvValue(test.value)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected an error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if out != test.out {
+				t.Errorf("expected %q, got %q", test.out, out)
+			}
+		})
+	}
+}
+
+func TestApplyEnvOverrides(t *testing.T) {
+	tests := []struct {
+		name  string
+		env   map[string]string
+		check func(t *testing.T, config *Config)
+		err   string
+	}{
+		{
+			name: "string",
+			env:  map[string]string{"GITLABFS_GIT_CLONE_LOCATION": "/tmp/other"},
+			check: func(t *testing.T, config *Config) {
+				if config.Git.CloneLocation != "/tmp/other" {
+					t.Errorf("expected the clone location to be overridden, got %v", config.Git.CloneLocation)
+				}
+			},
+		},
+		{
+			name: "parsed values",
+			env: map[string]string{
+				"GITLABFS_GIT_WORKER_COUNT": "3",
+				"GITLABFS_FS_RESTART_DELAY": "10s",
+			},
+			check: func(t *testing.T, config *Config) {
+				if config.Git.QueueWorkerCount != 3 || config.FS.RestartDelay != 10*time.Second {
+					t.Errorf("expected the settings to be overridden, got %+v", config)
+				}
+			},
+		},
+		{
+			name: "comma-separated list",
+			env:  map[string]string{"GITLABFS_GITLAB_FALLBACK_TOKENS": "a,b"},
+			check: func(t *testing.T, config *Config) {
+				if !reflect.DeepEqual(config.Gitlab.FallbackTokens, []string{"a", "b"}) {
+					t.Errorf("expected the list to be replaced, got %v", config.Gitlab.FallbackTokens)
+				}
+			},
+		},
+		{
+			name: "yaml list",
+			env:  map[string]string{"GITLABFS_GITLAB_FALLBACK_TOKENS": "[c]"},
+			check: func(t *testing.T, config *Config) {
+				if !reflect.DeepEqual(config.Gitlab.FallbackTokens, []string{"c"}) {
+					t.Errorf("expected the list to be replaced, got %v", config.Gitlab.FallbackTokens)
+				}
+			},
+		},
+		{
+			name: "unknown variable",
+			env:  map[string]string{"GITLABFS_GIT_CLONE_LOCATIONS": "/tmp/other"},
+			check: func(t *testing.T, config *Config) {
+				if config.Git.CloneLocation != "/tmp/clones" {
+					t.Errorf("expected the clone location to be kept, got %v", config.Git.CloneLocation)
+				}
+			},
+		},
+		{
+			name: "invalid value",
+			env:  map[string]string{"GITLABFS_GIT_WORKER_COUNT": "many"},
+			err:  "GITLABFS_GIT_WORKER_COUNT",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+			config := &Config{
+				Gitlab: GitlabConfig{FallbackTokens: []string{"old"}},
+				Git:    GitConfig{CloneLocation: "/tmp/clones", QueueWorkerCount: 5},
+			}
+			err := applyEnvOverrides(config)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected an error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			test.check(t, config)
+		})
+	}
+}
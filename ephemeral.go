@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Prefix of the temporary folders holding the local copies of the ephemeral instances, followed by their pid
+const ephemeralPrefix = "gitlabfs-"
+
+// makeEphemeralDir returns the folder the temporary clone location is created in
+// Default to /dev/shm, a tmpfs on most linux systems, and to the temporary folder of the system without it
+func makeEphemeralDir(config *Config) (string, error) {
+	if config.Git.EphemeralDir != "" {
+		info, err := os.Stat(config.Git.EphemeralDir)
+		if err != nil {
+			return "", fmt.Errorf("git.ephemeral_dir: %v", err)
+		}
+		if !info.IsDir() {
+			return "", fmt.Errorf("git.ephemeral_dir must be a folder, got %v", config.Git.EphemeralDir)
+		}
+		return config.Git.EphemeralDir, nil
+	}
+	if info, err := os.Stat("/dev/shm"); err == nil && info.IsDir() {
+		return "/dev/shm", nil
+	}
+	return os.TempDir(), nil
+}
+
+// makeEphemeralCloneLocation replaces the clone location of config with a new temporary folder, and returns the function removing it
+// The folders left behind by the ephemeral instances which did not exit cleanly are removed first
+func makeEphemeralCloneLocation(config *Config) (func(), error) {
+	dir, err := makeEphemeralDir(config)
+	if err != nil {
+		return nil, err
+	}
+	removeStaleEphemeralCloneLocations(dir)
+
+	cloneLocation, err := os.MkdirTemp(dir, ephemeralPrefix+strconv.Itoa(os.Getpid())+"-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the ephemeral clone location: %v", err)
+	}
+	logger.Info("keeping the local copies in an ephemeral clone location, removed on unmount", "clone_location", cloneLocation)
+	config.Git.CloneLocation = cloneLocation
+	return func() {
+		logger.Info("removing the ephemeral clone location", "clone_location", cloneLocation)
+		if err := os.RemoveAll(cloneLocation); err != nil {
+			logger.Error("failed to remove the ephemeral clone location", "clone_location", cloneLocation, "error", err)
+		}
+	}, nil
+}
+
+// removeStaleEphemeralCloneLocations removes the temporary clone locations in dir that belong to us and whose instance is gone, eg: after a crash
+func removeStaleEphemeralCloneLocations(dir string) {
+	paths, _ := filepath.Glob(filepath.Join(dir, ephemeralPrefix+"*-*"))
+	for _, path := range paths {
+		pidPart := strings.SplitN(strings.TrimPrefix(filepath.Base(path), ephemeralPrefix), "-", 2)[0]
+		pid, err := strconv.Atoi(pidPart)
+		if err != nil || pid <= 0 {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil || !info.IsDir() {
+			continue
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); !ok || int(stat.Uid) != os.Getuid() {
+			continue
+		}
+		// A process we can't signal is still running, as another user
+		if err := syscall.Kill(pid, 0); !errors.Is(err, syscall.ESRCH) {
+			continue
+		}
+		logger.Warn("removing the ephemeral clone location of an instance which did not exit cleanly", "clone_location", path, "pid", pid)
+		if err := os.RemoveAll(path); err != nil {
+			logger.Error("failed to remove the stale ephemeral clone location", "clone_location", path, "error", err)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// intListFlag is a flag which can be repeated, or take a comma-separated list, eg: "-group 123 -group 456" or "-group 123,456"
+type intListFlag []int
+
+// Ensure we are implementing the Value interface
+var _ = (flag.Value)((*intListFlag)(nil))
+
+func (l *intListFlag) String() string {
+	if l == nil {
+		return ""
+	}
+	values := make([]string, 0, len(*l))
+	for _, v := range *l {
+		values = append(values, strconv.Itoa(v))
+	}
+	return strings.Join(values, ",")
+}
+
+func (l *intListFlag) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		i, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			return fmt.Errorf("%v is not a valid id", v)
+		}
+		*l = append(*l, i)
+	}
+	return nil
+}
+
+// addConfigFlags adds the flags mirroring the most common settings of the config file to flags
+// The returned function applies the flags passed on the command-line on top of a config
+func addConfigFlags(flags *flag.FlagSet) func(config *Config) error {
+	gitlabURL := flags.String("gitlab-url", "", "The gitlab url. Overrides gitlab.url")
+	tokenFile := flags.String("token-file", "", "A file containing the gitlab api token. Overrides gitlab.token")
+	var groupIDs, userIDs intListFlag
+	flags.Var(&groupIDs, "group", "The id of a group to expose in the filesystem, can be repeated. Overrides gitlab.group_ids")
+	flags.Var(&userIDs, "user", "The id of a user to expose in the filesystem, can be repeated. Overrides gitlab.user_ids")
+	includeCurrentUser := flags.Bool("include-current-user", false, "Expose the user the api token belongs to. Overrides gitlab.include_current_user")
+	archivedProjectHandling := flags.String("archived-project-handling", "", "How to handle archived projects, either \"show\", \"hide\" or \"ignore\". Overrides gitlab.archived_project_handling")
+	projectMode := flags.String("project-mode", "", "How projects are exposed, either \"symlink\", \"directory\" or \"browse\". Overrides fs.project_mode")
+	readWrite := flags.Bool("read-write", false, "Allow creating and moving projects through the filesystem. Overrides fs.read_write")
+	cloneLocation := flags.String("clone-location", "", "The location of the local copies of the projects. Overrides git.clone_location")
+	ephemeral := flags.Bool("ephemeral", false, "Keep the local copies in a temporary folder removed on unmount. Overrides git.ephemeral")
+	pullMethod := flags.String("pull-method", "", "How to clone the projects, either \"http\" or \"ssh\". Overrides git.pull_method")
+	depth := flags.Int("depth", 0, "The depth of the git history to pull, 0 for the full history. Overrides git.depth")
+	workers := flags.Int("workers", 0, "The number of git operations run in parallel. Overrides git.worker_count")
+	autoPull := flags.Bool("auto-pull", false, "Pull the local copies that are on their default branch with a clean worktree. Overrides git.auto_pull")
+	logLevel := flags.String("log-level", "", "The minimum level of the logged messages. Overrides log.level")
+
+	return func(config *Config) error {
+		var err error
+		// Only the flags passed on the command-line override the config
+		flags.Visit(func(f *flag.Flag) {
+			if err != nil {
+				return
+			}
+			switch f.Name {
+			case "gitlab-url":
+				config.Gitlab.URL = *gitlabURL
+			case "token-file":
+				var token []byte
+				token, err = ioutil.ReadFile(*tokenFile)
+				if err != nil {
+					err = fmt.Errorf("failed to read token file: %v", err)
+					return
+				}
+				config.Gitlab.Token = strings.TrimSpace(string(token))
+			case "group":
+				config.Gitlab.GroupIDs = makeGroupList(groupIDs)
+			case "user":
+				config.Gitlab.UserIDs = userIDs
+			case "include-current-user":
+				config.Gitlab.IncludeCurrentUser = *includeCurrentUser
+			case "archived-project-handling":
+				config.Gitlab.ArchivedProjectHandling = *archivedProjectHandling
+			case "project-mode":
+				config.FS.ProjectMode = *projectMode
+			case "read-write":
+				config.FS.ReadWrite = *readWrite
+			case "clone-location":
+				config.Git.CloneLocation = *cloneLocation
+			case "ephemeral":
+				config.Git.Ephemeral = *ephemeral
+			case "pull-method":
+				config.Git.PullMethod = *pullMethod
+			case "depth":
+				config.Git.Depth = *depth
+			case "workers":
+				config.Git.QueueWorkerCount = *workers
+			case "auto-pull":
+				config.Git.AutoPull = *autoPull
+			case "log-level":
+				config.Log.Level = *logLevel
+			}
+		})
+		return err
+	}
+}
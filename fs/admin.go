@@ -0,0 +1,329 @@
+package fs
+
+import (
+	"context"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/badjware/gitlabfs/git"
+	"github.com/badjware/gitlabfs/gitlab"
+	"github.com/badjware/gitlabfs/utils"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	queueStateOK       = "ok"
+	queueStateDegraded = "degraded"
+)
+
+// adminNode is a folder exposing the runtime state of gitlabfs, similar to /proc
+type adminNode struct {
+	fs.Inode
+	param *FSParam
+
+	staticNodes map[string]staticNode
+}
+
+// Ensure we are implementing the NodeReaddirer interface
+var _ = (fs.NodeReaddirer)((*adminNode)(nil))
+
+// Ensure we are implementing the NodeLookuper interface
+var _ = (fs.NodeLookuper)((*adminNode)(nil))
+
+func newAdminNode(root *rootNode, param *FSParam) *adminNode {
+	return &adminNode{
+		param: param,
+		staticNodes: map[string]staticNode{
+			"config":    newInfoNode("admin/config", param.effectiveConfig, param),
+			"queue":     newInfoNode("admin/queue", param.queueStatus, param),
+			"ratelimit": newInfoNode("admin/ratelimit", param.rateLimitStatus, param),
+			"stats":     newInfoNode("admin/stats", root.stats, param),
+			"errors":    newInfoNode("admin/errors", param.recentErrors, param),
+			"version":   newInfoNode("admin/version", param.buildInfo, param),
+			"refresh":   newRefreshNode(root, "admin", param),
+		},
+	}
+}
+
+func (n *adminNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	entries := make([]fuse.DirEntry, 0, len(n.staticNodes))
+	for name, staticNode := range n.staticNodes {
+		entries = append(entries, fuse.DirEntry{
+			Name: name,
+			Ino:  staticNode.Ino(),
+			Mode: staticNode.Mode(),
+		})
+	}
+	return fs.NewListDirStream(entries), 0
+}
+
+func (n *adminNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	staticNode, ok := n.staticNodes[name]
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+	attrs := fs.StableAttr{
+		Ino:  staticNode.Ino(),
+		Mode: staticNode.Mode(),
+	}
+	return n.NewInode(ctx, staticNode, attrs), 0
+}
+
+func (p *FSParam) effectiveConfig(ctx context.Context) ([]byte, error) {
+	if p.EffectiveConfig == nil {
+		return []byte{}, nil
+	}
+	return p.EffectiveConfig()
+}
+
+func (p *FSParam) buildInfo(ctx context.Context) ([]byte, error) {
+	if p.BuildInfo == nil {
+		return []byte{}, nil
+	}
+	return p.BuildInfo()
+}
+
+func (p *FSParam) queueStatus(ctx context.Context) ([]byte, error) {
+	// The errors are exposed in their own file
+	status := p.Git.Status()
+	status.RecentErrors = nil
+	return yaml.Marshal(status)
+}
+
+func (p *FSParam) rateLimitStatus(ctx context.Context) ([]byte, error) {
+	return yaml.Marshal(p.Gitlab.Status().RateLimit)
+}
+
+// repoStatus returns a function describing the local copy of the project and its git operations
+func (p *FSParam) repoStatus(project *gitlab.Project) func(ctx context.Context) ([]byte, error) {
+	return func(ctx context.Context) ([]byte, error) {
+		localRepoLoc := p.Git.LocalRepoLoc(project.ID)
+		status := struct {
+			LocalCopy      string `yaml:"local_copy"`
+			Cloned         bool   `yaml:"cloned"`
+			git.RepoStatus `yaml:",inline"`
+		}{
+			LocalCopy:  localRepoLoc,
+			Cloned:     p.Git.IsCloned(project.ID),
+			RepoStatus: p.Git.RepoStatus(project.ID),
+		}
+		return yaml.Marshal(status)
+	}
+}
+
+// cloneError returns a function describing the last clone of the project, if it failed
+func (p *FSParam) cloneError(project *gitlab.Project) func(ctx context.Context) ([]byte, error) {
+	return func(ctx context.Context) ([]byte, error) {
+		entry := p.Git.RepoStatus(project.ID).CloneError
+		if entry == nil {
+			// A clone succeeded since the file was looked up
+			return []byte{}, nil
+		}
+		return yaml.Marshal(entry)
+	}
+}
+
+// stats reports live counters of the filesystem, without fetching anything from gitlab
+func (n *rootNode) stats(ctx context.Context) ([]byte, error) {
+	type gitlabStats struct {
+		CachedGroups     int               `yaml:"cached_groups"`
+		CachedUsers      int               `yaml:"cached_users"`
+		CachedProjects   int               `yaml:"cached_projects"`
+		RequestsLastHour int               `yaml:"requests_last_hour"`
+		RateLimit        *gitlab.RateLimit `yaml:"rate_limit"`
+		ActiveToken      int               `yaml:"active_token"`
+	}
+	type gitStats struct {
+		LocalCopies int `yaml:"local_copies"`
+		Queued      int `yaml:"queued"`
+		Running     int `yaml:"running"`
+		Workers     int `yaml:"workers"`
+		// Degraded while the queue is full and the operations wait in its overflow
+		State      string `yaml:"state"`
+		Overflowed int    `yaml:"overflowed"`
+		Dropped    int    `yaml:"dropped"`
+		// Size of the local copies in bytes, only measured with max_store_size
+		StoreSize    int64 `yaml:"store_size,omitempty"`
+		MaxStoreSize int64 `yaml:"max_store_size,omitempty"`
+		Evicted      int   `yaml:"evicted,omitempty"`
+	}
+	stats := struct {
+		Gitlab gitlabStats `yaml:"gitlab"`
+		Git    gitStats    `yaml:"git"`
+	}{}
+
+	// The same group can be reached more than once, eg: a root group which is also the subgroup of another
+	seen := map[int]bool{}
+	var countGroup func(group *gitlab.Group)
+	countGroup = func(group *gitlab.Group) {
+		content := group.CachedContent()
+		if content == nil || seen[group.ID] {
+			return
+		}
+		seen[group.ID] = true
+		stats.Gitlab.CachedGroups++
+		stats.Gitlab.CachedProjects += len(content.Projects)
+		for _, subgroup := range content.Groups {
+			countGroup(subgroup)
+		}
+	}
+	for _, child := range n.ns.groups.Children() {
+		if groupNode, ok := child.Operations().(*groupNode); ok {
+			countGroup(groupNode.group)
+		}
+	}
+	for _, child := range n.ns.users.Children() {
+		if userNode, ok := child.Operations().(*userNode); ok {
+			if content := userNode.user.CachedContent(); content != nil {
+				stats.Gitlab.CachedUsers++
+				stats.Gitlab.CachedProjects += len(content.Projects)
+			}
+		}
+	}
+	gitlabStatus := n.param.Gitlab.Status()
+	stats.Gitlab.RequestsLastHour = gitlabStatus.RequestsLastHour
+	stats.Gitlab.RateLimit = gitlabStatus.RateLimit
+	stats.Gitlab.ActiveToken = gitlabStatus.ActiveToken
+
+	localCopies, err := n.param.Git.CountLocalCopies()
+	if err != nil {
+		return nil, err
+	}
+	gitStatus := n.param.Git.Status()
+	stats.Git.LocalCopies = localCopies
+	stats.Git.Queued = len(gitStatus.Queued)
+	stats.Git.Running = len(gitStatus.Running)
+	stats.Git.Workers = gitStatus.Workers
+	stats.Git.State = queueStateOK
+	if gitStatus.Overflowed > 0 {
+		stats.Git.State = queueStateDegraded
+	}
+	stats.Git.Overflowed = gitStatus.Overflowed
+	stats.Git.Dropped = gitStatus.Dropped
+	stats.Git.StoreSize = gitStatus.StoreSize
+	stats.Git.MaxStoreSize = gitStatus.MaxStoreSize
+	stats.Git.Evicted = gitStatus.Evicted
+
+	return yaml.Marshal(stats)
+}
+
+func (p *FSParam) recentErrors(ctx context.Context) ([]byte, error) {
+	type source struct {
+		Source string    `yaml:"source"`
+		Time   time.Time `yaml:"time"`
+		Error  string    `yaml:"error"`
+	}
+	errors := []source{}
+	add := func(name string, entries []utils.LoggedError) {
+		for _, entry := range entries {
+			errors = append(errors, source{name, entry.Time, entry.Error})
+		}
+	}
+	add("git", p.Git.Status().RecentErrors)
+	add("gitlab", p.Gitlab.Status().RecentErrors)
+	sort.Slice(errors, func(i, j int) bool {
+		return errors[i].Time.Before(errors[j].Time)
+	})
+	return yaml.Marshal(errors)
+}
+
+// InvalidateCache invalidates the cache of every group and user of the filesystem
+func (n *rootNode) InvalidateCache() {
+	invalidateCaches(&n.Inode)
+}
+
+func invalidateCaches(inode *fs.Inode) {
+	for _, child := range inode.Children() {
+		switch node := child.Operations().(type) {
+		case *groupNode:
+			node.group.InvalidateCache()
+			invalidateCaches(child)
+		case *userNode:
+			node.user.InvalidateCache()
+		case *groupsNode, *usersNode:
+			invalidateCaches(child)
+		}
+	}
+}
+
+// infoNode is a read-only file whose content is generated when it's opened
+type infoNode struct {
+	fs.Inode
+	ino     uint64
+	content func(ctx context.Context) ([]byte, error)
+}
+
+// Ensure we are implementing the NodeGetattrer interface
+var _ = (fs.NodeGetattrer)((*infoNode)(nil))
+
+// Ensure we are implementing the NodeOpener interface
+var _ = (fs.NodeOpener)((*infoNode)(nil))
+
+// Ensure we are implementing the NodeReader interface
+var _ = (fs.NodeReader)((*infoNode)(nil))
+
+func newInfoNode(key string, content func(ctx context.Context) ([]byte, error), param *FSParam) *infoNode {
+	return &infoNode{
+		ino:     param.inodes.ino(key),
+		content: content,
+	}
+}
+
+func (n *infoNode) Ino() uint64 {
+	return n.ino
+}
+
+func (n *infoNode) Mode() uint32 {
+	return fuse.S_IFREG
+}
+
+func (n *infoNode) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = 0444
+	if data, ok := fh.(*infoFileHandle); ok {
+		out.Size = uint64(len(data.content))
+	}
+	return 0
+}
+
+func (n *infoNode) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	ctx, span := startSpan(ctx, "Open", &n.Inode)
+	defer span.End()
+
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR) != 0 {
+		return nil, 0, syscall.EACCES
+	}
+	content, err := n.content(ctx)
+	if err != nil {
+		return nil, 0, syscall.EIO
+	}
+	// The size of the file is unknown until it's opened, bypass the page cache
+	return &infoFileHandle{content: content}, fuse.FOPEN_DIRECT_IO, 0
+}
+
+func (n *infoNode) Read(ctx context.Context, fh fs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	data, ok := fh.(*infoFileHandle)
+	if !ok {
+		return nil, syscall.EBADF
+	}
+	return data.read(dest, off), 0
+}
+
+// infoFileHandle holds the content of an infoNode at the time it was opened
+type infoFileHandle struct {
+	content []byte
+}
+
+// read returns the content at off, up to the size of dest
+func (h *infoFileHandle) read(dest []byte, off int64) fuse.ReadResult {
+	if off >= int64(len(h.content)) {
+		return fuse.ReadResultData(nil)
+	}
+	end := off + int64(len(dest))
+	if end > int64(len(h.content)) {
+		end = int64(len(h.content))
+	}
+	return fuse.ReadResultData(h.content[off:end])
+}
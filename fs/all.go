@@ -0,0 +1,113 @@
+package fs
+
+import (
+	"context"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/badjware/gitlabfs/gitlab"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	// Separator used in place of "/" when flattening the path of a project
+	flattenedPathSeparator = "--"
+)
+
+type allNode struct {
+	fs.Inode
+	param *FSParam
+
+	ns *namespaces
+}
+
+// Ensure we are implementing the NodeReaddirer interface
+var _ = (fs.NodeReaddirer)((*allNode)(nil))
+
+// Ensure we are implementing the NodeLookuper interface
+var _ = (fs.NodeLookuper)((*allNode)(nil))
+
+func newAllNode(ns *namespaces, param *FSParam) *allNode {
+	return &allNode{
+		param: param,
+		ns:    ns,
+	}
+}
+
+// walkProjects calls fn with every project reachable in the filesystem, along with the path
+// of the project relative to its namespace folder and relative to the root of the filesystem
+func (ns *namespaces) walkProjects(ctx context.Context, fn func(name string, projectPath string, project *gitlab.Project)) {
+	ns.resolvePending(ctx)
+	for name, child := range ns.groups.Children() {
+		if groupNode, ok := child.Operations().(*groupNode); ok {
+			walkGroupProjects(ctx, groupNode.param, groupNode.group, name, ns.groupsPath, fn)
+		}
+	}
+	for name, child := range ns.users.Children() {
+		if userNode, ok := child.Operations().(*userNode); ok {
+			userContent, err := userNode.param.Gitlab.FetchUserContent(ctx, userNode.user)
+			if err != nil {
+				continue
+			}
+			for projectName, project := range userContent.Projects {
+				projectName = path.Join(name, projectName)
+				fn(projectName, path.Join(ns.usersPath, projectName), project)
+			}
+		}
+	}
+}
+
+func walkGroupProjects(ctx context.Context, param *FSParam, group *gitlab.Group, groupName string, parentPath string, fn func(name string, projectPath string, project *gitlab.Project)) {
+	projects, err := param.Gitlab.FetchGroupProjects(ctx, group)
+	if err != nil {
+		return
+	}
+	for name, project := range projects {
+		name = path.Join(groupName, name)
+		fn(name, path.Join(parentPath, name), project)
+	}
+}
+
+// listProjects returns a map of the flattened path of every projects to their path relative to the root of the filesystem
+func (n *allNode) listProjects(ctx context.Context) map[string]string {
+	projects := map[string]string{}
+	n.ns.walkProjects(ctx, func(name string, projectPath string, project *gitlab.Project) {
+		projects[strings.ReplaceAll(name, "/", flattenedPathSeparator)] = projectPath
+	})
+	return projects
+}
+
+func (n *allNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	ctx, span := startSpan(ctx, "Readdir", &n.Inode)
+	defer span.End()
+
+	projects := n.listProjects(ctx)
+	entries := make([]fuse.DirEntry, 0, len(projects))
+	for name := range projects {
+		entries = append(entries, fuse.DirEntry{
+			Name: name,
+			Ino:  n.param.inodes.ino("all/" + name),
+			Mode: fuse.S_IFLNK,
+		})
+	}
+	return fs.NewListDirStream(entries), 0
+}
+
+func (n *allNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	ctx, span := startSpan(ctx, "Lookup", &n.Inode, attribute.String("fs.name", name))
+	defer span.End()
+
+	projectPath, ok := n.listProjects(ctx)[name]
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+	attrs := fs.StableAttr{
+		Ino:  n.param.inodes.ino("all/" + name),
+		Mode: fuse.S_IFLNK,
+	}
+	// The symlink is relative so it remains valid wherever the filesystem is mounted
+	return n.NewInode(ctx, newSymlinkNode(path.Join("..", projectPath)), attrs), 0
+}
@@ -0,0 +1,136 @@
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/badjware/gitlabfs/gitlab"
+	"github.com/badjware/gitlabfs/utils"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+const (
+	auditActionCreateProject = "create_project"
+	auditActionMoveProject   = "move_project"
+	auditActionRemoveClone   = "remove_clone"
+)
+
+// auditEntry is an action triggered through the filesystem
+type auditEntry struct {
+	Time    time.Time `json:"time"`
+	Action  string    `json:"action"`
+	Path    string    `json:"path"`
+	Target  string    `json:"target,omitempty"`
+	Project int       `json:"project,omitempty"`
+	UID     uint32    `json:"uid"`
+	GID     uint32    `json:"gid"`
+	PID     uint32    `json:"pid"`
+	Process string    `json:"process,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// auditLog appends the actions triggered through the filesystem to a file, one json object per line
+type auditLog struct {
+	mux        sync.Mutex
+	mountpoint string
+	// Nil if the audit log is disabled
+	file *os.File
+}
+
+func newAuditLog(path string, mountpoint string) (*auditLog, error) {
+	// Record absolute paths, whatever the working directory gitlabfs was started from
+	if abs, err := filepath.Abs(mountpoint); err == nil {
+		mountpoint = abs
+	}
+	a := &auditLog{mountpoint: mountpoint}
+	if path == "" {
+		return a, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create audit log directory: %v", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %v", err)
+	}
+	a.file = f
+	return a, nil
+}
+
+// record appends action on the child name of inode to the log, name can be empty to record an action on inode itself
+func (a *auditLog) record(ctx context.Context, action string, inode *fs.Inode, name string, project *gitlab.Project, err error) {
+	if a.file == nil {
+		return
+	}
+	a.write(ctx, auditEntry{
+		Action: action,
+		Path:   a.path(inode, name),
+	}, project, err)
+}
+
+// recordMove appends the move of the child name of inode to the child newName of newParent to the log
+func (a *auditLog) recordMove(ctx context.Context, inode *fs.Inode, name string, newParent *fs.Inode, newName string, project *gitlab.Project, err error) {
+	if a.file == nil {
+		return
+	}
+	a.write(ctx, auditEntry{
+		Action: auditActionMoveProject,
+		Path:   a.path(inode, name),
+		Target: a.path(newParent, newName),
+	}, project, err)
+}
+
+func (a *auditLog) path(inode *fs.Inode, name string) string {
+	return filepath.Join(a.mountpoint, inode.Path(nil), name)
+}
+
+func (a *auditLog) write(ctx context.Context, entry auditEntry, project *gitlab.Project, err error) {
+	entry.Time = time.Now()
+	if project != nil {
+		entry.Project = project.ID
+	}
+	if err != nil {
+		entry.Error = utils.Redact(err.Error())
+	}
+	if caller, ok := fuse.FromContext(ctx); ok {
+		entry.UID = caller.Uid
+		entry.GID = caller.Gid
+		entry.PID = caller.Pid
+		entry.Process = callerName(ctx)
+	}
+	line, jsonErr := json.Marshal(entry)
+	if jsonErr != nil {
+		return
+	}
+
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	if a.file == nil {
+		// Closed while the entry was prepared
+		return
+	}
+	// A single write per entry, so the lines of concurrent writers never interleave
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		logger.Error("failed to write to the audit log", "error", err)
+	}
+}
+
+func (a *auditLog) close() error {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	if a.file == nil {
+		return nil
+	}
+	err := a.file.Close()
+	a.file = nil
+	return err
+}
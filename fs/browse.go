@@ -0,0 +1,184 @@
+package fs
+
+import (
+	"context"
+	"syscall"
+
+	"github.com/badjware/gitlabfs/gitlab"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// browseNode is a file or a folder of a project which is not cloned, read from the repository api
+// The content is read-only, it can only be changed once the project is cloned
+type browseNode struct {
+	fs.Inode
+	param   *FSParam
+	project *gitlab.Project
+	entry   gitlab.TreeEntry
+	// Size of the content of the blobs, fetched on lookup
+	size uint64
+}
+
+// Ensure we are implementing the NodeLookuper interface
+var _ = (fs.NodeLookuper)((*browseNode)(nil))
+
+// Ensure we are implementing the NodeOpendirHandler interface
+var _ = (fs.NodeOpendirHandler)((*browseNode)(nil))
+
+// Ensure we are implementing the NodeGetattrer interface
+var _ = (fs.NodeGetattrer)((*browseNode)(nil))
+
+// Ensure we are implementing the NodeOpener interface
+var _ = (fs.NodeOpener)((*browseNode)(nil))
+
+// Ensure we are implementing the NodeReader interface
+var _ = (fs.NodeReader)((*browseNode)(nil))
+
+// Ensure we are implementing the NodeReadlinker interface
+var _ = (fs.NodeReadlinker)((*browseNode)(nil))
+
+// browseMode returns the mode of the node exposing entry
+// Submodules are empty folders, their content is in another project
+func browseMode(entry gitlab.TreeEntry) uint32 {
+	switch {
+	case entry.Type != gitlab.TreeEntryBlob:
+		return fuse.S_IFDIR | 0555
+	case entry.Mode == gitlab.TreeModeSymlink:
+		return fuse.S_IFLNK | 0777
+	case entry.Mode == gitlab.TreeModeExecutable:
+		return fuse.S_IFREG | 0555
+	}
+	return fuse.S_IFREG | 0444
+}
+
+// browseEntry returns the entry named name in the folder at dir of project, or ENOENT if there is none
+func browseEntry(ctx context.Context, param *FSParam, project *gitlab.Project, dir string, name string) (gitlab.TreeEntry, syscall.Errno) {
+	entries, err := param.Gitlab.FetchTree(ctx, project, dir)
+	if err != nil {
+		logger.Error("failed to browse project", "project", project.ID, "error", err)
+		return gitlab.TreeEntry{}, syscall.EIO
+	}
+	for _, entry := range entries {
+		if entry.Name == name {
+			return entry, 0
+		}
+	}
+	return gitlab.TreeEntry{}, syscall.ENOENT
+}
+
+// lookupBrowsed returns the node of the entry named name in the folder at dir of project, as a child of parent
+func lookupBrowsed(ctx context.Context, parent *fs.Inode, param *FSParam, project *gitlab.Project, dir string, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	entry, errno := browseEntry(ctx, param, project, dir, name)
+	if errno != 0 {
+		return nil, errno
+	}
+	node := &browseNode{
+		param:   param,
+		project: project,
+		entry:   entry,
+	}
+	if entry.Type == gitlab.TreeEntryBlob {
+		// The tools reading a file, eg: cp, trust its size
+		size, err := param.Gitlab.FetchBlobSize(ctx, project, entry)
+		if err != nil {
+			logger.Error("failed to browse project", "project", project.ID, "path", entry.Path, "error", err)
+			return nil, syscall.EIO
+		}
+		node.size = uint64(size)
+	}
+	node.fillAttr(&out.Attr)
+	// The inode numbers are allocated for the lifetime of the mount, the inode table would grow with every file browsed
+	return parent.NewInode(ctx, node, fs.StableAttr{Mode: browseMode(entry)}), 0
+}
+
+// listBrowsed returns the entries of the folder at dir of project
+func listBrowsed(ctx context.Context, param *FSParam, project *gitlab.Project, dir string) ([]fuse.DirEntry, syscall.Errno) {
+	entries, err := param.Gitlab.FetchTree(ctx, project, dir)
+	if err != nil {
+		logger.Error("failed to browse project", "project", project.ID, "error", err)
+		return nil, syscall.EIO
+	}
+	dirEntries := make([]fuse.DirEntry, 0, len(entries))
+	for _, entry := range entries {
+		dirEntries = append(dirEntries, fuse.DirEntry{
+			Name: entry.Name,
+			Mode: browseMode(entry),
+		})
+	}
+	return dirEntries, 0
+}
+
+func (n *browseNode) fillAttr(out *fuse.Attr) {
+	out.Mode = browseMode(n.entry)
+	out.Size = n.size
+	mtime := n.project.LastActivityAt
+	if mtime.IsZero() {
+		mtime = n.project.CreatedAt
+	}
+	ctime := n.project.CreatedAt
+	out.SetTimes(&mtime, &mtime, &ctime)
+}
+
+func (n *browseNode) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	n.fillAttr(&out.Attr)
+	return 0
+}
+
+func (n *browseNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	ctx, span := startSpan(ctx, "Lookup", &n.Inode, attribute.String("fs.name", name))
+	defer span.End()
+
+	if n.entry.Type != gitlab.TreeEntryTree {
+		return nil, syscall.ENOENT
+	}
+	return lookupBrowsed(ctx, &n.Inode, n.param, n.project, n.entry.Path, name, out)
+}
+
+func (n *browseNode) OpendirHandle(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	if n.entry.Type != gitlab.TreeEntryTree {
+		return newDirHandle(nil), 0, 0
+	}
+	entries, errno := listBrowsed(ctx, n.param, n.project, n.entry.Path)
+	if errno != 0 {
+		return nil, 0, errno
+	}
+	return newDirHandle(entries), 0, 0
+}
+
+func (n *browseNode) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	ctx, span := startSpan(ctx, "Open", &n.Inode)
+	defer span.End()
+
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR) != 0 {
+		return nil, 0, syscall.EROFS
+	}
+	content, err := n.param.Gitlab.FetchBlob(ctx, n.project, n.entry.ID)
+	if err != nil {
+		logger.Error("failed to browse project", "project", n.project.ID, "path", n.entry.Path, "error", err)
+		return nil, 0, syscall.EIO
+	}
+	// A blob never changes, neither does the content of the node
+	return &infoFileHandle{content: content}, fuse.FOPEN_KEEP_CACHE, 0
+}
+
+func (n *browseNode) Read(ctx context.Context, fh fs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	data, ok := fh.(*infoFileHandle)
+	if !ok {
+		return nil, syscall.EBADF
+	}
+	return data.read(dest, off), 0
+}
+
+func (n *browseNode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	if n.entry.Mode != gitlab.TreeModeSymlink {
+		return nil, syscall.EINVAL
+	}
+	target, err := n.param.Gitlab.FetchBlob(ctx, n.project, n.entry.ID)
+	if err != nil {
+		logger.Error("failed to browse project", "project", n.project.ID, "path", n.entry.Path, "error", err)
+		return nil, syscall.EIO
+	}
+	return target, 0
+}
@@ -0,0 +1,78 @@
+package fs
+
+import (
+	"context"
+	"path"
+	"strconv"
+	"syscall"
+
+	"github.com/badjware/gitlabfs/gitlab"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+type byIDNode struct {
+	fs.Inode
+	param *FSParam
+
+	ns *namespaces
+}
+
+// Ensure we are implementing the NodeReaddirer interface
+var _ = (fs.NodeReaddirer)((*byIDNode)(nil))
+
+// Ensure we are implementing the NodeLookuper interface
+var _ = (fs.NodeLookuper)((*byIDNode)(nil))
+
+func newByIDNode(ns *namespaces, param *FSParam) *byIDNode {
+	return &byIDNode{
+		param: param,
+		ns:    ns,
+	}
+}
+
+// listProjects returns a map of the id of every projects to their path relative to the root of the filesystem
+func (n *byIDNode) listProjects(ctx context.Context) map[int]string {
+	projects := map[int]string{}
+	n.ns.walkProjects(ctx, func(name string, projectPath string, project *gitlab.Project) {
+		projects[project.ID] = projectPath
+	})
+	return projects
+}
+
+func (n *byIDNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	ctx, span := startSpan(ctx, "Readdir", &n.Inode)
+	defer span.End()
+
+	projects := n.listProjects(ctx)
+	entries := make([]fuse.DirEntry, 0, len(projects))
+	for pid := range projects {
+		entries = append(entries, fuse.DirEntry{
+			Name: strconv.Itoa(pid),
+			Ino:  n.param.inodes.ino(".by-id/" + projectInoKey(pid)),
+			Mode: fuse.S_IFLNK,
+		})
+	}
+	return fs.NewListDirStream(entries), 0
+}
+
+func (n *byIDNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	ctx, span := startSpan(ctx, "Lookup", &n.Inode, attribute.String("fs.name", name))
+	defer span.End()
+
+	pid, err := strconv.Atoi(name)
+	if err != nil {
+		return nil, syscall.ENOENT
+	}
+	projectPath, ok := n.listProjects(ctx)[pid]
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+	attrs := fs.StableAttr{
+		Ino:  n.param.inodes.ino(".by-id/" + projectInoKey(pid)),
+		Mode: fuse.S_IFLNK,
+	}
+	// The symlink is relative so it remains valid wherever the filesystem is mounted
+	return n.NewInode(ctx, newSymlinkNode(path.Join("..", projectPath)), attrs), 0
+}
@@ -0,0 +1,23 @@
+package fs
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// callerName returns the name of the process at the origin of the request, or an empty string if it's unknown
+func callerName(ctx context.Context) string {
+	caller, ok := fuse.FromContext(ctx)
+	if !ok || caller.Pid == 0 {
+		return ""
+	}
+	comm, err := ioutil.ReadFile(fmt.Sprintf("/proc/%v/comm", caller.Pid))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(comm))
+}
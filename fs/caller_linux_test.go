@@ -0,0 +1,33 @@
+package fs
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestCallerName(t *testing.T) {
+	comm, err := os.ReadFile("/proc/self/comm")
+	if err != nil {
+		t.Skipf("/proc is not mounted: %v", err)
+	}
+	tests := []struct {
+		name string
+		ctx  context.Context
+		out  string
+	}{
+		{name: "no caller", ctx: context.Background(), out: ""},
+		{name: "kernel", ctx: fuse.NewContext(context.Background(), &fuse.Caller{}), out: ""},
+		{name: "process", ctx: fuse.NewContext(context.Background(), &fuse.Caller{Pid: uint32(os.Getpid())}), out: strings.TrimSpace(string(comm))},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if out := callerName(test.ctx); out != test.out {
+				t.Errorf("expected %q, got %q", test.out, out)
+			}
+		})
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package fs
+
+import (
+	"context"
+)
+
+// callerName returns the name of the process at the origin of the request, or an empty string if it's unknown
+// The name of the process is only known on linux
+func callerName(ctx context.Context) string {
+	return ""
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package fs
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestCallerName(t *testing.T) {
+	// The name of the process is only known on linux
+	ctx := fuse.NewContext(context.Background(), &fuse.Caller{Pid: uint32(os.Getpid())})
+	if out := callerName(ctx); out != "" {
+		t.Errorf("expected the name to be unknown, got %q", out)
+	}
+}
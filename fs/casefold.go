@@ -0,0 +1,24 @@
+package fs
+
+import (
+	"strings"
+)
+
+// foldName returns the entry of names matching name regardless of case, or name itself if there is no such entry
+// This is meant for names without an exact match. If more than one entry only differ by case, the name is ambiguous and is not resolved
+func foldName(name string, names []string) string {
+	match := ""
+	for _, candidate := range names {
+		if strings.EqualFold(candidate, name) {
+			if match != "" {
+				logger.Debug("ignoring case is ambiguous, not resolving name", "name", name, "matches", []string{match, candidate})
+				return name
+			}
+			match = candidate
+		}
+	}
+	if match == "" {
+		return name
+	}
+	return match
+}
@@ -0,0 +1,38 @@
+package fs
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrNotMounted is returned when controlling a filesystem which is not mounted
+var ErrNotMounted = errors.New("filesystem is not mounted")
+
+// Stats returns the live counters of the filesystem, as exposed in the stats file of the admin folder
+func (p *FSParam) Stats(ctx context.Context) ([]byte, error) {
+	root := p.root.Load()
+	if root == nil {
+		return nil, ErrNotMounted
+	}
+	return root.stats(ctx)
+}
+
+// Reload reloads the configuration, like receiving SIGHUP
+func (p *FSParam) Reload() error {
+	root := p.root.Load()
+	if root == nil {
+		return ErrNotMounted
+	}
+	root.reload()
+	return nil
+}
+
+// Refresh invalidates the cache of every group and user of the filesystem
+func (p *FSParam) Refresh() error {
+	root := p.root.Load()
+	if root == nil {
+		return ErrNotMounted
+	}
+	root.InvalidateCache()
+	return nil
+}
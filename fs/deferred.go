@@ -0,0 +1,259 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/badjware/gitlabfs/gitlab"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// How long the root groups and users which could not be fetched keep their placeholder before they are fetched again
+const pendingRetryInterval = 30 * time.Second
+
+// pendingRoots are the root groups and users of a deferred mount which are not fetched yet
+// Until they are, they are mounted under a placeholder named after their id, whose content is fetched like any other group or user
+type pendingRoots struct {
+	root *rootNode
+
+	mux         sync.Mutex
+	groupIds    []int
+	userIds     []int
+	currentUser bool
+	retryAt     time.Time
+}
+
+func newPendingRoots(root *rootNode) *pendingRoots {
+	return &pendingRoots{
+		root:        root,
+		currentUser: true,
+	}
+}
+
+// placeholderName returns the name of the root group or user with the id until it's fetched
+func placeholderName(id int) string {
+	return strconv.Itoa(id)
+}
+
+// placeholderInoKey returns the key of the inode of a placeholder, so it's not confused with the fetched group or user
+func placeholderInoKey(key string) string {
+	return key + "/placeholder"
+}
+
+// addGroupPlaceholders adds the root groups as children of parent under their placeholder, without fetching them
+func (p *pendingRoots) addGroupPlaceholders(ctx context.Context, parent *fs.Inode, rootGroupIds []int) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	param := p.root.param
+	for _, groupID := range rootGroupIds {
+		groupNode, _ := newGroupNode(&gitlab.Group{ID: groupID, Name: placeholderName(groupID), CreatedAt: time.Now()}, param)
+		inode := parent.NewPersistentInode(
+			ctx,
+			groupNode,
+			fs.StableAttr{
+				Ino:  param.inodes.ino(placeholderInoKey(groupInoKey(groupID))),
+				Mode: fuse.S_IFDIR,
+			},
+		)
+		parent.AddChild(groupNode.group.Name, inode, false)
+		p.groupIds = append(p.groupIds, groupID)
+	}
+}
+
+// addUserPlaceholders adds the users as children of parent under their placeholder, without fetching them
+// The current user is only added once it's fetched
+func (p *pendingRoots) addUserPlaceholders(ctx context.Context, parent *fs.Inode, userIds []int) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	param := p.root.param
+	for _, userID := range userIds {
+		userNode, _ := newUserNode(&gitlab.User{ID: userID, Name: placeholderName(userID)}, param)
+		inode := parent.NewPersistentInode(
+			ctx,
+			userNode,
+			fs.StableAttr{
+				Ino:  param.inodes.ino(placeholderInoKey(userInoKey(userID))),
+				Mode: fuse.S_IFDIR,
+			},
+		)
+		parent.AddChild(userNode.user.Name, inode, false)
+		p.userIds = append(p.userIds, userID)
+	}
+}
+
+// resolve fetches the pending root groups and users, and replaces their placeholder with the group or the user
+// The ones which cannot be fetched keep their placeholder, and are fetched again on an access after pendingRetryInterval
+func (p *pendingRoots) resolve(ctx context.Context) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	if len(p.groupIds) == 0 && len(p.userIds) == 0 && !p.currentUser {
+		return
+	}
+	if time.Now().Before(p.retryAt) {
+		return
+	}
+	n := p.root
+	param := n.param
+
+	groupNodes, errs := fetchConcurrently(ctx, p.groupIds, param.StartupWorkerCount, func(ctx context.Context, gid int) (*groupNode, error) {
+		return newGroupNodeByID(ctx, gid, param)
+	})
+	var groupIds []int
+	for i, groupID := range p.groupIds {
+		if errs[i] != nil {
+			logger.Error("root group fetch fail, keeping its placeholder. Please verify the group exists, is public or a token with sufficient permissions is set in the config files.", "group", groupID, "error", errs[i])
+			groupIds = append(groupIds, groupID)
+			continue
+		}
+		replacePlaceholder(ctx, n.ns.groups, placeholderName(groupID), groupNodes[i].group.Name, groupNodes[i], groupInoKey(groupID), param)
+	}
+	p.groupIds = groupIds
+
+	if p.currentUser {
+		currentUser, err := param.Gitlab.FetchCurrentUser(ctx)
+		switch {
+		case errors.Is(err, gitlab.ErrCurrentUserDisabled):
+			p.currentUser = false
+		case err != nil:
+			logger.Error("current user fetch fail", "error", err)
+		default:
+			p.currentUser = false
+			currentUserNode, _ := newUserNode(currentUser, param)
+			// The current user may also be configured
+			userIds := make([]int, 0, len(p.userIds))
+			for _, userID := range p.userIds {
+				if userID != currentUser.ID {
+					userIds = append(userIds, userID)
+				}
+			}
+			if len(userIds) != len(p.userIds) {
+				replacePlaceholder(ctx, n.ns.users, placeholderName(currentUser.ID), currentUser.Name, currentUserNode, userInoKey(currentUser.ID), param)
+			} else {
+				inode := n.ns.users.NewPersistentInode(
+					ctx,
+					currentUserNode,
+					fs.StableAttr{
+						Ino:  param.inodes.ino(userInoKey(currentUser.ID)),
+						Mode: fuse.S_IFDIR,
+					},
+				)
+				n.ns.users.AddChild(currentUser.Name, inode, false)
+				go n.ns.users.NotifyEntry(currentUser.Name)
+			}
+			p.userIds = userIds
+			n.addCurrentUserLink(ctx, currentUser.Name)
+			if link := param.Layout.CurrentUserLink; link != "" {
+				go n.NotifyEntry(link)
+			}
+		}
+	}
+
+	userNodes, errs := fetchConcurrently(ctx, p.userIds, param.StartupWorkerCount, func(ctx context.Context, uid int) (*userNode, error) {
+		return newUserNodeByID(ctx, uid, param)
+	})
+	var userIds []int
+	for i, userID := range p.userIds {
+		if errs[i] != nil {
+			logger.Error("user fetch fail, keeping its placeholder. Please verify the user exists and token with sufficient permissions is set in the config files.", "user", userID, "error", errs[i])
+			userIds = append(userIds, userID)
+			continue
+		}
+		replacePlaceholder(ctx, n.ns.users, placeholderName(userID), userNodes[i].user.Name, userNodes[i], userInoKey(userID), param)
+	}
+	p.userIds = userIds
+
+	if len(p.groupIds) > 0 || len(p.userIds) > 0 || p.currentUser {
+		p.retryAt = time.Now().Add(pendingRetryInterval)
+	}
+}
+
+// replacePlaceholder replaces the child of parent named placeholder by node, named name
+func replacePlaceholder(ctx context.Context, parent *fs.Inode, placeholder string, name string, node fs.InodeEmbedder, inoKey string, param *FSParam) {
+	inode := parent.NewPersistentInode(
+		ctx,
+		node,
+		fs.StableAttr{
+			Ino:  param.inodes.ino(inoKey),
+			Mode: fuse.S_IFDIR,
+		},
+	)
+	parent.RmChild(placeholder)
+	parent.AddChild(name, inode, false)
+
+	// The kernel may have cached the placeholder, or the failed lookup of name
+	// The invalidation must happen after the access returns, since the kernel holds a lock on parent during the access
+	go func() {
+		parent.NotifyEntry(placeholder)
+		parent.NotifyEntry(name)
+	}()
+}
+
+// resolvePending fetches the root groups and users not fetched yet, if the mount is deferred
+func (ns *namespaces) resolvePending(ctx context.Context) {
+	if ns.pending != nil {
+		ns.pending.resolve(ctx)
+	}
+}
+
+// lookupChild returns the child of parent named name, like the lookup of a folder without a Lookup method
+func lookupChild(ctx context.Context, parent *fs.Inode, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	child := parent.GetChild(name)
+	if child == nil {
+		return nil, syscall.ENOENT
+	}
+	if getattrer, ok := child.Operations().(fs.NodeGetattrer); ok {
+		var attrOut fuse.AttrOut
+		if errno := getattrer.Getattr(ctx, nil, &attrOut); errno == 0 {
+			out.Attr = attrOut.Attr
+		}
+	}
+	return child, 0
+}
+
+// Ensure we are implementing the NodeOpendirer interface
+var _ = (fs.NodeOpendirer)((*rootNode)(nil))
+var _ = (fs.NodeOpendirer)((*groupsNode)(nil))
+var _ = (fs.NodeOpendirer)((*usersNode)(nil))
+
+// Ensure we are implementing the NodeLookuper interface
+var _ = (fs.NodeLookuper)((*rootNode)(nil))
+var _ = (fs.NodeLookuper)((*groupsNode)(nil))
+var _ = (fs.NodeLookuper)((*usersNode)(nil))
+
+func (n *rootNode) Opendir(ctx context.Context) syscall.Errno {
+	n.ns.resolvePending(ctx)
+	return 0
+}
+
+func (n *rootNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	n.ns.resolvePending(ctx)
+	return lookupChild(ctx, &n.Inode, name, out)
+}
+
+func (n *groupsNode) Opendir(ctx context.Context) syscall.Errno {
+	n.ns.resolvePending(ctx)
+	return 0
+}
+
+func (n *groupsNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	n.ns.resolvePending(ctx)
+	return lookupChild(ctx, &n.Inode, name, out)
+}
+
+func (n *usersNode) Opendir(ctx context.Context) syscall.Errno {
+	n.ns.resolvePending(ctx)
+	return 0
+}
+
+func (n *usersNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	n.ns.resolvePending(ctx)
+	return lookupChild(ctx, &n.Inode, name, out)
+}
@@ -0,0 +1,46 @@
+package fs
+
+import (
+	"context"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// dirHandle is an open folder listing a fixed set of entries
+type dirHandle struct {
+	entries []fuse.DirEntry
+	next    int
+}
+
+// Ensure we are implementing the FileReaddirenter interface
+var _ = (fs.FileReaddirenter)((*dirHandle)(nil))
+
+// Ensure we are implementing the FileSeekdirer interface
+var _ = (fs.FileSeekdirer)((*dirHandle)(nil))
+
+func newDirHandle(entries []fuse.DirEntry) *dirHandle {
+	return &dirHandle{
+		entries: entries,
+	}
+}
+
+func (h *dirHandle) Readdirent(ctx context.Context) (*fuse.DirEntry, syscall.Errno) {
+	if h.next >= len(h.entries) {
+		return nil, 0
+	}
+	entry := h.entries[h.next]
+	h.next++
+	// The offset of an entry is the offset to seek to to resume the listing after it
+	entry.Off = uint64(h.next)
+	return &entry, 0
+}
+
+func (h *dirHandle) Seekdir(ctx context.Context, off uint64) syscall.Errno {
+	if off > uint64(len(h.entries)) {
+		off = uint64(len(h.entries))
+	}
+	h.next = int(off)
+	return 0
+}
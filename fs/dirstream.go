@@ -0,0 +1,183 @@
+package fs
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// lazyDirStream is a listing whose entries are only built as they are read, so listing
+// a large folder doesn't require holding every entry in memory at once
+type lazyDirStream struct {
+	count int
+	next  int
+	entry func(i int) fuse.DirEntry
+}
+
+// Ensure we are implementing the DirStream interface
+var _ = (fs.DirStream)((*lazyDirStream)(nil))
+
+func newLazyDirStream(count int, entry func(i int) fuse.DirEntry) *lazyDirStream {
+	return &lazyDirStream{
+		count: count,
+		entry: entry,
+	}
+}
+
+func (s *lazyDirStream) HasNext() bool {
+	return s.next < s.count
+}
+
+func (s *lazyDirStream) Next() (fuse.DirEntry, syscall.Errno) {
+	entry := s.entry(s.next)
+	s.next++
+	return entry, 0
+}
+
+func (s *lazyDirStream) Close() {
+}
+
+// The number of entries a streamDirStream holds before adding more waits for them to be read
+const streamDirStreamSize = 1000
+
+// streamDirStream is a listing whose entries are added while it's read, eg: as the pages of a group are fetched
+// Reading waits for the next entry to be added, until the listing ends
+type streamDirStream struct {
+	mux     sync.Mutex
+	cond    *sync.Cond
+	entries []fuse.DirEntry
+	ended   bool
+	// Listing read once the entries added are read, if the listing ended with one
+	tail fs.DirStream
+	// Error read once the entries added are read, if the listing ended with one
+	errno syscall.Errno
+	// Once the listing is closed, the entries added are dropped
+	closed bool
+	cancel context.CancelFunc
+}
+
+// Ensure we are implementing the DirStream interface
+var _ = (fs.DirStream)((*streamDirStream)(nil))
+
+// newStreamDirStream returns a new listing, along with a context derived from ctx which is canceled when the listing is closed
+func newStreamDirStream(ctx context.Context) (context.Context, *streamDirStream) {
+	ctx, cancel := context.WithCancel(ctx)
+	s := &streamDirStream{cancel: cancel}
+	s.cond = sync.NewCond(&s.mux)
+	return ctx, s
+}
+
+// add adds entries at the end of the listing
+// It waits for the entries held to be read, if there are already too many of them
+func (s *streamDirStream) add(entries ...fuse.DirEntry) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	for len(s.entries) >= streamDirStreamSize && !s.closed {
+		s.cond.Wait()
+	}
+	if s.closed {
+		return
+	}
+	s.entries = append(s.entries, entries...)
+	s.cond.Broadcast()
+}
+
+// end ends the listing once its last entries are read
+func (s *streamDirStream) end() {
+	s.endWith(nil)
+}
+
+// endWith ends the listing with the entries of tail, once the entries added are read
+// The entries of tail are read as they are listed, they are not copied into the listing
+func (s *streamDirStream) endWith(tail fs.DirStream) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.ended = true
+	s.tail = tail
+	s.cond.Broadcast()
+}
+
+// fail ends the listing with errno, once the entries added are read
+func (s *streamDirStream) fail(errno syscall.Errno) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.ended = true
+	s.errno = errno
+	s.cond.Broadcast()
+}
+
+func (s *streamDirStream) HasNext() bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	for len(s.entries) == 0 && !s.ended {
+		s.cond.Wait()
+	}
+	if len(s.entries) == 0 && s.errno != 0 {
+		return true
+	}
+	if len(s.entries) == 0 && s.tail != nil {
+		return s.tail.HasNext()
+	}
+	return len(s.entries) > 0
+}
+
+func (s *streamDirStream) Next() (fuse.DirEntry, syscall.Errno) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if len(s.entries) == 0 && s.errno != 0 {
+		// The error is only read once, the listing ends with it
+		errno := s.errno
+		s.errno = 0
+		return fuse.DirEntry{}, errno
+	}
+	if len(s.entries) == 0 && s.tail != nil {
+		return s.tail.Next()
+	}
+	// The entries read are dropped, so the listing only holds the entries not read yet
+	entry := s.entries[0]
+	s.entries = s.entries[1:]
+	s.cond.Broadcast()
+	return entry, 0
+}
+
+func (s *streamDirStream) Close() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.closed = true
+	s.entries = nil
+	s.cancel()
+	s.cond.Broadcast()
+	if s.tail != nil {
+		s.tail.Close()
+	}
+}
+
+// sortedStaticNodeNames returns the names of the static nodes, sorted so the listings are stable
+func sortedStaticNodeNames(staticNodes map[string]staticNode) []string {
+	names := make([]string, 0, len(staticNodes))
+	for name := range staticNodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// existingChild returns the child of parent named name if it's already known with the inode number ino
+// This saves building a new node, only to have it discarded in favor of the known one
+func existingChild(parent *fs.Inode, name string, ino uint64) *fs.Inode {
+	child := parent.GetChild(name)
+	if child == nil || child.StableAttr().Ino != ino {
+		return nil
+	}
+	return child
+}
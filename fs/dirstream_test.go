@@ -0,0 +1,135 @@
+package fs
+
+import (
+	"context"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// readNames reads the names of the entries of stream until it ends
+func readNames(stream fs.DirStream) []string {
+	names := []string{}
+	for stream.HasNext() {
+		entry, _ := stream.Next()
+		names = append(names, entry.Name)
+	}
+	return names
+}
+
+func TestStreamDirStream(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries [][]string
+		tail    []string
+		names   []string
+	}{
+		{
+			name:    "pages",
+			entries: [][]string{{"a", "b"}, {"c"}},
+			names:   []string{"a", "b", "c"},
+		},
+		{
+			name:  "tail only",
+			tail:  []string{"a", "b"},
+			names: []string{"a", "b"},
+		},
+		{
+			name:    "pages then tail",
+			entries: [][]string{{"a"}},
+			tail:    []string{".refresh"},
+			names:   []string{"a", ".refresh"},
+		},
+		{
+			name:  "empty",
+			names: []string{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, stream := newStreamDirStream(context.Background())
+			go func() {
+				for _, page := range test.entries {
+					entries := []fuse.DirEntry{}
+					for _, name := range page {
+						entries = append(entries, fuse.DirEntry{Name: name})
+					}
+					stream.add(entries...)
+				}
+				if test.tail == nil {
+					stream.end()
+					return
+				}
+				stream.endWith(newLazyDirStream(len(test.tail), func(i int) fuse.DirEntry {
+					return fuse.DirEntry{Name: test.tail[i]}
+				}))
+			}()
+			if names := readNames(stream); !reflect.DeepEqual(names, test.names) {
+				t.Errorf("expected %v, got %v", test.names, names)
+			}
+		})
+	}
+}
+
+func TestStreamDirStreamError(t *testing.T) {
+	_, stream := newStreamDirStream(context.Background())
+	go func() {
+		stream.add(fuse.DirEntry{Name: "a"})
+		stream.fail(syscall.EIO)
+	}()
+
+	if !stream.HasNext() {
+		t.Fatal("expected an entry")
+	}
+	if entry, errno := stream.Next(); entry.Name != "a" || errno != 0 {
+		t.Fatalf("expected the entry a, got %v %v", entry.Name, errno)
+	}
+	if !stream.HasNext() {
+		t.Fatal("expected the error")
+	}
+	if _, errno := stream.Next(); errno != syscall.EIO {
+		t.Fatalf("expected EIO, got %v", errno)
+	}
+	if stream.HasNext() {
+		t.Error("expected the listing to end with the error")
+	}
+}
+
+func TestStreamDirStreamBackpressure(t *testing.T) {
+	ctx, stream := newStreamDirStream(context.Background())
+	added := make(chan int)
+	go func() {
+		count := 0
+		for count < 2*streamDirStreamSize && ctx.Err() == nil {
+			stream.add(fuse.DirEntry{Name: "a"})
+			count++
+		}
+		added <- count
+	}()
+
+	// Adding waits for the entries to be read, until the listing is closed
+	time.Sleep(50 * time.Millisecond)
+	stream.mux.Lock()
+	held := len(stream.entries)
+	stream.mux.Unlock()
+	if held != streamDirStreamSize {
+		t.Errorf("expected the listing to hold %v entries, got %v", streamDirStreamSize, held)
+	}
+
+	stream.Close()
+	select {
+	case count := <-added:
+		if count > streamDirStreamSize+1 {
+			t.Errorf("expected the entries to stop being added once the listing is closed, got %v", count)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected closing the listing to stop adding the entries")
+	}
+	if ctx.Err() == nil {
+		t.Error("expected closing the listing to cancel its context")
+	}
+}
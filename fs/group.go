@@ -2,11 +2,15 @@ package fs
 
 import (
 	"context"
+	"encoding/json"
+	"sort"
 	"syscall"
 
 	"github.com/badjware/gitlabfs/gitlab"
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type groupNode struct {
@@ -23,82 +27,265 @@ var _ = (fs.NodeReaddirer)((*groupNode)(nil))
 // Ensure we are implementing the NodeLookuper interface
 var _ = (fs.NodeLookuper)((*groupNode)(nil))
 
-func newGroupNodeByID(gid int, param *FSParam) (*groupNode, error) {
-	group, err := param.Gitlab.FetchGroup(gid)
+// Ensure we are implementing the NodeUnlinker interface
+var _ = (fs.NodeUnlinker)((*groupNode)(nil))
+
+// Ensure we are implementing the NodeRmdirer interface
+var _ = (fs.NodeRmdirer)((*groupNode)(nil))
+
+// Ensure we are implementing the NodeGetattrer interface
+var _ = (fs.NodeGetattrer)((*groupNode)(nil))
+
+// Ensure we are implementing the NodeMkdirer interface
+var _ = (fs.NodeMkdirer)((*groupNode)(nil))
+
+// Ensure we are implementing the NodeRenamer interface
+var _ = (fs.NodeRenamer)((*groupNode)(nil))
+
+func newGroupNodeByID(ctx context.Context, gid int, param *FSParam) (*groupNode, error) {
+	group, err := param.Gitlab.FetchGroup(ctx, gid)
 	if err != nil {
 		return nil, err
 	}
-	node := &groupNode{
-		param: param,
-		group: group,
-		staticNodes: map[string]staticNode{
-			".refresh": newRefreshNode(group, param),
-		},
-	}
-	return node, nil
+	return newGroupNode(group, param)
 }
 
 func newGroupNode(group *gitlab.Group, param *FSParam) (*groupNode, error) {
 	node := &groupNode{
 		param: param,
 		group: group,
-		staticNodes: map[string]staticNode{
-			".refresh": newRefreshNode(group, param),
-		},
+	}
+	node.staticNodes = map[string]staticNode{
+		".refresh":    newRefreshNode(group, groupInoKey(group.ID), param),
+		".group.json": newInfoNode(groupInoKey(group.ID)+"/.group.json", node.groupInfo, param),
+	}
+	if group.AvatarURL != "" {
+		node.staticNodes[avatarFileName] = newInfoNode(groupInoKey(group.ID)+"/"+avatarFileName, func(ctx context.Context) ([]byte, error) {
+			return param.Gitlab.FetchGroupAvatar(ctx, group)
+		}, param)
 	}
 	return node, nil
 }
 
+// Name of the file exposing the avatar of a group or a project, when it has one
+const avatarFileName = "avatar.png"
+
+// groupInfo describes the group for scripts, as json
+func (n *groupNode) groupInfo(ctx context.Context) ([]byte, error) {
+	content, err := n.param.Gitlab.FetchGroupContent(ctx, n.group)
+	if err != nil {
+		return nil, err
+	}
+	info := struct {
+		ID            int    `json:"id"`
+		FullPath      string `json:"full_path"`
+		Description   string `json:"description"`
+		Visibility    string `json:"visibility"`
+		SubgroupCount int    `json:"subgroup_count"`
+		ProjectCount  int    `json:"project_count"`
+	}{
+		ID:            n.group.ID,
+		FullPath:      n.group.FullPath,
+		Description:   n.group.Description,
+		Visibility:    n.group.Visibility,
+		SubgroupCount: len(content.Groups),
+		ProjectCount:  len(content.Projects),
+	}
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+func (n *groupNode) fillAttr(out *fuse.Attr) {
+	mtime := n.group.LastActivityAt()
+	ctime := n.group.CreatedAt
+	out.SetTimes(&mtime, &mtime, &ctime)
+
+	// Describe the content of the group without fetching it, if it's known
+	if counts, ok := n.group.Counts(); ok {
+		// Like a regular folder, "." and ".." plus the ".." of each subfolder
+		out.Nlink = uint32(2 + counts.Subgroups)
+		out.Size = uint64(counts.Subgroups + counts.Projects)
+	} else {
+		// A link count of 1 tells tools such as find that the number of subfolders is unknown
+		out.Nlink = 1
+	}
+}
+
+func (n *groupNode) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	n.fillAttr(&out.Attr)
+	return 0
+}
+
 func (n *groupNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
-	groupContent, _ := n.param.Gitlab.FetchGroupContent(n.group)
-	entries := make([]fuse.DirEntry, 0, len(groupContent.Groups)+len(groupContent.Projects)+len(n.staticNodes))
-	for _, group := range groupContent.Groups {
-		entries = append(entries, fuse.DirEntry{
-			Name: group.Name,
-			Ino:  uint64(group.ID),
-			Mode: fuse.S_IFDIR,
-		})
+	// The span ends with the listing, once the group is fetched
+	ctx, _ = startSpan(ctx, "Readdir", &n.Inode)
+
+	// Unless the content is cached, list the entries as the pages are fetched rather than once the whole group is fetched
+	return n.streamEntries(ctx, sortedStaticNodeNames(n.staticNodes)), 0
+}
+
+// contentEntries returns a listing of the content of the group, sorted by name, followed by the static nodes
+func (n *groupNode) contentEntries(groupContent *gitlab.GroupContent, staticNames []string) *lazyDirStream {
+	groupNames := make([]string, 0, len(groupContent.Groups))
+	for name := range groupContent.Groups {
+		groupNames = append(groupNames, name)
 	}
-	for _, project := range groupContent.Projects {
-		entries = append(entries, fuse.DirEntry{
-			Name: project.Name,
-			Ino:  uint64(project.ID),
-			Mode: fuse.S_IFLNK,
-		})
+	sort.Strings(groupNames)
+	projectNames := make([]string, 0, len(groupContent.Projects))
+	for name := range groupContent.Projects {
+		projectNames = append(projectNames, name)
 	}
-	for name, staticNode := range n.staticNodes {
-		entries = append(entries, fuse.DirEntry{
-			Name: name,
-			Ino:  staticNode.Ino(),
-			Mode: staticNode.Mode(),
+	sort.Strings(projectNames)
+
+	count := len(groupNames) + len(projectNames) + len(staticNames)
+	return newLazyDirStream(count, func(i int) fuse.DirEntry {
+		if i < len(groupNames) {
+			return n.subgroupEntry(groupContent.Groups[groupNames[i]])
+		}
+		i -= len(groupNames)
+		if i < len(projectNames) {
+			return n.projectEntry(groupContent.Projects[projectNames[i]])
+		}
+		i -= len(projectNames)
+		return n.staticEntry(staticNames[i])
+	})
+}
+
+// streamEntries returns a listing of the group whose entries are added as the pages of its content are fetched from gitlab,
+// including by a fetch of the group already in progress
+// The subgroups and the projects are listed in the order gitlab returns them, by path, or sorted by name if the content is cached
+// The listing ends with EIO if the group cannot be fetched, and the span of ctx ends once the group is fetched
+func (n *groupNode) streamEntries(ctx context.Context, staticNames []string) *streamDirStream {
+	span := trace.SpanFromContext(ctx)
+	// The listing outlives the request opening it, it's only canceled once it's closed
+	ctx, stream := newStreamDirStream(context.WithoutCancel(ctx))
+	go func() {
+		defer span.End()
+
+		streamed := false
+		groupContent, err := n.param.Gitlab.FetchGroupContentPages(ctx, n.group, func(groups []*gitlab.Group, projects []*gitlab.Project) {
+			streamed = true
+			// The fetch is shared with the other listings of the group, it goes on once the listing is closed
+			if ctx.Err() != nil {
+				return
+			}
+			entries := make([]fuse.DirEntry, 0, len(groups)+len(projects))
+			for _, group := range groups {
+				entries = append(entries, n.subgroupEntry(group))
+			}
+			for _, project := range projects {
+				entries = append(entries, n.projectEntry(project))
+			}
+			stream.add(entries...)
 		})
+		if err == nil && !streamed {
+			// The content is cached
+			stream.endWith(n.contentEntries(groupContent, staticNames))
+			return
+		}
+		// The static nodes are still listed, eg: to refresh the group once gitlab is reachable again
+		for _, name := range staticNames {
+			stream.add(n.staticEntry(name))
+		}
+		if err != nil {
+			logger.Error("failed to list the group", "group", n.group.ID, "error", err)
+			stream.fail(syscall.EIO)
+			return
+		}
+		stream.end()
+	}()
+	return stream
+}
+
+func (n *groupNode) subgroupEntry(group *gitlab.Group) fuse.DirEntry {
+	return fuse.DirEntry{
+		Name: group.Name,
+		Ino:  n.param.inodes.ino(groupInoKey(group.ID)),
+		Mode: fuse.S_IFDIR,
+	}
+}
+
+func (n *groupNode) projectEntry(project *gitlab.Project) fuse.DirEntry {
+	return fuse.DirEntry{
+		Name: project.Name,
+		Ino:  n.param.inodes.ino(projectInoKey(project.ID)),
+		Mode: n.param.projectFileMode(),
+	}
+}
+
+func (n *groupNode) staticEntry(name string) fuse.DirEntry {
+	return fuse.DirEntry{
+		Name: name,
+		Ino:  n.staticNodes[name].Ino(),
+		Mode: n.staticNodes[name].Mode(),
 	}
-	return fs.NewListDirStream(entries), 0
 }
 
 func (n *groupNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
-	groupContent, _ := n.param.Gitlab.FetchGroupContent(n.group)
+	ctx, span := startSpan(ctx, "Lookup", &n.Inode, attribute.String("fs.name", name))
+	defer span.End()
+
+	// The entries of a listing in progress are looked up without waiting for the rest of the group, eg: by readdirplus
+	group, project := n.group.FetchedEntry(name)
+	if group == nil && project == nil {
+		groupContent, err := n.param.Gitlab.FetchGroupContent(ctx, n.group)
+		if err != nil {
+			// The static nodes are still found, eg: to refresh the group once gitlab is reachable again
+			groupContent = &gitlab.GroupContent{}
+		}
+
+		_, isGroup := groupContent.Groups[name]
+		_, isProject := groupContent.Projects[name]
+		if n.param.CaseInsensitiveLookup && !isGroup && !isProject {
+			names := make([]string, 0, len(groupContent.Groups)+len(groupContent.Projects))
+			for name := range groupContent.Groups {
+				names = append(names, name)
+			}
+			for name := range groupContent.Projects {
+				names = append(names, name)
+			}
+			name = foldName(name, names)
+		}
+		group = groupContent.Groups[name]
+		project = groupContent.Projects[name]
+	}
 
 	// Check if the map of groups contains it
-	group, ok := groupContent.Groups[name]
-	if ok {
+	if group != nil {
 		attrs := fs.StableAttr{
-			Ino:  uint64(group.ID),
+			Ino:  n.param.inodes.ino(groupInoKey(group.ID)),
 			Mode: fuse.S_IFDIR,
 		}
+		if child := existingChild(&n.Inode, name, attrs.Ino); child != nil {
+			if groupNode, ok := child.Operations().(*groupNode); ok {
+				groupNode.fillAttr(&out.Attr)
+				return child, 0
+			}
+		}
 		groupNode, _ := newGroupNode(group, n.param)
+		groupNode.fillAttr(&out.Attr)
 		return n.NewInode(ctx, groupNode, attrs), 0
 	}
 
 	// Check if the map of projects contains it
-	project, ok := groupContent.Projects[name]
-	if ok {
+	if project != nil {
 		attrs := fs.StableAttr{
-			Ino:  uint64(project.ID),
-			Mode: fuse.S_IFLNK,
+			Ino:  n.param.inodes.ino(projectInoKey(project.ID)),
+			Mode: n.param.projectFileMode(),
 		}
-		repositoryNode, _ := newRepositoryNode(project, n.param)
-		return n.NewInode(ctx, repositoryNode, attrs), 0
+		if child := existingChild(&n.Inode, name, attrs.Ino); child != nil {
+			if projectNode, ok := child.Operations().(projectNode); ok {
+				projectNode.fillAttr(&out.Attr)
+				return child, 0
+			}
+		}
+		projectNode := newProjectNode(project, n.param)
+		projectNode.fillAttr(&out.Attr)
+		n.param.recordProject(&n.Inode, name, project, attrs.Ino)
+		return n.NewInode(ctx, projectNode, attrs), 0
 	}
 
 	// Check if the map of static nodes contains it
@@ -113,3 +300,164 @@ func (n *groupNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut)
 
 	return nil, syscall.ENOENT
 }
+
+func (n *groupNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	ctx, span := startSpan(ctx, "Mkdir", &n.Inode, attribute.String("fs.name", name))
+	defer span.End()
+
+	if !n.param.ReadWrite {
+		return nil, syscall.EROFS
+	}
+
+	groupContent, err := n.param.Gitlab.FetchGroupContent(ctx, n.group)
+	if err != nil {
+		logger.Error("failed to list the group", "group", n.group.ID, "error", err)
+		return nil, syscall.EIO
+	}
+	if _, ok := groupContent.Groups[name]; ok {
+		return nil, syscall.EEXIST
+	}
+	if _, ok := groupContent.Projects[name]; ok {
+		return nil, syscall.EEXIST
+	}
+	if _, ok := n.staticNodes[name]; ok {
+		return nil, syscall.EEXIST
+	}
+
+	// Create the project in gitlab
+	project, err := n.param.Gitlab.CreateGroupProject(ctx, n.group, name)
+	n.param.audit.record(ctx, auditActionCreateProject, &n.Inode, name, project, err)
+	if err != nil {
+		logger.Error("failed to create project", "error", err)
+		return nil, syscall.EIO
+	}
+
+	// The project is empty, there is nothing to fetch so we can initialize the local copy right away
+	_, err = n.param.Git.Init(project.CloneURL, project.ID, project.DefaultBranch)
+	if err != nil {
+		logger.Error("failed to initialize the local copy of the new project", "project", project.ID, "error", err)
+	}
+
+	if n.param.ProjectMode != ProjectModeSymlink {
+		attrs := fs.StableAttr{
+			Ino:  n.param.inodes.ino(projectInoKey(project.ID)),
+			Mode: fuse.S_IFDIR,
+		}
+		projectNode := newProjectNode(project, n.param)
+		projectNode.fillAttr(&out.Attr)
+		n.param.recordProject(&n.Inode, name, project, attrs.Ino)
+		return n.NewInode(ctx, projectNode, attrs), 0
+	}
+
+	// The kernel expects a directory to be returned, but the project is a symlink to its local copy.
+	// Return a placeholder directory and invalidate it, so the next lookup resolves it to the symlink.
+	// The invalidation must happen after we return, since the kernel holds a lock on the group during the mkdir.
+	go n.NotifyEntry(name)
+	return n.NewInode(ctx, &fs.Inode{}, fs.StableAttr{Mode: fuse.S_IFDIR}), 0
+}
+
+func (n *groupNode) Unlink(ctx context.Context, name string) syscall.Errno {
+	ctx, span := startSpan(ctx, "Unlink", &n.Inode, attribute.String("fs.name", name))
+	defer span.End()
+
+	content, err := n.param.Gitlab.FetchGroupContent(ctx, n.group)
+	if err != nil {
+		logger.Error("failed to list the group", "group", n.group.ID, "error", err)
+		return syscall.EIO
+	}
+	return n.unlinkEntry(ctx, content, name)
+}
+
+func (n *groupNode) Rmdir(ctx context.Context, name string) syscall.Errno {
+	ctx, span := startSpan(ctx, "Rmdir", &n.Inode, attribute.String("fs.name", name))
+	defer span.End()
+
+	content, err := n.param.Gitlab.FetchGroupContent(ctx, n.group)
+	if err != nil {
+		logger.Error("failed to list the group", "group", n.group.ID, "error", err)
+		return syscall.EIO
+	}
+	return n.unlinkEntry(ctx, content, name)
+}
+
+// unlinkEntry deletes the local copy of the project named name in the content of the group
+// Only the projects can be unlinked, the subgroups and the static nodes stay
+func (n *groupNode) unlinkEntry(ctx context.Context, content *gitlab.GroupContent, name string) syscall.Errno {
+	project, ok := content.Projects[name]
+	if !ok {
+		if _, isGroup := content.Groups[name]; isGroup {
+			return syscall.EPERM
+		}
+		if _, isStatic := n.staticNodes[name]; isStatic {
+			return syscall.EPERM
+		}
+		return syscall.ENOENT
+	}
+	return unlinkRepository(ctx, n.param, &n.Inode, name, project)
+}
+
+func (n *groupNode) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	ctx, span := startSpan(ctx, "Rename", &n.Inode, attribute.String("fs.name", name))
+	defer span.End()
+
+	if !n.param.ReadWrite {
+		return syscall.EROFS
+	}
+
+	// Projects can only be moved between groups
+	dstGroupNode, ok := newParent.(*groupNode)
+	if !ok {
+		return syscall.EXDEV
+	}
+
+	groupContent, err := n.param.Gitlab.FetchGroupContent(ctx, n.group)
+	if err != nil {
+		logger.Error("failed to list the group", "group", n.group.ID, "error", err)
+		return syscall.EIO
+	}
+	project, ok := groupContent.Projects[name]
+	if !ok {
+		_, isGroup := groupContent.Groups[name]
+		_, isStatic := n.staticNodes[name]
+		if !isGroup && !isStatic {
+			return syscall.ENOENT
+		}
+		// Only projects can be renamed
+		return syscall.EPERM
+	}
+
+	dstGroupContent, err := n.param.Gitlab.FetchGroupContent(ctx, dstGroupNode.group)
+	if err != nil {
+		logger.Error("failed to list the group", "group", dstGroupNode.group.ID, "error", err)
+		return syscall.EIO
+	}
+	if _, ok := dstGroupContent.Groups[newName]; ok {
+		return syscall.EEXIST
+	}
+	if _, ok := dstGroupContent.Projects[newName]; ok {
+		return syscall.EEXIST
+	}
+
+	moved, err := n.param.Gitlab.MoveGroupProject(ctx, project, n.group, dstGroupNode.group, newName)
+	n.param.audit.recordMove(ctx, &n.Inode, name, &dstGroupNode.Inode, newName, project, err)
+	if err != nil {
+		logger.Error("failed to move project", "project", project.ID, "error", err)
+		return syscall.EIO
+	}
+
+	// The local copy is stored by project id so it doesn't move, but its remote url changed
+	err = n.param.Git.UpdateRemoteURL(moved.CloneURL, moved.ID)
+	if err != nil {
+		logger.Error("failed to update the remote of the moved project", "project", moved.ID, "error", err)
+	}
+
+	// The node of the project still holds the project as it was before the move, drop it so the next lookup builds the
+	// node of the moved project
+	// The invalidation must happen after we return, since the kernel holds a lock on the groups during the rename. It
+	// only completes once the rename is done, and the node moved under newName.
+	go func() {
+		dstGroupNode.NotifyEntry(newName)
+		dstGroupNode.RmChild(newName)
+	}()
+	return 0
+}
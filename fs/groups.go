@@ -2,7 +2,6 @@ package fs
 
 import (
 	"context"
-	"fmt"
 
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
@@ -11,6 +10,7 @@ import (
 type groupsNode struct {
 	fs.Inode
 	param *FSParam
+	ns    *namespaces
 
 	rootGroupIds []int
 }
@@ -18,30 +18,42 @@ type groupsNode struct {
 // Ensure we are implementing the NodeOnAdder interface
 var _ = (fs.NodeOnAdder)((*groupsNode)(nil))
 
-func newGroupsNode(rootGroupIds []int, param *FSParam) *groupsNode {
+func newGroupsNode(rootGroupIds []int, ns *namespaces, param *FSParam) *groupsNode {
 	return &groupsNode{
 		param:        param,
+		ns:           ns,
 		rootGroupIds: rootGroupIds,
 	}
 }
 
 func (n *groupsNode) OnAdd(ctx context.Context) {
-	for _, groupID := range n.rootGroupIds {
-		groupNode, err := newGroupNodeByID(groupID, n.param)
-		if err != nil {
-			fmt.Printf("root group fetch fail: %v\n", err)
-			fmt.Printf("Please verify the group exists, is public or a token with sufficient permissions is set in the config files.\n")
-			fmt.Printf("Skipping group %v\n", groupID)
-			return
+	if n.ns.pending != nil {
+		n.ns.pending.addGroupPlaceholders(ctx, &n.Inode, n.rootGroupIds)
+		return
+	}
+	addRootGroupNodes(ctx, &n.Inode, n.rootGroupIds, n.param)
+}
+
+// addRootGroupNodes adds the root groups as children of parent
+// The groups are fetched concurrently, and added in the order they are configured
+func addRootGroupNodes(ctx context.Context, parent *fs.Inode, rootGroupIds []int, param *FSParam) {
+	groupNodes, errs := fetchConcurrently(ctx, rootGroupIds, param.StartupWorkerCount, func(ctx context.Context, gid int) (*groupNode, error) {
+		return newGroupNodeByID(ctx, gid, param)
+	})
+	for i, groupID := range rootGroupIds {
+		if errs[i] != nil {
+			logger.Error("root group fetch fail, skipping group. Please verify the group exists, is public or a token with sufficient permissions is set in the config files.", "group", groupID, "error", errs[i])
+			continue
 		}
-		inode := n.NewPersistentInode(
+		groupNode := groupNodes[i]
+		inode := parent.NewPersistentInode(
 			ctx,
 			groupNode,
 			fs.StableAttr{
-				Ino:  <-n.param.staticInoChan,
+				Ino:  param.inodes.ino(groupInoKey(groupID)),
 				Mode: fuse.S_IFDIR,
 			},
 		)
-		n.AddChild(groupNode.group.Name, inode, false)
+		parent.AddChild(groupNode.group.Name, inode, false)
 	}
 }
@@ -0,0 +1,115 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/badjware/gitlabfs/gitlab"
+	"github.com/hanwen/go-fuse/v2/fs"
+)
+
+// fakeGitlab returns the groups and the users it holds, by id, the other calls are not implemented
+type fakeGitlab struct {
+	gitlab.GitlabFetcher
+	groups      map[int]*gitlab.Group
+	users       map[int]*gitlab.User
+	currentUser *gitlab.User
+}
+
+func (f *fakeGitlab) FetchGroup(ctx context.Context, gid int) (*gitlab.Group, error) {
+	if group, ok := f.groups[gid]; ok {
+		return group, nil
+	}
+	return nil, errors.New("404 Not Found")
+}
+
+func (f *fakeGitlab) FetchUser(ctx context.Context, uid int) (*gitlab.User, error) {
+	if user, ok := f.users[uid]; ok {
+		return user, nil
+	}
+	return nil, errors.New("404 Not Found")
+}
+
+func (f *fakeGitlab) FetchCurrentUser(ctx context.Context) (*gitlab.User, error) {
+	if f.currentUser == nil {
+		return nil, errors.New("401 Unauthorized")
+	}
+	return f.currentUser, nil
+}
+
+func newTestParam(t *testing.T, fake *fakeGitlab) *FSParam {
+	t.Helper()
+	inodes, err := newInodeTable("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &FSParam{
+		Gitlab:             fake,
+		StartupWorkerCount: 2,
+		inodes:             inodes,
+	}
+}
+
+// childNames returns the sorted names of the children of node
+func childNames(node *fs.Inode) []string {
+	names := []string{}
+	for name := range node.Children() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestAddRootGroupNodes(t *testing.T) {
+	tests := []struct {
+		name     string
+		groupIds []int
+		children []string
+	}{
+		{name: "every group", groupIds: []int{1, 2}, children: []string{"a", "b"}},
+		{name: "failed group skipped", groupIds: []int{1, 3, 2}, children: []string{"a", "b"}},
+		{name: "first group failed", groupIds: []int{3, 2}, children: []string{"b"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			param := newTestParam(t, &fakeGitlab{
+				groups: map[int]*gitlab.Group{1: {ID: 1, Name: "a"}, 2: {ID: 2, Name: "b"}},
+			})
+			node := newGroupsNode(test.groupIds, &namespaces{}, param)
+			fs.NewNodeFS(node, &fs.Options{})
+			if children := childNames(&node.Inode); !reflect.DeepEqual(children, test.children) {
+				t.Errorf("expected the groups %v, got %v", test.children, children)
+			}
+		})
+	}
+}
+
+func TestAddUserNodes(t *testing.T) {
+	tests := []struct {
+		name        string
+		userIds     []int
+		currentUser *gitlab.User
+		children    []string
+	}{
+		{name: "every user", userIds: []int{1, 2}, children: []string{"a", "b"}},
+		{name: "failed user skipped", userIds: []int{1, 3, 2}, children: []string{"a", "b"}},
+		{name: "current user", userIds: []int{1, 3}, currentUser: &gitlab.User{ID: 4, Name: "me"}, children: []string{"a", "me"}},
+		{name: "current user configured", userIds: []int{4, 2}, currentUser: &gitlab.User{ID: 4, Name: "me"}, children: []string{"b", "me"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			param := newTestParam(t, &fakeGitlab{
+				users:       map[int]*gitlab.User{1: {ID: 1, Name: "a"}, 2: {ID: 2, Name: "b"}},
+				currentUser: test.currentUser,
+			})
+			node := newUsersNode(test.userIds, &namespaces{}, param)
+			fs.NewNodeFS(node, &fs.Options{})
+			if children := childNames(&node.Inode); !reflect.DeepEqual(children, test.children) {
+				t.Errorf("expected the users %v, got %v", test.children, children)
+			}
+		})
+	}
+}
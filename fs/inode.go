@@ -0,0 +1,115 @@
+package fs
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// The root inode is always 1, start allocating right after it
+	firstAllocatedIno = uint64(2)
+)
+
+// inodeTable allocates inode numbers and persists them on disk so that a
+// given group, project, user or static node keeps the same inode number across
+// refreshes and remounts.
+type inodeTable struct {
+	mux  sync.Mutex
+	inos map[string]uint64
+	next uint64
+	file *os.File
+}
+
+func newInodeTable(path string) (*inodeTable, error) {
+	t := &inodeTable{
+		inos: map[string]uint64{},
+		next: firstAllocatedIno,
+	}
+
+	if path == "" {
+		// Nothing to persist, inodes are only stable for the lifetime of the mount
+		return t, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create inode table directory: %v", err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open inode table: %v", err)
+	}
+
+	// Load the previously allocated inodes
+	// Each line of the file is in the format "<ino> <key>"
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), " ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		ino, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		t.inos[fields[1]] = ino
+		if ino >= t.next {
+			t.next = ino + 1
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to read inode table: %v", err)
+	}
+
+	t.file = f
+	return t, nil
+}
+
+// ino returns the inode number associated with the key, allocating a new one if needed
+func (t *inodeTable) ino(key string) uint64 {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	if ino, ok := t.inos[key]; ok {
+		return ino
+	}
+
+	ino := t.next
+	t.next++
+	t.inos[key] = ino
+	if t.file != nil {
+		if _, err := fmt.Fprintf(t.file, "%d %s\n", ino, key); err != nil {
+			logger.Warn("failed to persist inode", "ino", ino, "key", key, "error", err)
+		}
+	}
+	return ino
+}
+
+func (t *inodeTable) close() error {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	if t.file == nil {
+		return nil
+	}
+	err := t.file.Close()
+	t.file = nil
+	return err
+}
+
+func groupInoKey(gid int) string {
+	return "group/" + strconv.Itoa(gid)
+}
+
+func projectInoKey(pid int) string {
+	return "project/" + strconv.Itoa(pid)
+}
+
+func userInoKey(uid int) string {
+	return "user/" + strconv.Itoa(uid)
+}
@@ -0,0 +1,83 @@
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInodeTable(t *testing.T) {
+	tests := []struct {
+		name string
+		// Content of the inode table before it's opened
+		content string
+		keys    []string
+		inos    []uint64
+	}{
+		{
+			name: "allocated in order",
+			keys: []string{groupInoKey(1), projectInoKey(1), groupInoKey(1), userInoKey(1)},
+			inos: []uint64{2, 3, 2, 4},
+		},
+		{
+			name:    "loaded from the file",
+			content: "2 group/1\n7 project/1\n",
+			keys:    []string{projectInoKey(1), groupInoKey(1), groupInoKey(2)},
+			inos:    []uint64{7, 2, 8},
+		},
+		{
+			name:    "invalid lines skipped",
+			content: "garbage\nx project/1\n3 group/1\n",
+			keys:    []string{projectInoKey(1), groupInoKey(1)},
+			inos:    []uint64{4, 3},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "inodes")
+			if test.content != "" {
+				if err := os.WriteFile(path, []byte(test.content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			table, err := newInodeTable(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, key := range test.keys {
+				if ino := table.ino(key); ino != test.inos[i] {
+					t.Errorf("%v: expected inode %v, got %v", key, test.inos[i], ino)
+				}
+			}
+			if err := table.close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// The inodes are kept across mounts
+			table, err = newInodeTable(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer table.close()
+			for i, key := range test.keys {
+				if ino := table.ino(key); ino != test.inos[i] {
+					t.Errorf("%v: expected inode %v after reopening, got %v", key, test.inos[i], ino)
+				}
+			}
+		})
+	}
+}
+
+func TestInodeTableInMemory(t *testing.T) {
+	table, err := newInodeTable("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.close()
+	if ino := table.ino(groupInoKey(1)); ino != firstAllocatedIno {
+		t.Errorf("expected inode %v, got %v", firstAllocatedIno, ino)
+	}
+	if ino := table.ino(groupInoKey(1)); ino != firstAllocatedIno {
+		t.Errorf("expected the same inode, got %v", ino)
+	}
+}
@@ -0,0 +1,60 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"syscall"
+
+	"github.com/badjware/gitlabfs/git"
+	"github.com/badjware/gitlabfs/gitlab"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+type pullNode struct {
+	fs.Inode
+	ino     uint64
+	param   *FSParam
+	project *gitlab.Project
+}
+
+// Ensure we are implementing the NodeSetattrer interface
+var _ = (fs.NodeSetattrer)((*pullNode)(nil))
+
+// Ensure we are implementing the NodeOpener interface
+var _ = (fs.NodeOpener)((*pullNode)(nil))
+
+func newPullNode(project *gitlab.Project, param *FSParam) *pullNode {
+	return &pullNode{
+		ino:     param.inodes.ino(projectInoKey(project.ID) + "/.pull"),
+		param:   param,
+		project: project,
+	}
+}
+
+func (n *pullNode) Ino() uint64 {
+	return n.ino
+}
+
+func (n *pullNode) Mode() uint32 {
+	return fuse.S_IFREG
+}
+
+func (n *pullNode) Setattr(ctx context.Context, fh fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	return 0
+}
+
+func (n *pullNode) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	_, op, err := n.param.Git.Pull(n.project.CloneURL, n.project.ID, n.project.DefaultBranch, n.project.PullDepth)
+	if op != "" {
+		n.param.audit.record(ctx, op, &n.Inode, "", n.project, err)
+	}
+	if errors.Is(err, git.ErrIgnoredLocalCopy) {
+		logger.Warn("not pulling project", "project", n.project.ID, "error", err)
+		return nil, 0, syscall.EPERM
+	} else if err != nil {
+		logger.Error("failed to pull project", "project", n.project.ID, "error", err)
+		return nil, 0, syscall.EAGAIN
+	}
+	return nil, 0, 0
+}
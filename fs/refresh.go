@@ -21,9 +21,9 @@ var _ = (fs.NodeSetattrer)((*refreshNode)(nil))
 // Ensure we are implementing the NodeOpener interface
 var _ = (fs.NodeOpener)((*refreshNode)(nil))
 
-func newRefreshNode(refresher gitlab.Refresher, param *FSParam) *refreshNode {
+func newRefreshNode(refresher gitlab.Refresher, key string, param *FSParam) *refreshNode {
 	return &refreshNode{
-		ino:       <-param.staticInoChan,
+		ino:       param.inodes.ino(key + "/.refresh"),
 		refresher: refresher,
 	}
 }
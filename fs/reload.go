@@ -0,0 +1,87 @@
+package fs
+
+import (
+	"context"
+)
+
+// Reloader reloads the configuration and returns the part of it to apply to the filesystem
+type Reloader func() (*ReloadParam, error)
+
+type ReloadParam struct {
+	RootGroupIds []int
+	UserIds      []int
+
+	CloneDenylist []string
+
+	// If true, the settings applied when the groups and users are fetched changed, eg: how the archived projects are handled
+	// The cached content of the groups and users is fetched again
+	InvalidateCache bool
+}
+
+func (n *rootNode) reload() {
+	n.reloadMux.Lock()
+	defer n.reloadMux.Unlock()
+
+	if n.param.Reloader == nil {
+		logger.Warn("configuration reload is not supported, ignoring")
+		return
+	}
+	reloadParam, err := n.param.Reloader()
+	if err != nil {
+		logger.Error("failed to reload configuration", "error", err)
+		return
+	}
+
+	ctx := context.Background()
+
+	n.param.cloneDenylist.Store(&reloadParam.CloneDenylist)
+	if reloadParam.InvalidateCache {
+		logger.Info("the content of the groups and users changed, refreshing them")
+		n.InvalidateCache()
+	}
+
+	addedGroupIds, removedGroupIds := diffIds(n.rootGroupIds, reloadParam.RootGroupIds)
+	if len(addedGroupIds) > 0 {
+		logger.Info("adding groups", "groups", addedGroupIds)
+		addRootGroupNodes(ctx, n.ns.groups, addedGroupIds, n.param)
+	}
+	if len(removedGroupIds) > 0 {
+		logger.Warn("groups were removed, restart gitlabfs to apply", "groups", removedGroupIds)
+	}
+
+	addedUserIds, removedUserIds := diffIds(n.userIds, reloadParam.UserIds)
+	if len(addedUserIds) > 0 {
+		logger.Info("adding users", "users", addedUserIds)
+		addUserNodesByID(ctx, n.ns.users, addedUserIds, n.param)
+	}
+	if len(removedUserIds) > 0 {
+		logger.Warn("users were removed, restart gitlabfs to apply", "users", removedUserIds)
+	}
+
+	// Removed ids are still mounted, keep tracking them
+	n.rootGroupIds = append(n.rootGroupIds, addedGroupIds...)
+	n.userIds = append(n.userIds, addedUserIds...)
+
+	logger.Info("configuration reloaded")
+}
+
+// diffIds returns the ids present in next but not in prev, and the ids present in prev but not in next
+func diffIds(prev []int, next []int) (added []int, removed []int) {
+	prevSet := map[int]bool{}
+	for _, id := range prev {
+		prevSet[id] = true
+	}
+	nextSet := map[int]bool{}
+	for _, id := range next {
+		nextSet[id] = true
+		if !prevSet[id] {
+			added = append(added, id)
+		}
+	}
+	for _, id := range prev {
+		if !nextSet[id] {
+			removed = append(removed, id)
+		}
+	}
+	return added, removed
+}
@@ -2,12 +2,48 @@ package fs
 
 import (
 	"context"
+	"errors"
+	"path"
 	"syscall"
 
+	"github.com/badjware/gitlabfs/git"
 	"github.com/badjware/gitlabfs/gitlab"
 	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
 )
 
+// projectNode is a node exposing a project
+type projectNode interface {
+	fs.InodeEmbedder
+	fillAttr(out *fuse.Attr)
+}
+
+// newProjectNode returns the node exposing project according to the project mode
+func newProjectNode(project *gitlab.Project, param *FSParam) projectNode {
+	if param.ProjectMode != ProjectModeSymlink {
+		node, _ := newRepositoryDirNode(project, param)
+		return node
+	}
+	node, _ := newRepositoryNode(project, param)
+	return node
+}
+
+// projectFileMode returns the file type of the nodes exposing the projects
+func (p *FSParam) projectFileMode() uint32 {
+	if p.ProjectMode != ProjectModeSymlink {
+		return fuse.S_IFDIR
+	}
+	return fuse.S_IFLNK
+}
+
+// recordProject records in the metadata database that the project is found in parent under name, with the inode
+func (p *FSParam) recordProject(parent *fs.Inode, name string, project *gitlab.Project, ino uint64) {
+	if p.Metadata == nil {
+		return
+	}
+	p.Metadata.RecordProject(project.ID, p.mountpoint, path.Join(parent.Path(nil), name), ino, p.Git.LocalRepoLoc(project.ID))
+}
+
 type RepositoryNode struct {
 	fs.Inode
 	param   *FSParam
@@ -17,6 +53,9 @@ type RepositoryNode struct {
 // Ensure we are implementing the NodeReaddirer interface
 var _ = (fs.NodeReadlinker)((*RepositoryNode)(nil))
 
+// Ensure we are implementing the NodeGetattrer interface
+var _ = (fs.NodeGetattrer)((*RepositoryNode)(nil))
+
 func newRepositoryNode(project *gitlab.Project, param *FSParam) (*RepositoryNode, error) {
 	node := &RepositoryNode{
 		param:   param,
@@ -27,9 +66,73 @@ func newRepositoryNode(project *gitlab.Project, param *FSParam) (*RepositoryNode
 	return node, nil
 }
 
+func (n *RepositoryNode) fillAttr(out *fuse.Attr) {
+	mtime := n.project.LastActivityAt
+	if mtime.IsZero() {
+		mtime = n.project.CreatedAt
+	}
+	ctime := n.project.CreatedAt
+	out.SetTimes(&mtime, &mtime, &ctime)
+}
+
+func (n *RepositoryNode) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	n.fillAttr(&out.Attr)
+	return 0
+}
+
 func (n *RepositoryNode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	ctx, span := startSpan(ctx, "Readlink", &n.Inode)
+	defer span.End()
+
+	if n.param.cloneDenied(ctx) {
+		return []byte(n.param.Git.LocalRepoLoc(n.project.ID)), 0
+	}
+
 	// Create the local copy of the repo
-	localRepoLoc, _ := n.param.Git.CloneOrPull(n.project.CloneURL, n.project.ID, n.project.DefaultBranch)
+	localRepoLoc, op, err := n.param.Git.CloneOrPull(n.project.CloneURL, n.project.ID, n.project.DefaultBranch, n.project.PullDepth)
+	if op != "" {
+		n.param.audit.record(ctx, op, &n.Inode, "", n.project, err)
+	}
 
 	return []byte(localRepoLoc), 0
 }
+
+// cloneDenied returns whether the process at the origin of the request is not allowed to start clones
+func (p *FSParam) cloneDenied(ctx context.Context) bool {
+	denylist := p.CloneDenylist
+	if reloaded := p.cloneDenylist.Load(); reloaded != nil {
+		denylist = *reloaded
+	}
+	if len(denylist) == 0 {
+		return false
+	}
+	name := callerName(ctx)
+	for _, denied := range denylist {
+		if name == denied {
+			return true
+		}
+	}
+	return false
+}
+
+// unlinkRepository deletes the local copy of the project
+// The project itself is left untouched in gitlab, so the node reappears in its "not yet cloned" state
+// inode and name locate the project in the filesystem, for the audit log
+func unlinkRepository(ctx context.Context, param *FSParam, inode *fs.Inode, name string, project *gitlab.Project) syscall.Errno {
+	if !param.AllowCloneRemoval {
+		return syscall.EPERM
+	}
+	err := param.Git.RemoveLocalCopy(project.ID)
+	param.audit.record(ctx, auditActionRemoveClone, inode, name, project, err)
+	if errors.Is(err, git.ErrDirtyWorktree) || errors.Is(err, git.ErrLocalCopyLocked) {
+		logger.Warn("not removing the local copy of project", "project", project.ID, "error", err)
+		return syscall.EBUSY
+	} else if errors.Is(err, git.ErrIgnoredLocalCopy) {
+		logger.Warn("not removing the local copy of project", "project", project.ID, "error", err)
+		return syscall.EPERM
+	} else if err != nil {
+		logger.Error("failed to remove the local copy of project", "project", project.ID, "error", err)
+		return syscall.EIO
+	}
+	return 0
+}
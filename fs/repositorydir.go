@@ -0,0 +1,478 @@
+package fs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/badjware/gitlabfs/gitlab"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Name of the file describing the last clone of the project, present only while it failed
+const cloneErrorFileName = ".clone-error"
+
+// repositoryDirNode exposes a project as a folder mirroring its local copy
+type repositoryDirNode struct {
+	projectFileNode
+	project *gitlab.Project
+
+	// Created on the first access to the folder, most of the folders are only ever listed by their parent
+	staticNodesOnce sync.Once
+	staticNodes     map[string]staticNode
+}
+
+// Ensure we are implementing the NodeLookuper interface
+var _ = (fs.NodeLookuper)((*repositoryDirNode)(nil))
+
+// Ensure we are implementing the NodeOpendirHandler interface
+var _ = (fs.NodeOpendirHandler)((*repositoryDirNode)(nil))
+
+// Ensure we are implementing the NodeGetattrer interface
+var _ = (fs.NodeGetattrer)((*repositoryDirNode)(nil))
+
+// Ensure we are implementing the NodeUnlinker interface
+var _ = (fs.NodeUnlinker)((*repositoryDirNode)(nil))
+
+// Ensure we are implementing the NodeRmdirer interface
+var _ = (fs.NodeRmdirer)((*repositoryDirNode)(nil))
+
+// Ensure we are implementing the NodeRenamer interface
+var _ = (fs.NodeRenamer)((*repositoryDirNode)(nil))
+
+func newRepositoryDirNode(project *gitlab.Project, param *FSParam) (*repositoryDirNode, error) {
+	localRepoLoc := param.Git.LocalRepoLoc(project.ID)
+	node := &repositoryDirNode{
+		project: project,
+	}
+
+	// The local copy may not exist yet, use the device of the closest existing parent
+	st := syscall.Stat_t{}
+	syscall.Stat(closestExistingPath(localRepoLoc), &st)
+
+	node.param = param
+	node.RootData = &fs.LoopbackRoot{
+		Path:     localRepoLoc,
+		Dev:      uint64(st.Dev),
+		NewNode:  param.newProjectFileNode,
+		RootNode: node,
+	}
+	return node, nil
+}
+
+func (n *repositoryDirNode) fillAttr(out *fuse.Attr) {
+	st := syscall.Stat_t{}
+	if n.param.Git.IsCloned(n.project.ID) && syscall.Lstat(n.RootData.Path, &st) == nil {
+		out.FromStat(&st)
+		n.param.mapOwner(out)
+		// The inode number of the folder is allocated by gitlabfs, not by the local copy
+		out.Ino = 0
+		return
+	}
+
+	// There is no local copy yet, describe the folder from the project metadata
+	out.Mode = fuse.S_IFDIR | 0755
+	mtime := n.project.LastActivityAt
+	if mtime.IsZero() {
+		mtime = n.project.CreatedAt
+	}
+	ctime := n.project.CreatedAt
+	out.SetTimes(&mtime, &mtime, &ctime)
+}
+
+func (n *repositoryDirNode) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	n.fillAttr(&out.Attr)
+	return 0
+}
+
+func (n *repositoryDirNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	ctx, span := startSpan(ctx, "Lookup", &n.Inode, attribute.String("fs.name", name))
+	defer span.End()
+
+	// Check if the map of static nodes contains it
+	staticNode, ok := n.staticNode(name)
+	if ok {
+		attrs := fs.StableAttr{
+			Ino:  staticNode.Ino(),
+			Mode: staticNode.Mode(),
+		}
+		return n.NewInode(ctx, staticNode, attrs), 0
+	}
+	if n.browsing() {
+		return lookupBrowsed(ctx, &n.Inode, n.param, n.project, "", name, out)
+	}
+
+	n.cloneOn(ctx, CloneTriggerLookup, &n.Inode, name)
+
+	return n.projectFileNode.Lookup(ctx, name, out)
+}
+
+func (n *repositoryDirNode) OpendirHandle(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	n.cloneOn(ctx, CloneTriggerReaddir, &n.Inode, "")
+
+	staticNodes := n.getStaticNodes()
+	entries := make([]fuse.DirEntry, 0, len(staticNodes))
+	if n.browsing() {
+		browsed, errno := listBrowsed(ctx, n.param, n.project, "")
+		if errno != 0 {
+			return nil, 0, errno
+		}
+		for _, entry := range browsed {
+			if _, ok := n.staticNode(entry.Name); !ok {
+				entries = append(entries, entry)
+			}
+		}
+	} else if ds, errno := fs.NewLoopbackDirStream(n.RootData.Path); errno == 0 {
+		// The folder is listed empty until the local copy is created
+		for ds.HasNext() {
+			entry, errno := ds.Next()
+			if errno != 0 {
+				break
+			}
+			if _, ok := n.staticNode(entry.Name); ok {
+				// Shadowed by the static node
+				continue
+			}
+			entries = append(entries, entry)
+		}
+		ds.Close()
+	}
+	for name := range staticNodes {
+		staticNode, ok := n.staticNode(name)
+		if !ok {
+			continue
+		}
+		entries = append(entries, fuse.DirEntry{
+			Name: name,
+			Ino:  staticNode.Ino(),
+			Mode: staticNode.Mode(),
+		})
+	}
+	return newDirHandle(entries), 0, 0
+}
+
+// getStaticNodes returns the static nodes of the folder, creating them on the first call
+func (n *repositoryDirNode) getStaticNodes() map[string]staticNode {
+	n.staticNodesOnce.Do(func() {
+		project := n.project
+		param := n.param
+		n.staticNodes = map[string]staticNode{
+			".pull":   newPullNode(project, param),
+			".status": newInfoNode(projectInoKey(project.ID)+"/.status", param.repoStatus(project), param),
+
+			cloneErrorFileName: newInfoNode(projectInoKey(project.ID)+"/"+cloneErrorFileName, param.cloneError(project), param),
+		}
+		if project.AvatarURL != "" {
+			n.staticNodes[avatarFileName] = newInfoNode(projectInoKey(project.ID)+"/"+avatarFileName, func(ctx context.Context) ([]byte, error) {
+				return param.Gitlab.FetchProjectAvatar(ctx, project)
+			}, param)
+		}
+	})
+	return n.staticNodes
+}
+
+// cloneTriggerOrder orders the clone triggers by how far the access to a project has to go for them to happen
+var cloneTriggerOrder = map[string]int{
+	CloneTriggerLookup:  0,
+	CloneTriggerReaddir: 1,
+	CloneTriggerOpen:    2,
+}
+
+// cloneOn creates or updates the local copy of the repo if trigger is enough to start the clone
+// A trigger also satisfies the triggers happening before it, eg: opening a file clones the repo even when the clone starts on readdir
+// inode and name locate the path which was accessed, for the audit log
+func (n *repositoryDirNode) cloneOn(ctx context.Context, trigger string, inode *fs.Inode, name string) {
+	if cloneTriggerOrder[trigger] < cloneTriggerOrder[n.param.CloneTrigger] || n.param.cloneDenied(ctx) || n.browsing() {
+		return
+	}
+	_, op, err := n.param.Git.CloneOrPull(n.project.CloneURL, n.project.ID, n.project.DefaultBranch, n.project.PullDepth)
+	if op != "" {
+		n.param.audit.record(ctx, op, inode, name, n.project, err)
+	}
+}
+
+// browsing returns whether the content of the project is read from the repository api, until it's cloned
+// The project is then only cloned when it's pulled, eg: by touching its .pull file
+func (n *repositoryDirNode) browsing() bool {
+	return n.param.ProjectMode == ProjectModeBrowse && !n.param.Git.IsCloned(n.project.ID)
+}
+
+// staticNode returns the static node named name, if any
+// The avatar gives way to a file of the same name in the local copy, so the content of the repo is never hidden
+// The clone error only exists while the last clone of the project failed
+func (n *repositoryDirNode) staticNode(name string) (staticNode, bool) {
+	staticNode, ok := n.getStaticNodes()[name]
+	if ok && name == avatarFileName {
+		if _, err := os.Lstat(filepath.Join(n.RootData.Path, name)); err == nil {
+			return nil, false
+		}
+	}
+	if ok && name == cloneErrorFileName && n.param.Git.RepoStatus(n.project.ID).CloneError == nil {
+		return nil, false
+	}
+	return staticNode, ok
+}
+
+// protectsGitDir returns whether name is the git folder of the local copy, and the local copy can't be removed
+// Removing it, eg: with rm -r on the project, would remove the local copy without the checks of allow_clone_removal
+func (n *repositoryDirNode) protectsGitDir(name string) bool {
+	return name == ".git" && !n.param.AllowCloneRemoval
+}
+
+func (n *repositoryDirNode) Unlink(ctx context.Context, name string) syscall.Errno {
+	if _, ok := n.staticNode(name); ok || n.protectsGitDir(name) {
+		return syscall.EPERM
+	}
+	return n.projectFileNode.Unlink(ctx, name)
+}
+
+func (n *repositoryDirNode) Rmdir(ctx context.Context, name string) syscall.Errno {
+	if n.protectsGitDir(name) {
+		return syscall.EPERM
+	}
+	return n.projectFileNode.Rmdir(ctx, name)
+}
+
+func (n *repositoryDirNode) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	if _, ok := n.staticNode(name); ok || n.protectsGitDir(name) {
+		return syscall.EPERM
+	}
+	return n.projectFileNode.Rename(ctx, name, newParent, newName, flags)
+}
+
+// projectFileNode is a file or a folder inside the local copy of a project
+type projectFileNode struct {
+	fs.LoopbackNode
+	param *FSParam
+
+	// Modification time of the git index of the local copy when the file was last opened, in nanoseconds
+	indexTime atomic.Int64
+}
+
+// Ensure we are implementing the NodeLookuper interface
+var _ = (fs.NodeLookuper)((*projectFileNode)(nil))
+
+// Ensure we are implementing the NodeGetattrer interface
+var _ = (fs.NodeGetattrer)((*projectFileNode)(nil))
+
+// Ensure we are implementing the NodeSetattrer interface
+var _ = (fs.NodeSetattrer)((*projectFileNode)(nil))
+
+// Ensure we are implementing the NodeOpener interface
+var _ = (fs.NodeOpener)((*projectFileNode)(nil))
+
+// Ensure we are implementing the NodeCreater interface
+var _ = (fs.NodeCreater)((*projectFileNode)(nil))
+
+// Ensure we are implementing the NodeMkdirer interface
+var _ = (fs.NodeMkdirer)((*projectFileNode)(nil))
+
+// Ensure we are implementing the NodeMknoder interface
+var _ = (fs.NodeMknoder)((*projectFileNode)(nil))
+
+// Ensure we are implementing the NodeSymlinker interface
+var _ = (fs.NodeSymlinker)((*projectFileNode)(nil))
+
+// Ensure we are implementing the NodeRenamer interface
+var _ = (fs.NodeRenamer)((*projectFileNode)(nil))
+
+// Ensure we are implementing the NodeLinker interface
+var _ = (fs.NodeLinker)((*projectFileNode)(nil))
+
+func (p *FSParam) newProjectFileNode(rootData *fs.LoopbackRoot, parent *fs.Inode, name string, st *syscall.Stat_t) fs.InodeEmbedder {
+	node := &projectFileNode{
+		param: p,
+	}
+	node.RootData = rootData
+	return node
+}
+
+// The attributes returned by the loopback are those of the local copy, map their owner and their cache timeout for every operation returning them
+
+func (n *projectFileNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	n.recordAccess()
+	inode, errno := n.LoopbackNode.Lookup(ctx, name, out)
+	n.param.mapEntry(out)
+	return inode, errno
+}
+
+func (n *projectFileNode) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	errno := n.LoopbackNode.Getattr(ctx, fh, out)
+	n.param.mapAttr(out)
+	return errno
+}
+
+func (n *projectFileNode) Setattr(ctx context.Context, fh fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	errno := n.LoopbackNode.Setattr(ctx, fh, in, out)
+	n.param.mapAttr(out)
+	return errno
+}
+
+func (n *projectFileNode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*fs.Inode, fs.FileHandle, uint32, syscall.Errno) {
+	n.recordAccess()
+	inode, fh, fuseFlags, errno := n.LoopbackNode.Create(ctx, name, flags, mode, out)
+	n.param.mapEntry(out)
+	return inode, fh, fuseFlags | n.openFlags(), errno
+}
+
+func (n *projectFileNode) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	ctx, span := startSpan(ctx, "Open", &n.Inode)
+	defer span.End()
+
+	if root, ok := n.RootData.RootNode.(*repositoryDirNode); ok {
+		root.cloneOn(ctx, CloneTriggerOpen, &n.Inode, "")
+	}
+	n.recordAccess()
+	fh, fuseFlags, errno := n.LoopbackNode.Open(ctx, flags)
+	return fh, fuseFlags | n.openFlags(), errno
+}
+
+func (n *projectFileNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	inode, errno := n.LoopbackNode.Mkdir(ctx, name, mode, out)
+	n.param.mapEntry(out)
+	return inode, errno
+}
+
+func (n *projectFileNode) Mknod(ctx context.Context, name string, mode uint32, dev uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	inode, errno := n.LoopbackNode.Mknod(ctx, name, mode, dev, out)
+	n.param.mapEntry(out)
+	return inode, errno
+}
+
+func (n *projectFileNode) Symlink(ctx context.Context, target string, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	inode, errno := n.LoopbackNode.Symlink(ctx, target, name, out)
+	n.param.mapEntry(out)
+	return inode, errno
+}
+
+func (n *projectFileNode) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	return renameInProject(n.RootData, n, name, newParent, newName, flags)
+}
+
+func (n *projectFileNode) Link(ctx context.Context, target fs.InodeEmbedder, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	inode, errno := linkInProject(ctx, n.RootData, &n.LoopbackNode, target, name, out)
+	n.param.mapEntry(out)
+	return inode, errno
+}
+
+// recordAccess records the access to the local copy of the node, the local copies accessed least recently are evicted first
+func (n *projectFileNode) recordAccess() {
+	if root, ok := n.RootData.RootNode.(*repositoryDirNode); ok {
+		n.param.Git.RecordAccess(root.project.ID)
+	}
+}
+
+// mapOwner presents the files of the local copies owned by the user running gitlabfs as owned by the owner of the filesystem
+func (p *FSParam) mapOwner(out *fuse.Attr) {
+	if out.Uid == uint32(os.Getuid()) {
+		out.Uid = p.UID
+	}
+	if out.Gid == uint32(os.Getgid()) {
+		out.Gid = p.GID
+	}
+}
+
+// mapEntry maps the owner and the cache timeouts of an entry inside a local copy
+func (p *FSParam) mapEntry(out *fuse.EntryOut) {
+	p.mapOwner(&out.Attr)
+	if p.CloneCacheTimeout > 0 {
+		out.SetEntryTimeout(p.CloneCacheTimeout)
+		out.SetAttrTimeout(p.CloneCacheTimeout)
+	}
+}
+
+// mapAttr maps the owner and the cache timeout of the attributes of a file inside a local copy
+func (p *FSParam) mapAttr(out *fuse.AttrOut) {
+	p.mapOwner(&out.Attr)
+	if p.CloneCacheTimeout > 0 {
+		out.SetTimeout(p.CloneCacheTimeout)
+	}
+}
+
+// openFlags returns the flags of the file opened inside a local copy
+// When the kernel runs the reads and writes of the file directly on the local copy (passthrough), the page cache flag is ignored
+func (n *projectFileNode) openFlags() uint32 {
+	if !n.param.KernelCache {
+		return 0
+	}
+	// A pull checks out the files on the local copy behind the back of the kernel, which would keep serving their old
+	// content from its cache. git rewrites its index along with the files it checks out, the cached pages are only
+	// kept until the index changes. The local copies shouldn't be modified outside of the mount by other means.
+	info, err := os.Stat(filepath.Join(n.RootData.Path, ".git", "index"))
+	if err != nil {
+		return 0
+	}
+	indexTime := info.ModTime().UnixNano()
+	if n.indexTime.Swap(indexTime) != indexTime {
+		// Opening without the flag drops the cached pages
+		return 0
+	}
+	return fuse.FOPEN_KEEP_CACHE
+}
+
+// projectRootOf returns the root of the local copy node belongs to, or nil if node is not part of a local copy
+func projectRootOf(node fs.InodeEmbedder) *fs.LoopbackRoot {
+	switch n := node.(type) {
+	case *repositoryDirNode:
+		return n.RootData
+	case *projectFileNode:
+		return n.RootData
+	}
+	return nil
+}
+
+// localPath returns the path of node in the local copy of its project
+// The loopback resolves the paths of renames and links from the root of the mount, which
+// is wrong when the loopback is mounted in a subfolder, so we resolve them ourself.
+func localPath(root *fs.LoopbackRoot, node fs.InodeEmbedder) string {
+	return filepath.Join(root.Path, node.EmbeddedInode().Path(root.RootNode.EmbeddedInode()))
+}
+
+func renameInProject(root *fs.LoopbackRoot, parent fs.InodeEmbedder, name string, newParent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	// Files can only be moved within the local copy of the same project
+	if projectRootOf(newParent) != root {
+		return syscall.EXDEV
+	}
+	if flags&fs.RENAME_EXCHANGE != 0 {
+		return syscall.EINVAL
+	}
+	err := syscall.Rename(
+		filepath.Join(localPath(root, parent), name),
+		filepath.Join(localPath(root, newParent), newName),
+	)
+	return fs.ToErrno(err)
+}
+
+func linkInProject(ctx context.Context, root *fs.LoopbackRoot, parent *fs.LoopbackNode, target fs.InodeEmbedder, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	// Files can only be linked within the local copy of the same project
+	if projectRootOf(target) != root {
+		return nil, syscall.EXDEV
+	}
+	p := filepath.Join(localPath(root, parent), name)
+	if err := syscall.Link(localPath(root, target), p); err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	st := syscall.Stat_t{}
+	if err := syscall.Lstat(p, &st); err != nil {
+		syscall.Unlink(p)
+		return nil, fs.ToErrno(err)
+	}
+	out.Attr.FromStat(&st)
+	return parent.NewInode(ctx, root.NewNode(root, parent.EmbeddedInode(), name, &st), loopbackStableAttr(root, &st)), 0
+}
+
+// loopbackStableAttr computes the attributes of a node of the local copy the same way the loopback does
+func loopbackStableAttr(root *fs.LoopbackRoot, st *syscall.Stat_t) fs.StableAttr {
+	swapped := (uint64(st.Dev) << 32) | (uint64(st.Dev) >> 32)
+	swappedRootDev := (root.Dev << 32) | (root.Dev >> 32)
+	return fs.StableAttr{
+		Mode: uint32(st.Mode),
+		Gen:  1,
+		Ino:  (swapped ^ swappedRootDev) ^ st.Ino,
+	}
+}
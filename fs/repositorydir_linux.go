@@ -0,0 +1,39 @@
+package fs
+
+import (
+	"context"
+	"os"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Ensure we are implementing the NodeStatxer interface
+var _ = (fs.NodeStatxer)((*projectFileNode)(nil))
+var _ = (fs.NodeStatxer)((*repositoryDirNode)(nil))
+
+func (n *projectFileNode) Statx(ctx context.Context, fh fs.FileHandle, flags uint32, mask uint32, out *fuse.StatxOut) syscall.Errno {
+	errno := n.LoopbackNode.Statx(ctx, fh, flags, mask, out)
+	if out.Uid == uint32(os.Getuid()) {
+		out.Uid = n.param.UID
+	}
+	if out.Gid == uint32(os.Getgid()) {
+		out.Gid = n.param.GID
+	}
+	if n.param.CloneCacheTimeout > 0 {
+		out.SetTimeout(n.param.CloneCacheTimeout)
+	}
+	return errno
+}
+
+func (n *repositoryDirNode) Statx(ctx context.Context, fh fs.FileHandle, flags uint32, mask uint32, out *fuse.StatxOut) syscall.Errno {
+	if !n.param.Git.IsCloned(n.project.ID) {
+		// There is no local copy yet, let the kernel fallback on Getattr
+		return syscall.ENOSYS
+	}
+	errno := n.projectFileNode.Statx(ctx, fh, flags, mask, out)
+	// The inode number of the folder is allocated by gitlabfs, not by the local copy
+	out.Ino = 0
+	return errno
+}
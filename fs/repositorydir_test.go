@@ -0,0 +1,64 @@
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestProjectFileNodeOpenFlags(t *testing.T) {
+	localRepoLoc := t.TempDir()
+	index := filepath.Join(localRepoLoc, ".git", "index")
+	if err := os.MkdirAll(filepath.Dir(index), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(index, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	checkout := func(at time.Time) {
+		if err := os.Chtimes(index, at, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	checkout(now)
+
+	steps := []struct {
+		name string
+		// Applied before the file is opened
+		before func()
+		flags  uint32
+	}{
+		{name: "first open", flags: 0},
+		{name: "reopened", flags: fuse.FOPEN_KEEP_CACHE},
+		{name: "reopened again", flags: fuse.FOPEN_KEEP_CACHE},
+		{name: "after a pull", before: func() { checkout(now.Add(time.Second)) }, flags: 0},
+		{name: "reopened after the pull", flags: fuse.FOPEN_KEEP_CACHE},
+		{name: "index removed", before: func() { os.Remove(index) }, flags: 0},
+	}
+	node := &projectFileNode{param: &FSParam{KernelCache: true}}
+	node.RootData = &fs.LoopbackRoot{Path: localRepoLoc}
+	for _, step := range steps {
+		if step.before != nil {
+			step.before()
+		}
+		if flags := node.openFlags(); flags != step.flags {
+			t.Errorf("%v: expected the flags %v, got %v", step.name, step.flags, flags)
+		}
+	}
+
+	uncached := &projectFileNode{param: &FSParam{KernelCache: false}}
+	uncached.RootData = &fs.LoopbackRoot{Path: localRepoLoc}
+	if err := os.WriteFile(index, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if flags := uncached.openFlags(); flags != 0 {
+			t.Errorf("expected the pages not to be kept without kernel_cache, got %v", flags)
+		}
+	}
+}
@@ -5,19 +5,33 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"path"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/badjware/gitlabfs/git"
 	"github.com/badjware/gitlabfs/gitlab"
+	"github.com/badjware/gitlabfs/metadata"
+	"github.com/badjware/gitlabfs/utils"
 
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
 )
 
 const (
-	staticInodeStart = uint64(int(^(uint(0))>>1)) + 1
+	ProjectModeSymlink   = "symlink"
+	ProjectModeDirectory = "directory"
+	ProjectModeBrowse    = "browse"
+
+	CloneTriggerLookup  = "lookup"
+	CloneTriggerReaddir = "readdir"
+	CloneTriggerOpen    = "open"
 )
 
+var logger = utils.NewLogger("fs")
+
 type staticNode interface {
 	fs.InodeEmbedder
 	Ino() uint64
@@ -31,72 +45,306 @@ type FSParam struct {
 	RootGroupIds []int
 	UserIds      []int
 
-	staticInoChan chan uint64
+	// Number of root groups and users fetched at once when the filesystem is mounted
+	StartupWorkerCount int
+
+	// If true, the filesystem is mounted without calling gitlab
+	// The root groups and users are named after their id until they are fetched, on the first access to the filesystem
+	DeferredMount bool
+
+	Layout LayoutParam
+
+	// How the projects are exposed, either as a symlink to their local copy or as a folder mirroring it
+	// In browse mode, the folder shows the default branch read from the repository api until the project is cloned
+	ProjectMode string
+
+	// What starts the clone of a project, when projects are exposed as folders
+	CloneTrigger string
+
+	// Name of the processes which never start a clone when accessing a project, eg: file indexers
+	CloneDenylist []string
+
+	// Owner of the nodes of the filesystem
+	// The files of the local copies owned by the user running gitlabfs are also presented as owned by them
+	UID uint32
+	GID uint32
+
+	// If true, the names of the subgroups and projects are resolved regardless of case in groups and users
+	CaseInsensitiveLookup bool
+
+	// If true, write operations are mapped to operations in gitlab
+	ReadWrite bool
+
+	// If true, deleting a project deletes its local copy
+	AllowCloneRemoval bool
+
+	// Path of the local clones, used to report the usage of the filesystem
+	CloneLocation string
+
+	// Called once the filesystem is mounted
+	OnMounted func()
+
+	// Returns the configuration in effect, exposed in the administrative folder
+	EffectiveConfig func() ([]byte, error)
+
+	// Returns the version of gitlabfs and of its dependencies, exposed in the administrative folder
+	BuildInfo func() ([]byte, error)
+
+	// Called to reload the configuration when SIGHUP is received, or when Reload is called
+	// If nil, SIGHUP is ignored
+	Reloader Reloader
+
+	// Path of the file where the allocated inode numbers are persisted
+	// If empty, inode numbers are only stable for the lifetime of the mount
+	InodeTablePath string
+
+	// Path of the file where the clones, pulls and write operations triggered through the filesystem are recorded
+	// If empty, the actions are not recorded
+	AuditLogPath string
+
+	// Database where the projects found in the filesystem are recorded, along with where their local copy is
+	// If nil, the projects are not recorded
+	Metadata *metadata.Store
+
+	// How long the kernel is allowed to cache the lookups and attributes of the nodes
+	EntryTimeout    time.Duration
+	AttrTimeout     time.Duration
+	NegativeTimeout time.Duration
+
+	// How long the kernel is allowed to cache the lookups and attributes of the files inside the local copies
+	// If zero, EntryTimeout and AttrTimeout are used instead
+	CloneCacheTimeout time.Duration
+
+	// If true, the kernel keeps the content of the files of the local copies in its page cache between opens
+	KernelCache bool
+
+	inodes     *inodeTable
+	audit      *auditLog
+	mountpoint string
+	// Set while the filesystem is mounted
+	root atomic.Pointer[rootNode]
+	// Replaces CloneDenylist once the configuration is reloaded
+	cloneDenylist atomic.Pointer[[]string]
+}
+
+// LayoutParam configures where each part of the filesystem is placed at the root of the mount
+type LayoutParam struct {
+	// Name of the folders containing the root groups and the users
+	// If empty, the root groups or the users are placed directly at the root of the mount
+	GroupsDir string
+	UsersDir  string
+
+	// Name of the folders containing the flattened view and the by-id view of the projects
+	// If empty, the view is disabled
+	AllDir  string
+	ByIDDir string
+
+	// Name of the symlink to the folder of the user the token belongs to
+	// If empty, the symlink is disabled
+	CurrentUserLink string
+
+	// Name of the folder exposing the runtime state of gitlabfs
+	// If empty, the folder is disabled
+	AdminDir string
+}
+
+// namespaces locates the root groups and the users in the filesystem
+type namespaces struct {
+	groups     *fs.Inode
+	groupsPath string
+	users      *fs.Inode
+	usersPath  string
+
+	// The root groups and users not fetched yet when the mount is deferred, nil otherwise
+	pending *pendingRoots
 }
 
 type rootNode struct {
 	fs.Inode
-	param        *FSParam
+	param *FSParam
+
+	// Guards the ids, so the configuration is reloaded once at a time
+	reloadMux    sync.Mutex
 	rootGroupIds []int
 	userIds      []int
+
+	ns *namespaces
 }
 
 var _ = (fs.NodeOnAdder)((*rootNode)(nil))
 
 func (n *rootNode) OnAdd(ctx context.Context) {
-	groupsInode := n.NewPersistentInode(
-		ctx,
-		newGroupsNode(
-			n.rootGroupIds,
-			n.param,
-		),
-		fs.StableAttr{
-			Ino:  <-n.param.staticInoChan,
-			Mode: fuse.S_IFDIR,
-		},
-	)
-	n.AddChild("groups", groupsInode, false)
+	layout := n.param.Layout
+	ns := &namespaces{
+		groups:     &n.Inode,
+		groupsPath: layout.GroupsDir,
+		users:      &n.Inode,
+		usersPath:  layout.UsersDir,
+	}
+	n.ns = ns
+	if n.param.DeferredMount {
+		ns.pending = newPendingRoots(n)
+	}
 
-	usersInode := n.NewPersistentInode(
-		ctx,
-		newUsersNode(
+	if layout.GroupsDir != "" {
+		groupsInode := n.NewPersistentInode(
+			ctx,
+			newGroupsNode(
+				n.rootGroupIds,
+				ns,
+				n.param,
+			),
+			fs.StableAttr{
+				Ino:  n.param.inodes.ino("groups"),
+				Mode: fuse.S_IFDIR,
+			},
+		)
+		n.AddChild(layout.GroupsDir, groupsInode, false)
+		ns.groups = groupsInode
+	} else if ns.pending != nil {
+		ns.pending.addGroupPlaceholders(ctx, &n.Inode, n.rootGroupIds)
+	} else {
+		addRootGroupNodes(ctx, &n.Inode, n.rootGroupIds, n.param)
+	}
+
+	var currentUserName string
+	if layout.UsersDir != "" {
+		usersNode := newUsersNode(
 			n.userIds,
+			ns,
 			n.param,
-		),
+		)
+		usersInode := n.NewPersistentInode(
+			ctx,
+			usersNode,
+			fs.StableAttr{
+				Ino:  n.param.inodes.ino("users"),
+				Mode: fuse.S_IFDIR,
+			},
+		)
+		n.AddChild(layout.UsersDir, usersInode, false)
+		ns.users = usersInode
+		currentUserName = usersNode.currentUserName
+	} else if ns.pending != nil {
+		ns.pending.addUserPlaceholders(ctx, &n.Inode, n.userIds)
+	} else {
+		currentUserName = addUserNodes(ctx, &n.Inode, n.userIds, n.param)
+	}
+	n.addCurrentUserLink(ctx, currentUserName)
+
+	if layout.AllDir != "" {
+		allInode := n.NewPersistentInode(
+			ctx,
+			newAllNode(
+				ns,
+				n.param,
+			),
+			fs.StableAttr{
+				Ino:  n.param.inodes.ino("all"),
+				Mode: fuse.S_IFDIR,
+			},
+		)
+		n.AddChild(layout.AllDir, allInode, false)
+	}
+
+	if layout.ByIDDir != "" {
+		byIDInode := n.NewPersistentInode(
+			ctx,
+			newByIDNode(
+				ns,
+				n.param,
+			),
+			fs.StableAttr{
+				Ino:  n.param.inodes.ino(".by-id"),
+				Mode: fuse.S_IFDIR,
+			},
+		)
+		n.AddChild(layout.ByIDDir, byIDInode, false)
+	}
+
+	if layout.AdminDir != "" {
+		adminInode := n.NewPersistentInode(
+			ctx,
+			newAdminNode(
+				n,
+				n.param,
+			),
+			fs.StableAttr{
+				Ino:  n.param.inodes.ino("admin"),
+				Mode: fuse.S_IFDIR,
+			},
+		)
+		n.AddChild(layout.AdminDir, adminInode, false)
+	}
+
+	logger.Info("mounted and ready to use")
+}
+
+// addCurrentUserLink adds the symlink to the folder of the current user, if enabled and there is a current user
+func (n *rootNode) addCurrentUserLink(ctx context.Context, currentUserName string) {
+	layout := n.param.Layout
+	if layout.CurrentUserLink == "" || currentUserName == "" {
+		return
+	}
+	currentUserInode := n.NewPersistentInode(
+		ctx,
+		// The symlink is relative so it remains valid wherever the filesystem is mounted
+		newSymlinkNode(path.Join(layout.UsersDir, currentUserName)),
 		fs.StableAttr{
-			Ino:  <-n.param.staticInoChan,
-			Mode: fuse.S_IFDIR,
+			Ino:  n.param.inodes.ino("me"),
+			Mode: fuse.S_IFLNK,
 		},
 	)
-	n.AddChild("users", usersInode, false)
-
-	fmt.Println("Mounted and ready to use")
+	n.AddChild(layout.CurrentUserLink, currentUserInode, false)
 }
 
 func Start(mountpoint string, mountoptions []string, param *FSParam, debug bool) error {
-	fmt.Printf("Mounting in %v\n", mountpoint)
+	logger.Info("mounting", "mountpoint", mountpoint)
 
 	opts := &fs.Options{}
 	opts.MountOptions.Options = mountoptions
 	opts.Debug = debug
+	opts.EntryTimeout = &param.EntryTimeout
+	opts.AttrTimeout = &param.AttrTimeout
+	opts.NegativeTimeout = &param.NegativeTimeout
+	opts.UID = param.UID
+	opts.GID = param.GID
+
+	inodes, err := newInodeTable(param.InodeTablePath)
+	if err != nil {
+		return err
+	}
+	defer inodes.close()
+	param.inodes = inodes
+
+	audit, err := newAuditLog(param.AuditLogPath, mountpoint)
+	if err != nil {
+		return err
+	}
+	defer audit.close()
+	param.audit = audit
+	param.mountpoint = mountpoint
 
-	param.staticInoChan = make(chan uint64)
 	root := &rootNode{
 		param:        param,
 		rootGroupIds: param.RootGroupIds,
 		userIds:      param.UserIds,
 	}
 
-	go staticInoGenerator(root.param.staticInoChan)
-
 	server, err := fs.Mount(mountpoint, root, opts)
 	if err != nil {
 		return fmt.Errorf("mount failed: %v", err)
 	}
+	param.root.Store(root)
+	defer param.root.Store(nil)
+
+	if param.OnMounted != nil {
+		param.OnMounted()
+	}
 
-	signalChan := make(chan os.Signal)
-	go signalHandler(signalChan, server)
-	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+	signalChan := make(chan os.Signal, 1)
+	go signalHandler(signalChan, server, root)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
 	// server.Serve() is already called in fs.Mount() so we shouldn't call it ourself. We wait for the server to terminate.
 	server.Wait()
@@ -104,26 +352,23 @@ func Start(mountpoint string, mountoptions []string, param *FSParam, debug bool)
 	return nil
 }
 
-func staticInoGenerator(staticInoChan chan<- uint64) {
-	i := staticInodeStart
-	for {
-		staticInoChan <- i
-		i++
-	}
-}
-
-func signalHandler(signalChan <-chan os.Signal, server *fuse.Server) {
+func signalHandler(signalChan <-chan os.Signal, server *fuse.Server, root *rootNode) {
 	err := server.WaitMount()
 	if err != nil {
-		fmt.Printf("failed to start exit signal handler: %v\n", err)
+		logger.Error("failed to start exit signal handler", "error", err)
 		return
 	}
 	for {
 		s := <-signalChan
-		fmt.Printf("Caught %v: stopping\n", s)
+		if s == syscall.SIGHUP {
+			logger.Info("reloading configuration", "signal", s.String())
+			root.reload()
+			continue
+		}
+		logger.Info("stopping", "signal", s.String())
 		err := server.Unmount()
 		if err != nil {
-			fmt.Printf("Failed to unmount: %v\n", err)
+			logger.Error("failed to unmount", "error", err)
 		}
 	}
 }
@@ -0,0 +1,37 @@
+package fs
+
+import (
+	"context"
+	"sync"
+)
+
+// fetchConcurrently calls fetch for each id, with at most workers calls running at once
+// The results and the errors are returned in the order of ids
+func fetchConcurrently[T any](ctx context.Context, ids []int, workers int, fetch func(context.Context, int) (T, error)) ([]T, []error) {
+	results := make([]T, len(ids))
+	errs := make([]error, len(ids))
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(ids) {
+		workers = len(ids)
+	}
+
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				results[i], errs[i] = fetch(ctx, ids[i])
+			}
+		}()
+	}
+	for i := range ids {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return results, errs
+}
@@ -0,0 +1,84 @@
+package fs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Ensure we are implementing the NodeStatfser interface
+var _ = (fs.NodeStatfser)((*rootNode)(nil))
+var _ = (fs.NodeStatfser)((*groupsNode)(nil))
+var _ = (fs.NodeStatfser)((*groupNode)(nil))
+var _ = (fs.NodeStatfser)((*usersNode)(nil))
+var _ = (fs.NodeStatfser)((*userNode)(nil))
+var _ = (fs.NodeStatfser)((*allNode)(nil))
+var _ = (fs.NodeStatfser)((*byIDNode)(nil))
+var _ = (fs.NodeStatfser)((*repositoryDirNode)(nil))
+var _ = (fs.NodeStatfser)((*adminNode)(nil))
+
+// closestExistingPath returns path, or its closest parent that exists
+func closestExistingPath(path string) string {
+	for {
+		if _, err := os.Stat(path); err == nil || filepath.Dir(path) == path {
+			return path
+		}
+		path = filepath.Dir(path)
+	}
+}
+
+// statfs reports the usage of the filesystem holding the local clones
+func statfs(param *FSParam, out *fuse.StatfsOut) syscall.Errno {
+	if param.CloneLocation == "" {
+		// leave zeroed out
+		return 0
+	}
+
+	// The clone location may not be created yet, use the closest existing parent
+	s := syscall.Statfs_t{}
+	if err := syscall.Statfs(closestExistingPath(param.CloneLocation), &s); err != nil {
+		return fs.ToErrno(err)
+	}
+	out.FromStatfsT(&s)
+	return 0
+}
+
+func (n *rootNode) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	return statfs(n.param, out)
+}
+
+func (n *groupsNode) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	return statfs(n.param, out)
+}
+
+func (n *groupNode) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	return statfs(n.param, out)
+}
+
+func (n *usersNode) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	return statfs(n.param, out)
+}
+
+func (n *userNode) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	return statfs(n.param, out)
+}
+
+func (n *allNode) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	return statfs(n.param, out)
+}
+
+func (n *byIDNode) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	return statfs(n.param, out)
+}
+
+func (n *repositoryDirNode) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	return statfs(n.param, out)
+}
+
+func (n *adminNode) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	return statfs(n.param, out)
+}
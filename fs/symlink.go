@@ -0,0 +1,26 @@
+package fs
+
+import (
+	"context"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+)
+
+type symlinkNode struct {
+	fs.Inode
+	target string
+}
+
+// Ensure we are implementing the NodeReadlinker interface
+var _ = (fs.NodeReadlinker)((*symlinkNode)(nil))
+
+func newSymlinkNode(target string) *symlinkNode {
+	return &symlinkNode{
+		target: target,
+	}
+}
+
+func (n *symlinkNode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	return []byte(n.target), 0
+}
@@ -0,0 +1,22 @@
+package fs
+
+import (
+	"context"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/badjware/gitlabfs/fs")
+
+// startSpan starts the span of the fuse operation op on inode
+func startSpan(ctx context.Context, op string, inode *fs.Inode, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	ctx, span := tracer.Start(ctx, "fs."+op, trace.WithAttributes(attrs...))
+	if span.IsRecording() {
+		// Resolving the path walks up the tree, only do it when the span is sampled
+		span.SetAttributes(attribute.String("fs.path", inode.Path(nil)))
+	}
+	return ctx, span
+}
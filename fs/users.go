@@ -2,72 +2,100 @@ package fs
 
 import (
 	"context"
-	"fmt"
+	"sort"
 	"syscall"
 
 	"github.com/badjware/gitlabfs/gitlab"
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type usersNode struct {
 	fs.Inode
 	param *FSParam
+	ns    *namespaces
 
 	userIds []int
+
+	// Name of the user the token belongs to, empty if anonymous
+	currentUserName string
 }
 
 // Ensure we are implementing the NodeOnAdder interface
 var _ = (fs.NodeOnAdder)((*usersNode)(nil))
 
-func newUsersNode(userIds []int, param *FSParam) *usersNode {
+func newUsersNode(userIds []int, ns *namespaces, param *FSParam) *usersNode {
 	return &usersNode{
 		param:   param,
+		ns:      ns,
 		userIds: userIds,
 	}
 }
 
 func (n *usersNode) OnAdd(ctx context.Context) {
+	if n.ns.pending != nil {
+		n.ns.pending.addUserPlaceholders(ctx, &n.Inode, n.userIds)
+		return
+	}
+	n.currentUserName = addUserNodes(ctx, &n.Inode, n.userIds, n.param)
+}
+
+// addUserNodes adds the current user and the users as children of parent
+// The name of the current user is returned, or an empty string if there is none
+func addUserNodes(ctx context.Context, parent *fs.Inode, userIds []int, param *FSParam) (currentUserName string) {
 	// Fetch the current logged user
-	currentUser, err := n.param.Gitlab.FetchCurrentUser()
+	currentUser, err := param.Gitlab.FetchCurrentUser(ctx)
 	// Skip if we are anonymous (or the call fails for some reason...)
 	if err != nil {
-		fmt.Println(err)
+		logger.Info("skipping the current user", "error", err)
 	} else {
-		currentUserNode, _ := newUserNode(currentUser, n.param)
-		inode := n.NewPersistentInode(
+		currentUserNode, _ := newUserNode(currentUser, param)
+		inode := parent.NewPersistentInode(
 			ctx,
 			currentUserNode,
 			fs.StableAttr{
-				Ino:  <-n.param.staticInoChan,
+				Ino:  param.inodes.ino(userInoKey(currentUser.ID)),
 				Mode: fuse.S_IFDIR,
 			},
 		)
-		n.AddChild(currentUserNode.user.Name, inode, false)
+		parent.AddChild(currentUserNode.user.Name, inode, false)
+		currentUserName = currentUser.Name
 	}
 
-	for _, userID := range n.userIds {
+	otherUserIds := make([]int, 0, len(userIds))
+	for _, userID := range userIds {
 		if currentUser != nil && currentUser.ID == userID {
 			// We already added the current user, we can skip it
 			continue
 		}
+		otherUserIds = append(otherUserIds, userID)
+	}
+	addUserNodesByID(ctx, parent, otherUserIds, param)
+	return currentUserName
+}
 
-		userNode, err := newUserNodeByID(userID, n.param)
-		if err != nil {
-			fmt.Printf("user fetch fail: %v\n", err)
-			fmt.Printf("Please verify the user exists and token with sufficient permissions is set in the config files.\n")
-			fmt.Printf("Skipping user %v\n", userID)
-			return
+// addUserNodesByID adds the users as children of parent
+// The users are fetched concurrently, and added in the order they are configured
+func addUserNodesByID(ctx context.Context, parent *fs.Inode, userIds []int, param *FSParam) {
+	userNodes, errs := fetchConcurrently(ctx, userIds, param.StartupWorkerCount, func(ctx context.Context, uid int) (*userNode, error) {
+		return newUserNodeByID(ctx, uid, param)
+	})
+	for i, userID := range userIds {
+		if errs[i] != nil {
+			logger.Error("user fetch fail, skipping user. Please verify the user exists and token with sufficient permissions is set in the config files.", "user", userID, "error", errs[i])
+			continue
 		}
-		inode := n.NewPersistentInode(
+		userNode := userNodes[i]
+		inode := parent.NewPersistentInode(
 			ctx,
 			userNode,
 			fs.StableAttr{
-				Ino:  <-n.param.staticInoChan,
+				Ino:  param.inodes.ino(userInoKey(userID)),
 				Mode: fuse.S_IFDIR,
 			},
 		)
-		n.AddChild(userNode.user.Name, inode, false)
+		parent.AddChild(userNode.user.Name, inode, false)
 	}
 }
 
@@ -85,8 +113,14 @@ var _ = (fs.NodeReaddirer)((*userNode)(nil))
 // Ensure we are implementing the NodeLookuper interface
 var _ = (fs.NodeLookuper)((*userNode)(nil))
 
-func newUserNodeByID(uid int, param *FSParam) (*userNode, error) {
-	user, err := param.Gitlab.FetchUser(uid)
+// Ensure we are implementing the NodeUnlinker interface
+var _ = (fs.NodeUnlinker)((*userNode)(nil))
+
+// Ensure we are implementing the NodeRmdirer interface
+var _ = (fs.NodeRmdirer)((*userNode)(nil))
+
+func newUserNodeByID(ctx context.Context, uid int, param *FSParam) (*userNode, error) {
+	user, err := param.Gitlab.FetchUser(ctx, uid)
 	if err != nil {
 		return nil, err
 	}
@@ -94,7 +128,7 @@ func newUserNodeByID(uid int, param *FSParam) (*userNode, error) {
 		param: param,
 		user:  user,
 		staticNodes: map[string]staticNode{
-			".refresh": newRefreshNode(user, param),
+			".refresh": newRefreshNode(user, userInoKey(user.ID), param),
 		},
 	}
 	return node, nil
@@ -105,44 +139,83 @@ func newUserNode(user *gitlab.User, param *FSParam) (*userNode, error) {
 		param: param,
 		user:  user,
 		staticNodes: map[string]staticNode{
-			".refresh": newRefreshNode(user, param),
+			".refresh": newRefreshNode(user, userInoKey(user.ID), param),
 		},
 	}
 	return node, nil
 }
 
 func (n *userNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
-	userContent, _ := n.param.Gitlab.FetchUserContent(n.user)
-	entries := make([]fuse.DirEntry, 0, len(userContent.Projects)+len(n.staticNodes))
-	for _, project := range userContent.Projects {
-		entries = append(entries, fuse.DirEntry{
-			Name: project.Name,
-			Ino:  uint64(project.ID),
-			Mode: fuse.S_IFLNK,
-		})
-	}
-	for name, staticNode := range n.staticNodes {
-		entries = append(entries, fuse.DirEntry{
-			Name: name,
-			Ino:  staticNode.Ino(),
-			Mode: staticNode.Mode(),
-		})
+	ctx, span := startSpan(ctx, "Readdir", &n.Inode)
+	defer span.End()
+
+	userContent, err := n.param.Gitlab.FetchUserContent(ctx, n.user)
+	if err != nil {
+		logger.Error("failed to list the user", "user", n.user.ID, "error", err)
+		// The static nodes are still listed, eg: to refresh the user once gitlab is reachable again
+		userContent = &gitlab.UserContent{}
+	}
+	projectNames := make([]string, 0, len(userContent.Projects))
+	for name := range userContent.Projects {
+		projectNames = append(projectNames, name)
 	}
-	return fs.NewListDirStream(entries), 0
+	sort.Strings(projectNames)
+	staticNames := sortedStaticNodeNames(n.staticNodes)
+
+	count := len(projectNames) + len(staticNames)
+	return newLazyDirStream(count, func(i int) fuse.DirEntry {
+		if i < len(projectNames) {
+			name := projectNames[i]
+			return fuse.DirEntry{
+				Name: name,
+				Ino:  n.param.inodes.ino(projectInoKey(userContent.Projects[name].ID)),
+				Mode: n.param.projectFileMode(),
+			}
+		}
+		i -= len(projectNames)
+		name := staticNames[i]
+		return fuse.DirEntry{
+			Name: name,
+			Ino:  n.staticNodes[name].Ino(),
+			Mode: n.staticNodes[name].Mode(),
+		}
+	}), 0
 }
 
 func (n *userNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
-	userContent, _ := n.param.Gitlab.FetchUserContent(n.user)
+	ctx, span := startSpan(ctx, "Lookup", &n.Inode, attribute.String("fs.name", name))
+	defer span.End()
+
+	userContent, err := n.param.Gitlab.FetchUserContent(ctx, n.user)
+	if err != nil {
+		userContent = &gitlab.UserContent{}
+	}
+
+	if _, ok := userContent.Projects[name]; n.param.CaseInsensitiveLookup && !ok {
+		names := make([]string, 0, len(userContent.Projects))
+		for name := range userContent.Projects {
+			names = append(names, name)
+		}
+		name = foldName(name, names)
+	}
 
 	// Check if the map of projects contains it
 	project, ok := userContent.Projects[name]
 	if ok {
 		attrs := fs.StableAttr{
-			Ino:  uint64(project.ID),
-			Mode: fuse.S_IFLNK,
+			Ino:  n.param.inodes.ino(projectInoKey(project.ID)),
+			Mode: n.param.projectFileMode(),
 		}
-		repositoryNode, _ := newRepositoryNode(project, n.param)
-		return n.NewInode(ctx, repositoryNode, attrs), 0
+		if child := existingChild(&n.Inode, name, attrs.Ino); child != nil {
+			if projectNode, ok := child.Operations().(projectNode); ok {
+				projectNode.fillAttr(&out.Attr)
+				return child, 0
+			}
+		}
+		projectNode := newProjectNode(project, n.param)
+		projectNode.fillAttr(&out.Attr)
+		n.param.recordProject(&n.Inode, name, project, attrs.Ino)
+		return n.NewInode(ctx, projectNode, attrs), 0
 	}
 
 	// Check if the map of static nodes contains it
@@ -157,3 +230,40 @@ func (n *userNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut)
 
 	return nil, syscall.ENOENT
 }
+
+// unlinkEntry deletes the local copy of the project named name in the content of the user
+// Only the projects can be unlinked, the static nodes stay
+func (n *userNode) unlinkEntry(ctx context.Context, content *gitlab.UserContent, name string) syscall.Errno {
+	project, ok := content.Projects[name]
+	if !ok {
+		if _, isStatic := n.staticNodes[name]; isStatic {
+			return syscall.EPERM
+		}
+		return syscall.ENOENT
+	}
+	return unlinkRepository(ctx, n.param, &n.Inode, name, project)
+}
+
+func (n *userNode) Unlink(ctx context.Context, name string) syscall.Errno {
+	ctx, span := startSpan(ctx, "Unlink", &n.Inode, attribute.String("fs.name", name))
+	defer span.End()
+
+	content, err := n.param.Gitlab.FetchUserContent(ctx, n.user)
+	if err != nil {
+		logger.Error("failed to list the user", "user", n.user.ID, "error", err)
+		return syscall.EIO
+	}
+	return n.unlinkEntry(ctx, content, name)
+}
+
+func (n *userNode) Rmdir(ctx context.Context, name string) syscall.Errno {
+	ctx, span := startSpan(ctx, "Rmdir", &n.Inode, attribute.String("fs.name", name))
+	defer span.End()
+
+	content, err := n.param.Gitlab.FetchUserContent(ctx, n.user)
+	if err != nil {
+		logger.Error("failed to list the user", "user", n.user.ID, "error", err)
+		return syscall.EIO
+	}
+	return n.unlinkEntry(ctx, content, name)
+}
@@ -0,0 +1,147 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"syscall"
+	"time"
+
+	"github.com/badjware/gitlabfs/git"
+	"github.com/hanwen/go-fuse/v2/fs"
+)
+
+const (
+	// Setting this extended attribute on a node triggers an action on it, eg: `setfattr -n user.gitlabfs.action -v pull <project>`
+	actionXattr = "user.gitlabfs.action"
+
+	actionRefresh = "refresh"
+	actionPull    = "pull"
+	actionClone   = "clone"
+
+	// Extended attribute of a project holding the error of its last clone, while it failed
+	cloneErrorXattr = "user.gitlabfs.clone_error"
+)
+
+// Ensure we are implementing the NodeSetxattrer interface
+var _ = (fs.NodeSetxattrer)((*rootNode)(nil))
+var _ = (fs.NodeSetxattrer)((*groupsNode)(nil))
+var _ = (fs.NodeSetxattrer)((*groupNode)(nil))
+var _ = (fs.NodeSetxattrer)((*usersNode)(nil))
+var _ = (fs.NodeSetxattrer)((*userNode)(nil))
+var _ = (fs.NodeSetxattrer)((*repositoryDirNode)(nil))
+
+// Ensure we are implementing the NodeGetxattrer interface
+var _ = (fs.NodeGetxattrer)((*repositoryDirNode)(nil))
+
+// Ensure we are implementing the NodeListxattrer interface
+var _ = (fs.NodeListxattrer)((*repositoryDirNode)(nil))
+
+// setActionXattr runs the action set in the action extended attribute, if it's one of the actions supported by the node
+func setActionXattr(attr string, data []byte, actions map[string]func() syscall.Errno) syscall.Errno {
+	if attr != actionXattr {
+		return syscall.ENOTSUP
+	}
+	action, ok := actions[string(data)]
+	if !ok {
+		return syscall.EINVAL
+	}
+	return action()
+}
+
+// refreshAction returns an action invalidating the cache of every group and user under inode
+func refreshAction(inode *fs.Inode) func() syscall.Errno {
+	return func() syscall.Errno {
+		invalidateCaches(inode)
+		return 0
+	}
+}
+
+func (n *rootNode) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	return setActionXattr(attr, data, map[string]func() syscall.Errno{
+		actionRefresh: refreshAction(&n.Inode),
+	})
+}
+
+func (n *groupsNode) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	return setActionXattr(attr, data, map[string]func() syscall.Errno{
+		actionRefresh: refreshAction(&n.Inode),
+	})
+}
+
+func (n *groupNode) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	return setActionXattr(attr, data, map[string]func() syscall.Errno{
+		actionRefresh: func() syscall.Errno {
+			n.group.InvalidateCache()
+			return 0
+		},
+	})
+}
+
+func (n *usersNode) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	return setActionXattr(attr, data, map[string]func() syscall.Errno{
+		actionRefresh: refreshAction(&n.Inode),
+	})
+}
+
+func (n *userNode) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	return setActionXattr(attr, data, map[string]func() syscall.Errno{
+		actionRefresh: func() syscall.Errno {
+			n.user.InvalidateCache()
+			return 0
+		},
+	})
+}
+
+func (n *repositoryDirNode) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	if attr != actionXattr {
+		// Any other attribute is set on the local copy
+		return n.projectFileNode.Setxattr(ctx, attr, data, flags)
+	}
+	// The pull clones the repo if there is no local copy yet, like the .pull file
+	pull := func() syscall.Errno {
+		_, op, err := n.param.Git.Pull(n.project.CloneURL, n.project.ID, n.project.DefaultBranch, n.project.PullDepth)
+		if op != "" {
+			n.param.audit.record(ctx, op, &n.Inode, "", n.project, err)
+		}
+		if errors.Is(err, git.ErrIgnoredLocalCopy) {
+			logger.Warn("not pulling project", "project", n.project.ID, "error", err)
+			return syscall.EPERM
+		} else if err != nil {
+			logger.Error("failed to pull project", "project", n.project.ID, "error", err)
+			return syscall.EAGAIN
+		}
+		return 0
+	}
+	return setActionXattr(attr, data, map[string]func() syscall.Errno{
+		actionPull:  pull,
+		actionClone: pull,
+	})
+}
+
+func (n *repositoryDirNode) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	if attr != cloneErrorXattr {
+		// Any other attribute is read from the local copy
+		return n.projectFileNode.Getxattr(ctx, attr, dest)
+	}
+	entry := n.param.Git.RepoStatus(n.project.ID).CloneError
+	if entry == nil {
+		return 0, errNoXattr
+	}
+	return copyXattr(dest, entry.Start.Format(time.RFC3339)+": "+entry.Error)
+}
+
+func (n *repositoryDirNode) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	if n.param.Git.RepoStatus(n.project.ID).CloneError == nil {
+		return n.projectFileNode.Listxattr(ctx, dest)
+	}
+	// The clone failed, there is no local copy to list the attributes of
+	return copyXattr(dest, cloneErrorXattr+"\x00")
+}
+
+// copyXattr copies value to dest, or returns the size of the buffer required if dest is too small
+func copyXattr(dest []byte, value string) (uint32, syscall.Errno) {
+	if len(dest) < len(value) {
+		return uint32(len(value)), syscall.ERANGE
+	}
+	return uint32(copy(dest, value)), 0
+}
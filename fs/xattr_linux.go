@@ -0,0 +1,6 @@
+package fs
+
+import "syscall"
+
+// The error of the extended attributes which are not set
+const errNoXattr = syscall.ENODATA
@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package fs
+
+import "syscall"
+
+// The error of the extended attributes which are not set, ENODATA is only an alias of it on linux
+const errNoXattr = syscall.ENOATTR
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/badjware/gitlabfs/git"
+	"github.com/badjware/gitlabfs/gitlab"
+	"github.com/badjware/gitlabfs/utils"
+)
+
+// verifyLocalCopies implements the fsck subcommand
+// It checks the integrity of every local copy of the clone location, and that their remote still points to their project
+func verifyLocalCopies(args []string) error {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	configPath := flags.String("config", findConfig(), "The config file")
+	profile := flags.String("profile", "", "The profile of the config file to apply")
+	full := flags.Bool("full", false, "Also run git fsck on every local copy, which reads every object of the local copy")
+	remote := flags.Bool("remote", true, "Check that the remote of every local copy points to its project, which requests every project from gitlab")
+	flags.Usage = func() {
+		fmt.Println("USAGE:")
+		fmt.Printf("    %s fsck [-config CONFIG] [-full] [-remote=false]\n\n", os.Args[0])
+		fmt.Println("OPTIONS:")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *configPath == "" {
+		flags.Usage()
+		return errors.New("the config file is required, none was found in the default locations")
+	}
+	config, err := loadConfig(*configPath, *profile)
+	if err != nil {
+		return err
+	}
+
+	var gitlabClient gitlab.GitlabFetcher
+	if *remote {
+		gitlabClientParam, err := makeGitlabConfig(config)
+		if err != nil {
+			return err
+		}
+		gitlabClient, err = gitlab.NewClient(config.Gitlab.URL, config.Gitlab.Token, *gitlabClientParam)
+		if err != nil {
+			return err
+		}
+	}
+
+	lockEncryptedStore, err := unlockEncryptedStore(config)
+	if err != nil {
+		return err
+	}
+	defer lockEncryptedStore()
+
+	gitClientParam, err := makeGitConfig(config)
+	if err != nil {
+		return err
+	}
+	// Leave the history to the running instance
+	gitClientParam.HistoryFile = ""
+	gitClient, err := git.NewClient(*gitClientParam)
+	if err != nil {
+		return err
+	}
+	defer gitClient.Close()
+
+	localCopies, err := gitClient.LocalCopies()
+	if err != nil {
+		return err
+	}
+
+	broken, staleRemotes, orphaned := 0, 0, 0
+	report := func(format string, a ...interface{}) {
+		fmt.Println("error: " + utils.Redact(fmt.Sprintf(format, a...)))
+	}
+	ctx := context.Background()
+	for _, pid := range localCopies {
+		localRepoLoc := gitClient.LocalRepoLoc(pid)
+		if err := gitClient.VerifyLocalCopy(pid, *full); err != nil {
+			report("%v", err)
+			broken++
+			// The remote of a broken local copy may not be readable either
+			continue
+		}
+		if gitlabClient == nil {
+			continue
+		}
+
+		project, err := gitlabClient.FetchProject(ctx, pid)
+		if code := gitlab.StatusCode(err); code == http.StatusNotFound || code == http.StatusForbidden {
+			report("%v: project %v no longer exists or is not visible anymore, `gitlabfs gc` removes its local copy", localRepoLoc, pid)
+			orphaned++
+			continue
+		} else if err != nil {
+			return err
+		}
+		remoteURL, err := gitClient.LocalRemoteURL(pid)
+		if err != nil {
+			report("%v", err)
+			broken++
+			continue
+		}
+		// The token in the url may be another one of the tokens of the config
+		if withoutCredentials(remoteURL) != withoutCredentials(project.CloneURL) {
+			report("%v: remote %v points to %v, but project %v is at %v", localRepoLoc, gitClientParam.RemoteName, withoutCredentials(remoteURL), pid, withoutCredentials(project.CloneURL))
+			staleRemotes++
+		}
+	}
+
+	fmt.Printf("checked %v local copies: %v broken, %v with a stale remote, %v orphaned\n", len(localCopies), broken, staleRemotes, orphaned)
+	if problems := broken + staleRemotes + orphaned; problems > 0 {
+		return fmt.Errorf("found %v problems in the local copies", problems)
+	}
+	return nil
+}
+
+// withoutCredentials returns the clone url without the credentials it may hold
+func withoutCredentials(cloneURL string) string {
+	u, err := url.Parse(cloneURL)
+	if err != nil || u.User == nil {
+		// Eg: the scp-like syntax of the ssh urls
+		return cloneURL
+	}
+	u.User = nil
+	return u.String()
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/badjware/gitlabfs/git"
+	"github.com/badjware/gitlabfs/gitlab"
+)
+
+// collectGarbage implements the gc subcommand
+// It removes the local copies of the projects that are no longer visible in any mount, eg: because they were deleted
+func collectGarbage(args []string) error {
+	flags := flag.NewFlagSet("gc", flag.ExitOnError)
+	configPath := flags.String("config", findConfig(), "The config file")
+	profile := flags.String("profile", "", "The profile of the config file to apply")
+	dryRunFlag := flags.Bool("dry-run", false, "Print the local copies that would be removed, without removing them")
+	flags.Usage = func() {
+		fmt.Println("USAGE:")
+		fmt.Printf("    %s gc [-config CONFIG]\n\n", os.Args[0])
+		fmt.Println("OPTIONS:")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *configPath == "" {
+		flags.Usage()
+		return errors.New("the config file is required, none was found in the default locations")
+	}
+	config, err := loadConfig(*configPath, *profile)
+	if err != nil {
+		return err
+	}
+
+	gitlabClientParam, err := makeGitlabConfig(config)
+	if err != nil {
+		return err
+	}
+	// The archived projects may be hidden from the filesystem, their local copy is still in use
+	gitlabClientParam.ArchivedProjectHandling = gitlab.ArchivedProjectShow
+	// So are the local copies of the empty projects, eg: with commits not pushed yet
+	gitlabClientParam.SkipEmptyProjects = false
+	gitlabClient, err := gitlab.NewClient(config.Gitlab.URL, config.Gitlab.Token, *gitlabClientParam)
+	if err != nil {
+		return err
+	}
+
+	lockEncryptedStore, err := unlockEncryptedStore(config)
+	if err != nil {
+		return err
+	}
+	defer lockEncryptedStore()
+
+	// The clone location is shared by every mount, so is the git client
+	gitClientParam, err := makeGitConfig(config)
+	if err != nil {
+		return err
+	}
+	// Leave the history to the running instance
+	gitClientParam.HistoryFile = ""
+	gitClient, err := git.NewClient(*gitClientParam)
+	if err != nil {
+		return err
+	}
+	defer gitClient.Close()
+
+	groupIDs, userIDs := configuredNamespaces(config)
+	visible, err := visibleProjects(context.Background(), gitlabClient, gitlabClientParam.IncludeCurrentUser, groupIDs, userIDs)
+	if err != nil {
+		// A project we failed to list is not necessarily gone
+		return fmt.Errorf("%v, not removing any local copy", err)
+	}
+
+	removed, kept, err := removeLocalCopies(gitClient, visible, *dryRunFlag)
+	if err != nil {
+		return err
+	}
+	logger.Info("removed the local copies of the projects no longer visible", "removed", removed, "kept", kept, "dry_run", *dryRunFlag)
+	return nil
+}
+
+// configuredNamespaces returns the ids of the groups and the users of every mount of config
+func configuredNamespaces(config *Config) (groupIDs []int, userIDs []int) {
+	if len(config.Mounts) == 0 {
+		return config.Gitlab.GroupIDs.IDs(), config.Gitlab.UserIDs
+	}
+	for _, m := range config.Mounts {
+		groupIDs = append(groupIDs, m.GroupIDs.IDs()...)
+		userIDs = append(userIDs, m.UserIDs...)
+	}
+	return groupIDs, userIDs
+}
+
+// localCopyRemover removes the local copies of the projects
+type localCopyRemover interface {
+	LocalCopies() ([]int, error)
+	LocalRepoLoc(pid int) string
+	IgnoresLocalCopy(pid int) bool
+	RemoveLocalCopy(pid int) error
+}
+
+// removeLocalCopies removes the local copies of the projects that are not visible
+// The local copies with uncommitted changes and the ignored ones are kept. If dryRun is true, the local copies are only printed
+func removeLocalCopies(gitClient localCopyRemover, visible map[int]*gitlab.Project, dryRun bool) (removed int, kept int, err error) {
+	localCopies, err := gitClient.LocalCopies()
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, pid := range localCopies {
+		if _, ok := visible[pid]; ok {
+			continue
+		}
+		localRepoLoc := gitClient.LocalRepoLoc(pid)
+		if gitClient.IgnoresLocalCopy(pid) {
+			logger.Info("keeping ignored local copy", "repo", localRepoLoc)
+			kept++
+			continue
+		}
+		if dryRun {
+			fmt.Printf("would remove %v\n", localRepoLoc)
+			removed++
+			continue
+		}
+		if err := gitClient.RemoveLocalCopy(pid); err != nil {
+			if errors.Is(err, git.ErrDirtyWorktree) {
+				logger.Warn("keeping local copy", "repo", localRepoLoc, "error", err)
+				kept++
+				continue
+			}
+			return removed, kept, err
+		}
+		removed++
+	}
+	return removed, kept, nil
+}
+
+// visibleProjects returns every project found in the groups and the users, by id
+func visibleProjects(ctx context.Context, client gitlab.GitlabFetcher, includeCurrentUser bool, groupIDs []int, userIDs []int) (map[int]*gitlab.Project, error) {
+	visible := map[int]*gitlab.Project{}
+
+	// The content of each subgroup is listed rather than the projects of the group in a single pass,
+	// so the local copies of the projects shared with a subgroup are never removed
+	var walkGroup func(group *gitlab.Group) error
+	walkGroup = func(group *gitlab.Group) error {
+		content, err := client.FetchGroupContent(ctx, group)
+		if err != nil {
+			return fmt.Errorf("failed to list the projects of group %v: %v", group.ID, err)
+		}
+		for _, project := range content.Projects {
+			visible[project.ID] = project
+		}
+		for _, subgroup := range content.Groups {
+			if err := walkGroup(subgroup); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, gid := range groupIDs {
+		group, err := client.FetchGroup(ctx, gid)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch group %v: %v", gid, err)
+		}
+		if err := walkGroup(group); err != nil {
+			return nil, err
+		}
+	}
+
+	var users []*gitlab.User
+	if includeCurrentUser {
+		user, err := client.FetchCurrentUser(ctx)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	for _, uid := range userIDs {
+		user, err := client.FetchUser(ctx, uid)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch user %v: %v", uid, err)
+		}
+		users = append(users, user)
+	}
+	for _, user := range users {
+		content, err := client.FetchUserContent(ctx, user)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list the projects of user %v: %v", user.ID, err)
+		}
+		for _, project := range content.Projects {
+			visible[project.ID] = project
+		}
+	}
+	return visible, nil
+}
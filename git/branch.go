@@ -0,0 +1,106 @@
+package git
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/badjware/gitlabfs/utils"
+)
+
+// Prefixes of the refs pinning a local copy to a branch or a tag, instead of the default branch of its project
+const (
+	pinnedBranchPrefix = "refs/heads/"
+	pinnedTagPrefix    = "refs/tags/"
+)
+
+// parseRef returns the name of the branch or the tag the local copy follows, whether it's a tag and whether it's pinned
+// defaultBranch is either the name of the default branch, or the full ref the local copy is pinned to, eg: refs/tags/v1.0
+func parseRef(defaultBranch string) (name string, tag bool, pinned bool) {
+	if strings.HasPrefix(defaultBranch, pinnedTagPrefix) {
+		return strings.TrimPrefix(defaultBranch, pinnedTagPrefix), true, true
+	}
+	if strings.HasPrefix(defaultBranch, pinnedBranchPrefix) {
+		return strings.TrimPrefix(defaultBranch, pinnedBranchPrefix), false, true
+	}
+	return defaultBranch, false, false
+}
+
+// RefName returns the name of the branch or the tag followed by the local copies given defaultBranch
+func RefName(defaultBranch string) string {
+	name, _, _ := parseRef(defaultBranch)
+	return name
+}
+
+// LocalRef returns the branch checked out in the local copy of the repo, empty if HEAD is detached, and the commit of HEAD
+func (c *gitClient) LocalRef(pid int) (branch string, commit string, err error) {
+	localRepoLoc := c.getLocalRepoLoc(pid)
+	branch, err = utils.ExecProcessInDirContext(
+		c.ctx,
+		localRepoLoc, // workdir
+		"git", "branch",
+		"--show-current",
+	)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to retrieve the branch of git repo %v: %v", localRepoLoc, err)
+	}
+	commit, err = utils.ExecProcessInDirContext(
+		c.ctx,
+		localRepoLoc, // workdir
+		"git", "rev-parse",
+		"--verify", "HEAD",
+	)
+	if err != nil {
+		// An empty repo has no commit yet
+		return branch, "", nil
+	}
+	return branch, commit, nil
+}
+
+// CheckoutBranch fetches the branch from the remote at url and checks it out in the local copy of the repo
+// depth overrides the depth of the client, unless it's negative
+func (c *gitClient) CheckoutBranch(url string, pid int, branch string, depth int) error {
+	p := c.params()
+	_, credentialEnv := withoutCredentials(url)
+	localRepoLoc := c.getLocalRepoLoc(pid)
+	// A shallow clone only fetches the branch it cloned
+	_, err := utils.ExecProcessInDirContext(
+		c.ctx,
+		localRepoLoc, // workdir
+		"git", "remote", "set-branches",
+		"--add",
+		"--",
+		p.RemoteName, // name
+		branch,       // branch
+	)
+	if err != nil {
+		return fmt.Errorf("failed to track branch %v in git repo %v: %v", branch, localRepoLoc, err)
+	}
+	_, err = utils.ExecProcessInDirContextEnv(
+		c.ctx,
+		localRepoLoc, // workdir
+		credentialEnv,
+		"git", append(p.httpConfigArgs(),
+			"fetch",
+			"--depth", strconv.Itoa(p.pullDepth(depth)),
+			"--",
+			p.RemoteName, // repository
+			branch,       // refspec
+		)...,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to fetch branch %v of git repo %v: %v", branch, localRepoLoc, err)
+	}
+	_, err = utils.ExecProcessInDirContext(
+		c.ctx,
+		localRepoLoc, // workdir
+		"git", "checkout",
+		"--track",
+		"-b", branch,
+		p.RemoteName+"/"+branch, // start point
+	)
+	if err != nil {
+		return fmt.Errorf("failed to checkout branch %v of git repo %v: %v", branch, localRepoLoc, err)
+	}
+	return nil
+}
@@ -2,14 +2,20 @@ package git
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/badjware/gitlabfs/utils"
 	"github.com/vmihailenco/taskq/v3"
 	"github.com/vmihailenco/taskq/v3/memqueue"
+	"go.opentelemetry.io/otel"
 )
 
 const (
@@ -18,9 +24,23 @@ const (
 )
 
 type GitClonerPuller interface {
-	CloneOrPull(url string, pid int, defaultBranch string) (localRepoLoc string, err error)
+	CloneOrPull(url string, pid int, defaultBranch string, depth int) (localRepoLoc string, op string, err error)
+	Status() Status
+	RepoStatus(pid int) RepoStatus
+	Pull(url string, pid int, defaultBranch string, depth int) (localRepoLoc string, op string, err error)
+	LocalRepoLoc(pid int) string
+	IsCloned(pid int) bool
+	RecordAccess(pid int)
+	Init(url string, pid int, defaultBranch string) (localRepoLoc string, err error)
+	RemoveLocalCopy(pid int) error
+	UpdateRemoteURL(url string, pid int) error
+	CountLocalCopies() (int, error)
 }
 
+var ErrDirtyWorktree = errors.New("worktree has uncommitted changes")
+
+var ErrCloneRateExceeded = errors.New("too many clones in the last minute")
+
 type GitClientParam struct {
 	CloneLocation string
 	RemoteName    string
@@ -28,62 +48,423 @@ type GitClientParam struct {
 	CloneMethod   int
 	PullDepth     int
 	AutoPull      bool
+	// Configuration of git over http, passed to the git commands talking to the git server, eg: http.sslVersion=tlsv1.2
+	HTTPConfig []string
+
+	// Mode of the folders of the clone location and of the local copies, eg: 0700 to keep the other users out. If zero, the modes are kept
+	CloneMode os.FileMode
+	// Group owning the folders of the clone location and of the local copies. If negative, the groups are kept
+	CloneGID int
 
 	QueueSize        int
 	QueueWorkerCount int
+	// Number of operations held while the queue is full, the operations over the limit are dropped
+	QueueOverflowSize int
+
+	// Maximum number of clones started per minute, the clones over the limit are skipped
+	// The clones explicitly requested with Pull are not limited. If zero, the clones are not limited
+	MaxClonesPerMinute int
+
+	// How long to wait for the queued git operations to complete on shutdown before aborting them
+	ShutdownGracePeriod time.Duration
+
+	// Number of completed operations kept in the history of each repo
+	HistorySize int
+	// Path of the file where the history is persisted. If empty, the history is only kept in memory
+	HistoryFile string
+
+	// Called when the pull of a repo failed PullFailureThreshold times in a row. Disabled if the threshold is zero
+	PullFailureThreshold  int
+	OnRepeatedPullFailure func(repo string, failures int, err error)
+
+	// Called when a clone or a pull of the local copy at repo completes, with the error if it failed
+	OnOperationDone func(opType string, repo string, err error)
+
+	// If true, a local copy found corrupted after a failed pull is moved to the quarantine and cloned again
+	// Otherwise the corruption is only logged
+	RecloneCorrupted bool
+
+	// Path of the file listing the projects whose local copies are never pulled, removed or repaired. If empty, none is ignored
+	IgnoreFile string
+
+	// Maximum size of the local copies in bytes, the ones accessed least recently are evicted over it. If zero, the size is not limited
+	MaxStoreSize int64
+	// Full paths of the projects whose local copies are never evicted
+	PinnedProjects []string
 }
 
 type gitClient struct {
+	// Params the client was created with, the ones set by Reconfigure must be read with params instead
 	GitClientParam
-	queue     taskq.Queue
+
+	// Params as last reconfigured, replaced as a whole and never modified
+	// The git operations read the params once with params, so a reload doesn't wait for them to complete
+	current        atomic.Pointer[GitClientParam]
+	reconfigureMux sync.Mutex
+
+	// Cancelled to abort the git operations in progress
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	queue     *boundedQueue
+	workers   *workerLimit
 	cloneTask *taskq.Task
 	pullTask  *taskq.Task
+
+	// Queue of the operations explicitly requested by the user, processed ahead of the others
+	priorityQueue *boundedQueue
+
+	ops    *operationTracker
+	clones *cloneStates
+	ignore *ignoreList
+	usage  *storeUsage
+
+	// Start time of the clones dispatched in the last minute
+	cloneMux   sync.Mutex
+	cloneTimes []time.Time
 }
 
+var logger = utils.NewLogger("git")
+
+var tracer = otel.Tracer("github.com/badjware/gitlabfs/git")
+
+// Number of clients created, used to give a unique name to the tasks of each client
+var clientCount int32
+
 func NewClient(p GitClientParam) (*gitClient, error) {
+	history, err := newOperationHistory(p.HistorySize, p.HistoryFile)
+	if err != nil {
+		return nil, err
+	}
+
+	clientID := atomic.AddInt32(&clientCount, 1)
 	queueFactory := memqueue.NewFactory()
+	ctx, cancel := context.WithCancel(context.Background())
+	ops := newOperationTracker(history)
+	queue := queueFactory.RegisterQueue(&taskq.QueueOptions{
+		Name:         "git-queue",
+		MaxNumWorker: int32(max(p.QueueWorkerCount, minQueueWorkers)),
+		BufferSize:   p.QueueSize,
+		Storage:      taskq.NewLocalStorage(),
+	})
+	// Added before the hook of the bounded queue, so the messages waiting for a worker are still pending
+	workers := newWorkerLimit(p.QueueWorkerCount)
+	queue.Consumer().AddHook(workers)
 	// Create the client
 	c := &gitClient{
 		GitClientParam: p,
+		ctx:            ctx,
+		cancel:         cancel,
+		ops:            ops,
+		clones:         newCloneStates(filepath.Join(p.CloneLocation, p.RemoteURL.Hostname())),
+		ignore:         newIgnoreList(p.IgnoreFile),
+		usage:          newStoreUsage(),
 
-		queue: queueFactory.RegisterQueue(&taskq.QueueOptions{
-			Name:         "git-queue",
-			MaxNumWorker: int32(p.QueueWorkerCount),
+		queue:   newBoundedQueue(queue, ops, p.QueueOverflowSize),
+		workers: workers,
+		priorityQueue: newBoundedQueue(queueFactory.RegisterQueue(&taskq.QueueOptions{
+			Name:         "git-priority-queue",
+			MaxNumWorker: 1,
 			BufferSize:   p.QueueSize,
 			Storage:      taskq.NewLocalStorage(),
-		}),
+		}), ops, p.QueueOverflowSize),
 	}
+	c.current.Store(&p)
 
 	c.cloneTask = taskq.RegisterTask(&taskq.TaskOptions{
-		Name:       "git-clone",
+		Name:       fmt.Sprintf("git-clone-%v", clientID),
 		Handler:    c.clone,
 		RetryLimit: 1,
 	})
 	c.pullTask = taskq.RegisterTask(&taskq.TaskOptions{
-		Name:       "git-pull",
+		Name:       fmt.Sprintf("git-pull-%v", clientID),
 		Handler:    c.pull,
 		RetryLimit: 1,
 	})
 
+	c.removeStaleStaging()
+	if p.MaxStoreSize > 0 {
+		go c.watchStoreSize()
+	}
 	return c, nil
 }
 
+// Close stops accepting new git operations and waits for the queued ones to complete
+// The operations still in progress after the grace period are aborted
+func (c *gitClient) Close() error {
+	gracePeriod := c.params().ShutdownGracePeriod
+
+	timer := time.AfterFunc(gracePeriod, c.cancel)
+	defer timer.Stop()
+	defer c.cancel()
+
+	defer c.ops.history.close()
+	defer c.clones.close()
+
+	// The operations still waiting for room in the queue would delay the exit past the grace period
+	c.priorityQueue.discardOverflow()
+	c.queue.discardOverflow()
+
+	deadline := time.Now().Add(gracePeriod)
+	if err := c.priorityQueue.queue.CloseTimeout(time.Until(deadline)); err != nil {
+		return err
+	}
+	return c.queue.queue.CloseTimeout(time.Until(deadline))
+}
+
+// Reconfigure replaces the params of the client
+// The clone location and its permissions, the remote url, the size of the queue, the history, the store size and the callbacks
+// cannot be reconfigured, the current ones are kept
+// The worker count is applied to the operations started from then on, up to the number of workers of the queue
+func (c *gitClient) Reconfigure(p GitClientParam) {
+	c.reconfigureMux.Lock()
+	defer c.reconfigureMux.Unlock()
+
+	current := *c.current.Load()
+	current.RemoteName = p.RemoteName
+	current.CloneMethod = p.CloneMethod
+	current.PullDepth = p.PullDepth
+	current.AutoPull = p.AutoPull
+	current.HTTPConfig = p.HTTPConfig
+	current.MaxClonesPerMinute = p.MaxClonesPerMinute
+	current.ShutdownGracePeriod = p.ShutdownGracePeriod
+	current.PullFailureThreshold = p.PullFailureThreshold
+	current.RecloneCorrupted = p.RecloneCorrupted
+	current.QueueWorkerCount = p.QueueWorkerCount
+	c.current.Store(&current)
+	c.workers.setLimit(p.QueueWorkerCount)
+}
+
+// params returns a copy of the params of the client, for an operation to use from start to end
+func (c *gitClient) params() GitClientParam {
+	return *c.current.Load()
+}
+
+// pullDepth returns the depth of the git history to pull, depth unless it's negative
+func (p GitClientParam) pullDepth(depth int) int {
+	if depth < 0 {
+		return p.PullDepth
+	}
+	return depth
+}
+
+// httpConfigArgs returns the arguments of git applying the configuration of git over http
+func (p GitClientParam) httpConfigArgs() []string {
+	args := make([]string, 0, 2*len(p.HTTPConfig))
+	for _, kv := range p.HTTPConfig {
+		args = append(args, "-c", kv)
+	}
+	return args
+}
+
 func (c *gitClient) getLocalRepoLoc(pid int) string {
 	return filepath.Join(c.CloneLocation, c.RemoteURL.Hostname(), strconv.Itoa(pid))
 }
 
-func (c *gitClient) CloneOrPull(url string, pid int, defaultBranch string) (localRepoLoc string, err error) {
+// LocalRepoLoc returns the location of the local copy of the repo configured by p, without creating a client
+func LocalRepoLoc(p GitClientParam, pid int) string {
+	return filepath.Join(p.CloneLocation, p.RemoteURL.Hostname(), strconv.Itoa(pid))
+}
+
+// LocalRepoLoc returns the location of the local copy of the repo, whether it exists or not
+func (c *gitClient) LocalRepoLoc(pid int) string {
+	return c.getLocalRepoLoc(pid)
+}
+
+// IsCloned returns whether the repo has a local copy, without probing the disk when its state is known
+func (c *gitClient) IsCloned(pid int) bool {
+	return c.clones.isCloned(c.getLocalRepoLoc(pid))
+}
+
+// CloneOrPull dispatches a clone of the repo if there is no local copy yet, or a pull of it if auto_pull is enabled
+// op is the operation dispatched, empty if there was nothing to do or the operation was already queued or running
+// depth overrides the depth of the client, unless it's negative
+func (c *gitClient) CloneOrPull(url string, pid int, defaultBranch string, depth int) (localRepoLoc string, op string, err error) {
+	p := c.params()
 	localRepoLoc = c.getLocalRepoLoc(pid)
-	if _, err := os.Stat(localRepoLoc); os.IsNotExist(err) {
+	if !c.clones.isCloned(localRepoLoc) {
+		// The clone may still be waiting for a worker, eg: when several processes access the project at once
+		if c.ops.pending(OperationClone, localRepoLoc) {
+			return localRepoLoc, "", nil
+		}
 		// Dispatch clone msg
-		msg := c.cloneTask.WithArgs(context.Background(), url, defaultBranch, localRepoLoc)
+		msg := c.cloneTask.WithArgs(context.Background(), url, defaultBranch, localRepoLoc, depth)
 		msg.OnceInPeriod(time.Second, pid)
-		c.queue.Add(msg)
-	} else if c.AutoPull {
+		if err := c.dispatchLimitedClone(msg, localRepoLoc, p.MaxClonesPerMinute); err != nil {
+			return localRepoLoc, OperationClone, err
+		}
+		return localRepoLoc, dispatched(msg, OperationClone), nil
+	}
+	c.recordAccess(localRepoLoc)
+	if p.AutoPull {
+		// Don't pull a repo which is still being cloned
+		if c.ops.pending(OperationClone, localRepoLoc) || c.ops.pending(OperationPull, localRepoLoc) {
+			return localRepoLoc, "", nil
+		}
+		if c.ignores(url) {
+			return localRepoLoc, "", nil
+		}
 		// Dispatch pull msg
-		msg := c.pullTask.WithArgs(context.Background(), localRepoLoc, defaultBranch)
+		msg := c.pullTask.WithArgs(context.Background(), url, localRepoLoc, defaultBranch, depth)
 		msg.OnceInPeriod(time.Second, pid)
-		c.queue.Add(msg)
+		if err := c.dispatch(c.queue, msg, OperationPull, localRepoLoc); err != nil {
+			return localRepoLoc, OperationPull, err
+		}
+		return localRepoLoc, dispatched(msg, OperationPull), nil
+	}
+	return localRepoLoc, "", nil
+}
+
+// dispatchLimitedClone dispatches the clone msg, unless maxClonesPerMinute clones were already dispatched in the last minute
+func (c *gitClient) dispatchLimitedClone(msg *taskq.Message, localRepoLoc string, maxClonesPerMinute int) error {
+	if maxClonesPerMinute <= 0 {
+		return c.dispatch(c.queue, msg, OperationClone, localRepoLoc)
+	}
+
+	c.cloneMux.Lock()
+	defer c.cloneMux.Unlock()
+
+	// Forget the clones older than a minute
+	now := time.Now()
+	recent := c.cloneTimes[:0]
+	for _, t := range c.cloneTimes {
+		if now.Sub(t) < time.Minute {
+			recent = append(recent, t)
+		}
+	}
+	c.cloneTimes = recent
+
+	if len(c.cloneTimes) >= maxClonesPerMinute {
+		err := fmt.Errorf("%w: skipping the clone of %v", ErrCloneRateExceeded, localRepoLoc)
+		logger.Warn("too many clones in the last minute, skipping clone", "repo", localRepoLoc)
+		c.ops.errors.Add(err)
+		return err
+	}
+	if err := c.dispatch(c.queue, msg, OperationClone, localRepoLoc); err != nil {
+		return err
+	}
+	if msg.Err == nil {
+		// Only count the clones that are not deduplicated with a clone already queued
+		c.cloneTimes = append(c.cloneTimes, now)
+	}
+	return nil
+}
+
+// Pull dispatches a pull of the repo ahead of the other queued operations, regardless of auto_pull
+// The repo is cloned instead if there is no local copy yet
+func (c *gitClient) Pull(url string, pid int, defaultBranch string, depth int) (localRepoLoc string, op string, err error) {
+	localRepoLoc = c.getLocalRepoLoc(pid)
+	var msg *taskq.Message
+	opType := OperationPull
+	if !c.clones.isCloned(localRepoLoc) {
+		msg = c.cloneTask.WithArgs(context.Background(), url, defaultBranch, localRepoLoc, depth)
+		opType = OperationClone
+	} else {
+		if c.ignores(url) {
+			return localRepoLoc, opType, fmt.Errorf("%w: not pulling git repo %v", ErrIgnoredLocalCopy, localRepoLoc)
+		}
+		c.recordAccess(localRepoLoc)
+		msg = c.pullTask.WithArgs(context.Background(), url, localRepoLoc, defaultBranch, depth)
+	}
+	msg.OnceInPeriod(time.Second, pid)
+	if err := c.dispatch(c.priorityQueue, msg, opType, localRepoLoc); err != nil {
+		return localRepoLoc, opType, fmt.Errorf("failed to dispatch the pull of git repo %v: %v", localRepoLoc, err)
+	}
+	return localRepoLoc, dispatched(msg, opType), nil
+}
+
+// RemoveLocalCopy deletes the local copy of the repo, if any
+// The local copy is not deleted if its worktree has uncommitted changes
+func (c *gitClient) RemoveLocalCopy(pid int) error {
+	localRepoLoc := c.getLocalRepoLoc(pid)
+	if _, err := os.Stat(localRepoLoc); os.IsNotExist(err) {
+		return nil
+	}
+	if c.ignoresLocalCopy(localRepoLoc) {
+		return fmt.Errorf("%w: not removing git repo %v", ErrIgnoredLocalCopy, localRepoLoc)
+	}
+	// Don't remove a local copy another host sharing the clone location is pulling
+	lock, err := c.tryLockRepo(c.ctx, localRepoLoc, true)
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
+	if _, err := os.Stat(filepath.Join(localRepoLoc, ".git")); os.IsNotExist(err) {
+		// Not a git repo (anymore), only remove it if it's empty so we can't lose any file
+		logger.Info("removing local copy", "repo", localRepoLoc)
+		if err := os.Remove(localRepoLoc); err != nil {
+			return fmt.Errorf("%w: %v is not a git repo and could not be removed: %v", ErrDirtyWorktree, localRepoLoc, err)
+		}
+		c.clones.set(localRepoLoc, false)
+		return nil
+	}
+
+	status, err := utils.ExecProcessInDirContext(
+		c.ctx,
+		localRepoLoc, // workdir
+		"git", "status",
+		"--porcelain",
+	)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve the status of git repo %v: %v", localRepoLoc, err)
+	}
+	if status != "" {
+		return fmt.Errorf("%w: git repo %v has uncommitted changes", ErrDirtyWorktree, localRepoLoc)
+	}
+
+	logger.Info("removing local copy", "repo", localRepoLoc)
+	err = os.RemoveAll(localRepoLoc)
+	// The removal may have deleted part of the local copy before failing
+	c.clones.forget(localRepoLoc)
+	if err != nil {
+		return fmt.Errorf("failed to remove git repo %v: %v", localRepoLoc, err)
+	}
+	return nil
+}
+
+// CountLocalCopies returns the number of repos that have a local copy
+func (c *gitClient) CountLocalCopies() (int, error) {
+	pids, err := c.LocalCopies()
+	return len(pids), err
+}
+
+// LocalCopies returns the id of the projects that have a local copy
+func (c *gitClient) LocalCopies() ([]int, error) {
+	entries, err := os.ReadDir(filepath.Join(c.CloneLocation, c.RemoteURL.Hostname()))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to list the local copies: %v", err)
+	}
+	var pids []int
+	for _, entry := range entries {
+		// The local copies are named after the id of their project
+		if pid, err := strconv.Atoi(entry.Name()); err == nil && entry.IsDir() {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
+
+// UpdateRemoteURL points the remote of the local copy of the repo to url, if there is a local copy
+func (c *gitClient) UpdateRemoteURL(url string, pid int) error {
+	p := c.params()
+	url, _ = withoutCredentials(url)
+	localRepoLoc := c.getLocalRepoLoc(pid)
+	if _, err := os.Stat(localRepoLoc); os.IsNotExist(err) {
+		return nil
+	}
+
+	_, err := utils.ExecProcessInDirContext(
+		c.ctx,
+		localRepoLoc, // workdir
+		"git", "remote", "set-url",
+		"--",
+		p.RemoteName, // name
+		url,          // url
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update remote %v in git repo %v: %v", url, localRepoLoc, err)
 	}
-	return localRepoLoc, nil
+	return nil
 }
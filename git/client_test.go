@@ -0,0 +1,43 @@
+package git
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestReconfigure(t *testing.T) {
+	c := &gitClient{
+		GitClientParam: GitClientParam{CloneLocation: "/tmp/clones", RemoteName: "origin", QueueWorkerCount: 1},
+		workers:        newWorkerLimit(1),
+	}
+	c.current.Store(&c.GitClientParam)
+
+	// The operations in progress keep reading the params they started with while the client is reconfigured
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if p := c.params(); p.CloneLocation != "/tmp/clones" {
+					t.Errorf("expected the clone location to be kept, got %v", p.CloneLocation)
+				}
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		c.Reconfigure(GitClientParam{CloneLocation: "/tmp/other", RemoteName: "upstream", AutoPull: true, QueueWorkerCount: 3})
+	}
+	wg.Wait()
+
+	p := c.params()
+	if p.RemoteName != "upstream" || !p.AutoPull || p.QueueWorkerCount != 3 {
+		t.Errorf("expected the reconfigured params, got %+v", p)
+	}
+	if c.workers.limit != 3 {
+		t.Errorf("expected the worker count to be reconfigured, got %v", c.workers.limit)
+	}
+	if p.CloneLocation != "/tmp/clones" {
+		t.Errorf("expected the clone location not to be reconfigured, got %v", p.CloneLocation)
+	}
+}
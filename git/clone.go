@@ -1,80 +1,173 @@
 package git
 
 import (
+	"context"
 	"fmt"
+	"os"
 	"strconv"
 
 	"github.com/badjware/gitlabfs/utils"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func (c *gitClient) clone(url string, defaultBranch string, dst string) error {
-	if c.CloneMethod == CloneInit {
-		// "Fake" cloning the repo by never actually talking to the git server
-		// This skip a fetch operation that we would do if we where to do a proper clone
-		// We can save a lot of time and network i/o doing it this way, at the cost of
-		// resulting in a very barebone local copy
-
-		// Init the local repo
-		fmt.Printf("Initializing %v into %v\n", url, dst)
-		_, err := utils.ExecProcess(
-			"git", "init",
-			"--initial-branch", defaultBranch,
-			"--",
-			dst, // directory
-		)
+func (c *gitClient) clone(url string, defaultBranch string, dst string, depth int) (err error) {
+	remoteURL, credentialEnv := withoutCredentials(url)
+	ctx, span := tracer.Start(c.ctx, "git.clone", trace.WithAttributes(attribute.String("git.url", remoteURL), attribute.String("git.repo", dst)))
+	defer func() {
 		if err != nil {
-			return fmt.Errorf("failed to init git repo %v to %v: %v", url, dst, err)
+			span.SetStatus(codes.Error, utils.Redact(err.Error()))
 		}
+		span.End()
+	}()
 
-		// Configure the remote
-		_, err = utils.ExecProcessInDir(
-			dst, // workdir
-			"git", "remote", "add",
-			"-m", defaultBranch,
-			"--",
-			c.RemoteName, // name
-			url,          // url
-		)
+	p := c.params()
+	c.ops.start(OperationClone, dst)
+	defer func() {
+		c.ops.done(OperationClone, dst, err)
+		// A failed clone may leave a partial local copy behind, or none
 		if err != nil {
-			return fmt.Errorf("failed to setup remote %v in git repo %v: %v", url, dst, err)
+			c.clones.forget(dst)
+		} else {
+			c.clones.set(dst, true)
+			c.notifyCloned()
+		}
+		if c.OnOperationDone != nil {
+			c.OnOperationDone(OperationClone, dst, err)
 		}
+	}()
 
-		// Configure the default branch
-		_, err = utils.ExecProcessInDir(
-			dst, // workdir
-			"git", "config", "--local",
-			"--",
-			fmt.Sprintf("branch.%s.remote", defaultBranch), // key
-			c.RemoteName, // value
+	// Another host sharing the clone location may be cloning it too
+	lock, err := c.lockRepo(ctx, dst)
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
+	if _, err := os.Stat(dst); err == nil && c.verifyLocalCopy(dst, false) == nil {
+		logger.Info("local copy was cloned meanwhile, eg: by another host sharing the clone location", "repo", dst)
+		return nil
+	}
 
-		)
-		if err != nil {
-			return fmt.Errorf("failed to setup default branch remote in git repo %v: %v", dst, err)
+	ref, tag, pinned := parseRef(defaultBranch)
+	// The clone is staged, an interrupted clone leaves no partial local copy behind
+	err = c.stage(dst, func(staged string) error {
+		// A tag cannot be checked out without fetching it
+		if p.CloneMethod == CloneInit && !tag {
+			return initRepo(ctx, p.RemoteName, remoteURL, ref, staged)
 		}
-		_, err = utils.ExecProcessInDir(
-			dst, // workdir
-			"git", "config", "--local",
-			"--",
-			fmt.Sprintf("branch.%s.merge", defaultBranch), // key
-			fmt.Sprintf("refs/heads/%s", defaultBranch),   // value
-
+		// Clone the repo
+		args := append(p.httpConfigArgs(),
+			"clone",
+			"--origin", p.RemoteName,
+			"--depth", strconv.Itoa(p.pullDepth(depth)),
 		)
-		if err != nil {
-			return fmt.Errorf("failed to setup default branch merge in git repo %v: %v", dst, err)
+		if pinned {
+			// A tag is checked out as a detached HEAD
+			args = append(args, "--branch", ref)
 		}
-	} else {
-		// Clone the repo
-		_, err := utils.ExecProcess(
-			"git", "clone",
-			"--origin", c.RemoteName,
-			"--depth", strconv.Itoa(c.PullDepth),
-			"--",
-			url, // repository
-			dst, // directory
+		_, err := utils.ExecProcessInDirContextEnv(
+			ctx,
+			"", // workdir
+			credentialEnv,
+			"git", append(args,
+				"--",
+				remoteURL, // repository
+				staged,    // directory
+			)...,
 		)
 		if err != nil {
-			return fmt.Errorf("failed to clone git repo %v to %v: %v", url, dst, err)
+			return fmt.Errorf("failed to clone git repo %v to %v: %w", remoteURL, dst, err)
 		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	c.applyClonePermissions(dst)
+	return nil
+}
+
+// Init synchronously initializes the local copy of the repo without querying the git server
+// This is meant for newly created projects, which have nothing to fetch
+func (c *gitClient) Init(url string, pid int, defaultBranch string) (localRepoLoc string, err error) {
+	remoteName := c.params().RemoteName
+	remoteURL, _ := withoutCredentials(url)
+	localRepoLoc = c.getLocalRepoLoc(pid)
+	lock, err := c.lockRepo(c.ctx, localRepoLoc)
+	if err != nil {
+		return localRepoLoc, err
+	}
+	defer lock.unlock()
+	err = c.stage(localRepoLoc, func(staged string) error {
+		return initRepo(c.ctx, remoteName, remoteURL, defaultBranch, staged)
+	})
+	if err != nil {
+		return localRepoLoc, err
+	}
+	c.applyClonePermissions(localRepoLoc)
+	c.clones.set(localRepoLoc, true)
+	return localRepoLoc, nil
+}
+
+// initRepo initializes the local copy at dst with the remote remoteName pointing to url, which must not carry credentials
+func initRepo(ctx context.Context, remoteName string, url string, defaultBranch string, dst string) error {
+	// "Fake" cloning the repo by never actually talking to the git server
+	// This skip a fetch operation that we would do if we where to do a proper clone
+	// We can save a lot of time and network i/o doing it this way, at the cost of
+	// resulting in a very barebone local copy
+
+	// Init the local repo
+	logger.Info("initializing repo", "url", url, "repo", dst)
+	_, err := utils.ExecProcessContext(
+		ctx,
+		"git", "init",
+		"--initial-branch", defaultBranch,
+		"--",
+		dst, // directory
+	)
+	if err != nil {
+		return fmt.Errorf("failed to init git repo %v to %v: %w", url, dst, err)
+	}
+
+	// Configure the remote
+	_, err = utils.ExecProcessInDirContext(
+		ctx,
+		dst, // workdir
+		"git", "remote", "add",
+		"-m", defaultBranch,
+		"--",
+		remoteName, // name
+		url,        // url
+	)
+	if err != nil {
+		return fmt.Errorf("failed to setup remote %v in git repo %v: %w", url, dst, err)
+	}
+
+	// Configure the default branch
+	_, err = utils.ExecProcessInDirContext(
+		ctx,
+		dst, // workdir
+		"git", "config", "--local",
+		"--",
+		fmt.Sprintf("branch.%s.remote", defaultBranch), // key
+		remoteName, // value
+
+	)
+	if err != nil {
+		return fmt.Errorf("failed to setup default branch remote in git repo %v: %w", dst, err)
+	}
+	_, err = utils.ExecProcessInDirContext(
+		ctx,
+		dst, // workdir
+		"git", "config", "--local",
+		"--",
+		fmt.Sprintf("branch.%s.merge", defaultBranch), // key
+		fmt.Sprintf("refs/heads/%s", defaultBranch),   // value
+
+	)
+	if err != nil {
+		return fmt.Errorf("failed to setup default branch merge in git repo %v: %w", dst, err)
 	}
 	return nil
 }
@@ -0,0 +1,132 @@
+package git
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// cloneStates caches whether each local copy exists, so the accesses to the projects don't probe the disk
+// The cache is updated by the git operations of the client, and by a watcher of the folder holding the local copies for the changes made outside of the client, eg: rm -rf
+// Until the folder can be watched, eg: before the first clone creates it, the disk is probed on every access
+type cloneStates struct {
+	dir string
+
+	mux     sync.RWMutex
+	cloned  map[string]bool
+	watcher *fsnotify.Watcher
+	// Incremented on every change seen by the watcher, so a probe racing with a change is not cached
+	generation uint64
+}
+
+func newCloneStates(dir string) *cloneStates {
+	s := &cloneStates{
+		dir:    dir,
+		cloned: map[string]bool{},
+	}
+	s.watch()
+	return s
+}
+
+// watch starts watching the folder holding the local copies, if it's not watched yet
+func (s *cloneStates) watch() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.watcher != nil {
+		return
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logger.Warn("failed to watch the local copies, their state is not cached", "error", err)
+		return
+	}
+	if err := watcher.Add(s.dir); err != nil {
+		// The folder is created by the first clone
+		watcher.Close()
+		return
+	}
+	s.watcher = watcher
+	// The local copies may have changed while they were not watched
+	s.cloned = map[string]bool{}
+
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Dir(event.Name) == s.dir {
+					s.forget(event.Name)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				// Some changes may have been missed, eg: when too many happened at once
+				logger.Warn("failed to watch the local copies, probing them again", "error", err)
+				s.mux.Lock()
+				s.cloned = map[string]bool{}
+				s.generation++
+				s.mux.Unlock()
+			}
+		}
+	}()
+}
+
+// isCloned returns whether the local copy at localRepoLoc exists
+func (s *cloneStates) isCloned(localRepoLoc string) bool {
+	s.mux.RLock()
+	cloned, ok := s.cloned[localRepoLoc]
+	watched := s.watcher != nil
+	generation := s.generation
+	s.mux.RUnlock()
+	if ok {
+		return cloned
+	}
+
+	_, err := os.Stat(localRepoLoc)
+	cloned = !os.IsNotExist(err)
+	if watched {
+		s.mux.Lock()
+		if s.generation == generation {
+			s.cloned[localRepoLoc] = cloned
+		}
+		s.mux.Unlock()
+	}
+	return cloned
+}
+
+// set records whether the local copy at localRepoLoc exists after the client changed it
+func (s *cloneStates) set(localRepoLoc string, cloned bool) {
+	// The first clone creates the watched folder
+	s.watch()
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.watcher != nil {
+		s.cloned[localRepoLoc] = cloned
+	}
+}
+
+// forget drops the state of the local copy at localRepoLoc, it's probed again on the next access
+func (s *cloneStates) forget(localRepoLoc string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	delete(s.cloned, localRepoLoc)
+	s.generation++
+}
+
+func (s *cloneStates) close() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.watcher != nil {
+		s.watcher.Close()
+	}
+}
@@ -0,0 +1,71 @@
+package git
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+
+	"github.com/badjware/gitlabfs/utils"
+)
+
+// withoutCredentials returns the clone url without its credentials, along with the environment passing them to git
+// The urls of the projects cloned over http carry the credentials of the clone, eg: a deploy token, they are sent in the
+// authorization header of the requests of git rather than written in the remote of the local copy, so they never end up
+// on disk
+// The environment is nil if the url has no credentials, eg: the ssh urls
+func withoutCredentials(cloneURL string) (string, []string) {
+	u, err := url.Parse(cloneURL)
+	if err != nil || u.User == nil {
+		// Eg: the scp-like syntax of the ssh urls
+		return cloneURL, nil
+	}
+	password, _ := u.User.Password()
+	credentials := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + password))
+	u.User = nil
+
+	// The header is only sent to the gitlab instance, eg: not on a redirect to another host
+	origin := url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/"}
+	// The configuration passed through the environment of gitlabfs itself is kept
+	count, _ := strconv.Atoi(os.Getenv("GIT_CONFIG_COUNT"))
+	env := []string{
+		fmt.Sprintf("GIT_CONFIG_COUNT=%v", count+1),
+		fmt.Sprintf("GIT_CONFIG_KEY_%v=http.%v.extraHeader", count, origin.String()),
+		fmt.Sprintf("GIT_CONFIG_VALUE_%v=Authorization: Basic %v", count, credentials),
+	}
+	return u.String(), env
+}
+
+// scrubRemoteCredentials removes the credentials from the url of the remote of the local copy at repoPath, if it points to
+// remoteURL along with credentials
+// The local copies cloned before the credentials were passed per command have their token written in their remote
+func scrubRemoteCredentials(ctx context.Context, remoteName string, remoteURL string, repoPath string) error {
+	current, err := utils.ExecProcessInDirContext(
+		ctx,
+		repoPath, // workdir
+		"git", "remote", "get-url",
+		"--",
+		remoteName, // name
+	)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve remote %v of git repo %v: %v", remoteName, repoPath, err)
+	}
+	if scrubbed, env := withoutCredentials(current); env == nil || scrubbed != remoteURL {
+		// Eg: the remote was changed by hand
+		return nil
+	}
+	_, err = utils.ExecProcessInDirContext(
+		ctx,
+		repoPath, // workdir
+		"git", "remote", "set-url",
+		"--",
+		remoteName, // name
+		remoteURL,  // url
+	)
+	if err != nil {
+		return fmt.Errorf("failed to remove the credentials of remote %v of git repo %v: %v", remoteName, repoPath, err)
+	}
+	return nil
+}
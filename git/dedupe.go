@@ -0,0 +1,287 @@
+package git
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/badjware/gitlabfs/utils"
+)
+
+// PoolsDirName is the folder of the clone location holding the objects shared by the local copies of forks
+const PoolsDirName = "pools"
+
+// DedupeReport is the outcome of the deduplication of the local copies
+type DedupeReport struct {
+	// Number of groups of forks found, and of local copies sharing their objects with the other forks of their group
+	Networks     int
+	Deduplicated int
+	// Number of local copies left out, eg: shallow or with a git operation in progress
+	Skipped int
+	// Size of the objects of the local copies and of the pools, in bytes, before and after
+	SizeBefore int64
+	SizeAfter  int64
+	// Local copies to deduplicate and the pool they would share their objects through, only filled in a dry run
+	Planned []PlannedDedupe
+}
+
+// PlannedDedupe is a local copy a dry run would deduplicate
+type PlannedDedupe struct {
+	Repo string
+	Pool string
+}
+
+// forkMember is a local copy in a group of forks
+type forkMember struct {
+	pid  int
+	path string
+}
+
+// Dedupe shares the objects of the local copies of forks through a pool, a bare repo holding the objects of every fork
+// forkNetworks holds the fork network of the projects, as the id of the project at the root of their forks, the local copies of the
+// projects not in it are left out. Each fork gets the pool of its network as alternate and drops its objects found in it
+// If dryRun is true, the local copies to deduplicate are only reported
+func (c *gitClient) Dedupe(forkNetworks map[int]int, dryRun bool) (DedupeReport, error) {
+	report := DedupeReport{}
+	pids, err := c.LocalCopies()
+	if err != nil {
+		return report, err
+	}
+
+	networks := map[int][]forkMember{}
+	for _, pid := range pids {
+		localRepoLoc := c.LocalRepoLoc(pid)
+		network, ok := forkNetworks[pid]
+		if !ok {
+			logger.Debug("not deduplicating local copy", "repo", localRepoLoc, "reason", "its fork network is not known")
+			report.Skipped++
+			continue
+		}
+		if err := c.checkDedupable(localRepoLoc); err != nil {
+			logger.Debug("not deduplicating local copy", "repo", localRepoLoc, "reason", err)
+			report.Skipped++
+			continue
+		}
+		networks[network] = append(networks[network], forkMember{pid: pid, path: localRepoLoc})
+	}
+
+	roots := make([]int, 0, len(networks))
+	for root, members := range networks {
+		// A project without forks has nothing to share
+		if len(members) > 1 {
+			roots = append(roots, root)
+		}
+	}
+	sort.Ints(roots)
+	for _, root := range roots {
+		members := networks[root]
+		report.Networks++
+		poolPath := c.poolPath(root)
+		before := objectsSize(poolPath)
+		for _, m := range members {
+			before += objectsSize(m.path)
+		}
+		report.SizeBefore += before
+		if dryRun {
+			for _, m := range members {
+				report.Planned = append(report.Planned, PlannedDedupe{Repo: m.path, Pool: poolPath})
+			}
+			report.Deduplicated += len(members)
+			report.SizeAfter += before
+			continue
+		}
+
+		if err := c.preparePool(poolPath); err != nil {
+			return report, err
+		}
+		var joined []forkMember
+		for _, m := range members {
+			if err := c.joinPool(poolPath, m); err != nil {
+				logger.Warn("failed to deduplicate local copy", "repo", m.path, "pool", poolPath, "error", err)
+				report.Skipped++
+				continue
+			}
+			joined = append(joined, m)
+		}
+		// Consolidate the objects fetched from each fork before the forks drop theirs, the objects the forks may still need are never dropped
+		if _, err := utils.ExecProcessInDirContext(c.ctx, poolPath, "git", "repack", "-a", "-d", "--keep-unreachable", "-q"); err != nil {
+			return report, fmt.Errorf("failed to repack the pool %v: %v", poolPath, commandError(err))
+		}
+		for _, m := range joined {
+			if err := c.dropPooledObjects(poolPath, m); err != nil {
+				logger.Warn("failed to deduplicate local copy", "repo", m.path, "pool", poolPath, "error", err)
+				report.Skipped++
+				continue
+			}
+			report.Deduplicated++
+		}
+
+		after := objectsSize(poolPath)
+		for _, m := range members {
+			after += objectsSize(m.path)
+		}
+		report.SizeAfter += after
+		logger.Info("deduplicated the local copies of forks", "pool", poolPath, "forks", len(members), "size_before", before, "size_after", after)
+	}
+	return report, nil
+}
+
+// checkDedupable returns an error if the local copy at localRepoLoc must be left out, eg: it's shallow, ignored,
+// or a git command is in progress in it
+func (c *gitClient) checkDedupable(localRepoLoc string) error {
+	if err := c.verifyLocalCopy(localRepoLoc, false); err != nil {
+		return err
+	}
+	if c.ignoresLocalCopy(localRepoLoc) {
+		return ErrIgnoredLocalCopy
+	}
+	if locks, _ := filepath.Glob(filepath.Join(localRepoLoc, ".git", "*.lock")); len(locks) > 0 {
+		return fmt.Errorf("a git command is in progress, found %v", locks[0])
+	}
+	shallow, err := utils.ExecProcessInDirContext(c.ctx, localRepoLoc, "git", "rev-parse", "--is-shallow-repository")
+	if err != nil {
+		return fmt.Errorf("failed to check whether git repo %v is shallow: %v", localRepoLoc, commandError(err))
+	}
+	if shallow == "true" {
+		// The pool can't be fetched from a shallow local copy
+		return fmt.Errorf("git repo %v is shallow", localRepoLoc)
+	}
+	return nil
+}
+
+// poolPath returns the location of the pool of the forks whose network is rooted at the project with the id root
+func (c *gitClient) poolPath(root int) string {
+	return filepath.Join(c.CloneLocation, PoolsDirName, c.RemoteURL.Hostname(), strconv.Itoa(root)+".git")
+}
+
+// preparePool creates the pool at poolPath if it does not exist yet
+// Nothing is ever pruned from a pool, the forks may need any of its objects
+func (c *gitClient) preparePool(poolPath string) error {
+	if _, err := os.Stat(poolPath); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(poolPath), 0755); err != nil {
+		return fmt.Errorf("failed to create the pools: %v", err)
+	}
+	if _, err := utils.ExecProcessContext(c.ctx, "git", "init", "--bare", "-q", "--", poolPath); err != nil {
+		return fmt.Errorf("failed to create the pool %v: %v", poolPath, commandError(err))
+	}
+	for _, kv := range [][]string{{"gc.auto", "0"}, {"gc.pruneExpire", "never"}, {"core.logAllRefUpdates", "false"}} {
+		if _, err := utils.ExecProcessInDirContext(c.ctx, poolPath, "git", "config", "--local", "--", kv[0], kv[1]); err != nil {
+			return fmt.Errorf("failed to configure the pool %v: %v", poolPath, commandError(err))
+		}
+	}
+	c.applyClonePermissions(poolPath)
+	return nil
+}
+
+// joinPool fetches the objects of the fork m into the pool at poolPath, and adds the pool to its alternates
+// The alternates are left as they were if the local copy can't read the pool
+func (c *gitClient) joinPool(poolPath string, m forkMember) error {
+	lock, err := c.tryLockRepo(c.ctx, m.path, true)
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
+
+	// Keep the refs of each fork apart, so the objects they point to stay reachable in the pool
+	refspec := fmt.Sprintf("+refs/*:refs/forks/%v/*", m.pid)
+	if _, err := utils.ExecProcessInDirContext(c.ctx, poolPath, "git", "fetch", "--quiet", "--no-tags", "--", m.path, refspec); err != nil {
+		return fmt.Errorf("failed to fetch git repo %v into the pool: %v", m.path, commandError(err))
+	}
+
+	objectsDir := filepath.Join(m.path, ".git", "objects")
+	alternatesPath := filepath.Join(objectsDir, "info", "alternates")
+	poolObjects := filepath.Join(poolPath, "objects")
+	// git reads a relative alternate from the objects of the local copy, so the clone location can be moved
+	alternate, err := filepath.Rel(objectsDir, poolObjects)
+	if err != nil {
+		alternate = poolObjects
+	}
+	alternates, err := os.ReadFile(alternatesPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read the alternates of git repo %v: %v", m.path, err)
+	}
+	if containsLine(string(alternates), alternate) {
+		return nil
+	}
+	// Replace the absolute path of the pool, if it was added with one
+	updated := withoutLine(string(alternates), poolObjects)
+	if updated != "" && !strings.HasSuffix(updated, "\n") {
+		updated += "\n"
+	}
+	updated += alternate + "\n"
+	if err := os.MkdirAll(filepath.Dir(alternatesPath), 0755); err != nil {
+		return fmt.Errorf("failed to add the pool to the alternates of git repo %v: %v", m.path, err)
+	}
+	if err := os.WriteFile(alternatesPath, []byte(updated), 0644); err != nil {
+		return fmt.Errorf("failed to add the pool to the alternates of git repo %v: %v", m.path, err)
+	}
+	if err := c.checkConnectivity(m.path); err != nil {
+		// Nothing was dropped yet, go back to the objects of the local copy
+		os.WriteFile(alternatesPath, alternates, 0644)
+		return err
+	}
+	return nil
+}
+
+// dropPooledObjects repacks the fork m without its objects found in the pool at poolPath, and checks it can still read every object
+func (c *gitClient) dropPooledObjects(poolPath string, m forkMember) error {
+	lock, err := c.tryLockRepo(c.ctx, m.path, true)
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
+
+	// -l leaves out the objects found in the pool, the unreachable objects of the local copy are kept, eg: the ones of a dropped stash
+	if _, err := utils.ExecProcessInDirContext(c.ctx, m.path, "git", "repack", "-a", "-d", "-l", "--keep-unreachable", "-q"); err != nil {
+		return fmt.Errorf("failed to repack git repo %v: %v", m.path, commandError(err))
+	}
+	if err := c.checkConnectivity(m.path); err != nil {
+		logger.Error("local copy is missing objects after its deduplication, do not remove its pool", "repo", m.path, "pool", poolPath, "error", err)
+		return err
+	}
+	return nil
+}
+
+// checkConnectivity checks that every object reachable in the local copy at localRepoLoc can be read
+func (c *gitClient) checkConnectivity(localRepoLoc string) error {
+	if _, err := utils.ExecProcessInDirContext(c.ctx, localRepoLoc, "git", "fsck", "--connectivity-only", "--no-progress"); err != nil {
+		return fmt.Errorf("git fsck failed on git repo %v: %v", localRepoLoc, commandError(err))
+	}
+	return nil
+}
+
+// containsLine returns whether one of the lines of s is line
+func containsLine(s string, line string) bool {
+	for _, l := range strings.Split(s, "\n") {
+		if strings.TrimSpace(l) == line {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutLine returns s without its lines which are line
+func withoutLine(s string, line string) string {
+	var b strings.Builder
+	for _, l := range strings.SplitAfter(s, "\n") {
+		if strings.TrimSpace(l) != line {
+			b.WriteString(l)
+		}
+	}
+	return b.String()
+}
+
+// objectsSize returns the size of the objects of the git repo at repoPath, either a local copy or a bare pool
+func objectsSize(repoPath string) int64 {
+	objects := filepath.Join(repoPath, ".git", "objects")
+	if _, err := os.Stat(objects); err != nil {
+		objects = filepath.Join(repoPath, "objects")
+	}
+	size, _ := dirSize(objects)
+	return size
+}
@@ -0,0 +1,22 @@
+package git
+
+import "testing"
+
+func TestWithoutLine(t *testing.T) {
+	tests := []struct {
+		s    string
+		line string
+		out  string
+	}{
+		{s: "", line: "/pools/a.git/objects", out: ""},
+		{s: "/pools/a.git/objects\n", line: "/pools/a.git/objects", out: ""},
+		{s: "/other/objects\n/pools/a.git/objects\n", line: "/pools/a.git/objects", out: "/other/objects\n"},
+		{s: "/pools/a.git/objects\n/other/objects", line: "/pools/a.git/objects", out: "/other/objects"},
+		{s: "/other/objects\n", line: "/pools/a.git/objects", out: "/other/objects\n"},
+	}
+	for _, test := range tests {
+		if out := withoutLine(test.s, test.line); out != test.out {
+			t.Errorf("withoutLine(%q, %q): expected %q, got %q", test.s, test.line, test.out, out)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package git
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/badjware/gitlabfs/utils"
+)
+
+// Maximum length of the output of a failed command kept in the history
+const maxHistoryOutput = 512
+
+// HistoryEntry is a git operation that completed, successfully or not
+type HistoryEntry struct {
+	Type     string    `yaml:"type" json:"type"`
+	Repo     string    `yaml:"-" json:"repo"`
+	Start    time.Time `yaml:"start" json:"start"`
+	Duration string    `yaml:"duration" json:"duration"`
+	// Exit code of the git command that failed, -1 if the operation failed before or without running it
+	ExitCode int    `yaml:"exit_code" json:"exit_code"`
+	Error    string `yaml:"error,omitempty" json:"error,omitempty"`
+	Output   string `yaml:"output,omitempty" json:"output,omitempty"`
+}
+
+// operationHistory keeps the most recent operations of each repo, optionally persisted in a file
+type operationHistory struct {
+	mux sync.Mutex
+	// Number of operations kept per repo
+	size    int
+	entries map[string][]HistoryEntry
+	// Nil if the history is only kept in memory
+	file *os.File
+}
+
+func newHistoryEntry(opType string, repo string, start time.Time, err error) HistoryEntry {
+	entry := HistoryEntry{
+		Type:     opType,
+		Repo:     repo,
+		Start:    start,
+		Duration: time.Since(start).Round(time.Millisecond).String(),
+	}
+	if err != nil {
+		entry.ExitCode = -1
+		entry.Error = utils.Redact(err.Error())
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			entry.ExitCode = exitErr.ExitCode()
+			output := utils.Redact(strings.TrimSpace(string(exitErr.Stderr)))
+			if len(output) > maxHistoryOutput {
+				output = "..." + output[len(output)-maxHistoryOutput:]
+			}
+			entry.Output = output
+		}
+	}
+	return entry
+}
+
+// newOperationHistory returns a history of size operations per repo
+// If path is not empty, the history is loaded from and persisted to path
+func newOperationHistory(size int, path string) (*operationHistory, error) {
+	h := &operationHistory{
+		size:    size,
+		entries: map[string][]HistoryEntry{},
+	}
+	if path == "" || size <= 0 {
+		return h, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create history directory: %v", err)
+	}
+	if f, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var entry HistoryEntry
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				// Skip a line truncated by a crash
+				continue
+			}
+			h.append(entry)
+		}
+		f.Close()
+	}
+
+	// Rewrite the file with only the entries kept, so it doesn't grow forever
+	tmpPath := path + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write history file: %v", err)
+	}
+	encoder := json.NewEncoder(tmp)
+	for _, entries := range h.entries {
+		for _, entry := range entries {
+			encoder.Encode(entry)
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write history file: %v", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return nil, fmt.Errorf("failed to write history file: %v", err)
+	}
+
+	h.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open history file: %v", err)
+	}
+	return h, nil
+}
+
+func (h *operationHistory) append(entry HistoryEntry) {
+	entries := append(h.entries[entry.Repo], entry)
+	if len(entries) > h.size {
+		entries = append([]HistoryEntry{}, entries[len(entries)-h.size:]...)
+	}
+	h.entries[entry.Repo] = entries
+}
+
+func (h *operationHistory) add(entry HistoryEntry) {
+	if h.size <= 0 {
+		return
+	}
+
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	h.append(entry)
+	if h.file != nil {
+		if err := json.NewEncoder(h.file).Encode(entry); err != nil {
+			logger.Warn("failed to persist the history of the git operations", "error", err)
+		}
+	}
+}
+
+// get returns the operations of repo, from the oldest to the most recent
+func (h *operationHistory) get(repo string) []HistoryEntry {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	return append([]HistoryEntry{}, h.entries[repo]...)
+}
+
+func (h *operationHistory) close() error {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	if h.file == nil {
+		return nil
+	}
+	err := h.file.Close()
+	h.file = nil
+	return err
+}
@@ -0,0 +1,144 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/badjware/gitlabfs/utils"
+)
+
+// IgnoreFileName is the name of the file of the clone location listing the projects whose local copies are never touched
+const IgnoreFileName = ".gitlabfsignore"
+
+var ErrIgnoredLocalCopy = errors.New("local copy is ignored")
+
+// ignoreList holds the patterns of the ignore file, read again whenever the file changes
+type ignoreList struct {
+	path string
+
+	mux      sync.Mutex
+	modTime  time.Time
+	size     int64
+	patterns []string
+}
+
+func newIgnoreList(path string) *ignoreList {
+	return &ignoreList{path: path}
+}
+
+// current returns the patterns of the ignore file, none if it does not exist
+// If the file cannot be read, the patterns read last are kept
+func (l *ignoreList) current() []string {
+	if l.path == "" {
+		return nil
+	}
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	info, err := os.Stat(l.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warn("failed to read the ignore file, keeping the previous patterns", "file", l.path, "error", err)
+			return l.patterns
+		}
+		l.patterns, l.modTime, l.size = nil, time.Time{}, 0
+		return nil
+	}
+	if info.ModTime().Equal(l.modTime) && info.Size() == l.size {
+		return l.patterns
+	}
+	// Only report a broken file once per change
+	l.modTime, l.size = info.ModTime(), info.Size()
+	patterns, err := readIgnoreFile(l.path)
+	if err != nil {
+		logger.Warn("failed to read the ignore file, keeping the previous patterns", "file", l.path, "error", err)
+		return l.patterns
+	}
+	logger.Info("loaded the ignore file", "file", l.path, "patterns", len(patterns))
+	l.patterns = patterns
+	return l.patterns
+}
+
+// readIgnoreFile returns the patterns of the ignore file, one per line
+// The blank lines and the lines starting with a # are skipped
+func readIgnoreFile(file string) ([]string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var patterns []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pattern := strings.Trim(line, "/")
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", line, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// matchesIgnorePatterns returns whether the project at projectPath or one of its groups matches one of the patterns
+func matchesIgnorePatterns(patterns []string, projectPath string) bool {
+	for p := projectPath; p != "." && p != "/" && p != ""; p = path.Dir(p) {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, p); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// projectPath returns the full path of the project cloned from cloneURL, eg: gitlab-org/gitlab
+func (c *gitClient) projectPath(cloneURL string) string {
+	p := cloneURL
+	if u, err := url.Parse(cloneURL); err == nil && u.Scheme != "" {
+		// Gitlab may be served under a path, eg: https://example.com/gitlab
+		p = strings.TrimPrefix(strings.Trim(u.Path, "/"), strings.Trim(c.RemoteURL.Path, "/")+"/")
+	} else if i := strings.Index(cloneURL, ":"); i != -1 {
+		// The scp-like syntax of the ssh urls, eg: git@gitlab.com:gitlab-org/gitlab.git
+		p = cloneURL[i+1:]
+	}
+	return strings.TrimSuffix(strings.Trim(p, "/"), ".git")
+}
+
+// ignores returns whether the local copy of the project cloned from cloneURL is ignored
+func (c *gitClient) ignores(cloneURL string) bool {
+	patterns := c.ignore.current()
+	return len(patterns) > 0 && matchesIgnorePatterns(patterns, c.projectPath(cloneURL))
+}
+
+// ignoresLocalCopy returns whether the local copy at localRepoLoc is ignored, going by the url of its remote
+func (c *gitClient) ignoresLocalCopy(localRepoLoc string) bool {
+	patterns := c.ignore.current()
+	if len(patterns) == 0 {
+		return false
+	}
+	remoteURL, err := utils.ExecProcessInDirContext(
+		c.ctx,
+		localRepoLoc, // workdir
+		"git", "remote", "get-url",
+		"--",
+		c.params().RemoteName, // name
+	)
+	if err != nil {
+		// Eg: not a git repo, it's not a local copy gitlabfs manages
+		return false
+	}
+	return matchesIgnorePatterns(patterns, c.projectPath(remoteURL))
+}
+
+// IgnoresLocalCopy returns whether the local copy of the repo is listed in the ignore file
+func (c *gitClient) IgnoresLocalCopy(pid int) bool {
+	return c.ignoresLocalCopy(c.getLocalRepoLoc(pid))
+}
@@ -0,0 +1,194 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// Folders of the clone location holding the lock files of the local copies, and the clones in progress
+	locksDirName   = "locks"
+	stagingDirName = "staging"
+
+	// How often a lock held by another process is tried again
+	lockRetryInterval = 250 * time.Millisecond
+)
+
+// ErrLocalCopyLocked is returned when the local copy is locked by another git operation, eg: of another host sharing the clone location
+var ErrLocalCopyLocked = errors.New("local copy is locked by another git operation")
+
+// The locks held by this process, by lock file
+// On NFS, the advisory locks are held by the process rather than the file descriptor, so they don't exclude the operations of the same process
+var heldLocks = struct {
+	mux   sync.Mutex
+	slots map[string]chan struct{}
+}{slots: map[string]chan struct{}{}}
+
+func lockSlot(path string) chan struct{} {
+	heldLocks.mux.Lock()
+	defer heldLocks.mux.Unlock()
+
+	slot, ok := heldLocks.slots[path]
+	if !ok {
+		slot = make(chan struct{}, 1)
+		heldLocks.slots[path] = slot
+	}
+	return slot
+}
+
+// repoLock is an advisory lock on a local copy, excluding the git operations of every process and every host sharing the clone location
+type repoLock struct {
+	slot chan struct{}
+	file *os.File
+}
+
+// lockPath returns the lock file of the local copy at localRepoLoc
+// The lock files live outside of the local copies, so they survive their removal and are never part of a clone
+func (c *gitClient) lockPath(localRepoLoc string) string {
+	return filepath.Join(c.CloneLocation, locksDirName, c.RemoteURL.Hostname(), filepath.Base(localRepoLoc)+".lock")
+}
+
+// lockRepo waits until it holds the lock of the local copy at localRepoLoc, or until ctx is done
+func (c *gitClient) lockRepo(ctx context.Context, localRepoLoc string) (*repoLock, error) {
+	lock, err := c.tryLockRepo(ctx, localRepoLoc, true)
+	if errors.Is(err, ErrLocalCopyLocked) {
+		logger.Info("local copy is locked by another git operation, waiting for it", "repo", localRepoLoc)
+		lock, err = c.tryLockRepo(ctx, localRepoLoc, false)
+	}
+	return lock, err
+}
+
+// tryLockRepo acquires the lock of the local copy at localRepoLoc. If once is true, it returns ErrLocalCopyLocked instead of waiting for it
+func (c *gitClient) tryLockRepo(ctx context.Context, localRepoLoc string, once bool) (*repoLock, error) {
+	path := c.lockPath(localRepoLoc)
+	slot := lockSlot(path)
+	select {
+	case slot <- struct{}{}:
+	default:
+		if once {
+			return nil, fmt.Errorf("%w: %v", ErrLocalCopyLocked, localRepoLoc)
+		}
+		select {
+		case slot <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		<-slot
+		return nil, fmt.Errorf("failed to create the lock of git repo %v: %v", localRepoLoc, err)
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		<-slot
+		return nil, fmt.Errorf("failed to create the lock of git repo %v: %v", localRepoLoc, err)
+	}
+	for {
+		err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			return &repoLock{slot: slot, file: file}, nil
+		}
+		if errors.Is(err, syscall.ENOLCK) || errors.Is(err, syscall.ENOTSUP) || errors.Is(err, syscall.EOPNOTSUPP) {
+			// Eg: NFS without a lock manager, the other processes of the host are still excluded
+			logger.Debug("the clone location does not support locking, the hosts sharing it are not excluded", "repo", localRepoLoc, "error", err)
+			return &repoLock{slot: slot, file: file}, nil
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			file.Close()
+			<-slot
+			return nil, fmt.Errorf("failed to lock git repo %v: %v", localRepoLoc, err)
+		}
+		if once {
+			file.Close()
+			<-slot
+			return nil, fmt.Errorf("%w: %v", ErrLocalCopyLocked, localRepoLoc)
+		}
+		select {
+		case <-time.After(lockRetryInterval):
+		case <-ctx.Done():
+			file.Close()
+			<-slot
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// unlock releases the lock. The lock file is kept, removing it would let two processes lock different files
+func (l *repoLock) unlock() {
+	syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	l.file.Close()
+	<-l.slot
+}
+
+// stagingDir returns the folder the local copies are cloned in before they are moved to their location
+// It's in the clone location, so moving a clone is atomic
+func (c *gitClient) stagingDir() string {
+	return filepath.Join(c.CloneLocation, stagingDirName, c.RemoteURL.Hostname())
+}
+
+// stage runs create on a new folder of the staging area, then moves it to dst
+// dst only appears once create succeeded, so an interrupted clone never leaves a partial local copy behind
+// The lock of dst must be held
+func (c *gitClient) stage(dst string, create func(staged string) error) error {
+	if err := os.MkdirAll(c.stagingDir(), 0700); err != nil {
+		return fmt.Errorf("failed to create the staging area: %v", err)
+	}
+	tmp, err := os.MkdirTemp(c.stagingDir(), filepath.Base(dst)+"-")
+	if err != nil {
+		return fmt.Errorf("failed to create the staging area: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	// The local copy is created by git inside the temporary folder, with the usual mode
+	staged := filepath.Join(tmp, filepath.Base(dst))
+	if err := create(staged); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return fmt.Errorf("failed to create the folder of git repo %v: %v", dst, err)
+	}
+	if err := os.Rename(staged, dst); err != nil {
+		if _, statErr := os.Stat(dst); statErr == nil && c.verifyLocalCopy(dst, false) == nil {
+			// Cloned meanwhile by a host which does not lock the local copies
+			logger.Info("local copy was created meanwhile, discarding the clone", "repo", dst)
+			return nil
+		}
+		return fmt.Errorf("failed to move the clone to %v: %v", dst, err)
+	}
+	return nil
+}
+
+// removeStaleStaging removes the clones left in the staging area by the processes which did not complete them, eg: after a crash
+func (c *gitClient) removeStaleStaging() {
+	entries, err := os.ReadDir(c.stagingDir())
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		// The clones are staged in a folder named after their local copy, followed by a random suffix
+		i := strings.LastIndex(entry.Name(), "-")
+		if i <= 0 {
+			continue
+		}
+		localRepoLoc := filepath.Join(c.CloneLocation, c.RemoteURL.Hostname(), entry.Name()[:i])
+		lock, err := c.tryLockRepo(c.ctx, localRepoLoc, true)
+		if err != nil {
+			// Still being cloned, eg: by another host
+			continue
+		}
+		path := filepath.Join(c.stagingDir(), entry.Name())
+		logger.Warn("removing an interrupted clone", "path", path)
+		if err := os.RemoveAll(path); err != nil {
+			logger.Warn("failed to remove the interrupted clone", "path", path, "error", err)
+		}
+		lock.unlock()
+	}
+}
@@ -0,0 +1,172 @@
+package git
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/vmihailenco/taskq/v3"
+)
+
+// ErrQueueFull is returned when an operation is dispatched while both the git queue and its overflow are full
+var ErrQueueFull = errors.New("git queue and its overflow are full")
+
+// boundedQueue bounds the number of messages waiting in a queue, without ever blocking the caller
+// A delayed message is held by a timer of taskq, which then blocks until a worker frees up a slot in the buffer of the queue,
+// so nothing bounds the messages waiting for a worker. Instead, the messages are held in a bounded overflow list
+// while the queue is full, and moved to the queue as it frees up
+type boundedQueue struct {
+	queue taskq.Queue
+	ops   *operationTracker
+	// Number of messages the buffer of the queue can hold
+	size int
+	// Number of messages the overflow can hold before the messages are dropped
+	overflowSize int
+
+	mux sync.Mutex
+	// Number of messages added to the queue and not yet picked up by a worker
+	pending  int
+	overflow []overflowedMessage
+	// Number of messages dropped since the queue was created
+	dropped int
+	// Whether messages were dropped since the overflow was last empty
+	dropping bool
+	// Signaled when a worker picks up a message, so the overflow can be moved to the queue
+	freed chan struct{}
+	stop  chan struct{}
+}
+
+type overflowedMessage struct {
+	msg    *taskq.Message
+	opType string
+	repo   string
+}
+
+func newBoundedQueue(queue taskq.Queue, ops *operationTracker, overflowSize int) *boundedQueue {
+	q := &boundedQueue{
+		queue:        queue,
+		ops:          ops,
+		size:         queue.Options().BufferSize,
+		overflowSize: overflowSize,
+		freed:        make(chan struct{}, 1),
+		stop:         make(chan struct{}),
+	}
+	queue.Consumer().AddHook(q)
+	go q.drainOverflow()
+	return q
+}
+
+// Ensure we are implementing the ConsumerHook interface
+var _ = (taskq.ConsumerHook)((*boundedQueue)(nil))
+
+// BeforeProcessMessage is called when a worker picks up a message, making room for the messages of the overflow
+func (q *boundedQueue) BeforeProcessMessage(evt *taskq.ProcessMessageEvent) error {
+	q.mux.Lock()
+	q.pending--
+	q.mux.Unlock()
+
+	select {
+	case q.freed <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (q *boundedQueue) AfterProcessMessage(evt *taskq.ProcessMessageEvent) error {
+	return nil
+}
+
+// add adds msg to the queue, or to the overflow if the queue is full
+// It returns ErrQueueFull and drops msg if the overflow is full too
+func (q *boundedQueue) add(msg *taskq.Message, opType string, repo string) error {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	// Keep the order of the operations, nothing jumps ahead of the overflow
+	if len(q.overflow) == 0 && q.pending < q.size {
+		return q.addToQueue(msg)
+	}
+	for _, m := range q.overflow {
+		if m.opType == opType && m.repo == repo {
+			// Same as the deduplication of the queue
+			msg.Err = taskq.ErrDuplicate
+			return nil
+		}
+	}
+	if len(q.overflow) >= q.overflowSize {
+		if !q.dropping {
+			logger.Error("git queue and its overflow are full, dropping operations", "overflow_size", q.overflowSize)
+			q.dropping = true
+		}
+		q.dropped++
+		return ErrQueueFull
+	}
+	if len(q.overflow) == 0 {
+		logger.Warn("git queue is full, holding operations in the overflow", "queue_size", q.size)
+	}
+	q.overflow = append(q.overflow, overflowedMessage{msg: msg, opType: opType, repo: repo})
+	return nil
+}
+
+func (q *boundedQueue) addToQueue(msg *taskq.Message) error {
+	err := q.queue.Add(msg)
+	if err == nil && msg.Err == nil {
+		q.pending++
+	}
+	return err
+}
+
+// drainOverflow moves the messages of the overflow to the queue as it frees up
+func (q *boundedQueue) drainOverflow() {
+	for {
+		select {
+		case <-q.stop:
+			return
+		case <-q.freed:
+		}
+
+		q.mux.Lock()
+		for len(q.overflow) > 0 && q.pending < q.size {
+			m := q.overflow[0]
+			q.overflow = q.overflow[1:]
+			err := q.addToQueue(m.msg)
+			if err != nil {
+				logger.Error("failed to move operation from the overflow to the git queue", "type", m.opType, "repo", m.repo, "error", err)
+			}
+			if err != nil || m.msg.Err != nil {
+				// Failed, or deduplicated with an operation which already went through the queue
+				q.ops.unqueue(m.opType, m.repo)
+			}
+			if len(q.overflow) == 0 {
+				// Release the backing array, which may have grown large
+				q.overflow = nil
+				q.dropping = false
+				logger.Info("git queue is no longer full")
+			}
+		}
+		q.mux.Unlock()
+	}
+}
+
+// discardOverflow drops the messages of the overflow and stops moving them to the queue
+func (q *boundedQueue) discardOverflow() {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	if len(q.overflow) > 0 {
+		logger.Warn("dropping the operations of the overflow of the git queue", "count", len(q.overflow))
+	}
+	for _, m := range q.overflow {
+		q.ops.unqueue(m.opType, m.repo)
+	}
+	q.dropped += len(q.overflow)
+	q.overflow = nil
+	close(q.stop)
+}
+
+// overflowStatus returns the number of messages in the overflow, and the number of messages dropped
+func (q *boundedQueue) overflowStatus() (overflowed int, dropped int) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	return len(q.overflow), q.dropped
+}
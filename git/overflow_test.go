@@ -0,0 +1,125 @@
+package git
+
+import (
+	"testing"
+
+	"github.com/vmihailenco/taskq/v3"
+)
+
+// newFullQueue returns a boundedQueue whose queue is full, so the messages added only ever go to its overflow
+func newFullQueue(overflowSize int) *boundedQueue {
+	return &boundedQueue{
+		ops:          newOperationTracker(nil),
+		overflowSize: overflowSize,
+		freed:        make(chan struct{}, 1),
+		stop:         make(chan struct{}),
+	}
+}
+
+func TestBoundedQueueOverflow(t *testing.T) {
+	type op struct {
+		opType string
+		repo   string
+	}
+	tests := []struct {
+		name         string
+		overflowSize int
+		ops          []op
+		errs         []error
+		duplicates   []bool
+		overflowed   int
+		dropped      int
+	}{
+		{
+			name:         "held in the overflow",
+			overflowSize: 2,
+			ops:          []op{{"clone", "a"}, {"pull", "a"}},
+			errs:         []error{nil, nil},
+			duplicates:   []bool{false, false},
+			overflowed:   2,
+		},
+		{
+			name:         "duplicates",
+			overflowSize: 2,
+			ops:          []op{{"clone", "a"}, {"clone", "a"}, {"clone", "b"}},
+			errs:         []error{nil, nil, nil},
+			duplicates:   []bool{false, true, false},
+			overflowed:   2,
+		},
+		{
+			name:         "dropped when full",
+			overflowSize: 1,
+			ops:          []op{{"clone", "a"}, {"clone", "b"}, {"clone", "c"}},
+			errs:         []error{nil, ErrQueueFull, ErrQueueFull},
+			duplicates:   []bool{false, false, false},
+			overflowed:   1,
+			dropped:      2,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			q := newFullQueue(test.overflowSize)
+			for i, o := range test.ops {
+				msg := &taskq.Message{}
+				if err := q.add(msg, o.opType, o.repo); err != test.errs[i] {
+					t.Errorf("%v %v: expected the error %v, got %v", o.opType, o.repo, test.errs[i], err)
+				}
+				if duplicate := msg.Err == taskq.ErrDuplicate; duplicate != test.duplicates[i] {
+					t.Errorf("%v %v: expected the message to be deduplicated: %v", o.opType, o.repo, test.duplicates[i])
+				}
+			}
+			overflowed, dropped := q.overflowStatus()
+			if overflowed != test.overflowed || dropped != test.dropped {
+				t.Errorf("expected %v overflowed and %v dropped, got %v and %v", test.overflowed, test.dropped, overflowed, dropped)
+			}
+		})
+	}
+}
+
+func TestBoundedQueueDiscardOverflow(t *testing.T) {
+	q := newFullQueue(2)
+	for _, repo := range []string{"a", "b"} {
+		if !q.ops.queue("clone", repo) {
+			t.Fatalf("expected the clone of %v to be queued", repo)
+		}
+		if err := q.add(&taskq.Message{}, "clone", repo); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	q.discardOverflow()
+	overflowed, dropped := q.overflowStatus()
+	if overflowed != 0 || dropped != 2 {
+		t.Errorf("expected the overflow to be dropped, got %v overflowed and %v dropped", overflowed, dropped)
+	}
+	for _, repo := range []string{"a", "b"} {
+		if q.ops.pending("clone", repo) {
+			t.Errorf("expected the clone of %v to no longer be queued", repo)
+		}
+	}
+	select {
+	case <-q.stop:
+	default:
+		t.Errorf("expected the overflow to stop being moved to the queue")
+	}
+}
+
+func TestOperationTrackerQueue(t *testing.T) {
+	ops := newOperationTracker(nil)
+	if !ops.queue("pull", "a") {
+		t.Fatalf("expected the pull to be queued")
+	}
+	if ops.queue("pull", "a") {
+		t.Errorf("expected the pull to be queued only once")
+	}
+	if !ops.queue("clone", "a") || !ops.queue("pull", "b") {
+		t.Errorf("expected the other operations to be queued")
+	}
+	ops.unqueue("pull", "a")
+	if ops.pending("pull", "a") {
+		t.Errorf("expected the pull to no longer be queued")
+	}
+	if !ops.queue("pull", "a") {
+		t.Errorf("expected the pull to be queued again")
+	}
+}
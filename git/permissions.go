@@ -0,0 +1,85 @@
+package git
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// PrepareCloneLocation creates the clone location with the mode and the group of p, and repairs those of the existing local copies
+// Only the folders are changed, a folder other users cannot traverse also keeps them out of the files it contains
+func PrepareCloneLocation(p GitClientParam) error {
+	if p.CloneMode == 0 && p.CloneGID < 0 {
+		return nil
+	}
+	if err := os.MkdirAll(p.CloneLocation, 0700); err != nil {
+		return fmt.Errorf("failed to create clone location: %v", err)
+	}
+
+	paths := []string{p.CloneLocation}
+	hostDir := filepath.Join(p.CloneLocation, p.RemoteURL.Hostname())
+	if entries, err := os.ReadDir(hostDir); err == nil {
+		paths = append(paths, hostDir)
+		for _, entry := range entries {
+			if entry.IsDir() {
+				paths = append(paths, filepath.Join(hostDir, entry.Name()))
+			}
+		}
+	}
+	for _, path := range paths {
+		repaired, err := p.applyPermissions(path)
+		if err != nil {
+			return err
+		}
+		if repaired {
+			logger.Warn("repaired the permissions of the clone location", "path", path)
+		}
+	}
+	return nil
+}
+
+// applyPermissions applies the mode and the group of p to the folder at path, and returns whether they were changed
+func (p GitClientParam) applyPermissions(path string) (bool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, fmt.Errorf("failed to set the permissions of %v: %v", path, err)
+	}
+	mode := info.Mode() & (os.ModePerm | os.ModeSetgid)
+	want := mode
+	if p.CloneMode != 0 {
+		want = p.CloneMode | mode&os.ModeSetgid
+	}
+	if p.CloneGID >= 0 {
+		// The folders created in path inherit its group
+		want |= os.ModeSetgid
+	}
+
+	changed := false
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && p.CloneGID >= 0 && int(stat.Gid) != p.CloneGID {
+		if err := os.Chown(path, -1, p.CloneGID); err != nil {
+			return false, fmt.Errorf("failed to set the group of %v: %v", path, err)
+		}
+		changed = true
+	}
+	// Changing the group may clear the setgid bit
+	if want != mode || changed {
+		if err := os.Chmod(path, want); err != nil {
+			return false, fmt.Errorf("failed to set the mode of %v: %v", path, err)
+		}
+		changed = true
+	}
+	return changed, nil
+}
+
+// applyClonePermissions applies the mode and the group of the clone location to the new local copy at dst
+func (c *gitClient) applyClonePermissions(dst string) {
+	if c.CloneMode == 0 && c.CloneGID < 0 {
+		return
+	}
+	for _, path := range []string{filepath.Dir(dst), dst} {
+		if _, err := c.params().applyPermissions(path); err != nil {
+			logger.Warn("failed to apply the permissions of the clone location to the local copy", "repo", dst, "error", err)
+		}
+	}
+}
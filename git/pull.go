@@ -1,39 +1,160 @@
 package git
 
 import (
+	"context"
 	"fmt"
 	"strconv"
 
 	"github.com/badjware/gitlabfs/utils"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func (c *gitClient) pull(repoPath string, defaultBranch string) error {
+func (c *gitClient) pull(url string, repoPath string, defaultBranch string, depth int) (err error) {
+	ctx, span := tracer.Start(c.ctx, "git.pull", trace.WithAttributes(attribute.String("git.repo", repoPath)))
+	defer func() {
+		if err != nil {
+			span.SetStatus(codes.Error, utils.Redact(err.Error()))
+		}
+		span.End()
+	}()
+
+	p := c.params()
+	c.ops.start(OperationPull, repoPath)
+	defer func() {
+		failures := c.ops.done(OperationPull, repoPath, err)
+		// Only report once per streak of failures, the next report is after a successful pull
+		if c.OnRepeatedPullFailure != nil && p.PullFailureThreshold > 0 && failures == p.PullFailureThreshold {
+			c.OnRepeatedPullFailure(repoPath, failures, err)
+		}
+		if c.OnOperationDone != nil {
+			c.OnOperationDone(OperationPull, repoPath, err)
+		}
+	}()
+	// Another host sharing the clone location may be pulling it too, the lock is held until the repair of a corrupted local copy is done
+	lock, err := c.lockRepo(ctx, repoPath)
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
+	defer func() {
+		if err != nil {
+			c.repairIfCorrupted(err, url, repoPath, defaultBranch, depth, p.RecloneCorrupted)
+		}
+	}()
+
+	remoteURL, credentialEnv := withoutCredentials(url)
+	if credentialEnv != nil {
+		if err := scrubRemoteCredentials(ctx, p.RemoteName, remoteURL, repoPath); err != nil {
+			logger.Warn("failed to remove the credentials from the remote of the local copy", "repo", repoPath, "error", err)
+		}
+	}
+
+	branch, tag, _ := parseRef(defaultBranch)
+	if tag {
+		return c.pullTag(ctx, p, credentialEnv, repoPath, branch, depth)
+	}
+
 	// Check if the local repo is on default branch
-	branchName, err := utils.ExecProcessInDir(
+	branchName, err := utils.ExecProcessInDirContext(
+		ctx,
 		repoPath, // workdir
 		"git", "branch",
 		"--show-current",
 	)
 	if err != nil {
-		return fmt.Errorf("failed to retrieve HEAD of git repo %v: %v", repoPath, err)
+		return fmt.Errorf("failed to retrieve HEAD of git repo %v: %w", repoPath, err)
 	}
 
-	if branchName == defaultBranch {
+	if branchName == branch {
 		// Pull the repo
-		_, err = utils.ExecProcessInDir(
+		_, err = utils.ExecProcessInDirContextEnv(
+			ctx,
 			repoPath, // workdir
-			"git", "pull",
-			"--depth", strconv.Itoa(c.PullDepth),
-			"--",
-			c.RemoteName,  // repository
-			defaultBranch, // refspec
+			credentialEnv,
+			"git", append(p.httpConfigArgs(),
+				"pull",
+				"--depth", strconv.Itoa(p.pullDepth(depth)),
+				"--",
+				p.RemoteName, // repository
+				branch,       // refspec
+			)...,
 		)
 		if err != nil {
-			return fmt.Errorf("failed to pull git repo %v: %v", repoPath, err)
+			return fmt.Errorf("failed to pull git repo %v: %w", repoPath, err)
 		}
 	} else {
-		fmt.Printf("%v != %v, skipping pull", branchName, defaultBranch)
+		logger.Info("not on the default branch, skipping pull", "repo", repoPath, "branch", branchName, "default_branch", branch)
 	}
 
 	return nil
 }
+
+// pullTag fetches the tag the local copy is pinned to, and checks it out again if it was moved
+// Nothing is fetched if something else than the tag is checked out
+// credentialEnv passes the credentials of the remote to git, see withoutCredentials
+func (c *gitClient) pullTag(ctx context.Context, p GitClientParam, credentialEnv []string, repoPath string, tag string, depth int) error {
+	head, err := utils.ExecProcessInDirContext(
+		ctx,
+		repoPath, // workdir
+		"git", "rev-parse",
+		"--verify", "HEAD",
+	)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve HEAD of git repo %v: %w", repoPath, err)
+	}
+	tagged, err := utils.ExecProcessInDirContext(
+		ctx,
+		repoPath, // workdir
+		"git", "rev-parse",
+		"--verify", "--quiet",
+		pinnedTagPrefix+tag+"^{commit}",
+	)
+	if err != nil || tagged != head {
+		logger.Info("not on the pinned tag, skipping pull", "repo", repoPath, "tag", tag)
+		return nil
+	}
+
+	// The tag may have been moved, it replaces the local one
+	_, err = utils.ExecProcessInDirContextEnv(
+		ctx,
+		repoPath, // workdir
+		credentialEnv,
+		"git", append(p.httpConfigArgs(),
+			"fetch",
+			"--depth", strconv.Itoa(p.pullDepth(depth)),
+			"--force",
+			"--",
+			p.RemoteName, // repository
+			fmt.Sprintf("%s%s:%s%s", pinnedTagPrefix, tag, pinnedTagPrefix, tag), // refspec
+		)...,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to fetch tag %v of git repo %v: %w", tag, repoPath, err)
+	}
+	tagged, err = utils.ExecProcessInDirContext(
+		ctx,
+		repoPath, // workdir
+		"git", "rev-parse",
+		"--verify",
+		pinnedTagPrefix+tag+"^{commit}",
+	)
+	if err != nil {
+		return fmt.Errorf("failed to resolve tag %v of git repo %v: %w", tag, repoPath, err)
+	}
+	if tagged == head {
+		return nil
+	}
+	logger.Info("pinned tag was moved, checking it out", "repo", repoPath, "tag", tag, "commit", tagged)
+	_, err = utils.ExecProcessInDirContext(
+		ctx,
+		repoPath, // workdir
+		"git", "checkout",
+		"--detach", tagged,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to checkout tag %v of git repo %v: %w", tag, repoPath, err)
+	}
+	return nil
+}
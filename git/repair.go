@@ -0,0 +1,82 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// What git prints when it reads a corrupted object, lower-cased
+var corruptionMarkers = []string{"corrupt", "bad object", "invalid object", "missing blob", "missing tree", "missing commit"}
+
+// corruption returns why the local copy at repoPath is corrupted, or nil if it's not
+// opErr is the error of the git operation which failed on it. The objects are only all checked if it looks like git read a corrupted object
+func (c *gitClient) corruption(repoPath string, opErr error) error {
+	if err := c.verifyLocalCopy(repoPath, false); err != nil {
+		return err
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(opErr, &exitErr) {
+		return nil
+	}
+	output := strings.ToLower(string(exitErr.Stderr))
+	for _, marker := range corruptionMarkers {
+		if strings.Contains(output, marker) {
+			return c.verifyLocalCopy(repoPath, true)
+		}
+	}
+	return nil
+}
+
+// repairIfCorrupted moves the local copy at repoPath to the quarantine and dispatches its clone again, if it's corrupted
+// opErr is the error of the git operation which failed on it. If reclone is false, the corruption is only logged
+func (c *gitClient) repairIfCorrupted(opErr error, url string, repoPath string, defaultBranch string, depth int, reclone bool) {
+	if c.ctx.Err() != nil {
+		// The operation was aborted, the local copy is not to blame
+		return
+	}
+	if c.ignores(url) {
+		return
+	}
+	corruptionErr := c.corruption(repoPath, opErr)
+	if corruptionErr == nil {
+		return
+	}
+	if !reclone {
+		logger.Warn("local copy is corrupted, move it away or set on_corruption to reclone to clone it again", "repo", repoPath, "error", corruptionErr)
+		return
+	}
+
+	quarantined, err := c.quarantine(repoPath)
+	if err != nil {
+		logger.Error("local copy is corrupted but could not be moved to the quarantine", "repo", repoPath, "error", corruptionErr, "quarantine_error", err)
+		return
+	}
+	logger.Warn("local copy is corrupted, moved it to the quarantine and cloning it again", "repo", repoPath, "quarantine", quarantined, "error", corruptionErr)
+
+	msg := c.cloneTask.WithArgs(context.Background(), url, defaultBranch, repoPath, depth)
+	if err := c.dispatch(c.queue, msg, OperationClone, repoPath); err != nil {
+		logger.Error("failed to dispatch the clone of the corrupted local copy, it's cloned again on the next access", "repo", repoPath, "error", err)
+	}
+}
+
+// quarantine moves the local copy at repoPath out of the clone location of the repos, so its files can still be recovered
+// It returns where the local copy was moved to
+func (c *gitClient) quarantine(repoPath string) (string, error) {
+	dir := filepath.Join(c.CloneLocation, "quarantine", c.RemoteURL.Hostname())
+	// The local copy may hold tokens in its git config
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create the quarantine: %v", err)
+	}
+	dst := filepath.Join(dir, filepath.Base(repoPath)+"-"+time.Now().Format("20060102T150405"))
+	if err := os.Rename(repoPath, dst); err != nil {
+		return "", fmt.Errorf("failed to move %v to %v: %v", repoPath, dst, err)
+	}
+	c.clones.set(repoPath, false)
+	return dst, nil
+}
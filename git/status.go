@@ -0,0 +1,247 @@
+package git
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/badjware/gitlabfs/utils"
+	"github.com/vmihailenco/taskq/v3"
+)
+
+const (
+	OperationClone = "clone"
+	OperationPull  = "pull"
+)
+
+type Operation struct {
+	Type  string    `yaml:"type"`
+	Repo  string    `yaml:"repo"`
+	Since time.Time `yaml:"since"`
+}
+
+type Status struct {
+	Workers int         `yaml:"workers"`
+	Queued  []Operation `yaml:"queued"`
+	Running []Operation `yaml:"running"`
+	// Number of queued operations held in the overflow because the queue is full, and number of operations dropped because the overflow was full too
+	Overflowed   int                 `yaml:"overflowed"`
+	Dropped      int                 `yaml:"dropped"`
+	RecentErrors []utils.LoggedError `yaml:"recent_errors,omitempty"`
+	// Size of the local copies in bytes at their last check, and number of local copies evicted to stay under MaxStoreSize
+	// Only measured when MaxStoreSize is set
+	StoreSize    int64 `yaml:"store_size,omitempty"`
+	MaxStoreSize int64 `yaml:"max_store_size,omitempty"`
+	Evicted      int   `yaml:"evicted,omitempty"`
+}
+
+type RepoStatus struct {
+	Queued  []Operation    `yaml:"queued"`
+	Running []Operation    `yaml:"running"`
+	History []HistoryEntry `yaml:"history"`
+	// Last clone of the repo, if it failed and was not attempted again successfully since
+	CloneError *HistoryEntry `yaml:"clone_error,omitempty"`
+}
+
+// operationTracker keeps track of the git operations that are queued and running
+type operationTracker struct {
+	mux     sync.Mutex
+	queued  map[string]Operation
+	running map[string]Operation
+	errors  *utils.ErrorLog
+	history *operationHistory
+	// Last failed clone of each repo, until a clone succeeds
+	cloneErrors map[string]HistoryEntry
+	// Number of consecutive failed pulls of each repo
+	pullFailures map[string]int
+}
+
+func newOperationTracker(history *operationHistory) *operationTracker {
+	return &operationTracker{
+		queued:  map[string]Operation{},
+		running: map[string]Operation{},
+		errors:  utils.NewErrorLog(50),
+		history: history,
+
+		cloneErrors:  map[string]HistoryEntry{},
+		pullFailures: map[string]int{},
+	}
+}
+
+// queue tracks an operation of opType on repo as queued, and returns false if one is already queued or running
+// The priority queue and the queue share the tracker, so the same operation is never queued on both
+func (t *operationTracker) queue(opType string, repo string) bool {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	key := opType + " " + repo
+	_, queued := t.queued[key]
+	_, running := t.running[key]
+	if queued || running {
+		return false
+	}
+	t.queued[key] = Operation{
+		Type:  opType,
+		Repo:  repo,
+		Since: time.Now(),
+	}
+	return true
+}
+
+func (t *operationTracker) unqueue(opType string, repo string) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	delete(t.queued, opType+" "+repo)
+}
+
+// pending returns whether an operation of opType on repo is queued or running
+func (t *operationTracker) pending(opType string, repo string) bool {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	key := opType + " " + repo
+	_, queued := t.queued[key]
+	_, running := t.running[key]
+	return queued || running
+}
+
+func (t *operationTracker) start(opType string, repo string) {
+	t.unqueue(opType, repo)
+
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	t.running[opType+" "+repo] = Operation{
+		Type:  opType,
+		Repo:  repo,
+		Since: time.Now(),
+	}
+}
+
+// done records the completion of the operation
+// It returns the number of consecutive failed pulls of the repo, if the operation is a pull
+func (t *operationTracker) done(opType string, repo string, err error) (pullFailures int) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	key := opType + " " + repo
+	if op, ok := t.running[key]; ok {
+		entry := newHistoryEntry(opType, repo, op.Since, err)
+		t.history.add(entry)
+		if opType == OperationClone && err != nil {
+			t.cloneErrors[repo] = entry
+		}
+	}
+	if opType == OperationClone && err == nil {
+		delete(t.cloneErrors, repo)
+	}
+	if opType == OperationPull && err != nil {
+		t.pullFailures[repo]++
+	} else if opType == OperationPull {
+		delete(t.pullFailures, repo)
+	}
+	delete(t.running, key)
+	if err != nil {
+		t.errors.Add(err)
+	}
+	return t.pullFailures[repo]
+}
+
+func sortedOperations(ops []Operation) []Operation {
+	sorted := append([]Operation{}, ops...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Since.Before(sorted[j].Since)
+	})
+	return sorted
+}
+
+// Status returns the git operations that are queued and running, along with the recent failures
+func (c *gitClient) Status() Status {
+	// The queues lock the tracker while holding their own lock, get their status before locking it
+	overflowed, dropped := c.queue.overflowStatus()
+	priorityOverflowed, priorityDropped := c.priorityQueue.overflowStatus()
+	c.usage.mux.Lock()
+	storeSize, evicted := c.usage.size, c.usage.evicted
+	c.usage.mux.Unlock()
+
+	c.ops.mux.Lock()
+	defer c.ops.mux.Unlock()
+
+	queued := make([]Operation, 0, len(c.ops.queued))
+	for _, op := range c.ops.queued {
+		queued = append(queued, op)
+	}
+	running := make([]Operation, 0, len(c.ops.running))
+	for _, op := range c.ops.running {
+		running = append(running, op)
+	}
+
+	return Status{
+		// The priority queue has its own worker
+		Workers:      c.params().QueueWorkerCount + 1,
+		Queued:       sortedOperations(queued),
+		Running:      sortedOperations(running),
+		Overflowed:   overflowed + priorityOverflowed,
+		Dropped:      dropped + priorityDropped,
+		RecentErrors: c.ops.errors.Entries(),
+		StoreSize:    storeSize,
+		MaxStoreSize: c.MaxStoreSize,
+		Evicted:      evicted,
+	}
+}
+
+// RepoStatus returns the git operations of the repo that are queued and running, along with the most recent ones that completed
+func (c *gitClient) RepoStatus(pid int) RepoStatus {
+	localRepoLoc := c.getLocalRepoLoc(pid)
+
+	c.ops.mux.Lock()
+	defer c.ops.mux.Unlock()
+
+	status := RepoStatus{
+		Queued:  []Operation{},
+		Running: []Operation{},
+		History: c.ops.history.get(localRepoLoc),
+	}
+	for _, op := range c.ops.queued {
+		if op.Repo == localRepoLoc {
+			status.Queued = append(status.Queued, op)
+		}
+	}
+	for _, op := range c.ops.running {
+		if op.Repo == localRepoLoc {
+			status.Running = append(status.Running, op)
+		}
+	}
+	status.Queued = sortedOperations(status.Queued)
+	status.Running = sortedOperations(status.Running)
+	if entry, ok := c.ops.cloneErrors[localRepoLoc]; ok {
+		status.CloneError = &entry
+	}
+	return status
+}
+
+// dispatched returns opType if msg was added to the queue, or an empty string if it was deduplicated with an operation already queued
+func dispatched(msg *taskq.Message, opType string) string {
+	if msg.Err != nil {
+		return ""
+	}
+	return opType
+}
+
+// dispatch adds msg to queue and tracks the operation until it's processed
+// It never blocks, the operation is held in the overflow of the queue if it's full
+// msg is deduplicated with the same operation on the repo queued or running, on either queue
+func (c *gitClient) dispatch(queue *boundedQueue, msg *taskq.Message, opType string, repo string) error {
+	// Track before adding the msg, a worker may pick it up right away
+	if !c.ops.queue(opType, repo) {
+		msg.Err = taskq.ErrDuplicate
+		return nil
+	}
+	if err := queue.add(msg, opType, repo); err != nil || msg.Err != nil {
+		// Failed, or deduplicated with an operation which is already tracked
+		c.ops.unqueue(opType, repo)
+		return err
+	}
+	return nil
+}
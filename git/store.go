@@ -0,0 +1,285 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/badjware/gitlabfs/utils"
+)
+
+const (
+	// How often the size of the local copies is checked against MaxStoreSize
+	storeCheckInterval = 5 * time.Minute
+	// How long after a clone the size is checked, so the clones started together are measured at once
+	storeCheckDelay = time.Minute
+	// How often an access to a local copy is recorded on disk
+	accessRecordInterval = time.Minute
+)
+
+// storeUsage tracks the size of the local copies and when each of them was last accessed
+type storeUsage struct {
+	mux sync.Mutex
+	// Last access recorded on disk, by local copy
+	recorded map[string]time.Time
+	// Size of the local copies at the last check, and number of local copies evicted since the start
+	size    int64
+	evicted int
+
+	// Signaled when a clone completes
+	cloned chan struct{}
+}
+
+func newStoreUsage() *storeUsage {
+	return &storeUsage{
+		recorded: map[string]time.Time{},
+		cloned:   make(chan struct{}, 1),
+	}
+}
+
+// ErrUnpushedWork is returned when a local copy holds work which does not exist in gitlab, so it's not evicted
+var ErrUnpushedWork = errors.New("local copy has work which is not pushed")
+
+// localCopyUsage is the size of a local copy and when it was last accessed
+type localCopyUsage struct {
+	pid          int
+	path         string
+	size         int64
+	lastAccessed time.Time
+}
+
+// recordAccess records that the local copy at localRepoLoc is accessed, by touching its .git folder
+// The access time survives the restarts, the local copies accessed least recently are evicted first
+func (c *gitClient) recordAccess(localRepoLoc string) {
+	if c.MaxStoreSize <= 0 {
+		return
+	}
+	now := time.Now()
+	c.usage.mux.Lock()
+	if now.Sub(c.usage.recorded[localRepoLoc]) < accessRecordInterval {
+		c.usage.mux.Unlock()
+		return
+	}
+	c.usage.recorded[localRepoLoc] = now
+	c.usage.mux.Unlock()
+
+	if err := os.Chtimes(filepath.Join(localRepoLoc, ".git"), now, now); err != nil && !os.IsNotExist(err) {
+		logger.Debug("failed to record the access to the local copy", "repo", localRepoLoc, "error", err)
+	}
+}
+
+// RecordAccess records that the local copy of the repo is accessed, eg: by a file operation inside of it
+func (c *gitClient) RecordAccess(pid int) {
+	c.recordAccess(c.getLocalRepoLoc(pid))
+}
+
+// notifyCloned schedules a check of the size of the local copies, after a clone completed
+func (c *gitClient) notifyCloned() {
+	select {
+	case c.usage.cloned <- struct{}{}:
+	default:
+	}
+}
+
+// watchStoreSize evicts the local copies accessed least recently whenever their size exceeds MaxStoreSize, until the client is closed
+func (c *gitClient) watchStoreSize() {
+	ticker := time.NewTicker(storeCheckInterval)
+	defer ticker.Stop()
+	for {
+		c.enforceStoreSize()
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+		case <-c.usage.cloned:
+			select {
+			case <-c.ctx.Done():
+				return
+			case <-time.After(storeCheckDelay):
+			}
+		}
+	}
+}
+
+// enforceStoreSize measures the local copies and evicts the ones accessed least recently until their size is under MaxStoreSize
+// The local copies of the pinned projects, the ignored ones, the ones with uncommitted or unpushed work and the ones with an operation pending are kept
+func (c *gitClient) enforceStoreSize() {
+	maxSize := c.MaxStoreSize
+
+	copies, size, err := c.measureLocalCopies()
+	if err != nil {
+		logger.Warn("failed to measure the local copies", "error", err)
+		return
+	}
+	c.setStoreSize(size, 0)
+	if size <= maxSize {
+		return
+	}
+
+	logger.Info("local copies exceed max_store_size, evicting the ones accessed least recently", "size", size, "max_store_size", maxSize)
+	sort.Slice(copies, func(i, j int) bool {
+		return copies[i].lastAccessed.Before(copies[j].lastAccessed)
+	})
+	evicted := 0
+	for _, lc := range copies {
+		if size <= maxSize {
+			break
+		}
+		if !c.evictable(lc.path) {
+			continue
+		}
+		if err := c.RemoveLocalCopy(lc.pid); err != nil {
+			if errors.Is(err, ErrDirtyWorktree) || errors.Is(err, ErrIgnoredLocalCopy) || errors.Is(err, ErrLocalCopyLocked) {
+				logger.Debug("not evicting local copy", "repo", lc.path, "error", err)
+			} else {
+				logger.Warn("failed to evict local copy", "repo", lc.path, "error", err)
+			}
+			continue
+		}
+		logger.Info("evicted local copy", "repo", lc.path, "size", lc.size, "last_accessed", lc.lastAccessed)
+		size -= lc.size
+		evicted++
+	}
+	c.setStoreSize(size, evicted)
+	if size > maxSize {
+		logger.Warn("local copies still exceed max_store_size, the others are pinned, ignored, busy or have uncommitted or unpushed work", "size", size, "max_store_size", maxSize)
+	}
+}
+
+// evictable returns whether the local copy at localRepoLoc may be evicted, checking what RemoveLocalCopy does not
+func (c *gitClient) evictable(localRepoLoc string) bool {
+	if c.ops.pending(OperationClone, localRepoLoc) || c.ops.pending(OperationPull, localRepoLoc) {
+		return false
+	}
+	if err := c.checkUnpushedWork(localRepoLoc); err != nil {
+		logger.Debug("not evicting local copy", "repo", localRepoLoc, "error", err)
+		return false
+	}
+	if len(c.PinnedProjects) == 0 {
+		return true
+	}
+	remoteURL, err := utils.ExecProcessInDirContext(
+		c.ctx,
+		localRepoLoc, // workdir
+		"git", "remote", "get-url",
+		"--",
+		c.params().RemoteName, // name
+	)
+	if err != nil {
+		// Can't tell which project it is, better keep it
+		return false
+	}
+	projectPath := c.projectPath(remoteURL)
+	for _, pinned := range c.PinnedProjects {
+		if pinned == projectPath {
+			return false
+		}
+	}
+	return true
+}
+
+// checkUnpushedWork returns ErrUnpushedWork if the local copy at localRepoLoc holds anything which only exists there:
+// commits of a branch not pushed to a remote, stashed changes, or files git does not track, including the ignored ones, eg: .env
+// The uncommitted changes are checked by RemoveLocalCopy
+func (c *gitClient) checkUnpushedWork(localRepoLoc string) error {
+	unpushed, err := utils.ExecProcessInDirContext(
+		c.ctx,
+		localRepoLoc, // workdir
+		"git", "rev-list",
+		"--max-count=1",
+		"--branches",
+		"--not", "--remotes",
+	)
+	if err != nil {
+		return fmt.Errorf("failed to list the unpushed commits of git repo %v: %v", localRepoLoc, err)
+	}
+	if unpushed != "" {
+		return fmt.Errorf("%w: git repo %v has commits which are not pushed", ErrUnpushedWork, localRepoLoc)
+	}
+
+	if _, err := utils.ExecProcessInDirContext(
+		c.ctx,
+		localRepoLoc, // workdir
+		"git", "rev-parse",
+		"--verify", "--quiet",
+		"refs/stash",
+	); err == nil {
+		return fmt.Errorf("%w: git repo %v has stashed changes", ErrUnpushedWork, localRepoLoc)
+	}
+
+	untracked, err := utils.ExecProcessInDirContext(
+		c.ctx,
+		localRepoLoc, // workdir
+		"git", "status",
+		"--porcelain",
+		"--ignored",
+	)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve the status of git repo %v: %v", localRepoLoc, err)
+	}
+	if untracked != "" {
+		return fmt.Errorf("%w: git repo %v has untracked or ignored files", ErrUnpushedWork, localRepoLoc)
+	}
+	return nil
+}
+
+// measureLocalCopies returns the size and the last access of each local copy, and their total size
+func (c *gitClient) measureLocalCopies() ([]localCopyUsage, int64, error) {
+	pids, err := c.LocalCopies()
+	if err != nil {
+		return nil, 0, err
+	}
+	copies := make([]localCopyUsage, 0, len(pids))
+	var total int64
+	for _, pid := range pids {
+		localRepoLoc := c.LocalRepoLoc(pid)
+		size, err := dirSize(localRepoLoc)
+		if err != nil {
+			// Eg: the local copy was removed meanwhile
+			continue
+		}
+		lc := localCopyUsage{pid: pid, path: localRepoLoc, size: size}
+		if info, err := os.Stat(filepath.Join(localRepoLoc, ".git")); err == nil {
+			lc.lastAccessed = info.ModTime()
+		} else if info, err := os.Stat(localRepoLoc); err == nil {
+			lc.lastAccessed = info.ModTime()
+		}
+		copies = append(copies, lc)
+		total += size
+	}
+	return copies, total, nil
+}
+
+// dirSize returns the size of the files under dir, without following the symlinks
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path != dir {
+				// Eg: a lock file removed by a git command meanwhile
+				return nil
+			}
+			return err
+		}
+		if entry.Type().IsRegular() {
+			if info, err := entry.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size, err
+}
+
+func (c *gitClient) setStoreSize(size int64, evicted int) {
+	c.usage.mux.Lock()
+	defer c.usage.mux.Unlock()
+
+	c.usage.size = size
+	c.usage.evicted += evicted
+}
@@ -0,0 +1,85 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/badjware/gitlabfs/utils"
+)
+
+// VerifyLocalCopy checks that HEAD of the local copy of the repo points to a valid commit, and runs git fsck on it if full is true
+// A local copy with nothing fetched yet, eg: initialized without cloning, is valid
+func (c *gitClient) VerifyLocalCopy(pid int, full bool) error {
+	return c.verifyLocalCopy(c.getLocalRepoLoc(pid), full)
+}
+
+func (c *gitClient) verifyLocalCopy(localRepoLoc string, full bool) error {
+	if _, err := os.Stat(filepath.Join(localRepoLoc, ".git")); err != nil {
+		return fmt.Errorf("%v is not a git repo: %v", localRepoLoc, err)
+	}
+
+	_, err := utils.ExecProcessInDirContext(
+		c.ctx,
+		localRepoLoc, // workdir
+		"git", "rev-parse",
+		"--verify", "HEAD^{commit}",
+	)
+	if err != nil {
+		refs, refsErr := utils.ExecProcessInDirContext(
+			c.ctx,
+			localRepoLoc, // workdir
+			"git", "for-each-ref",
+			"--count", "1",
+		)
+		if refsErr != nil || refs != "" {
+			return fmt.Errorf("HEAD of git repo %v is not a valid commit: %v", localRepoLoc, commandError(err))
+		}
+		// Nothing was fetched yet, there is nothing to check
+		return nil
+	}
+
+	if full {
+		_, err := utils.ExecProcessInDirContext(
+			c.ctx,
+			localRepoLoc, // workdir
+			"git", "fsck",
+			"--no-progress",
+		)
+		if err != nil {
+			return fmt.Errorf("git fsck failed on git repo %v: %v", localRepoLoc, commandError(err))
+		}
+	}
+	return nil
+}
+
+// LocalRemoteURL returns the url of the remote of the local copy of the repo
+func (c *gitClient) LocalRemoteURL(pid int) (string, error) {
+	remoteName := c.params().RemoteName
+	localRepoLoc := c.getLocalRepoLoc(pid)
+	url, err := utils.ExecProcessInDirContext(
+		c.ctx,
+		localRepoLoc, // workdir
+		"git", "remote", "get-url",
+		"--",
+		remoteName, // name
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to retrieve remote %v of git repo %v: %v", remoteName, localRepoLoc, commandError(err))
+	}
+	return url, nil
+}
+
+// commandError returns the last line the failed git command printed on its standard error, or err if it printed nothing
+func commandError(err error) string {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if output := strings.TrimSpace(string(exitErr.Stderr)); output != "" {
+			return utils.Redact(output[strings.LastIndex(output, "\n")+1:])
+		}
+	}
+	return err.Error()
+}
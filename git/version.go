@@ -0,0 +1,72 @@
+package git
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/badjware/gitlabfs/utils"
+)
+
+// GitInfo describes the git binary used by gitlabfs and the features it supports
+type GitInfo struct {
+	Path    string `yaml:"path"`
+	Version string `yaml:"version"`
+
+	// git init --initial-branch, required by on_clone: init (git 2.28)
+	InitialBranch bool `yaml:"initial_branch"`
+	// git sparse-checkout (git 2.25)
+	SparseCheckout bool `yaml:"sparse_checkout"`
+	// git clone --filter (git 2.19)
+	PartialClone bool `yaml:"partial_clone"`
+	// GIT_CONFIG_COUNT, required to authenticate the clones over http with the tokens (git 2.31)
+	ConfigEnv bool `yaml:"config_env"`
+}
+
+// DetectGit locates the git binary and returns the features it supports
+func DetectGit(ctx context.Context) (*GitInfo, error) {
+	path, err := exec.LookPath("git")
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate git: %v", err)
+	}
+	output, err := utils.ExecProcessContext(ctx, "git", "version")
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve the version of git: %v", err)
+	}
+
+	// eg: "git version 2.39.2" or "git version 2.39.3 (Apple Git-145)"
+	version := strings.TrimPrefix(strings.TrimSpace(output), "git version ")
+	info := &GitInfo{Path: path, Version: version}
+	major, minor := parseGitVersion(version)
+	atLeast := func(wantMajor int, wantMinor int) bool {
+		return major > wantMajor || (major == wantMajor && minor >= wantMinor)
+	}
+	info.InitialBranch = atLeast(2, 28)
+	info.SparseCheckout = atLeast(2, 25)
+	info.PartialClone = atLeast(2, 19)
+	info.ConfigEnv = atLeast(2, 31)
+	return info, nil
+}
+
+// parseGitVersion returns the major and minor version of version, or zeros if it can't be parsed
+func parseGitVersion(version string) (major int, minor int) {
+	words := strings.Fields(version)
+	if len(words) == 0 {
+		return 0, 0
+	}
+	fields := strings.SplitN(words[0], ".", 3)
+	if len(fields) < 2 {
+		return 0, 0
+	}
+	major, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return 0, 0
+	}
+	minor, err = strconv.Atoi(fields[1])
+	if err != nil {
+		return 0, 0
+	}
+	return major, minor
+}
@@ -0,0 +1,61 @@
+package git
+
+import (
+	"sync"
+
+	"github.com/vmihailenco/taskq/v3"
+)
+
+// Number of workers of the git queue when fewer are configured, so the worker count can be raised when the config is reloaded
+// taskq cannot add workers to a queue once it's created
+const minQueueWorkers = 32
+
+// workerLimit limits the number of messages of a queue processed at once, below the number of workers of the queue
+// The workers over the limit wait before processing their message, which is still counted as pending in the queue
+// The limit can be changed while the messages are processed
+type workerLimit struct {
+	mux     sync.Mutex
+	cond    *sync.Cond
+	limit   int
+	running int
+}
+
+// Ensure we are implementing the ConsumerHook interface
+var _ = (taskq.ConsumerHook)((*workerLimit)(nil))
+
+func newWorkerLimit(limit int) *workerLimit {
+	l := &workerLimit{limit: limit}
+	l.cond = sync.NewCond(&l.mux)
+	return l
+}
+
+// setLimit changes the number of messages processed at once
+// When it's lowered, the messages being processed over the limit are completed
+func (l *workerLimit) setLimit(limit int) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	l.limit = limit
+	l.cond.Broadcast()
+}
+
+// BeforeProcessMessage waits for the number of messages being processed to be under the limit
+func (l *workerLimit) BeforeProcessMessage(evt *taskq.ProcessMessageEvent) error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	for l.running >= l.limit {
+		l.cond.Wait()
+	}
+	l.running++
+	return nil
+}
+
+func (l *workerLimit) AfterProcessMessage(evt *taskq.ProcessMessageEvent) error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	l.running--
+	l.cond.Broadcast()
+	return nil
+}
@@ -0,0 +1,38 @@
+package git
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWorkerLimit(t *testing.T) {
+	l := newWorkerLimit(1)
+	l.BeforeProcessMessage(nil)
+
+	started := make(chan struct{})
+	go func() {
+		l.BeforeProcessMessage(nil)
+		close(started)
+	}()
+
+	// The second message waits for the first one, until the limit is raised
+	select {
+	case <-started:
+		t.Fatal("expected the message over the limit to wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+	l.setLimit(2)
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("expected raising the limit to start the waiting message")
+	}
+
+	// Lowering the limit lets the messages being processed complete
+	l.setLimit(1)
+	l.AfterProcessMessage(nil)
+	l.AfterProcessMessage(nil)
+	if l.running != 0 {
+		t.Errorf("expected no message to be processed, got %v", l.running)
+	}
+}
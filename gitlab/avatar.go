@@ -0,0 +1,57 @@
+package gitlab
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/xanzy/go-gitlab"
+)
+
+type AvatarFetcher interface {
+	FetchGroupAvatar(ctx context.Context, group *Group) ([]byte, error)
+	FetchProjectAvatar(ctx context.Context, project *Project) ([]byte, error)
+}
+
+// fetchAvatar downloads the avatar at the api path, caching it by avatarURL
+// The url of an avatar changes when it's replaced, so a cached avatar never goes stale
+func (c *gitlabClient) fetchAvatar(ctx context.Context, path string, avatarURL string) ([]byte, error) {
+	c.avatarMux.Lock()
+	avatar, ok := c.avatars[avatarURL]
+	c.avatarMux.Unlock()
+	if ok {
+		return avatar, nil
+	}
+
+	client := c.current().client
+	req, err := client.NewRequest(http.MethodGet, path, nil, []gitlab.RequestOptionFunc{gitlab.WithContext(ctx)})
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if _, err := client.Do(req, &buf); err != nil {
+		return nil, err
+	}
+
+	c.avatarMux.Lock()
+	defer c.avatarMux.Unlock()
+	c.avatars[avatarURL] = buf.Bytes()
+	return buf.Bytes(), nil
+}
+
+func (c *gitlabClient) FetchGroupAvatar(ctx context.Context, group *Group) ([]byte, error) {
+	avatar, err := c.fetchAvatar(ctx, fmt.Sprintf("groups/%d/avatar", group.ID), group.AvatarURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch the avatar of group %v: %v", group.ID, err)
+	}
+	return avatar, nil
+}
+
+func (c *gitlabClient) FetchProjectAvatar(ctx context.Context, project *Project) ([]byte, error) {
+	avatar, err := c.fetchAvatar(ctx, fmt.Sprintf("projects/%d/avatar", project.ID), project.AvatarURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch the avatar of project %v: %v", project.ID, err)
+	}
+	return avatar, nil
+}
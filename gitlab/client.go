@@ -1,47 +1,288 @@
 package gitlab
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"net/http"
+	"sync"
+	"time"
 
+	"github.com/badjware/gitlabfs/utils"
 	"github.com/xanzy/go-gitlab"
+	"go.opentelemetry.io/otel"
 )
 
 const (
 	PullMethodHTTP = "http"
 	PullMethodSSH  = "ssh"
+
+	ArchivedProjectShow   = "show"
+	ArchivedProjectHide   = "hide"
+	ArchivedProjectIgnore = "ignore"
+
+	VisibilityPrivate  = "private"
+	VisibilityInternal = "internal"
+	VisibilityPublic   = "public"
 )
 
 type GitlabFetcher interface {
 	GroupFetcher
 	UserFetcher
+	ProjectFetcher
+	ProjectCreator
+	StatusReporter
+	AvatarFetcher
+	RepositoryBrowser
 }
 
+var logger = utils.NewLogger("gitlab")
+
+var tracer = otel.Tracer("github.com/badjware/gitlabfs/gitlab")
+
 type Refresher interface {
 	InvalidateCache()
 }
 
 type GitlabClientParam struct {
-	PullMethod         string
-	IncludeCurrentUser bool
+	PullMethod              string
+	IncludeCurrentUser      bool
+	ArchivedProjectHandling string
+	NewProjectVisibility    string
+
+	// If true, the projects with an empty repository are not listed
+	SkipEmptyProjects bool
+
+	// How long the content of the groups and the users is cached before being fetched again
+	// If zero, the content is cached until it's explicitly refreshed
+	RefreshInterval time.Duration
+
+	// Refresh interval of specific groups and their subgroups, by group id, overriding RefreshInterval
+	GroupRefreshIntervals map[int]time.Duration
+
+	// If true, the content of the subgroups of a group is fetched in the background once the content of the group is fetched
+	PrefetchSubgroups bool
+
+	// If true, the expired content of a group or a user is served while it's fetched again in the background
+	StaleWhileRevalidate bool
+
+	// Settings of specific groups and their subgroups, by group id, overriding the settings above
+	GroupParams map[int]GroupParam
+
+	// TLS configuration of the connections to the gitlab api. If nil, the default configuration is used
+	// Only applied when the client is created
+	TLSConfig *tls.Config
+
+	// Tokens used in order when gitlab rejects the token, eg: while it's rotated
+	FallbackTokens []string
+
+	// Refs the local copies of the projects matching a pattern are pinned to, instead of the default branch of the project
+	// The first pattern matching the project applies
+	PinnedRefs []PinnedRef
+
+	// Credentials of the clones over http of the projects of specific groups and their subgroups, by full path of the group
+	// They take precedence over the tokens, and are never used for the api requests
+	DeployTokens map[string]DeployToken
+
+	// Called when the content of a group or a user is fetched from gitlab, with the error if the fetch failed
+	OnGroupFetched func(group *Group, err error)
+	OnUserFetched  func(user *User, err error)
+}
+
+// GroupParam overrides the settings of the client for the projects of a group and its subgroups
+type GroupParam struct {
+	// If false, the subgroups of the group are not listed. Nil to inherit the setting
+	IncludeSubgroups *bool
+	// Empty to inherit the setting
+	ArchivedProjectHandling string
+	// Depth of the git history to pull, overriding the depth of the git client. Nil to inherit the setting
+	PullDepth *int
+	// Token authenticating the requests to gitlab and the clones over http, eg: a group access token. Empty to inherit the setting
+	// The fallback tokens of the client are not used with it
+	Token string
+}
+
+// PinnedRef pins the local copies of the projects whose full path matches Pattern, as matched by path.Match, to Ref
+type PinnedRef struct {
+	Pattern string
+	// Full ref of the branch or the tag, eg: refs/heads/stable or refs/tags/v1.0
+	Ref string
+}
+
+// DeployToken authenticates git over http, without access to the api
+type DeployToken struct {
+	Username string
+	Token    string
+}
+
+// archivedFilter returns the value of the "archived" filter to pass to the project listing apis
+func archivedFilter(archivedProjectHandling string) *bool {
+	if archivedProjectHandling == ArchivedProjectIgnore {
+		return gitlab.Bool(false)
+	}
+	return nil
 }
 
 type gitlabClient struct {
+	// Guards the configuration, which is swapped on reload
+	mux    sync.RWMutex
+	config *apiConfig
+
+	// Shared by the successive clients so the status survives a reload
+	transport *statusTransport
+
+	// Avatars downloaded so far, by avatar url
+	avatarMux sync.Mutex
+	avatars   map[string][]byte
+
+	// Content of the repositories browsed so far, see RepositoryBrowser
+	browseMux sync.Mutex
+	snapshots map[int]browseSnapshot
+	trees     *fifoCache[[]TreeEntry]
+	blobs     *fifoCache[[]byte]
+	blobSizes *fifoCache[int64]
+
+	// Fetches of the content of the groups in progress, by group id
+	fetchMux     sync.Mutex
+	groupFetches map[int]*groupFetch
+
+	// Full path of the groups fetched by id so far, by group id
+	pathsMux   sync.Mutex
+	groupPaths map[int]string
+}
+
+// apiConfig is the configuration of the client: its params, along with the api clients authenticated with its tokens
+// It's replaced as a whole on reload and never modified, so a request reads it once and doesn't hold the mutex of the
+// client while it waits on gitlab
+type apiConfig struct {
 	GitlabClientParam
+
 	client *gitlab.Client
+	tokens *tokenTransport
+	// Clients authenticated with the tokens of the groups, by token
+	groupClients map[string]*gitlab.Client
 }
 
 func NewClient(gitlabUrl string, gitlabToken string, p GitlabClientParam) (*gitlabClient, error) {
+	base := http.DefaultTransport
+	if p.TLSConfig != nil {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.TLSClientConfig = p.TLSConfig
+		base = t
+	}
+	transport := newStatusTransport(base)
+	client, tokens, err := newGitlabApiClient(gitlabUrl, gitlabToken, p.FallbackTokens, transport)
+	if err != nil {
+		return nil, err
+	}
+	groupClients, err := newGroupApiClients(gitlabUrl, p.GroupParams, transport)
+	if err != nil {
+		return nil, err
+	}
+
+	gitlabClient := &gitlabClient{
+		config: &apiConfig{
+			GitlabClientParam: p,
+			client:            client,
+			tokens:            tokens,
+			groupClients:      groupClients,
+		},
+		transport:    transport,
+		avatars:      map[string][]byte{},
+		snapshots:    map[int]browseSnapshot{},
+		trees:        newFifoCache(treeCacheSize, func(entries []TreeEntry) int { return len(entries) + 1 }),
+		blobs:        newFifoCache(blobCacheSize, func(content []byte) int { return len(content) }),
+		blobSizes:    newFifoCache(blobSizeCacheSize, func(int64) int { return 1 }),
+		groupFetches: map[int]*groupFetch{},
+		groupPaths:   map[int]string{},
+	}
+	return gitlabClient, nil
+}
+
+func newGitlabApiClient(gitlabUrl string, gitlabToken string, fallbackTokens []string, transport http.RoundTripper) (*gitlab.Client, *tokenTransport, error) {
+	var tokens []string
+	for _, token := range append([]string{gitlabToken}, fallbackTokens...) {
+		if token != "" {
+			tokens = append(tokens, token)
+		}
+	}
+	// The requests are authenticated by the token transport
+	tokenTransport := newTokenTransport(transport, tokens)
 	client, err := gitlab.NewClient(
-		gitlabToken,
+		"",
 		gitlab.WithBaseURL(gitlabUrl),
+		gitlab.WithHTTPClient(&http.Client{Transport: tokenTransport}),
 	)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create gitlab client: %v", err)
+		return nil, nil, fmt.Errorf("failed to create gitlab client: %v", err)
+	}
+	return client, tokenTransport, nil
+}
+
+// newGroupApiClients returns a client for each token of the groups, by token
+func newGroupApiClients(gitlabUrl string, groupParams map[int]GroupParam, transport http.RoundTripper) (map[string]*gitlab.Client, error) {
+	clients := map[string]*gitlab.Client{}
+	for _, param := range groupParams {
+		if param.Token == "" || clients[param.Token] != nil {
+			continue
+		}
+		client, _, err := newGitlabApiClient(gitlabUrl, param.Token, nil, transport)
+		if err != nil {
+			return nil, err
+		}
+		clients[param.Token] = client
 	}
+	return clients, nil
+}
 
-	gitlabClient := &gitlabClient{
+// current returns the configuration in effect
+func (c *gitlabClient) current() *apiConfig {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+
+	return c.config
+}
+
+// groupClient returns the client authenticated with the token of param, or the client of the default token if it has none
+func (c *apiConfig) groupClient(param GroupParam) *gitlab.Client {
+	if client, ok := c.groupClients[param.Token]; ok {
+		return client
+	}
+	return c.client
+}
+
+// Reconfigure replaces the token and the params of the client
+// Requests in progress are completed with the previous configuration
+// The callbacks cannot be reconfigured, the current ones are kept
+func (c *gitlabClient) Reconfigure(gitlabUrl string, gitlabToken string, p GitlabClientParam) error {
+	client, tokens, err := newGitlabApiClient(gitlabUrl, gitlabToken, p.FallbackTokens, c.transport)
+	if err != nil {
+		return err
+	}
+	groupClients, err := newGroupApiClients(gitlabUrl, p.GroupParams, c.transport)
+	if err != nil {
+		return err
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	p.OnGroupFetched = c.config.OnGroupFetched
+	p.OnUserFetched = c.config.OnUserFetched
+	c.config = &apiConfig{
 		GitlabClientParam: p,
 		client:            client,
+		tokens:            tokens,
+		groupClients:      groupClients,
 	}
-	return gitlabClient, nil
+	return nil
+}
+
+// StatusCode returns the http status gitlab answered the request that failed with err, or 0 if gitlab did not answer
+func StatusCode(err error) int {
+	var errResp *gitlab.ErrorResponse
+	if errors.As(err, &errResp) && errResp.Response != nil {
+		return errResp.Response.StatusCode
+	}
+	return 0
 }
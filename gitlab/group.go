@@ -1,15 +1,25 @@
 package gitlab
 
 import (
+	"context"
 	"fmt"
+	"path"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/badjware/gitlabfs/utils"
 	"github.com/xanzy/go-gitlab"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type GroupFetcher interface {
-	FetchGroup(gid int) (*Group, error)
-	FetchGroupContent(group *Group) (*GroupContent, error)
+	FetchGroup(ctx context.Context, gid int) (*Group, error)
+	FetchGroupContent(ctx context.Context, group *Group) (*GroupContent, error)
+	FetchGroupContentPages(ctx context.Context, group *Group, page func(groups []*Group, projects []*Project)) (*GroupContent, error)
+	FetchGroupProjects(ctx context.Context, group *Group) (map[string]*Project, error)
 }
 
 type GroupContent struct {
@@ -17,69 +27,623 @@ type GroupContent struct {
 	Projects map[string]*Project
 }
 
-type Group struct {
-	ID   int
-	Name string
+func newGroupContent() *GroupContent {
+	return &GroupContent{
+		Groups:   map[string]*Group{},
+		Projects: map[string]*Project{},
+	}
+}
 
+// add adds a page of subgroups and projects to the content
+func (c *GroupContent) add(groups []*Group, projects []*Project) {
+	for _, group := range groups {
+		c.Groups[group.Name] = group
+	}
+	for _, project := range projects {
+		c.Projects[project.Name] = project
+	}
+}
+
+// clone returns a copy of the content, to be modified without affecting the readers of the content
+func (c *GroupContent) clone() *GroupContent {
+	content := &GroupContent{
+		Groups:   make(map[string]*Group, len(c.Groups)),
+		Projects: make(map[string]*Project, len(c.Projects)),
+	}
+	for name, group := range c.Groups {
+		content.Groups[name] = group
+	}
+	for name, project := range c.Projects {
+		content.Projects[name] = project
+	}
+	return content
+}
+
+// groupFetch is a fetch of the content of a group from gitlab in progress, shared by the callers waiting on it
+type groupFetch struct {
+	// Guards the content fetched so far
 	mux     sync.Mutex
 	content *GroupContent
+	// Called with each page fetched, for the callers listing the content as it's fetched
+	pages []func(groups []*Group, projects []*Project)
+
+	// Set once done is closed
+	err            error
+	fetchedAt      time.Time
+	lastActivityAt time.Time
+	done           chan struct{}
+}
+
+// GroupCounts is the number of subgroups and projects in a group
+type GroupCounts struct {
+	Subgroups int
+	Projects  int
+}
+
+type Group struct {
+	ID          int
+	Name        string
+	FullPath    string
+	Description string
+	Visibility  string
+	AvatarURL   string
+	CreatedAt   time.Time
+
+	// Ids of the parent groups the group was found in, from the root
+	// Shared with the other subgroups of its parent, it's never modified
+	ancestorIDs []int
+
+	mux            sync.Mutex
+	content        *GroupContent
+	fetchedAt      time.Time
+	lastActivityAt time.Time
+	// Set while the content is fetched from gitlab
+	fetch *groupFetch
+	// Set while the expired content is fetched again in the background
+	revalidating bool
+
+	// Guarded separately so the counts can be read while the content is being fetched
+	countsMux sync.Mutex
+	counts    *GroupCounts
+
+	// Projects of the group and of its subgroups, when they are listed in a single pass
+	projectsMux       sync.Mutex
+	projects          map[string]*Project
+	projectsFetchedAt time.Time
 }
 
 func NewGroupFromGitlabGroup(group *gitlab.Group) Group {
 	// https://godoc.org/github.com/xanzy/go-gitlab#Group
+	var createdAt time.Time
+	if group.CreatedAt != nil {
+		createdAt = *group.CreatedAt
+	}
 	return Group{
-		ID:   group.ID,
-		Name: group.Path,
+		ID:          group.ID,
+		Name:        group.Path,
+		FullPath:    group.FullPath,
+		Description: group.Description,
+		Visibility:  utils.Intern(string(group.Visibility)),
+		AvatarURL:   group.AvatarURL,
+		CreatedAt:   createdAt,
 	}
 }
 
-func (g *Group) InvalidateCache() {
+// LastActivityAt returns the most recent activity of the projects in the group.
+// Gitlab does not track activity on groups, so this is only known once the content
+// of the group has been fetched. Until then, the creation time of the group is returned.
+func (g *Group) LastActivityAt() time.Time {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	if g.lastActivityAt.IsZero() {
+		return g.CreatedAt
+	}
+	return g.lastActivityAt
+}
+
+// Counts returns the number of subgroups and projects in the group, if its content was fetched at least once
+func (g *Group) Counts() (GroupCounts, bool) {
+	g.countsMux.Lock()
+	defer g.countsMux.Unlock()
+
+	if g.counts == nil {
+		return GroupCounts{}, false
+	}
+	return *g.counts, true
+}
+
+// CachedContent returns the content of the group if it's cached, without fetching it
+func (g *Group) CachedContent() *GroupContent {
 	g.mux.Lock()
 	defer g.mux.Unlock()
 
+	return g.content
+}
+
+// FetchedEntry returns the subgroup or the project named name if the content of the group is being fetched and it was already fetched,
+// so listing the group doesn't have to wait for the whole content to look up its entries
+func (g *Group) FetchedEntry(name string) (*Group, *Project) {
+	g.mux.Lock()
+	fetch := g.fetch
+	g.mux.Unlock()
+	if fetch == nil {
+		return nil, nil
+	}
+
+	fetch.mux.Lock()
+	defer fetch.mux.Unlock()
+
+	if fetch.content == nil {
+		return nil, nil
+	}
+	return fetch.content.Groups[name], fetch.content.Projects[name]
+}
+
+// follow calls page with the content fetched so far, sorted by name, then with each page fetched until the fetch is done
+func (f *groupFetch) follow(page func(groups []*Group, projects []*Project)) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if f.content == nil {
+		return
+	}
+	groups := make([]*Group, 0, len(f.content.Groups))
+	for _, group := range f.content.Groups {
+		groups = append(groups, group)
+	}
+	projects := make([]*Project, 0, len(f.content.Projects))
+	for _, project := range f.content.Projects {
+		projects = append(projects, project)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+	sort.Slice(projects, func(i, j int) bool { return projects[i].Name < projects[j].Name })
+	if len(groups) > 0 || len(projects) > 0 {
+		page(groups, projects)
+	}
+	f.pages = append(f.pages, page)
+}
+
+func (g *Group) InvalidateCache() {
+	g.mux.Lock()
 	g.content = nil
+	g.mux.Unlock()
+
+	g.projectsMux.Lock()
+	g.projects = nil
+	g.projectsMux.Unlock()
+}
+
+// groupRefreshInterval returns how long the content of group is cached before being fetched again
+// A group without its own interval inherits the interval of its closest parent that has one
+func (c *apiConfig) groupRefreshInterval(group *Group) time.Duration {
+	if interval, ok := c.GroupRefreshIntervals[group.ID]; ok {
+		return interval
+	}
+	for i := len(group.ancestorIDs) - 1; i >= 0; i-- {
+		if interval, ok := c.GroupRefreshIntervals[group.ancestorIDs[i]]; ok {
+			return interval
+		}
+	}
+	return c.RefreshInterval
+}
+
+// defaultGroupParam returns the settings of the client that can be overridden by a group
+func (c *apiConfig) defaultGroupParam() GroupParam {
+	return GroupParam{ArchivedProjectHandling: c.ArchivedProjectHandling}
+}
+
+// groupParam returns the settings applying to the projects of group
+// Each setting the group does not override is inherited from its closest parent that does
+func (c *apiConfig) groupParam(group *Group) GroupParam {
+	param := c.defaultGroupParam()
+	// From the root, so the closest override is applied last
+	for _, gid := range append(append([]int{}, group.ancestorIDs...), group.ID) {
+		p, ok := c.GroupParams[gid]
+		if !ok {
+			continue
+		}
+		if p.IncludeSubgroups != nil {
+			param.IncludeSubgroups = p.IncludeSubgroups
+		}
+		if p.ArchivedProjectHandling != "" {
+			param.ArchivedProjectHandling = p.ArchivedProjectHandling
+		}
+		if p.PullDepth != nil {
+			param.PullDepth = p.PullDepth
+		}
+		if p.Token != "" {
+			param.Token = p.Token
+		}
+	}
+	return param
+}
+
+// cacheExpired returns whether content fetched at fetchedAt is older than interval
+// An interval of 0 never expires
+func cacheExpired(fetchedAt time.Time, interval time.Duration) bool {
+	return interval > 0 && time.Since(fetchedAt) >= interval
 }
 
-func (c *gitlabClient) FetchGroup(gid int) (*Group, error) {
-	gitlabGroup, _, err := c.client.Groups.GetGroup(gid)
+func (c *gitlabClient) FetchGroup(ctx context.Context, gid int) (*Group, error) {
+	ctx, span := tracer.Start(ctx, "gitlab.FetchGroup", trace.WithAttributes(attribute.Int("gitlab.group.id", gid)))
+	defer span.End()
+
+	cfg := c.current()
+	// Only the root groups are fetched by id, their ancestors don't matter
+	gitlabGroup, _, err := cfg.groupClient(cfg.GroupParams[gid]).Groups.GetGroup(gid, gitlab.WithContext(ctx))
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch group with id %v: %v", gid, err)
+		return nil, fmt.Errorf("failed to fetch group with id %v: %w", gid, err)
 	}
 	group := NewGroupFromGitlabGroup(gitlabGroup)
+
+	c.pathsMux.Lock()
+	c.groupPaths[group.ID] = group.FullPath
+	c.pathsMux.Unlock()
 	return &group, nil
 }
 
-func (c *gitlabClient) FetchGroupContent(group *Group) (*GroupContent, error) {
+func (c *gitlabClient) FetchGroupContent(ctx context.Context, group *Group) (*GroupContent, error) {
+	return c.fetchGroupContent(ctx, group, c.current().PrefetchSubgroups, nil)
+}
+
+// FetchGroupContentPages returns the content of the group like FetchGroupContent
+// If the content is fetched from gitlab, by this call or by another one in progress, page is called with each page of subgroups and
+// projects as soon as it's fetched, the pages fetched before this call first, otherwise it's not called at all
+func (c *gitlabClient) FetchGroupContentPages(ctx context.Context, group *Group, page func(groups []*Group, projects []*Project)) (*GroupContent, error) {
+	return c.fetchGroupContent(ctx, group, c.current().PrefetchSubgroups, page)
+}
+
+// FetchGroupProjects returns the projects of the group and of its subgroups, by their path relative to the group, eg: subgroup/project
+// When no subgroup can have its own settings, the projects are listed in a single pass instead of listing each subgroup
+func (c *gitlabClient) FetchGroupProjects(ctx context.Context, group *Group) (map[string]*Project, error) {
+	ctx, span := tracer.Start(ctx, "gitlab.FetchGroupProjects", trace.WithAttributes(attribute.Int("gitlab.group.id", group.ID)))
+	defer span.End()
+
+	cfg := c.current()
+	if !c.flattenable(cfg, group) {
+		projects := map[string]*Project{}
+		err := c.walkGroupProjects(ctx, group, "", projects)
+		return projects, err
+	}
+
+	group.projectsMux.Lock()
+	defer group.projectsMux.Unlock()
+
+	// Get cached data if available
+	if group.projects != nil && !cacheExpired(group.projectsFetchedAt, cfg.groupRefreshInterval(group)) {
+		span.SetAttributes(attribute.Bool("gitlab.cached", true))
+		return group.projects, nil
+	}
+	fetchedAt := time.Now()
+	projects, err := c.listGroupProjects(ctx, cfg, group)
+	if err != nil {
+		return nil, err
+	}
+	group.projects = projects
+	group.projectsFetchedAt = fetchedAt
+	return projects, nil
+}
+
+// flattenable returns whether the projects of the group and of its subgroups can be listed in a single pass
+// It's not the case when one of the subgroups may have its own settings in cfg, eg: when it's also a root group with its own settings
+func (c *gitlabClient) flattenable(cfg *apiConfig, group *Group) bool {
+	// The path of the projects is found from the path of the group
+	if group.FullPath == "" {
+		return false
+	}
+	param := cfg.groupParam(group)
+	if param.IncludeSubgroups != nil && !*param.IncludeSubgroups {
+		return false
+	}
+	parents := map[int]bool{group.ID: true}
+	for _, gid := range group.ancestorIDs {
+		parents[gid] = true
+	}
+
+	c.pathsMux.Lock()
+	defer c.pathsMux.Unlock()
+
+	for gid := range cfg.GroupParams {
+		if parents[gid] {
+			continue
+		}
+		fullPath, ok := c.groupPaths[gid]
+		if !ok || strings.HasPrefix(fullPath, group.FullPath+"/") {
+			return false
+		}
+	}
+	return true
+}
+
+// walkGroupProjects adds the projects of the group and of its subgroups to projects, listing the content of each subgroup
+// The subgroups which cannot be listed are skipped
+func (c *gitlabClient) walkGroupProjects(ctx context.Context, group *Group, groupPath string, projects map[string]*Project) error {
+	content, err := c.FetchGroupContent(ctx, group)
+	if err != nil {
+		return err
+	}
+	for name, project := range content.Projects {
+		projects[path.Join(groupPath, name)] = project
+	}
+	for name, subgroup := range content.Groups {
+		c.walkGroupProjects(ctx, subgroup, path.Join(groupPath, name), projects)
+	}
+	return nil
+}
+
+// listGroupProjects fetches the projects of the group and of its subgroups from gitlab in a single pass
+// The subgroup of each project is found from its namespace
+func (c *gitlabClient) listGroupProjects(ctx context.Context, cfg *apiConfig, group *Group) (map[string]*Project, error) {
+	param := cfg.groupParam(group)
+	client := cfg.groupClient(param)
+	projects := map[string]*Project{}
+	listProjectOpt := &gitlab.ListGroupProjectsOptions{
+		ListOptions: gitlab.ListOptions{
+			Page:    1,
+			PerPage: 100,
+		},
+		Archived:         archivedFilter(param.ArchivedProjectHandling),
+		IncludeSubgroups: gitlab.Bool(true),
+	}
+	for {
+		gitlabProjects, response, err := client.Groups.ListGroupProjects(group.ID, listProjectOpt, gitlab.WithContext(ctx))
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch projects in gitlab: %v", err)
+		}
+		for _, gitlabProject := range gitlabProjects {
+			if !cfg.isListed(gitlabProject) {
+				continue
+			}
+			project := cfg.newProjectFromGitlabProject(gitlabProject, param)
+			name := project.Name
+			// The projects shared with the group from outside of it are found in the group itself
+			if gitlabProject.Namespace != nil && strings.HasPrefix(gitlabProject.Namespace.FullPath, group.FullPath+"/") {
+				name = path.Join(strings.TrimPrefix(gitlabProject.Namespace.FullPath, group.FullPath+"/"), name)
+			}
+			projects[name] = &project
+		}
+		if response.CurrentPage >= response.TotalPages {
+			break
+		}
+		// Get the next page
+		listProjectOpt.Page = response.NextPage
+	}
+	return projects, nil
+}
+
+// prefetchGroupContents fetches the content of the groups one at a time, without prefetching their own subgroups
+func (c *gitlabClient) prefetchGroupContents(ctx context.Context, groups map[string]*Group) {
+	ctx, span := tracer.Start(ctx, "gitlab.PrefetchGroupContents", trace.WithAttributes(attribute.Int("gitlab.group.count", len(groups))))
+	defer span.End()
+
+	for _, group := range groups {
+		if _, err := c.fetchGroupContent(ctx, group, false, nil); err != nil {
+			logger.Warn("failed to prefetch group content", "group", group.ID, "error", err)
+		}
+	}
+}
+
+// fetchGroupContent returns the content of the group
+// If prefetch is true and the content is fetched from gitlab, the content of the subgroups is also fetched in the background
+// If page is not nil and the content is fetched from gitlab, it's called with each page fetched
+func (c *gitlabClient) fetchGroupContent(ctx context.Context, group *Group, prefetch bool, page func(groups []*Group, projects []*Project)) (*GroupContent, error) {
+	ctx, span := tracer.Start(ctx, "gitlab.FetchGroupContent", trace.WithAttributes(attribute.Int("gitlab.group.id", group.ID)))
+	defer span.End()
+
+	cfg := c.current()
 	group.mux.Lock()
-	defer group.mux.Unlock()
 
 	// Get cached data if available
-	if group.content != nil {
-		return group.content, nil
+	if group.content != nil && !cacheExpired(group.fetchedAt, cfg.groupRefreshInterval(group)) {
+		span.SetAttributes(attribute.Bool("gitlab.cached", true))
+		content := group.content
+		group.mux.Unlock()
+		return content, nil
 	}
+	// The content is shared with the other callers waiting on the group, don't abort the fetch if the caller is interrupted
+	ctx = context.WithoutCancel(ctx)
 
-	content := &GroupContent{
-		Groups:   map[string]*Group{},
-		Projects: map[string]*Project{},
+	// Serve the expired content while it's fetched again in the background
+	if group.content != nil && cfg.StaleWhileRevalidate {
+		span.SetAttributes(attribute.Bool("gitlab.cached", true), attribute.Bool("gitlab.stale", true))
+		if !group.revalidating {
+			group.revalidating = true
+			go c.revalidateGroupContent(ctx, group, prefetch)
+		}
+		content := group.content
+		group.mux.Unlock()
+		return content, nil
+	}
+
+	// Wait on the fetch of another caller
+	if fetch := group.fetch; fetch != nil {
+		group.mux.Unlock()
+		if page != nil {
+			fetch.follow(page)
+		}
+		<-fetch.done
+		return fetch.content, fetch.err
+	}
+	// The same group may be found in several places, eg: as a root group and as a subgroup, they share the fetch
+	fetch, shared := c.startGroupFetch(group.ID)
+	group.fetch = fetch
+	group.mux.Unlock()
+	if shared {
+		if page != nil {
+			fetch.follow(page)
+		}
+		<-fetch.done
+		group.mux.Lock()
+		group.fetch = nil
+		if fetch.err == nil {
+			group.setContent(fetch.content, fetch.fetchedAt, fetch.lastActivityAt)
+		}
+		group.mux.Unlock()
+		return fetch.content, fetch.err
+	}
+
+	// The entries are visible to FetchedEntry as soon as their page is fetched
+	fetch.fetchedAt = time.Now()
+	if page != nil {
+		fetch.follow(page)
 	}
+	lastActivityAt, err := c.listGroupContent(ctx, cfg, group, func(groups []*Group, projects []*Project) {
+		fetch.mux.Lock()
+		defer fetch.mux.Unlock()
+		fetch.content.add(groups, projects)
+		for _, page := range fetch.pages {
+			page(groups, projects)
+		}
+	})
 
-	// List subgroups in path
+	fetch.mux.Lock()
+	if err != nil {
+		fetch.content = nil
+		fetch.err = err
+	}
+	fetch.lastActivityAt = lastActivityAt
+	fetch.pages = nil
+	fetch.mux.Unlock()
+
+	group.mux.Lock()
+	group.fetch = nil
+	if err == nil {
+		group.setContent(fetch.content, fetch.fetchedAt, lastActivityAt)
+	}
+	group.mux.Unlock()
+	c.endGroupFetch(group.ID)
+	close(fetch.done)
+	if cfg.OnGroupFetched != nil {
+		cfg.OnGroupFetched(group, err)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	if prefetch {
+		go c.prefetchGroupContents(ctx, fetch.content.Groups)
+	}
+	return fetch.content, nil
+}
+
+// startGroupFetch returns the fetch of the content of the group with the id, and whether it was already started by another caller
+// If it was not, the caller must fetch the content and call endGroupFetch
+func (c *gitlabClient) startGroupFetch(gid int) (*groupFetch, bool) {
+	c.fetchMux.Lock()
+	defer c.fetchMux.Unlock()
+
+	if fetch, ok := c.groupFetches[gid]; ok {
+		return fetch, true
+	}
+	fetch := &groupFetch{
+		content: newGroupContent(),
+		done:    make(chan struct{}),
+	}
+	c.groupFetches[gid] = fetch
+	return fetch, false
+}
+
+func (c *gitlabClient) endGroupFetch(gid int) {
+	c.fetchMux.Lock()
+	defer c.fetchMux.Unlock()
+
+	delete(c.groupFetches, gid)
+}
+
+// revalidateGroupContent fetches the expired content of the group again, while the callers are served the expired content
+// If the fetch fails, the expired content is kept and the fetch is attempted again on the next access
+func (c *gitlabClient) revalidateGroupContent(ctx context.Context, group *Group, prefetch bool) {
+	ctx, span := tracer.Start(ctx, "gitlab.RevalidateGroupContent", trace.WithAttributes(attribute.Int("gitlab.group.id", group.ID)))
+	defer span.End()
+
+	cfg := c.current()
+	fetchedAt := time.Now()
+	content := newGroupContent()
+	lastActivityAt, err := c.listGroupContent(ctx, cfg, group, content.add)
+
+	group.mux.Lock()
+	defer group.mux.Unlock()
+
+	group.revalidating = false
+	if cfg.OnGroupFetched != nil {
+		cfg.OnGroupFetched(group, err)
+	}
+	if err != nil {
+		logger.Warn("failed to refresh the content of the group, serving the expired content", "group", group.ID, "error", err)
+		return
+	}
+	group.setContent(content, fetchedAt, lastActivityAt)
+
+	if prefetch {
+		go c.prefetchGroupContents(ctx, content.Groups)
+	}
+}
+
+// updateCachedContent applies update to a copy of the cached content of the group, if any, and caches the copy in its place
+// The cached content is read without holding the mutex of the group, eg: by the listings, so it's never modified once cached
+func (g *Group) updateCachedContent(update func(content *GroupContent)) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	if g.content == nil {
+		return
+	}
+	content := g.content.clone()
+	update(content)
+	g.setContent(content, g.fetchedAt, g.lastActivityAt)
+}
+
+// setContent caches the content of the group, fetched at fetchedAt
+// The mutex of the group must be held
+func (g *Group) setContent(content *GroupContent, fetchedAt time.Time, lastActivityAt time.Time) {
+	g.content = content
+	g.fetchedAt = fetchedAt
+	if lastActivityAt.After(g.lastActivityAt) {
+		g.lastActivityAt = lastActivityAt
+	}
+
+	g.countsMux.Lock()
+	g.counts = &GroupCounts{
+		Subgroups: len(content.Groups),
+		Projects:  len(content.Projects),
+	}
+	g.countsMux.Unlock()
+}
+
+// listGroupContent fetches the subgroups and the projects of the group from gitlab, and returns the most recent activity of its projects
+// page is called with each page as soon as it's fetched, so the pages returned by gitlab are not held in memory until the end of the listing
+// The subgroups and the projects are listed by path, with the configuration cfg
+func (c *gitlabClient) listGroupContent(ctx context.Context, cfg *apiConfig, group *Group, page func(groups []*Group, projects []*Project)) (time.Time, error) {
+	var lastActivityAt time.Time
+	param := cfg.groupParam(group)
+	client := cfg.groupClient(param)
+	includeSubgroups := param.IncludeSubgroups == nil || *param.IncludeSubgroups
+
+	// List subgroups in path, unless the group excludes them
 	ListGroupsOpt := &gitlab.ListSubgroupsOptions{
 		ListOptions: gitlab.ListOptions{
 			Page:    1,
 			PerPage: 100,
 		},
 		AllAvailable: gitlab.Bool(true),
+		OrderBy:      gitlab.String("path"),
+		Sort:         gitlab.String("asc"),
 	}
-	for {
-		gitlabGroups, response, err := c.client.Groups.ListSubgroups(group.ID, ListGroupsOpt)
+	// The subgroups share the ids of their parents
+	ancestorIDs := append(append([]int{}, group.ancestorIDs...), group.ID)
+	for includeSubgroups {
+		gitlabGroups, response, err := client.Groups.ListSubgroups(group.ID, ListGroupsOpt, gitlab.WithContext(ctx))
 		if err != nil {
-			return nil, fmt.Errorf("failed to fetch groups in gitlab: %v", err)
+			return lastActivityAt, fmt.Errorf("failed to fetch groups in gitlab: %v", err)
 		}
+		subgroups := make([]*Group, 0, len(gitlabGroups))
 		for _, gitlabGroup := range gitlabGroups {
-			group := NewGroupFromGitlabGroup(gitlabGroup)
-			content.Groups[group.Name] = &group
+			subgroup := NewGroupFromGitlabGroup(gitlabGroup)
+			subgroup.ancestorIDs = ancestorIDs
+			subgroups = append(subgroups, &subgroup)
 		}
+		page(subgroups, nil)
 		if response.CurrentPage >= response.TotalPages {
 			break
 		}
@@ -92,23 +656,33 @@ func (c *gitlabClient) FetchGroupContent(group *Group) (*GroupContent, error) {
 		ListOptions: gitlab.ListOptions{
 			Page:    1,
 			PerPage: 100,
-		}}
+		},
+		Archived: archivedFilter(param.ArchivedProjectHandling),
+		OrderBy:  gitlab.String("path"),
+		Sort:     gitlab.String("asc"),
+	}
 	for {
-		gitlabProjects, response, err := c.client.Groups.ListGroupProjects(group.ID, listProjectOpt)
+		gitlabProjects, response, err := client.Groups.ListGroupProjects(group.ID, listProjectOpt, gitlab.WithContext(ctx))
 		if err != nil {
-			return nil, fmt.Errorf("failed to fetch projects in gitlab: %v", err)
+			return lastActivityAt, fmt.Errorf("failed to fetch projects in gitlab: %v", err)
 		}
+		projects := make([]*Project, 0, len(gitlabProjects))
 		for _, gitlabProject := range gitlabProjects {
-			project := c.newProjectFromGitlabProject(gitlabProject)
-			content.Projects[project.Name] = &project
+			if !cfg.isListed(gitlabProject) {
+				continue
+			}
+			project := cfg.newProjectFromGitlabProject(gitlabProject, param)
+			projects = append(projects, &project)
+			if project.LastActivityAt.After(lastActivityAt) {
+				lastActivityAt = project.LastActivityAt
+			}
 		}
+		page(nil, projects)
 		if response.CurrentPage >= response.TotalPages {
 			break
 		}
 		// Get the next page
 		listProjectOpt.Page = response.NextPage
 	}
-
-	group.content = content
-	return content, nil
+	return lastActivityAt, nil
 }
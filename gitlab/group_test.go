@@ -0,0 +1,71 @@
+package gitlab
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// pageNames returns the names of the subgroups and the projects of each page passed to the returned func
+func pageNames() (*[][]string, func(groups []*Group, projects []*Project)) {
+	pages := [][]string{}
+	return &pages, func(groups []*Group, projects []*Project) {
+		names := []string{}
+		for _, group := range groups {
+			names = append(names, group.Name)
+		}
+		for _, project := range projects {
+			names = append(names, project.Name)
+		}
+		pages = append(pages, names)
+	}
+}
+
+func TestGroupFetchFollow(t *testing.T) {
+	fetch := &groupFetch{content: newGroupContent()}
+	fetch.content.add([]*Group{{Name: "b"}, {Name: "a"}}, []*Project{{Name: "p"}})
+
+	// The pages fetched so far are passed at once, then the next pages as they are fetched
+	followed, follow := pageNames()
+	fetch.follow(follow)
+	for _, page := range fetch.pages {
+		page(nil, []*Project{{Name: "q"}})
+	}
+	if expected := [][]string{{"a", "b", "p"}, {"q"}}; !reflect.DeepEqual(*followed, expected) {
+		t.Errorf("expected the pages %v, got %v", expected, *followed)
+	}
+
+	// A failed fetch has no content to follow
+	failed := &groupFetch{}
+	followed, follow = pageNames()
+	failed.follow(follow)
+	if len(*followed) != 0 || len(failed.pages) != 0 {
+		t.Errorf("expected the failed fetch not to be followed, got %v", *followed)
+	}
+}
+
+func TestUpdateCachedContent(t *testing.T) {
+	group := &Group{}
+	group.updateCachedContent(func(content *GroupContent) {
+		t.Errorf("expected a group without content not to be updated")
+	})
+
+	cached := newGroupContent()
+	cached.add([]*Group{{Name: "a"}}, []*Project{{Name: "p"}})
+	group.setContent(cached, time.Now(), time.Time{})
+	group.updateCachedContent(func(content *GroupContent) {
+		content.Projects["q"] = &Project{Name: "q"}
+	})
+
+	// The content already read is left untouched
+	if _, ok := cached.Projects["q"]; ok || len(cached.Projects) != 1 {
+		t.Errorf("expected the previous content to be left untouched, got %v", cached.Projects)
+	}
+	content := group.CachedContent()
+	if _, ok := content.Projects["q"]; !ok || content.Groups["a"] == nil || content.Projects["p"] == nil {
+		t.Errorf("expected the content to be updated, got %+v", content)
+	}
+	if counts, _ := group.Counts(); counts.Projects != 2 {
+		t.Errorf("expected the counts to be updated, got %+v", counts)
+	}
+}
@@ -1,30 +1,260 @@
 package gitlab
 
 import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/badjware/gitlabfs/utils"
 	"github.com/xanzy/go-gitlab"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+type ProjectFetcher interface {
+	FetchProject(ctx context.Context, pid int) (*Project, error)
+	FetchProjectByPath(ctx context.Context, projectPath string) (*Project, error)
+}
+
+type ProjectCreator interface {
+	CreateGroupProject(ctx context.Context, group *Group, name string) (*Project, error)
+	MoveGroupProject(ctx context.Context, project *Project, srcGroup *Group, dstGroup *Group, name string) (*Project, error)
+}
+
 type Project struct {
-	ID            int
-	Name          string
-	CloneURL      string
-	DefaultBranch string
+	ID             int
+	Name           string
+	DefaultBranch  string
+	Archived       bool
+	AvatarURL      string
+	CreatedAt      time.Time
+	LastActivityAt time.Time
+
+	// Url the project is cloned from, over http it carries the credentials of the clone
+	// The git client passes them to each git command, they are never written in the remote of the local copy
+	CloneURL string
+
+	// Depth of the git history to pull, or -1 to use the depth of the git client
+	PullDepth int
+
+	// Id of the project this project is a fork of, or zero if it's not a fork
+	ForkedFromID int
+
+	// Token of the group the project was fetched with, for the requests on its repository. Empty for the token of the client
+	token string
+}
+
+// isListed returns whether the project is listed in its group or user
+// The projects with the repository feature disabled, eg: issues-only projects, have nothing to clone
+func (c *apiConfig) isListed(project *gitlab.Project) bool {
+	if project.RepositoryAccessLevel == gitlab.DisabledAccessControl {
+		return false
+	}
+	return !c.SkipEmptyProjects || !project.EmptyRepo
 }
 
-func (c *gitlabClient) newProjectFromGitlabProject(project *gitlab.Project) Project {
+// newProjectFromGitlabProject returns the project with the settings of param applied
+func (c *apiConfig) newProjectFromGitlabProject(project *gitlab.Project, param GroupParam) Project {
 	// https://godoc.org/github.com/xanzy/go-gitlab#Project
 	p := Project{
 		ID:            project.ID,
 		Name:          project.Path,
-		DefaultBranch: project.DefaultBranch,
+		DefaultBranch: utils.Intern(project.DefaultBranch),
+		Archived:      project.Archived,
+		AvatarURL:     project.AvatarURL,
+		PullDepth:     -1,
+		token:         param.Token,
+	}
+	if p.Archived && param.ArchivedProjectHandling == ArchivedProjectHide {
+		// Prefix the name with a "." so the project is hidden from a normal `ls`
+		p.Name = "." + p.Name
+	}
+	if param.PullDepth != nil {
+		p.PullDepth = *param.PullDepth
+	}
+	if project.ForkedFromProject != nil {
+		p.ForkedFromID = project.ForkedFromProject.ID
+	}
+	if project.CreatedAt != nil {
+		p.CreatedAt = *project.CreatedAt
+	}
+	if project.LastActivityAt != nil {
+		p.LastActivityAt = *project.LastActivityAt
 	}
 	if p.DefaultBranch == "" {
 		p.DefaultBranch = "master"
 	}
+	if ref := c.pinnedRef(project); ref != "" {
+		// The git client follows the ref instead of the default branch
+		p.DefaultBranch = ref
+	}
 	if c.PullMethod == PullMethodSSH {
 		p.CloneURL = project.SSHURLToRepo
 	} else {
-		p.CloneURL = project.HTTPURLToRepo
+		p.CloneURL = withCredentials(project.HTTPURLToRepo, c.cloneCredentials(project.PathWithNamespace, param))
 	}
 	return p
 }
+
+// pinnedRef returns the ref the local copy of the project is pinned to, or an empty string if it's not pinned
+func (c *apiConfig) pinnedRef(project *gitlab.Project) string {
+	if project.EmptyRepo {
+		// There is no ref to checkout yet
+		return ""
+	}
+	for _, pin := range c.PinnedRefs {
+		if ok, _ := path.Match(pin.Pattern, project.PathWithNamespace); ok {
+			return utils.Intern(pin.Ref)
+		}
+	}
+	return ""
+}
+
+// cloneCredentials returns the credentials of the clones over http of the project at projectPath, or nil if they are not authenticated
+// The deploy token of the closest group of the project is used, or else the token of param
+func (c *apiConfig) cloneCredentials(projectPath string, param GroupParam) *url.Userinfo {
+	for groupPath := path.Dir(projectPath); groupPath != "." && groupPath != "/"; groupPath = path.Dir(groupPath) {
+		if deployToken, ok := c.DeployTokens[groupPath]; ok {
+			return url.UserPassword(deployToken.Username, deployToken.Token)
+		}
+	}
+	if param.Token != "" {
+		// Gitlab accepts any username along with an access token
+		return url.UserPassword("oauth2", param.Token)
+	}
+	return nil
+}
+
+// FetchProject returns the project with the id, with the settings of the client applied
+// The settings of the group of the project are not, its group is not known
+// If the project is not visible with the token of the client, the tokens of the groups are tried
+func (c *gitlabClient) FetchProject(ctx context.Context, pid int) (*Project, error) {
+	ctx, span := tracer.Start(ctx, "gitlab.FetchProject", trace.WithAttributes(attribute.Int("gitlab.project.id", pid)))
+	defer span.End()
+
+	project, err := c.fetchProject(ctx, pid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch project with id %v: %w", pid, err)
+	}
+	return project, nil
+}
+
+// FetchProjectByPath returns the project at its full path, eg: gitlab-org/gitlab, like FetchProject
+func (c *gitlabClient) FetchProjectByPath(ctx context.Context, projectPath string) (*Project, error) {
+	ctx, span := tracer.Start(ctx, "gitlab.FetchProjectByPath", trace.WithAttributes(attribute.String("gitlab.project.path", projectPath)))
+	defer span.End()
+
+	project, err := c.fetchProject(ctx, projectPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch project %v: %w", projectPath, err)
+	}
+	return project, nil
+}
+
+// fetchProject returns the project with pid, either its id or its full path
+func (c *gitlabClient) fetchProject(ctx context.Context, pid interface{}) (*Project, error) {
+	cfg := c.current()
+	param := cfg.defaultGroupParam()
+	gitlabProject, _, err := cfg.client.Projects.GetProject(pid, &gitlab.GetProjectOptions{}, gitlab.WithContext(ctx))
+	for token, client := range cfg.groupClients {
+		if code := StatusCode(err); code != http.StatusNotFound && code != http.StatusForbidden {
+			break
+		}
+		gitlabProject, _, err = client.Projects.GetProject(pid, &gitlab.GetProjectOptions{}, gitlab.WithContext(ctx))
+		param.Token = token
+	}
+	if err != nil {
+		return nil, err
+	}
+	project := cfg.newProjectFromGitlabProject(gitlabProject, param)
+	return &project, nil
+}
+
+// withCredentials returns the http clone url authenticated with user, or the url itself if user is nil
+// The url is only passed to the git client, which strips the credentials from the remote of the local copy
+func withCredentials(cloneURL string, user *url.Userinfo) string {
+	if user == nil {
+		return cloneURL
+	}
+	u, err := url.Parse(cloneURL)
+	if err != nil {
+		return cloneURL
+	}
+	u.User = user
+	return u.String()
+}
+
+func (c *gitlabClient) CreateGroupProject(ctx context.Context, group *Group, name string) (*Project, error) {
+	ctx, span := tracer.Start(ctx, "gitlab.CreateGroupProject", trace.WithAttributes(attribute.Int("gitlab.group.id", group.ID)))
+	defer span.End()
+
+	cfg := c.current()
+	gitlabProject, _, err := cfg.groupClient(cfg.groupParam(group)).Projects.CreateProject(&gitlab.CreateProjectOptions{
+		Name:        gitlab.String(name),
+		Path:        gitlab.String(name),
+		NamespaceID: gitlab.Int(group.ID),
+		Visibility:  gitlab.Visibility(gitlab.VisibilityValue(cfg.NewProjectVisibility)),
+	}, gitlab.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create project %v in group %v: %v", name, group.ID, err)
+	}
+	project := cfg.newProjectFromGitlabProject(gitlabProject, cfg.groupParam(group))
+
+	// Add the project to the cached content of the group, if any
+	group.updateCachedContent(func(content *GroupContent) {
+		content.Projects[project.Name] = &project
+	})
+
+	return &project, nil
+}
+
+// MoveGroupProject transfers the project from srcGroup to dstGroup, then renames it to name, and returns the moved project
+// The project passed is left untouched, it may still be read by the listings of the source group
+func (c *gitlabClient) MoveGroupProject(ctx context.Context, project *Project, srcGroup *Group, dstGroup *Group, name string) (*Project, error) {
+	ctx, span := tracer.Start(ctx, "gitlab.MoveGroupProject", trace.WithAttributes(attribute.Int("gitlab.project.id", project.ID)))
+	defer span.End()
+
+	cfg := c.current()
+	oldName := project.Name
+	if project.Archived && cfg.groupParam(srcGroup).ArchivedProjectHandling == ArchivedProjectHide {
+		// Remove the "." we added to hide the project
+		name = strings.TrimPrefix(name, ".")
+	}
+
+	// The token of the source group must also be allowed to create projects in the destination group
+	client := cfg.groupClient(cfg.groupParam(srcGroup))
+	var gitlabProject *gitlab.Project
+	var err error
+	if srcGroup.ID != dstGroup.ID {
+		gitlabProject, _, err = client.Projects.TransferProject(project.ID, &gitlab.TransferProjectOptions{
+			Namespace: dstGroup.ID,
+		}, gitlab.WithContext(ctx))
+		if err != nil {
+			return nil, fmt.Errorf("failed to transfer project %v to group %v: %v", project.ID, dstGroup.ID, err)
+		}
+	}
+	if gitlabProject == nil || gitlabProject.Path != name {
+		gitlabProject, _, err = client.Projects.EditProject(project.ID, &gitlab.EditProjectOptions{
+			Name: gitlab.String(name),
+			Path: gitlab.String(name),
+		}, gitlab.WithContext(ctx))
+		if err != nil {
+			return nil, fmt.Errorf("failed to rename project %v to %v: %v", project.ID, name, err)
+		}
+	}
+
+	// Move the project in the cached content of the groups, if any
+	moved := cfg.newProjectFromGitlabProject(gitlabProject, cfg.groupParam(dstGroup))
+	srcGroup.updateCachedContent(func(content *GroupContent) {
+		delete(content.Projects, oldName)
+	})
+	dstGroup.updateCachedContent(func(content *GroupContent) {
+		content.Projects[moved.Name] = &moved
+	})
+
+	return &moved, nil
+}
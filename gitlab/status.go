@@ -0,0 +1,176 @@
+package gitlab
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/badjware/gitlabfs/utils"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type StatusReporter interface {
+	Status() Status
+}
+
+type RateLimit struct {
+	Limit     int       `yaml:"limit"`
+	Remaining int       `yaml:"remaining"`
+	Reset     time.Time `yaml:"reset"`
+	UpdatedAt time.Time `yaml:"updated_at"`
+}
+
+type Status struct {
+	// Nil until gitlab returned a rate-limited response
+	RateLimit    *RateLimit          `yaml:"rate_limit"`
+	RecentErrors []utils.LoggedError `yaml:"recent_errors"`
+
+	// Time of the last request that reached gitlab, and of the last one that could not
+	LastSuccess time.Time `yaml:"last_success,omitempty"`
+	LastFailure time.Time `yaml:"last_failure,omitempty"`
+
+	// Number of requests made to the gitlab api in the last hour
+	RequestsLastHour int `yaml:"requests_last_hour"`
+
+	// Position of the token the requests are authenticated with among the configured tokens, starting at 1, or 0 if they are anonymous
+	ActiveToken int `yaml:"active_token"`
+}
+
+// Reachable returns false if the last request failed to reach gitlab
+func (s Status) Reachable() bool {
+	return !s.LastFailure.After(s.LastSuccess)
+}
+
+// statusTransport records the rate-limit state and the failures of the requests made to the gitlab api
+type statusTransport struct {
+	base http.RoundTripper
+
+	mux         sync.Mutex
+	rateLimit   *RateLimit
+	errors      *utils.ErrorLog
+	lastSuccess time.Time
+	lastFailure time.Time
+	requests    requestCounter
+}
+
+// requestCounter counts the requests of the last hour, by minute
+type requestCounter struct {
+	// Indexed by the minute of the hour
+	counts  [60]int
+	minutes [60]int64
+}
+
+func (c *requestCounter) add(now time.Time) {
+	minute := now.Unix() / 60
+	i := minute % 60
+	if c.minutes[i] != minute {
+		// The bucket was last used an hour ago or more
+		c.minutes[i] = minute
+		c.counts[i] = 0
+	}
+	c.counts[i]++
+}
+
+func (c *requestCounter) lastHour(now time.Time) int {
+	minute := now.Unix() / 60
+	total := 0
+	for i := range c.counts {
+		if minute-c.minutes[i] < 60 {
+			total += c.counts[i]
+		}
+	}
+	return total
+}
+
+func newStatusTransport(base http.RoundTripper) *statusTransport {
+	return &statusTransport{
+		base:   base,
+		errors: utils.NewErrorLog(50),
+	}
+}
+
+func (t *statusTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	_, span := tracer.Start(req.Context(), "HTTP "+req.Method, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("http.request.method", req.Method),
+		attribute.String("url.path", req.URL.Path),
+		attribute.String("gitlab.page", req.URL.Query().Get("page")),
+	))
+	defer span.End()
+
+	t.mux.Lock()
+	t.requests.add(time.Now())
+	t.mux.Unlock()
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		t.errors.Add(fmt.Errorf("%v %v: %v", req.Method, req.URL.Path, err))
+		t.recordReachable(false)
+		span.SetStatus(codes.Error, utils.Redact(err.Error()))
+		return resp, err
+	}
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	if resp.StatusCode >= 500 {
+		span.SetStatus(codes.Error, resp.Status)
+	}
+	if resp.StatusCode >= 400 {
+		t.errors.Add(fmt.Errorf("%v %v: %v", req.Method, req.URL.Path, resp.Status))
+	}
+	// A server error means gitlab is unavailable, a client error is only about the request
+	t.recordReachable(resp.StatusCode < 500)
+
+	// https://docs.gitlab.com/ee/user/admin_area/settings/user_and_ip_rate_limits.html#response-headers
+	limit, err := strconv.Atoi(resp.Header.Get("RateLimit-Limit"))
+	if err != nil {
+		// Not rate-limited
+		return resp, nil
+	}
+	remaining, _ := strconv.Atoi(resp.Header.Get("RateLimit-Remaining"))
+	reset, _ := strconv.ParseInt(resp.Header.Get("RateLimit-Reset"), 10, 64)
+
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.rateLimit = &RateLimit{
+		Limit:     limit,
+		Remaining: remaining,
+		Reset:     time.Unix(reset, 0),
+		UpdatedAt: time.Now(),
+	}
+	return resp, nil
+}
+
+func (t *statusTransport) recordReachable(reachable bool) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	if reachable {
+		t.lastSuccess = time.Now()
+	} else {
+		t.lastFailure = time.Now()
+	}
+}
+
+// Status returns the rate-limit state of the gitlab api, along with the recent failures
+func (c *gitlabClient) Status() Status {
+	activeToken := c.current().tokens.activeToken()
+
+	c.transport.mux.Lock()
+	defer c.transport.mux.Unlock()
+
+	status := Status{
+		ActiveToken:  activeToken,
+		RecentErrors: c.transport.errors.Entries(),
+		LastSuccess:  c.transport.lastSuccess,
+		LastFailure:  c.transport.lastFailure,
+
+		RequestsLastHour: c.transport.requests.lastHour(time.Now()),
+	}
+	if c.transport.rateLimit != nil {
+		rateLimit := *c.transport.rateLimit
+		status.RateLimit = &rateLimit
+	}
+	return status
+}
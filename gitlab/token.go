@@ -0,0 +1,34 @@
+package gitlab
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/xanzy/go-gitlab"
+)
+
+// FetchTokenExpiry returns when the token of the client expires, or the zero time if it never expires
+// The token is looked up with the personal_access_tokens/self api, which requires gitlab 15.5
+func (c *gitlabClient) FetchTokenExpiry(ctx context.Context) (time.Time, error) {
+	ctx, span := tracer.Start(ctx, "gitlab.FetchTokenExpiry")
+	defer span.End()
+
+	client := c.current().client
+	// Not supported by this version of go-gitlab
+	req, err := client.NewRequest(http.MethodGet, "personal_access_tokens/self", nil, []gitlab.RequestOptionFunc{gitlab.WithContext(ctx)})
+	if err != nil {
+		return time.Time{}, err
+	}
+	var token struct {
+		ExpiresAt *gitlab.ISOTime `json:"expires_at"`
+	}
+	if _, err := client.Do(req, &token); err != nil {
+		return time.Time{}, fmt.Errorf("failed to fetch token: %w", err)
+	}
+	if token.ExpiresAt == nil {
+		return time.Time{}, nil
+	}
+	return time.Time(*token.ExpiresAt), nil
+}
@@ -0,0 +1,100 @@
+package gitlab
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// tokenTransport authenticates the requests with the first token gitlab accepts, eg: while a token is rotated
+// When gitlab rejects the active token, the request is retried with the next one, which is then used by the next requests
+type tokenTransport struct {
+	base   http.RoundTripper
+	tokens []string
+
+	mux sync.Mutex
+	// Index of the token the requests are authenticated with
+	active int
+}
+
+func newTokenTransport(base http.RoundTripper, tokens []string) *tokenTransport {
+	return &tokenTransport{
+		base:   base,
+		tokens: tokens,
+	}
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if len(t.tokens) == 0 {
+		// Anonymous
+		return t.base.RoundTrip(req)
+	}
+	hasBody := req.Body != nil && req.Body != http.NoBody
+
+	for attempt := 1; ; attempt++ {
+		t.mux.Lock()
+		active := t.active
+		t.mux.Unlock()
+
+		r := req.Clone(req.Context())
+		if attempt > 1 && hasBody {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			r.Body = body
+		}
+		r.Header.Set("PRIVATE-TOKEN", t.tokens[active])
+
+		resp, err := t.base.RoundTrip(r)
+		if err != nil || !tokenRejected(resp) {
+			return resp, err
+		}
+		t.failover(active)
+		if attempt >= len(t.tokens) || hasBody && req.GetBody == nil {
+			// Every token was rejected, or the request cannot be sent again
+			return resp, nil
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+}
+
+// failover switches to the token following rejected, unless another request switched already
+func (t *tokenTransport) failover(rejected int) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	if len(t.tokens) < 2 || t.active != rejected {
+		return
+	}
+	t.active = (rejected + 1) % len(t.tokens)
+	logger.Warn("gitlab rejected the token, failing over to the next one", "rejected_token", rejected+1, "active_token", t.active+1, "tokens", len(t.tokens))
+}
+
+// activeToken returns the position of the token the requests are authenticated with, starting at 1, or 0 if they are anonymous
+func (t *tokenTransport) activeToken() int {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	if len(t.tokens) == 0 {
+		return 0
+	}
+	return t.active + 1
+}
+
+// tokenRejected returns whether gitlab rejected the token of the request, as opposed to the request itself
+// An expired or revoked token is unauthorized, a token missing a scope is forbidden with an insufficient_scope error
+func tokenRejected(resp *http.Response) bool {
+	switch resp.StatusCode {
+	case http.StatusUnauthorized:
+		return true
+	case http.StatusForbidden:
+		return strings.Contains(resp.Header.Get("WWW-Authenticate"), "insufficient_scope")
+	}
+	return false
+}
+
+// Ensure we are implementing the http.RoundTripper interface
+var _ = (http.RoundTripper)((*tokenTransport)(nil))
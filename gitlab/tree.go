@@ -0,0 +1,244 @@
+package gitlab
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/xanzy/go-gitlab"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	TreeEntryBlob = "blob"
+	TreeEntryTree = "tree"
+	// A submodule, the entry is the commit it points to
+	TreeEntryCommit = "commit"
+
+	// Mode of the blob entries which are symlinks, their content is the target of the link
+	TreeModeSymlink = "120000"
+	// Mode of the blob entries which are executable
+	TreeModeExecutable = "100755"
+
+	// Size of the contents of the files kept in memory, the oldest contents are dropped past it
+	blobCacheSize = 256 << 20
+	// Number of the entries of the trees kept in memory, the oldest trees are dropped past it
+	treeCacheSize = 1 << 18
+	// Number of the sizes of the files kept in memory
+	blobSizeCacheSize = 1 << 16
+)
+
+// RepositoryBrowser reads the content of the default branch of the projects from the repository api, without cloning them
+type RepositoryBrowser interface {
+	// FetchTree returns the entries of the folder at path of the default branch of project, or nil if the project has no commits
+	FetchTree(ctx context.Context, project *Project, path string) ([]TreeEntry, error)
+	// FetchBlob returns the content of the blob with the sha of project, as found in a TreeEntry
+	FetchBlob(ctx context.Context, project *Project, sha string) ([]byte, error)
+	// FetchBlobSize returns the size of the content of the blob entry of project, without fetching its content
+	FetchBlobSize(ctx context.Context, project *Project, entry TreeEntry) (int64, error)
+}
+
+// TreeEntry is a file or a folder of the repository of a project
+type TreeEntry struct {
+	// Sha of the blob, the tree or the commit of the entry
+	ID   string
+	Name string
+	// Path of the entry from the root of the repository
+	Path string
+	// Either TreeEntryBlob, TreeEntryTree or TreeEntryCommit
+	Type string
+	// Git mode of the entry, eg: 100644
+	Mode string
+}
+
+// browseSnapshot is the commit of the default branch of a project the browsed trees are read from
+// A project browsed through several folders is read from the same commit, so its content stays consistent until the project changes
+type browseSnapshot struct {
+	ref            string
+	lastActivityAt time.Time
+	commit         string
+}
+
+// fifoCache holds the values read so far, by key, up to maxSize as measured by sizeOf, the oldest values are dropped past it
+// It holds what never changes, eg: the blobs by sha or the trees by commit, so a cached value never goes stale
+type fifoCache[V any] struct {
+	values map[string]V
+	// Keys of the cached values, from the oldest
+	order   []string
+	size    int
+	maxSize int
+	sizeOf  func(V) int
+}
+
+func newFifoCache[V any](maxSize int, sizeOf func(V) int) *fifoCache[V] {
+	return &fifoCache[V]{
+		values:  map[string]V{},
+		maxSize: maxSize,
+		sizeOf:  sizeOf,
+	}
+}
+
+func (c *fifoCache[V]) get(key string) (V, bool) {
+	value, ok := c.values[key]
+	return value, ok
+}
+
+func (c *fifoCache[V]) add(key string, value V) {
+	size := c.sizeOf(value)
+	if _, ok := c.values[key]; ok || size > c.maxSize {
+		return
+	}
+	for c.size+size > c.maxSize {
+		c.size -= c.sizeOf(c.values[c.order[0]])
+		delete(c.values, c.order[0])
+		c.order = c.order[1:]
+	}
+	c.values[key] = value
+	c.order = append(c.order, key)
+	c.size += size
+}
+
+// snapshot returns the commit of the default branch of project to browse, or an empty string if the project has no commits
+// The branch is resolved again once gitlab reports an activity on the project
+func (c *gitlabClient) snapshot(ctx context.Context, client *gitlab.Client, project *Project) (string, error) {
+	c.browseMux.Lock()
+	snapshot, ok := c.snapshots[project.ID]
+	c.browseMux.Unlock()
+	if ok && snapshot.ref == project.DefaultBranch && snapshot.lastActivityAt.Equal(project.LastActivityAt) {
+		return snapshot.commit, nil
+	}
+
+	commit, _, err := client.Commits.GetCommit(project.ID, project.DefaultBranch, gitlab.WithContext(ctx))
+	if StatusCode(err) == http.StatusNotFound {
+		// Empty repository
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	c.browseMux.Lock()
+	defer c.browseMux.Unlock()
+	c.snapshots[project.ID] = browseSnapshot{
+		ref:            project.DefaultBranch,
+		lastActivityAt: project.LastActivityAt,
+		commit:         commit.ID,
+	}
+	return commit.ID, nil
+}
+
+func (c *gitlabClient) FetchTree(ctx context.Context, project *Project, path string) ([]TreeEntry, error) {
+	ctx, span := tracer.Start(ctx, "gitlab.FetchTree", trace.WithAttributes(attribute.Int("gitlab.project.id", project.ID), attribute.String("gitlab.tree.path", path)))
+	defer span.End()
+
+	client := c.current().groupClient(GroupParam{Token: project.token})
+	commit, err := c.snapshot(ctx, client, project)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch the default branch of project %v: %v", project.ID, err)
+	}
+	if commit == "" {
+		return nil, nil
+	}
+
+	// The tree of a commit never changes
+	key := commit + ":" + path
+	c.browseMux.Lock()
+	entries, ok := c.trees.get(key)
+	c.browseMux.Unlock()
+	if ok {
+		return entries, nil
+	}
+
+	listTreeOpt := &gitlab.ListTreeOptions{
+		ListOptions: gitlab.ListOptions{
+			Page:    1,
+			PerPage: 100,
+		},
+		Ref: gitlab.String(commit),
+	}
+	if path != "" {
+		listTreeOpt.Path = gitlab.String(path)
+	}
+	entries = []TreeEntry{}
+	for {
+		nodes, response, err := client.Repositories.ListTree(project.ID, listTreeOpt, gitlab.WithContext(ctx))
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch the tree %v of project %v: %v", path, project.ID, err)
+		}
+		for _, node := range nodes {
+			entries = append(entries, TreeEntry{
+				ID:   node.ID,
+				Name: node.Name,
+				Path: node.Path,
+				Type: node.Type,
+				Mode: node.Mode,
+			})
+		}
+		// Gitlab leaves out the total of the pages of the large trees
+		if response.NextPage == 0 {
+			break
+		}
+		// Get the next page
+		listTreeOpt.Page = response.NextPage
+	}
+
+	c.browseMux.Lock()
+	defer c.browseMux.Unlock()
+	c.trees.add(key, entries)
+	return entries, nil
+}
+
+func (c *gitlabClient) FetchBlob(ctx context.Context, project *Project, sha string) ([]byte, error) {
+	c.browseMux.Lock()
+	content, ok := c.blobs.get(sha)
+	c.browseMux.Unlock()
+	if ok {
+		return content, nil
+	}
+
+	ctx, span := tracer.Start(ctx, "gitlab.FetchBlob", trace.WithAttributes(attribute.Int("gitlab.project.id", project.ID), attribute.String("gitlab.blob.sha", sha)))
+	defer span.End()
+
+	client := c.current().groupClient(GroupParam{Token: project.token})
+	content, _, err := client.Repositories.RawBlobContent(project.ID, sha, gitlab.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch the blob %v of project %v: %v", sha, project.ID, err)
+	}
+
+	c.browseMux.Lock()
+	defer c.browseMux.Unlock()
+	c.blobs.add(sha, content)
+	return content, nil
+}
+
+func (c *gitlabClient) FetchBlobSize(ctx context.Context, project *Project, entry TreeEntry) (int64, error) {
+	c.browseMux.Lock()
+	size, ok := c.blobSizes.get(entry.ID)
+	if content, cached := c.blobs.get(entry.ID); !ok && cached {
+		size, ok = int64(len(content)), true
+	}
+	c.browseMux.Unlock()
+	if ok {
+		return size, nil
+	}
+
+	ctx, span := tracer.Start(ctx, "gitlab.FetchBlobSize", trace.WithAttributes(attribute.Int("gitlab.project.id", project.ID), attribute.String("gitlab.blob.sha", entry.ID)))
+	defer span.End()
+
+	client := c.current().groupClient(GroupParam{Token: project.token})
+	commit, err := c.snapshot(ctx, client, project)
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch the default branch of project %v: %v", project.ID, err)
+	}
+	// The files api only reports the size of the files, from the headers of a HEAD request
+	file, _, err := client.RepositoryFiles.GetFileMetaData(project.ID, entry.Path, &gitlab.GetFileMetaDataOptions{Ref: gitlab.String(commit)}, gitlab.WithContext(ctx))
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch the size of the blob %v of project %v: %v", entry.ID, project.ID, err)
+	}
+
+	c.browseMux.Lock()
+	defer c.browseMux.Unlock()
+	c.blobSizes.add(entry.ID, int64(file.Size))
+	return int64(file.Size), nil
+}
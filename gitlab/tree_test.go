@@ -0,0 +1,38 @@
+package gitlab
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFifoCache(t *testing.T) {
+	tests := []struct {
+		name    string
+		maxSize int
+		adds    []string
+		cached  []string
+		size    int
+	}{
+		{name: "under the size", maxSize: 10, adds: []string{"aa", "bbb"}, cached: []string{"aa", "bbb"}, size: 5},
+		{name: "oldest dropped", maxSize: 5, adds: []string{"aa", "bbb", "cc"}, cached: []string{"bbb", "cc"}, size: 5},
+		{name: "several dropped", maxSize: 5, adds: []string{"a", "b", "c", "dddd"}, cached: []string{"c", "dddd"}, size: 5},
+		{name: "larger than the size", maxSize: 3, adds: []string{"aa", "bbbb"}, cached: []string{"aa"}, size: 2},
+		{name: "added once", maxSize: 5, adds: []string{"aa", "aa", "bbb"}, cached: []string{"aa", "bbb"}, size: 5},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newFifoCache(test.maxSize, func(v string) int { return len(v) })
+			for _, v := range test.adds {
+				c.add(v, v)
+			}
+			if !reflect.DeepEqual(c.order, test.cached) || c.size != test.size {
+				t.Errorf("expected %v of size %v to be cached, got %v of size %v", test.cached, test.size, c.order, c.size)
+			}
+			for _, v := range test.cached {
+				if cached, ok := c.get(v); !ok || cached != v {
+					t.Errorf("expected %v to be cached", v)
+				}
+			}
+		})
+	}
+}
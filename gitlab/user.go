@@ -1,19 +1,26 @@
 package gitlab
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/xanzy/go-gitlab"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type UserFetcher interface {
-	FetchUser(uid int) (*User, error)
-	FetchCurrentUser() (*User, error)
-	FetchUserContent(user *User) (*UserContent, error)
+	FetchUser(ctx context.Context, uid int) (*User, error)
+	FetchCurrentUser(ctx context.Context) (*User, error)
+	FetchUserContent(ctx context.Context, user *User) (*UserContent, error)
 }
 
+// Returned when fetching the current user while there is none, eg: without a token
+var ErrCurrentUserDisabled = errors.New("current user fetch is disabled")
+
 type UserContent struct {
 	Projects map[string]*Project
 }
@@ -22,8 +29,11 @@ type User struct {
 	ID   int
 	Name string
 
-	mux     sync.Mutex
-	content *UserContent
+	mux       sync.Mutex
+	content   *UserContent
+	fetchedAt time.Time
+	// Set while the expired content is fetched again in the background
+	revalidating bool
 }
 
 func NewUserFromGitlabUser(user *gitlab.User) User {
@@ -34,6 +44,14 @@ func NewUserFromGitlabUser(user *gitlab.User) User {
 	}
 }
 
+// CachedContent returns the content of the user if it's cached, without fetching it
+func (u *User) CachedContent() *UserContent {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+
+	return u.content
+}
+
 func (u *User) InvalidateCache() {
 	u.mux.Lock()
 	defer u.mux.Unlock()
@@ -41,37 +59,102 @@ func (u *User) InvalidateCache() {
 	u.content = nil
 }
 
-func (c *gitlabClient) FetchUser(uid int) (*User, error) {
-	gitlabUser, _, err := c.client.Users.GetUser(uid)
+func (c *gitlabClient) FetchUser(ctx context.Context, uid int) (*User, error) {
+	ctx, span := tracer.Start(ctx, "gitlab.FetchUser", trace.WithAttributes(attribute.Int("gitlab.user.id", uid)))
+	defer span.End()
+
+	gitlabUser, _, err := c.current().client.Users.GetUser(uid, gitlab.WithContext(ctx))
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch user with id %v: %v", uid, err)
+		return nil, fmt.Errorf("failed to fetch user with id %v: %w", uid, err)
 	}
 	user := NewUserFromGitlabUser(gitlabUser)
 	return &user, nil
 }
 
-func (c *gitlabClient) FetchCurrentUser() (*User, error) {
-	if c.IncludeCurrentUser {
-		gitlabUser, _, err := c.client.Users.CurrentUser()
+func (c *gitlabClient) FetchCurrentUser(ctx context.Context) (*User, error) {
+	ctx, span := tracer.Start(ctx, "gitlab.FetchCurrentUser")
+	defer span.End()
+
+	cfg := c.current()
+	if cfg.IncludeCurrentUser {
+		gitlabUser, _, err := cfg.client.Users.CurrentUser(gitlab.WithContext(ctx))
 		if err != nil {
-			return nil, fmt.Errorf("failed to fetch current user: %v", err)
+			return nil, fmt.Errorf("failed to fetch current user: %w", err)
 		}
 		user := NewUserFromGitlabUser(gitlabUser)
 		return &user, nil
 	}
 	// no current user to fetch, return nil
-	return nil, errors.New("current user fetch is disabled")
+	return nil, ErrCurrentUserDisabled
 }
 
-func (c *gitlabClient) FetchUserContent(user *User) (*UserContent, error) {
+func (c *gitlabClient) FetchUserContent(ctx context.Context, user *User) (*UserContent, error) {
+	ctx, span := tracer.Start(ctx, "gitlab.FetchUserContent", trace.WithAttributes(attribute.Int("gitlab.user.id", user.ID)))
+	defer span.End()
+
+	cfg := c.current()
+
 	user.mux.Lock()
 	defer user.mux.Unlock()
 
 	// Get cached data if available
-	if user.content != nil {
+	if user.content != nil && !cacheExpired(user.fetchedAt, cfg.RefreshInterval) {
+		span.SetAttributes(attribute.Bool("gitlab.cached", true))
+		return user.content, nil
+	}
+	// The content is shared with the other callers waiting on the user, don't abort the fetch if the caller is interrupted
+	ctx = context.WithoutCancel(ctx)
+
+	// Serve the expired content while it's fetched again in the background
+	if user.content != nil && cfg.StaleWhileRevalidate {
+		span.SetAttributes(attribute.Bool("gitlab.cached", true), attribute.Bool("gitlab.stale", true))
+		if !user.revalidating {
+			user.revalidating = true
+			go c.revalidateUserContent(ctx, user)
+		}
 		return user.content, nil
 	}
 
+	fetchedAt := time.Now()
+	content, err := c.listUserContent(ctx, cfg, user)
+	if cfg.OnUserFetched != nil {
+		cfg.OnUserFetched(user, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	user.content = content
+	user.fetchedAt = fetchedAt
+	return content, nil
+}
+
+// revalidateUserContent fetches the expired content of the user again, while the callers are served the expired content
+// If the fetch fails, the expired content is kept and the fetch is attempted again on the next access
+func (c *gitlabClient) revalidateUserContent(ctx context.Context, user *User) {
+	ctx, span := tracer.Start(ctx, "gitlab.RevalidateUserContent", trace.WithAttributes(attribute.Int("gitlab.user.id", user.ID)))
+	defer span.End()
+
+	cfg := c.current()
+	fetchedAt := time.Now()
+	content, err := c.listUserContent(ctx, cfg, user)
+
+	user.mux.Lock()
+	defer user.mux.Unlock()
+
+	user.revalidating = false
+	if cfg.OnUserFetched != nil {
+		cfg.OnUserFetched(user, err)
+	}
+	if err != nil {
+		logger.Warn("failed to refresh the content of the user, serving the expired content", "user", user.ID, "error", err)
+		return
+	}
+	user.content = content
+	user.fetchedAt = fetchedAt
+}
+
+// listUserContent fetches the projects of the user from gitlab, with the configuration cfg
+func (c *gitlabClient) listUserContent(ctx context.Context, cfg *apiConfig, user *User) (*UserContent, error) {
 	content := &UserContent{
 		Projects: map[string]*Project{},
 	}
@@ -81,14 +164,19 @@ func (c *gitlabClient) FetchUserContent(user *User) (*UserContent, error) {
 		ListOptions: gitlab.ListOptions{
 			Page:    1,
 			PerPage: 100,
-		}}
+		},
+		Archived: archivedFilter(cfg.ArchivedProjectHandling),
+	}
 	for {
-		gitlabProjects, response, err := c.client.Projects.ListUserProjects(user.ID, listProjectOpt)
+		gitlabProjects, response, err := cfg.client.Projects.ListUserProjects(user.ID, listProjectOpt, gitlab.WithContext(ctx))
 		if err != nil {
 			return nil, fmt.Errorf("failed to fetch projects in gitlab: %v", err)
 		}
 		for _, gitlabProject := range gitlabProjects {
-			project := c.newProjectFromGitlabProject(gitlabProject)
+			if !cfg.isListed(gitlabProject) {
+				continue
+			}
+			project := cfg.newProjectFromGitlabProject(gitlabProject, cfg.defaultGroupParam())
 			content.Projects[project.Name] = &project
 		}
 		if response.CurrentPage >= response.TotalPages {
@@ -97,7 +185,5 @@ func (c *gitlabClient) FetchUserContent(user *User) (*UserContent, error) {
 		// Get the next page
 		listProjectOpt.Page = response.NextPage
 	}
-
-	user.content = content
 	return content, nil
 }
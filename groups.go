@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/badjware/gitlabfs/gitlab"
+)
+
+// GroupConfig is a group exposed in the filesystem
+// It's either the id of the group, or an object overriding the settings of the projects of the group and its subgroups
+type GroupConfig struct {
+	ID                      int            `yaml:"id"`
+	IncludeSubgroups        *bool          `yaml:"include_subgroups,omitempty"`
+	ArchivedProjectHandling string         `yaml:"archived_project_handling,omitempty"`
+	Depth                   *int           `yaml:"depth,omitempty"`
+	RefreshInterval         *time.Duration `yaml:"refresh_interval,omitempty"`
+	Token                   string         `yaml:"token,omitempty"`
+}
+
+// GroupList is the list of groups exposed in the filesystem
+type GroupList []GroupConfig
+
+func (g *GroupConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&g.ID); err == nil {
+		return nil
+	}
+	// Without the methods of GroupConfig, so it's not called recursively
+	type plain GroupConfig
+	return unmarshal((*plain)(g))
+}
+
+func (g GroupConfig) MarshalYAML() (interface{}, error) {
+	if g.overrides() {
+		type plain GroupConfig
+		return plain(g), nil
+	}
+	return g.ID, nil
+}
+
+// overrides returns whether the group overrides any setting
+func (g GroupConfig) overrides() bool {
+	return !reflect.DeepEqual(g, GroupConfig{ID: g.ID})
+}
+
+func makeGroupList(gids []int) GroupList {
+	groups := make(GroupList, 0, len(gids))
+	for _, gid := range gids {
+		groups = append(groups, GroupConfig{ID: gid})
+	}
+	return groups
+}
+
+// IDs returns the id of each group
+func (l GroupList) IDs() []int {
+	gids := make([]int, 0, len(l))
+	for _, g := range l {
+		gids = append(gids, g.ID)
+	}
+	return gids
+}
+
+// Tokens returns the token of each group which has one
+func (l GroupList) Tokens() []string {
+	var tokens []string
+	for _, g := range l {
+		if g.Token != "" {
+			tokens = append(tokens, g.Token)
+		}
+	}
+	return tokens
+}
+
+// redacted returns a copy of the list with the tokens redacted
+func (l GroupList) redacted() GroupList {
+	if l == nil {
+		return nil
+	}
+	groups := append(GroupList{}, l...)
+	for i := range groups {
+		if groups[i].Token != "" {
+			groups[i].Token = "<redacted>"
+		}
+	}
+	return groups
+}
+
+// makeGroupParams returns the settings overridden by the groups of every mount, by group id
+// The gitlab client is shared by every mount, so a group must have the same overrides everywhere it's listed
+func makeGroupParams(config *Config) (map[int]gitlab.GroupParam, map[int]time.Duration, error) {
+	groups := append(GroupList{}, config.Gitlab.GroupIDs...)
+	for _, m := range config.Mounts {
+		groups = append(groups, m.GroupIDs...)
+	}
+
+	params := map[int]gitlab.GroupParam{}
+	refreshIntervals := map[int]time.Duration{}
+	overridden := map[int]GroupConfig{}
+	for _, g := range groups {
+		if g.ID == 0 {
+			return nil, nil, fmt.Errorf("the id of the groups in group_ids must be set")
+		}
+		if !g.overrides() {
+			continue
+		}
+		if other, ok := overridden[g.ID]; ok && !reflect.DeepEqual(other, g) {
+			return nil, nil, fmt.Errorf("group %v must have the same settings everywhere it's listed", g.ID)
+		}
+		overridden[g.ID] = g
+
+		if g.ArchivedProjectHandling != "" {
+			if err := checkEnum(fmt.Sprintf("archived_project_handling of group %v", g.ID), g.ArchivedProjectHandling, gitlab.ArchivedProjectShow, gitlab.ArchivedProjectHide, gitlab.ArchivedProjectIgnore); err != nil {
+				return nil, nil, err
+			}
+		}
+		if g.Depth != nil && *g.Depth < 0 {
+			return nil, nil, fmt.Errorf("the depth of group %v must not be negative", g.ID)
+		}
+		if g.RefreshInterval != nil {
+			if *g.RefreshInterval < 0 {
+				return nil, nil, fmt.Errorf("the refresh interval of group %v must not be negative", g.ID)
+			}
+			refreshIntervals[g.ID] = *g.RefreshInterval
+		}
+		params[g.ID] = gitlab.GroupParam{
+			IncludeSubgroups:        g.IncludeSubgroups,
+			ArchivedProjectHandling: g.ArchivedProjectHandling,
+			PullDepth:               g.Depth,
+			Token:                   g.Token,
+		}
+	}
+	return params, refreshIntervals, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/badjware/gitlabfs/git"
+	"github.com/badjware/gitlabfs/gitlab"
+	"github.com/badjware/gitlabfs/utils"
+)
+
+// How long the mountpoint has to answer a stat before the filesystem is considered wedged
+const mountProbeTimeout = 5 * time.Second
+
+// mountHealth tracks the state of a mount for the health endpoints
+type mountHealth struct {
+	name       string
+	mountpoint string
+	git        git.GitClonerPuller
+
+	mounted atomic.Bool
+}
+
+// healthChecker reports whether the filesystems are mounted and responsive, gitlab is reachable and the git queues are moving
+type healthChecker struct {
+	gitlab gitlab.StatusReporter
+	mounts []*mountHealth
+
+	// A git operation running for longer than this is considered stuck
+	stalledOperationTimeout time.Duration
+}
+
+type healthReport struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+const healthOK = "ok"
+
+// probeMount stats the root of the mount, which is answered by gitlabfs itself
+func probeMount(mountpoint string) error {
+	done := make(chan error, 1)
+	go func() {
+		_, err := os.Stat(mountpoint)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(mountProbeTimeout):
+		return fmt.Errorf("no answer after %v", mountProbeTimeout)
+	}
+}
+
+// checkQueue returns an error if a git operation of the mount is stuck, or if its queue is full and full is true
+// A full queue is degraded rather than wedged, its operations wait in the overflow
+func (h *healthChecker) checkQueue(m *mountHealth, full bool) error {
+	status := m.git.Status()
+	for _, op := range status.Running {
+		if h.stalledOperationTimeout > 0 && time.Since(op.Since) > h.stalledOperationTimeout {
+			return fmt.Errorf("%v of %v running since %v", op.Type, op.Repo, op.Since.Format(time.RFC3339))
+		}
+	}
+	if full && status.Overflowed > 0 {
+		return fmt.Errorf("queue is full, %v operations are waiting in its overflow", status.Overflowed)
+	}
+	return nil
+}
+
+// anyMounted returns whether one of the filesystems is mounted
+func (h *healthChecker) anyMounted() bool {
+	for _, m := range h.mounts {
+		if m.mounted.Load() {
+			return true
+		}
+	}
+	return false
+}
+
+// live checks that nothing is wedged, a filesystem which is still mounting is live
+func (h *healthChecker) live() healthReport {
+	checks := map[string]string{}
+	for _, m := range h.mounts {
+		if m.mounted.Load() {
+			checks["mount:"+m.name] = errorOrOK(probeMount(m.mountpoint))
+		}
+		checks["git:"+m.name] = errorOrOK(h.checkQueue(m, false))
+	}
+	return newHealthReport(checks)
+}
+
+// responsive checks that the filesystems which are mounted answer, regardless of their git operations
+func (h *healthChecker) responsive() healthReport {
+	checks := map[string]string{}
+	for _, m := range h.mounts {
+		if m.mounted.Load() {
+			checks["mount:"+m.name] = errorOrOK(probeMount(m.mountpoint))
+		}
+	}
+	return newHealthReport(checks)
+}
+
+// ready checks that every filesystem is mounted and can serve projects
+func (h *healthChecker) ready() healthReport {
+	checks := map[string]string{}
+	for _, m := range h.mounts {
+		if !m.mounted.Load() {
+			checks["mount:"+m.name] = "not mounted"
+		} else {
+			checks["mount:"+m.name] = errorOrOK(probeMount(m.mountpoint))
+		}
+		checks["git:"+m.name] = errorOrOK(h.checkQueue(m, true))
+	}
+	status := h.gitlab.Status()
+	if status.Reachable() {
+		checks["gitlab"] = healthOK
+	} else {
+		checks["gitlab"] = fmt.Sprintf("unreachable since %v", status.LastFailure.Format(time.RFC3339))
+	}
+	return newHealthReport(checks)
+}
+
+func errorOrOK(err error) string {
+	if err != nil {
+		return utils.Redact(err.Error())
+	}
+	return healthOK
+}
+
+func newHealthReport(checks map[string]string) healthReport {
+	report := healthReport{Status: healthOK, Checks: checks}
+	for _, result := range checks {
+		if result != healthOK {
+			report.Status = "fail"
+		}
+	}
+	return report
+}
+
+func serveHealthReport(check func() healthReport) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := check()
+		w.Header().Set("Content-Type", "application/json")
+		if report.Status != healthOK {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(report)
+	}
+}
+
+// startHTTPServer serves the health endpoints on listen in the background
+func startHTTPServer(listen string, health *healthChecker) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", serveHealthReport(health.live))
+	mux.HandleFunc("/readyz", serveHealthReport(health.ready))
+
+	go func() {
+		logger.Info("serving http", "listen", listen)
+		if err := http.ListenAndServe(listen, mux); err != nil {
+			logger.Error("http listener failed", "listen", listen, "error", err)
+		}
+	}()
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// The top-level setting listing the config files included by a config file
+const includeKey = "include"
+
+// The suffix of the settings appending to the list of the files applied before, eg: "group_ids+"
+const appendSuffix = "+"
+
+// readConfigFiles returns the content of the config file at configPath merged with the files it includes, converted to yaml,
+// along with the path of every file read
+// The files are applied one after the other, each one after the files it includes, in the order they are listed
+func readConfigFiles(configPath string) ([]byte, []string, error) {
+	path, err := filepath.Abs(configPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open config file: %v", err)
+	}
+	content, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open config file: %v", err)
+	}
+	content, root, err := parseConfigDocument(path, content)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse config file: %v", err)
+	}
+	if !needsMerge(root) {
+		// Keep the content as is, so the errors point to the lines of the file
+		return content, []string{path}, nil
+	}
+
+	files := []string{}
+	doc, err := applyConfigDocument(nil, path, root, []string{path}, &files)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse config file: %v", err)
+	}
+	out, err := yaml.Marshal(doc)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse config file: %v", err)
+	}
+	return out, files, nil
+}
+
+// parseConfigDocument returns the content of the config file at path converted to yaml, along with its settings
+func parseConfigDocument(path string, content []byte) ([]byte, yaml.MapSlice, error) {
+	if convert, ok := configFormats[strings.ToLower(filepath.Ext(path))]; ok {
+		var err error
+		content, err = convert(content)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	var root yaml.MapSlice
+	if err := yaml.Unmarshal(content, &root); err != nil {
+		return nil, nil, err
+	}
+	return content, root, nil
+}
+
+// applyConfigDocument applies the settings of the config file at path, and of the files it includes before them, on top of base
+// stack holds the files including path, to detect the cycles
+func applyConfigDocument(base yaml.MapSlice, path string, doc yaml.MapSlice, stack []string, files *[]string) (yaml.MapSlice, error) {
+	*files = append(*files, path)
+
+	var includes []string
+	settings := make(yaml.MapSlice, 0, len(doc))
+	for _, item := range doc {
+		if item.Key != includeKey {
+			settings = append(settings, item)
+			continue
+		}
+		paths, err := includePaths(path, item.Value)
+		if err != nil {
+			return nil, err
+		}
+		includes = append(includes, paths...)
+	}
+
+	for _, include := range includes {
+		for _, p := range stack {
+			if p == include {
+				return nil, fmt.Errorf("include cycle: %v -> %v", strings.Join(stack, " -> "), include)
+			}
+		}
+		content, err := ioutil.ReadFile(include)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", includeKey, err)
+		}
+		_, included, err := parseConfigDocument(include, content)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", include, err)
+		}
+		base, err = applyConfigDocument(base, include, included, append(stack[:len(stack):len(stack)], include), files)
+		if err != nil {
+			return nil, err
+		}
+	}
+	merged, err := mergeSettings(base, settings, "")
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return merged, nil
+}
+
+// includePaths returns the files included by the config file at path, from the value of its include setting
+// A relative path is relative to the folder of the file, and a pattern includes every file it matches, in alphabetical order
+func includePaths(path string, value interface{}) ([]string, error) {
+	var patterns []string
+	switch v := value.(type) {
+	case nil:
+	case string:
+		patterns = []string{v}
+	case []interface{}:
+		for _, p := range v {
+			s, ok := p.(string)
+			if !ok {
+				return nil, fmt.Errorf("%v must be a path or a list of paths", includeKey)
+			}
+			patterns = append(patterns, s)
+		}
+	default:
+		return nil, fmt.Errorf("%v must be a path or a list of paths", includeKey)
+	}
+
+	var paths []string
+	for _, pattern := range patterns {
+		expanded, err := expandEnvValue(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", includeKey, err)
+		}
+		if !filepath.IsAbs(expanded) {
+			expanded = filepath.Join(filepath.Dir(path), expanded)
+		}
+		if !strings.ContainsAny(expanded, "*?[") {
+			paths = append(paths, filepath.Clean(expanded))
+			continue
+		}
+		// A pattern matching no file is not an error, eg: an empty conf.d folder
+		matches, err := filepath.Glob(expanded)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", includeKey, err)
+		}
+		sort.Strings(matches)
+		paths = append(paths, matches...)
+	}
+	return paths, nil
+}
+
+// mergeSettings returns the settings of overlay applied on top of the settings of base
+// The sections are merged setting by setting, while a value or a list replaces the one of base, unless its key ends with appendSuffix
+// A setting without a value keeps the value of base
+func mergeSettings(base yaml.MapSlice, overlay yaml.MapSlice, path string) (yaml.MapSlice, error) {
+	merged := append(yaml.MapSlice{}, base...)
+	for _, item := range overlay {
+		key := item.Key
+		appending := false
+		if s, ok := key.(string); ok && len(s) > len(appendSuffix) && strings.HasSuffix(s, appendSuffix) {
+			key = configKey(strings.TrimSuffix(s, appendSuffix))
+			appending = true
+		}
+		settingPath := fmt.Sprint(key)
+		if path != "" {
+			settingPath = path + "." + settingPath
+		}
+
+		i := -1
+		for j := range merged {
+			if merged[j].Key == key {
+				i = j
+				break
+			}
+		}
+		var inherited interface{}
+		if i != -1 {
+			inherited = merged[i].Value
+		}
+
+		value := item.Value
+		switch v := item.Value.(type) {
+		case nil:
+			if i != -1 {
+				continue
+			}
+		case yaml.MapSlice:
+			if appending {
+				return nil, fmt.Errorf("%v%v must be a list", settingPath, appendSuffix)
+			}
+			section, _ := inherited.(yaml.MapSlice)
+			s, err := mergeSettings(section, v, settingPath)
+			if err != nil {
+				return nil, err
+			}
+			value = s
+		case []interface{}:
+			l, err := resolveList(v, settingPath)
+			if err != nil {
+				return nil, err
+			}
+			value = l
+			if appending {
+				l, err := appendList(inherited, l)
+				if err != nil {
+					return nil, fmt.Errorf("%v%v: %v", settingPath, appendSuffix, err)
+				}
+				value = l
+			}
+		default:
+			if appending {
+				return nil, fmt.Errorf("%v%v must be a list", settingPath, appendSuffix)
+			}
+		}
+
+		if i == -1 {
+			merged = append(merged, yaml.MapItem{Key: key, Value: value})
+		} else {
+			merged[i].Value = value
+		}
+	}
+	return merged, nil
+}
+
+// resolveList returns the items of a list with the settings of its sections merged, eg: the mounts
+func resolveList(items []interface{}, path string) ([]interface{}, error) {
+	list := make([]interface{}, 0, len(items))
+	for i, item := range items {
+		if section, ok := item.(yaml.MapSlice); ok {
+			s, err := mergeSettings(nil, section, fmt.Sprintf("%v[%v]", path, i))
+			if err != nil {
+				return nil, err
+			}
+			item = s
+		}
+		list = append(list, item)
+	}
+	return list, nil
+}
+
+// appendList returns the items of inherited followed by the items which are not already in it
+func appendList(inherited interface{}, items []interface{}) ([]interface{}, error) {
+	var list []interface{}
+	switch v := inherited.(type) {
+	case nil:
+	case []interface{}:
+		list = append(list, v...)
+	default:
+		return nil, fmt.Errorf("the setting it appends to is not a list")
+	}
+	for _, item := range items {
+		found := false
+		for _, existing := range list {
+			if reflect.DeepEqual(existing, item) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, item)
+		}
+	}
+	return list, nil
+}
+
+// needsMerge returns whether the config file doc includes other files or appends to a list
+func needsMerge(doc yaml.MapSlice) bool {
+	for _, item := range doc {
+		if item.Key == includeKey {
+			return true
+		}
+	}
+	return appendsToList(doc)
+}
+
+func appendsToList(settings yaml.MapSlice) bool {
+	for _, item := range settings {
+		if s, ok := item.Key.(string); ok && len(s) > len(appendSuffix) && strings.HasSuffix(s, appendSuffix) {
+			return true
+		}
+		if section, ok := item.Value.(yaml.MapSlice); ok && appendsToList(section) {
+			return true
+		}
+		if items, ok := item.Value.([]interface{}); ok {
+			for _, i := range items {
+				if section, ok := i.(yaml.MapSlice); ok && appendsToList(section) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
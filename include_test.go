@@ -0,0 +1,139 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadConfigFiles(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		yaml  string
+		read  []string
+		err   string
+	}{
+		{
+			name: "no include",
+			files: map[string]string{
+				"config.yaml": "git:\n  worker_count: 2\n",
+			},
+			yaml: "git:\n  worker_count: 2\n",
+			read: []string{"config.yaml"},
+		},
+		{
+			name: "include",
+			files: map[string]string{
+				"config.yaml": "include: base.yaml\ngit:\n  worker_count: 2\n",
+				"base.yaml":   "git:\n  clone_location: /tmp/clones\n  worker_count: 1\n",
+			},
+			yaml: "git:\n  clone_location: /tmp/clones\n  worker_count: 2\n",
+			read: []string{"config.yaml", "base.yaml"},
+		},
+		{
+			name: "pattern",
+			files: map[string]string{
+				"config.yaml":       "include: conf.d/*.yaml\n",
+				"conf.d/b.yaml":     "gitlab:\n  url: https://b.example.com\n",
+				"conf.d/a.yaml":     "gitlab:\n  url: https://a.example.com\n  token: a\n",
+				"conf.d/ignore.txt": "gitlab:\n  url: https://c.example.com\n",
+			},
+			yaml: "gitlab:\n  url: https://b.example.com\n  token: a\n",
+			read: []string{"config.yaml", "conf.d/a.yaml", "conf.d/b.yaml"},
+		},
+		{
+			name: "list replaced",
+			files: map[string]string{
+				"config.yaml": "include: base.yaml\ngitlab:\n  group_ids: [456]\n",
+				"base.yaml":   "gitlab:\n  group_ids: [123]\n",
+			},
+			yaml: "gitlab:\n  group_ids:\n  - 456\n",
+			read: []string{"config.yaml", "base.yaml"},
+		},
+		{
+			name: "list appended",
+			files: map[string]string{
+				"config.yaml": "include: base.yaml\ngitlab:\n  group_ids+: [123, 456]\n",
+				"base.yaml":   "gitlab:\n  group_ids: [123]\n",
+			},
+			yaml: "gitlab:\n  group_ids:\n  - 123\n  - 456\n",
+			read: []string{"config.yaml", "base.yaml"},
+		},
+		{
+			name: "empty setting keeps the included value",
+			files: map[string]string{
+				"config.yaml": "include: base.yaml\ngit:\n  clone_location:\n",
+				"base.yaml":   "git:\n  clone_location: /tmp/clones\n",
+			},
+			yaml: "git:\n  clone_location: /tmp/clones\n",
+			read: []string{"config.yaml", "base.yaml"},
+		},
+		{
+			name: "toml include",
+			files: map[string]string{
+				"config.yaml": "include: base.toml\n",
+				"base.toml":   "[git]\nworker_count = 3\n",
+			},
+			yaml: "git:\n  worker_count: 3\n",
+			read: []string{"config.yaml", "base.toml"},
+		},
+		{
+			name: "append to a value",
+			files: map[string]string{
+				"config.yaml": "include: base.yaml\ngitlab:\n  url+: [a]\n",
+				"base.yaml":   "gitlab:\n  url: https://gitlab.example.com\n",
+			},
+			err: "gitlab.url+: the setting it appends to is not a list",
+		},
+		{
+			name: "cycle",
+			files: map[string]string{
+				"config.yaml": "include: base.yaml\n",
+				"base.yaml":   "include: config.yaml\n",
+			},
+			err: "include cycle",
+		},
+		{
+			name: "missing include",
+			files: map[string]string{
+				"config.yaml": "include: base.yaml\n",
+			},
+			err: "base.yaml",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, content := range test.files {
+				if d := filepath.Dir(name); d != "." {
+					if err := os.MkdirAll(filepath.Join(dir, d), 0700); err != nil {
+						t.Fatal(err)
+					}
+				}
+				writeConfigFile(t, dir, name, content)
+			}
+			out, read, err := readConfigFiles(filepath.Join(dir, "config.yaml"))
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected an error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(out) != test.yaml {
+				t.Errorf("expected:\n%v\ngot:\n%v", test.yaml, string(out))
+			}
+			expected := make([]string, 0, len(test.read))
+			for _, name := range test.read {
+				expected = append(expected, filepath.Join(dir, name))
+			}
+			if strings.Join(read, ",") != strings.Join(expected, ",") {
+				t.Errorf("expected the files %v to be read, got %v", expected, read)
+			}
+		})
+	}
+}
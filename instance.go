@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// instanceInfo describes the instance of gitlabfs holding the lock of a clone location, as written in the lock file
+type instanceInfo struct {
+	PID         int       `json:"pid"`
+	Command     string    `json:"command"`
+	Mountpoints []string  `json:"mountpoints,omitempty"`
+	Started     time.Time `json:"started"`
+}
+
+// instanceLock is held by the instance of gitlabfs managing the clone location, for as long as it runs
+type instanceLock struct {
+	file *os.File
+}
+
+// Name of the lock file of a clone location, at its root
+const instanceLockName = "gitlabfs.lock"
+
+func makeInstanceLockPath(config *Config) (string, error) {
+	// A single lock for the whole clone location, whatever the gitlab instance or the profile: the git client of each
+	// instance manages every local copy of the clone location, eg: its size and the deduplication of the forks
+	return filepath.Join(config.Git.CloneLocation, instanceLockName), nil
+}
+
+// acquireInstanceLock locks the clone location for the instance described by info
+// It fails with an error naming the other instance if it's already locked
+func acquireInstanceLock(path string, info instanceInfo) (*instanceLock, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create the lock of the clone location: %v", err)
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the lock of the clone location: %v", err)
+	}
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		defer file.Close()
+		return nil, lockedError(path, file)
+	} else if errors.Is(err, syscall.ENOLCK) || errors.Is(err, syscall.ENOTSUP) || errors.Is(err, syscall.EOPNOTSUPP) {
+		// Eg: NFS without a lock manager
+		logger.Warn("the clone location does not support locking, another instance of gitlabfs could manage it at the same time", "lock", path, "error", err)
+	} else if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to lock the clone location: %v", err)
+	}
+
+	info.PID = os.Getpid()
+	info.Started = time.Now()
+	content, _ := json.Marshal(info)
+	if err := file.Truncate(0); err == nil {
+		file.WriteAt(append(content, '\n'), 0)
+	}
+	return &instanceLock{file: file}, nil
+}
+
+// lockedError returns the error naming the instance holding the lock file
+func lockedError(path string, file *os.File) error {
+	location := filepath.Dir(path)
+	content, _ := io.ReadAll(file)
+	var other instanceInfo
+	if err := json.Unmarshal(content, &other); err != nil || other.PID == 0 {
+		return fmt.Errorf("clone location %v is managed by another instance of gitlabfs, stop it first. See %v", location, path)
+	}
+	holder := fmt.Sprintf("gitlabfs %v, pid %v, started %v", other.Command, other.PID, other.Started.Format(time.RFC3339))
+	if len(other.Mountpoints) > 0 {
+		holder += ", mounted on " + strings.Join(other.Mountpoints, ", ")
+	}
+	return fmt.Errorf("clone location %v is managed by another instance of gitlabfs (%v), stop it first", location, holder)
+}
+
+// release unlocks the clone location
+// The lock file is kept, removing it would let two instances started at once lock different files
+func (l *instanceLock) release() {
+	l.file.Truncate(0)
+	syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	l.file.Close()
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/badjware/gitlabfs/git"
+	"github.com/badjware/gitlabfs/gitlab"
+	"github.com/badjware/gitlabfs/metadata"
+)
+
+// Version of the format of the inventory, bumped on incompatible changes
+const inventoryVersion = 1
+
+// inventory is what is known of the projects of a gitlab instance on a machine, to be imported on another one
+type inventory struct {
+	Version    int                `json:"version"`
+	GitlabURL  string             `json:"gitlab_url"`
+	ExportedAt time.Time          `json:"exported_at"`
+	Projects   []inventoryProject `json:"projects"`
+}
+
+type inventoryProject struct {
+	ID int `json:"id"`
+	// Where the project was last found in each filesystem, by mountpoint
+	Paths map[string]string `json:"paths,omitempty"`
+	// Whether the project has a local copy, with the branch checked out and the commit of HEAD in it
+	Cloned bool   `json:"cloned"`
+	Branch string `json:"branch,omitempty"`
+	Commit string `json:"commit,omitempty"`
+	// Last successful clone or pull of the local copy, if any
+	SyncedAt *time.Time `json:"synced_at,omitempty"`
+}
+
+func (p *inventoryProject) syncedAt() time.Time {
+	if p.SyncedAt == nil {
+		return time.Time{}
+	}
+	return *p.SyncedAt
+}
+
+// manageInventory implements the inventory subcommand
+func manageInventory(args []string) error {
+	usage := func() {
+		fmt.Println("USAGE:")
+		fmt.Printf("    %s inventory export [-config CONFIG] [-output FILE]\n", os.Args[0])
+		fmt.Printf("    %s inventory import [-config CONFIG] FILE\n", os.Args[0])
+	}
+	if len(args) == 0 {
+		usage()
+		return errors.New("the command is required")
+	}
+	switch args[0] {
+	case "export":
+		return exportInventory(args[1:])
+	case "import":
+		return importInventory(args[1:])
+	default:
+		usage()
+		return fmt.Errorf("unknown command %v", args[0])
+	}
+}
+
+// exportInventory writes the inventory of the projects of the config, from the metadata database and the local copies
+func exportInventory(args []string) error {
+	flags := flag.NewFlagSet("inventory export", flag.ExitOnError)
+	configPath := flags.String("config", findConfig(), "The config file")
+	profile := flags.String("profile", "", "The profile of the config file to apply")
+	output := flags.String("output", "-", "The file to write the inventory to, - for the standard output")
+	flags.Usage = func() {
+		fmt.Println("USAGE:")
+		fmt.Printf("    %s inventory export [-config CONFIG] [-output FILE]\n\n", os.Args[0])
+		fmt.Println("OPTIONS:")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *configPath == "" {
+		flags.Usage()
+		return errors.New("the config file is required, none was found in the default locations")
+	}
+	config, err := loadConfig(*configPath, *profile)
+	if err != nil {
+		return err
+	}
+
+	lockEncryptedStore, err := unlockEncryptedStore(config)
+	if err != nil {
+		return err
+	}
+	defer lockEncryptedStore()
+
+	metadataPath, err := makeMetadataDBPath(config)
+	if err != nil {
+		return err
+	}
+	metadataStore, err := metadata.Open(metadataPath)
+	if err != nil {
+		// The running instance holds the database
+		return fmt.Errorf("%v, stop the instance of gitlabfs using it first", err)
+	}
+	projects, err := metadataStore.Projects()
+	metadataStore.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read the metadata database: %v", err)
+	}
+
+	gitClientParam, err := makeGitConfig(config)
+	if err != nil {
+		return err
+	}
+	// Leave the history to the running instance
+	gitClientParam.HistoryFile = ""
+	gitClient, err := git.NewClient(*gitClientParam)
+	if err != nil {
+		return err
+	}
+	defer gitClient.Close()
+
+	byID := map[int]*inventoryProject{}
+	for _, project := range projects {
+		p := &inventoryProject{ID: project.ID}
+		if !project.SyncedAt.IsZero() {
+			syncedAt := project.SyncedAt
+			p.SyncedAt = &syncedAt
+		}
+		for mountpoint, mount := range project.Mounts {
+			if p.Paths == nil {
+				p.Paths = map[string]string{}
+			}
+			p.Paths[mountpoint] = mount.Path
+		}
+		byID[project.ID] = p
+	}
+	localCopies, err := gitClient.LocalCopies()
+	if err != nil {
+		return err
+	}
+	for _, pid := range localCopies {
+		p, ok := byID[pid]
+		if !ok {
+			p = &inventoryProject{ID: pid}
+			byID[pid] = p
+		}
+		p.Cloned = true
+		if p.Branch, p.Commit, err = gitClient.LocalRef(pid); err != nil {
+			logger.Warn("failed to read the local copy, exporting it without its branch", "repo", gitClient.LocalRepoLoc(pid), "error", err)
+		}
+	}
+
+	inv := inventory{
+		Version:    inventoryVersion,
+		GitlabURL:  config.Gitlab.URL,
+		ExportedAt: time.Now(),
+		Projects:   make([]inventoryProject, 0, len(byID)),
+	}
+	for _, p := range byID {
+		inv.Projects = append(inv.Projects, *p)
+	}
+	sort.Slice(inv.Projects, func(i, j int) bool { return inv.Projects[i].ID < inv.Projects[j].ID })
+
+	w := io.Writer(os.Stdout)
+	if *output != "-" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return fmt.Errorf("failed to create the inventory file: %v", err)
+		}
+		defer f.Close()
+		w = f
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(inv); err != nil {
+		return fmt.Errorf("failed to write the inventory: %v", err)
+	}
+	logger.Info("exported the inventory", "projects", len(inv.Projects), "cloned", len(localCopies))
+	return nil
+}
+
+// importInventory seeds the metadata database with the projects of the inventory, and clones the projects that had a local copy
+// The most recently synced projects are cloned first, and are switched back to the branch they were on once cloned
+func importInventory(args []string) error {
+	flags := flag.NewFlagSet("inventory import", flag.ExitOnError)
+	configPath := flags.String("config", findConfig(), "The config file")
+	profile := flags.String("profile", "", "The profile of the config file to apply")
+	flags.Usage = func() {
+		fmt.Println("USAGE:")
+		fmt.Printf("    %s inventory import [-config CONFIG] FILE\n\n", os.Args[0])
+		fmt.Println("OPTIONS:")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *configPath == "" {
+		flags.Usage()
+		return errors.New("the config file is required, none was found in the default locations")
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("the inventory file is required")
+	}
+	config, err := loadConfig(*configPath, *profile)
+	if err != nil {
+		return err
+	}
+	if err := configureLogging(config); err != nil {
+		return err
+	}
+
+	inv, err := readInventory(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	// The ids of the projects are only meaningful on the gitlab instance they were exported from
+	exportedURL, err := url.Parse(inv.GitlabURL)
+	if err != nil {
+		return fmt.Errorf("failed to parse the gitlab url of the inventory: %v", err)
+	}
+	gitlabURL, err := url.Parse(config.Gitlab.URL)
+	if err != nil {
+		return err
+	}
+	if exportedURL.Hostname() != gitlabURL.Hostname() {
+		return fmt.Errorf("the inventory was exported from %v, not from %v", inv.GitlabURL, config.Gitlab.URL)
+	}
+
+	gitlabClientParam, err := makeGitlabConfig(config)
+	if err != nil {
+		return err
+	}
+	gitlabClient, err := gitlab.NewClient(config.Gitlab.URL, config.Gitlab.Token, *gitlabClientParam)
+	if err != nil {
+		return err
+	}
+
+	lockEncryptedStore, err := unlockEncryptedStore(config)
+	if err != nil {
+		return err
+	}
+	defer lockEncryptedStore()
+
+	gitClientParam, err := makeGitConfig(config)
+	if err != nil {
+		return err
+	}
+	if err := git.PrepareCloneLocation(*gitClientParam); err != nil {
+		return err
+	}
+	metadataPath, err := makeMetadataDBPath(config)
+	if err != nil {
+		return err
+	}
+	metadataStore, err := metadata.Open(metadataPath)
+	if err != nil {
+		return fmt.Errorf("%v, stop the instance of gitlabfs using it first", err)
+	}
+	defer metadataStore.Close()
+	gitClientParam.OnOperationDone = func(opType string, repo string, err error) {
+		metadataStore.RecordOperation(repo, err)
+	}
+	gitClient, err := git.NewClient(*gitClientParam)
+	if err != nil {
+		return err
+	}
+	defer gitClient.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// The git queue runs the clones in the order they are dispatched
+	sort.SliceStable(inv.Projects, func(i, j int) bool {
+		if inv.Projects[i].Cloned != inv.Projects[j].Cloned {
+			return inv.Projects[i].Cloned
+		}
+		return inv.Projects[i].syncedAt().After(inv.Projects[j].syncedAt())
+	})
+
+	// Branch to checkout in each local copy once it's cloned
+	branches := map[int]string{}
+	depths := map[int]int{}
+	cloneURLs := map[int]string{}
+	cloned, skipped := 0, 0
+	for _, p := range inv.Projects {
+		mounts := make(map[string]metadata.ProjectMount, len(p.Paths))
+		for mountpoint, path := range p.Paths {
+			// The inodes are assigned by the filesystem of this machine
+			mounts[mountpoint] = metadata.ProjectMount{Path: path}
+		}
+		metadataStore.SeedProject(p.ID, mounts, gitClient.LocalRepoLoc(p.ID))
+
+		if !p.Cloned || gitClient.IsCloned(p.ID) {
+			continue
+		}
+		project, err := gitlabClient.FetchProject(ctx, p.ID)
+		if err != nil {
+			logger.Warn("failed to fetch the project, not cloning it", "project", p.ID, "error", err)
+			skipped++
+			continue
+		}
+		_, op, err := gitClient.CloneOrPull(project.CloneURL, project.ID, project.DefaultBranch, project.PullDepth)
+		if err != nil {
+			// Importing the inventory again clones the projects skipped, eg: when too many clones were started in the last minute
+			logger.Warn("failed to dispatch the clone", "project", p.ID, "error", err)
+			skipped++
+			continue
+		}
+		if op != git.OperationClone {
+			continue
+		}
+		cloned++
+		if p.Branch != "" && p.Branch != git.RefName(project.DefaultBranch) {
+			branches[p.ID] = p.Branch
+			depths[p.ID] = project.PullDepth
+			cloneURLs[p.ID] = project.CloneURL
+		}
+	}
+	logger.Info("seeded the metadata database, waiting for the clones to complete", "projects", len(inv.Projects), "cloning", cloned)
+
+	if !waitForGitOperations(ctx, gitClient) {
+		return nil
+	}
+	for pid, branch := range branches {
+		if !gitClient.IsCloned(pid) {
+			// The clone failed, it's in the logs already
+			continue
+		}
+		if err := gitClient.CheckoutBranch(cloneURLs[pid], pid, branch, depths[pid]); err != nil {
+			// Eg: the branch was never pushed
+			logger.Warn("failed to checkout the branch of the local copy, leaving it on the default branch", "repo", gitClient.LocalRepoLoc(pid), "branch", branch, "error", err)
+		}
+	}
+	logger.Info("imported the inventory", "projects", len(inv.Projects), "cloned", cloned, "skipped", skipped)
+	return nil
+}
+
+// readInventory reads the inventory from path, - for the standard input
+func readInventory(path string) (*inventory, error) {
+	r := io.Reader(os.Stdin)
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open the inventory file: %v", err)
+		}
+		defer f.Close()
+		r = f
+	}
+	var inv inventory
+	if err := json.NewDecoder(r).Decode(&inv); err != nil {
+		return nil, fmt.Errorf("failed to read the inventory: %v", err)
+	}
+	if inv.Version != inventoryVersion {
+		return nil, fmt.Errorf("unsupported inventory version %v, expected %v", inv.Version, inventoryVersion)
+	}
+	return &inv, nil
+}
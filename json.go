@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"gopkg.in/yaml.v2"
+)
+
+// jsonToYAML converts a json document to yaml, so it is decoded like a yaml config file
+func jsonToYAML(content []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	// Keep the integers exact
+	decoder.UseNumber()
+	doc, err := decodeJSONValue(decoder)
+	if err == nil {
+		if _, err = decoder.Token(); err == io.EOF {
+			return yaml.Marshal(doc)
+		} else if err == nil {
+			err = errors.New("unexpected content after the end of the document")
+		}
+	}
+
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		line := bytes.Count(content[:syntaxErr.Offset], []byte("\n")) + 1
+		return nil, fmt.Errorf("json: line %v: %v", line, err)
+	} else if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, errors.New("json: unexpected end of the document")
+	}
+	return nil, fmt.Errorf("json: %v", err)
+}
+
+// decodeJSONValue decodes the next value of decoder, keeping the order of the keys of the objects
+func decodeJSONValue(decoder *json.Decoder) (interface{}, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch t := token.(type) {
+	case json.Delim:
+		if t == '{' {
+			doc := yaml.MapSlice{}
+			for decoder.More() {
+				key, err := decoder.Token()
+				if err != nil {
+					return nil, err
+				}
+				value, err := decodeJSONValue(decoder)
+				if err != nil {
+					return nil, err
+				}
+				doc = append(doc, yaml.MapItem{Key: configKey(key.(string)), Value: value})
+			}
+			// The closing delimiter
+			_, err := decoder.Token()
+			return doc, err
+		}
+		array := []interface{}{}
+		for decoder.More() {
+			value, err := decodeJSONValue(decoder)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, value)
+		}
+		_, err := decoder.Token()
+		return array, err
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return i, nil
+		}
+		return t.Float64()
+	default:
+		// A string, a boolean or null
+		return t, nil
+	}
+}
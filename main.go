@@ -1,49 +1,259 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"log/slog"
 	"net/url"
 	"os"
+	"os/user"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/badjware/gitlabfs/fs"
 	"github.com/badjware/gitlabfs/git"
 	"github.com/badjware/gitlabfs/gitlab"
+	"github.com/badjware/gitlabfs/metadata"
+	"github.com/badjware/gitlabfs/utils"
 	"gopkg.in/yaml.v2"
 )
 
+var logger = utils.NewLogger("main")
+
+const (
+	logOutputDefault  = ""
+	logOutputSyslog   = "syslog"
+	logOutputJournald = "journald"
+)
+
+var (
+	// File the logs are currently written to, nil if they are not written to a file
+	logFile *utils.RotatingFile
+	// Handler the logs are currently sent to, closed when it's replaced
+	logHandler slog.Handler
+)
+
 type (
 	Config struct {
-		FS     FSConfig     `yaml:"fs,omitempty"`
-		Gitlab GitlabConfig `yaml:"gitlab,omitempty"`
-		Git    GitConfig    `yaml:"git,omitempty"`
+		Log     LogConfig     `yaml:"log,omitempty"`
+		FS      FSConfig      `yaml:"fs,omitempty"`
+		Gitlab  GitlabConfig  `yaml:"gitlab,omitempty"`
+		Git     GitConfig     `yaml:"git,omitempty"`
+		HTTP    HTTPConfig    `yaml:"http,omitempty"`
+		Tracing TracingConfig `yaml:"tracing,omitempty"`
+
+		Notifications NotificationsConfig `yaml:"notifications,omitempty"`
+
+		Mounts []MountConfig `yaml:"mounts,omitempty"`
+
+		// Settings applied on top of the others when the profile is selected, by profile name
+		Profiles map[string]yaml.MapSlice `yaml:"profiles,omitempty"`
+		// The profile applied, if any
+		Profile string `yaml:"-"`
+	}
+	LogConfig struct {
+		Level  string            `yaml:"level,omitempty"`
+		Format string            `yaml:"format,omitempty"`
+		Levels map[string]string `yaml:"levels,omitempty"`
+		Output string            `yaml:"output,omitempty"`
+
+		File       string        `yaml:"file,omitempty"`
+		MaxSize    int           `yaml:"max_size,omitempty"`
+		MaxAge     time.Duration `yaml:"max_age,omitempty"`
+		MaxBackups int           `yaml:"max_backups,omitempty"`
 	}
 	FSConfig struct {
-		Mountpoint   string `yaml:"mountpoint,omitempty"`
-		MountOptions string `yaml:"mountoptions,omitempty"`
+		Mountpoint       string `yaml:"mountpoint,omitempty"`
+		CreateMountpoint bool   `yaml:"create_mountpoint,omitempty"`
+		MountOptions     string `yaml:"mountoptions,omitempty"`
+		InodeTable       string `yaml:"inode_table,omitempty"`
+		MetadataDB       string `yaml:"metadata_db,omitempty"`
+		AuditLog         string `yaml:"audit_log,omitempty"`
+		PIDFile          string `yaml:"pidfile,omitempty"`
+		DaemonLog        string `yaml:"daemon_log,omitempty"`
+
+		Supervise    bool          `yaml:"supervise,omitempty"`
+		RestartDelay time.Duration `yaml:"restart_delay,omitempty"`
+
+		UID int `yaml:"uid"`
+		GID int `yaml:"gid"`
+
+		EntryTimeout    time.Duration `yaml:"entry_timeout,omitempty"`
+		AttrTimeout     time.Duration `yaml:"attr_timeout,omitempty"`
+		NegativeTimeout time.Duration `yaml:"negative_timeout,omitempty"`
+
+		CloneCacheTimeout time.Duration `yaml:"clone_cache_timeout,omitempty"`
+		KernelCache       bool          `yaml:"kernel_cache"`
+
+		Layout      LayoutConfig `yaml:"layout,omitempty"`
+		ProjectMode string       `yaml:"project_mode,omitempty"`
+
+		CaseInsensitiveLookup bool `yaml:"case_insensitive_lookup,omitempty"`
+		ReadWrite             bool `yaml:"read_write,omitempty"`
+		AllowCloneRemoval     bool `yaml:"allow_clone_removal,omitempty"`
+
+		DeferredMount bool `yaml:"deferred_mount,omitempty"`
+	}
+	LayoutConfig struct {
+		Groups string `yaml:"groups"`
+		Users  string `yaml:"users"`
+		All    string `yaml:"all"`
+		ByID   string `yaml:"by_id"`
+		Me     string `yaml:"me"`
+		Admin  string `yaml:"admin"`
 	}
 	GitlabConfig struct {
-		URL                string `yaml:"url,omitempty"`
-		Token              string `yaml:"token,omitempty"`
-		GroupIDs           []int  `yaml:"group_ids,omitempty"`
-		UserIDs            []int  `yaml:"user_ids,omitempty"`
-		IncludeCurrentUser bool   `yaml:"include_current_user,omitempty"`
+		URL                string    `yaml:"url,omitempty"`
+		Token              string    `yaml:"token,omitempty"`
+		FallbackTokens     []string  `yaml:"fallback_tokens,omitempty"`
+		GroupIDs           GroupList `yaml:"group_ids,omitempty"`
+		UserIDs            []int     `yaml:"user_ids,omitempty"`
+		IncludeCurrentUser bool      `yaml:"include_current_user,omitempty"`
+
+		ArchivedProjectHandling string `yaml:"archived_project_handling,omitempty"`
+		NewProjectVisibility    string `yaml:"new_project_visibility,omitempty"`
+		SkipEmpty               bool   `yaml:"skip_empty,omitempty"`
+
+		RefreshInterval       time.Duration         `yaml:"refresh_interval,omitempty"`
+		GroupRefreshIntervals map[int]time.Duration `yaml:"group_refresh_intervals,omitempty"`
+		PrefetchSubgroups     bool                  `yaml:"prefetch_subgroups,omitempty"`
+		StaleWhileRevalidate  bool                  `yaml:"stale_while_revalidate,omitempty"`
+		StartupWorkerCount    int                   `yaml:"startup_worker_count,omitempty"`
+
+		TLSMinVersion   string   `yaml:"tls_min_version,omitempty"`
+		TLSCipherSuites []string `yaml:"tls_cipher_suites,omitempty"`
+
+		DeployTokens map[string]DeployTokenConfig `yaml:"deploy_tokens,omitempty"`
+		PinnedRefs   []PinnedRefConfig            `yaml:"pinned_refs,omitempty"`
+	}
+	PinnedRefConfig struct {
+		Projects string `yaml:"projects"`
+		Branch   string `yaml:"branch,omitempty"`
+		Tag      string `yaml:"tag,omitempty"`
+	}
+	DeployTokenConfig struct {
+		Username string `yaml:"username"`
+		Token    string `yaml:"token"`
 	}
 	GitConfig struct {
 		CloneLocation    string `yaml:"clone_location,omitempty"`
+		CloneMode        string `yaml:"clone_mode,omitempty"`
+		CloneGroup       string `yaml:"clone_group,omitempty"`
 		Remote           string `yaml:"remote,omitempty"`
 		PullMethod       string `yaml:"pull_method,omitempty"`
 		OnClone          string `yaml:"on_clone,omitempty"`
+		OnCorruption     string `yaml:"on_corruption,omitempty"`
+		CloneTrigger     string `yaml:"clone_trigger,omitempty"`
 		AutoPull         bool   `yaml:"auto_pull,omitempty"`
 		Depth            int    `yaml:"depth,omitempty"`
 		QueueSize        int    `yaml:"queue_size,omitempty"`
+		QueueOverflow    int    `yaml:"queue_overflow,omitempty"`
 		QueueWorkerCount int    `yaml:"worker_count,omitempty"`
+
+		MaxClonesPerMinute int      `yaml:"max_clones_per_minute,omitempty"`
+		CloneDenylist      []string `yaml:"clone_denylist,omitempty"`
+
+		ShutdownGracePeriod time.Duration `yaml:"shutdown_grace_period,omitempty"`
+
+		HistorySize int    `yaml:"history_size"`
+		HistoryFile string `yaml:"history_file,omitempty"`
+
+		IgnoreFile string `yaml:"ignore_file,omitempty"`
+
+		Pins        []string      `yaml:"pins,omitempty"`
+		PinInterval time.Duration `yaml:"pin_interval,omitempty"`
+
+		MaxStoreSize string `yaml:"max_store_size,omitempty"`
+
+		Ephemeral    bool   `yaml:"ephemeral,omitempty"`
+		EphemeralDir string `yaml:"ephemeral_dir,omitempty"`
+
+		EncryptedStore     string `yaml:"encrypted_store,omitempty"`
+		EncryptionPassfile string `yaml:"encryption_passfile,omitempty"`
+		EncryptionExtpass  string `yaml:"encryption_extpass,omitempty"`
+	}
+	HTTPConfig struct {
+		Listen                  string        `yaml:"listen,omitempty"`
+		StalledOperationTimeout time.Duration `yaml:"stalled_operation_timeout,omitempty"`
+		PprofListen             string        `yaml:"pprof_listen,omitempty"`
+		ControlSocket           string        `yaml:"control_socket,omitempty"`
+	}
+	TracingConfig struct {
+		Endpoint    string  `yaml:"endpoint,omitempty"`
+		Insecure    bool    `yaml:"insecure,omitempty"`
+		ServiceName string  `yaml:"service_name,omitempty"`
+		SampleRatio float64 `yaml:"sample_ratio"`
+	}
+	NotificationsConfig struct {
+		Desktop      bool          `yaml:"desktop,omitempty"`
+		PullFailures int           `yaml:"pull_failures,omitempty"`
+		TokenExpiry  time.Duration `yaml:"token_expiry,omitempty"`
 	}
 )
 
-func loadConfig(configPath string) (*Config, error) {
+// hasToken returns whether the requests to gitlab are authenticated
+func (c GitlabConfig) hasToken() bool {
+	if c.Token != "" {
+		return true
+	}
+	for _, token := range c.FallbackTokens {
+		if token != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// findConfig returns the config file loaded when none is passed on the command-line, or an empty string if there is none
+func findConfig() string {
+	var dirs []string
+	if configHome, err := os.UserConfigDir(); err == nil {
+		dirs = append(dirs, filepath.Join(configHome, "gitlabfs"))
+	}
+	// For the system services
+	dirs = append(dirs, "/etc/gitlabfs")
+
+	for _, dir := range dirs {
+		for _, name := range []string{"config.yaml", "config.toml", "config.json"} {
+			if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+				return filepath.Join(dir, name)
+			}
+		}
+	}
+	return ""
+}
+
+// configFormats converts the config files written in another format than yaml to yaml, by extension
+// Every format is decoded into the same struct as yaml, so the settings and their validation are the same in each of them
+var configFormats = map[string]func(content []byte) ([]byte, error){
+	".toml": tomlToYAML,
+	".json": jsonToYAML,
+}
+
+// configKey returns the yaml key of a key of a config file converted to yaml
+// The keys of the other formats are always strings, the integer ones are converted back to integers so they decode into the maps keyed by id
+func configKey(key string) interface{} {
+	if i, err := strconv.Atoi(key); err == nil {
+		return i
+	}
+	return key
+}
+
+// readConfig reads the config file, converted to yaml, along with the files it includes
+func readConfig(configPath string) ([]byte, error) {
+	content, _, err := readConfigFiles(configPath)
+	return content, err
+}
+
+// loadConfig loads the config file, with the settings of profile applied if it's not empty
+func loadConfig(configPath string, profile string) (*Config, error) {
 	// defaults
 	dataHome := os.Getenv("XDG_DATA_HOME")
 	if dataHome == "" {
@@ -52,54 +262,527 @@ func loadConfig(configPath string) (*Config, error) {
 	defaultCloneLocation := filepath.Join(dataHome, "gitlabfs")
 
 	config := &Config{
+		Log: LogConfig{
+			Level:  "info",
+			Format: utils.LogFormatText,
+			Levels: map[string]string{},
+			Output: logOutputDefault,
+
+			File:       "",
+			MaxSize:    100,
+			MaxAge:     0,
+			MaxBackups: 5,
+		},
 		FS: FSConfig{
 			Mountpoint:   "",
-			MountOptions: "nodev,nosuid",
+			MountOptions: defaultMountOptions,
+
+			Supervise:    false,
+			RestartDelay: 5 * time.Second,
+
+			UID: os.Getuid(),
+			GID: os.Getgid(),
+
+			EntryTimeout:    0,
+			AttrTimeout:     0,
+			NegativeTimeout: 0,
+
+			CloneCacheTimeout: 0,
+			KernelCache:       true,
+
+			Layout: LayoutConfig{
+				Groups: "groups",
+				Users:  "users",
+				All:    "all",
+				ByID:   ".by-id",
+				Me:     "me",
+				Admin:  ".gitlabfs",
+			},
+			ProjectMode: fs.ProjectModeSymlink,
+
+			CaseInsensitiveLookup: false,
+			ReadWrite:             false,
+			AllowCloneRemoval:     false,
+
+			DeferredMount: false,
 		},
 		Gitlab: GitlabConfig{
 			URL:                "https://gitlab.com",
 			Token:              "",
-			GroupIDs:           []int{9970},
+			FallbackTokens:     []string{},
+			GroupIDs:           GroupList{},
 			UserIDs:            []int{},
 			IncludeCurrentUser: true,
+
+			ArchivedProjectHandling: gitlab.ArchivedProjectShow,
+			NewProjectVisibility:    gitlab.VisibilityPrivate,
+
+			RefreshInterval:       0,
+			GroupRefreshIntervals: map[int]time.Duration{},
+			PrefetchSubgroups:     false,
+			StaleWhileRevalidate:  true,
+			StartupWorkerCount:    8,
+
+			TLSMinVersion:   "",
+			TLSCipherSuites: []string{},
 		},
 		Git: GitConfig{
 			CloneLocation:    defaultCloneLocation,
+			CloneMode:        "",
+			CloneGroup:       "",
 			Remote:           "origin",
 			PullMethod:       "http",
 			OnClone:          "init",
+			OnCorruption:     "report",
+			CloneTrigger:     fs.CloneTriggerLookup,
 			AutoPull:         false,
 			Depth:            0,
 			QueueSize:        200,
+			QueueOverflow:    1000,
 			QueueWorkerCount: 5,
+
+			MaxClonesPerMinute: 0,
+			CloneDenylist:      []string{},
+
+			ShutdownGracePeriod: 30 * time.Second,
+
+			HistorySize: 10,
+			HistoryFile: "",
+
+			Pins:        []string{},
+			PinInterval: 5 * time.Minute,
+
+			MaxStoreSize: "",
+
+			Ephemeral:    false,
+			EphemeralDir: "",
+
+			EncryptedStore:     "",
+			EncryptionPassfile: "",
+			EncryptionExtpass:  "",
+		},
+		HTTP: HTTPConfig{
+			Listen:                  "",
+			StalledOperationTimeout: 15 * time.Minute,
+			PprofListen:             "",
+			ControlSocket:           "",
+		},
+		Tracing: TracingConfig{
+			Endpoint:    "",
+			Insecure:    false,
+			ServiceName: "gitlabfs",
+			SampleRatio: 1,
+		},
+		Notifications: NotificationsConfig{
+			Desktop:      false,
+			PullFailures: 3,
+			TokenExpiry:  7 * 24 * time.Hour,
 		},
 	}
 
 	if configPath != "" {
-		f, err := os.Open(configPath)
+		content, err := readConfig(configPath)
 		if err != nil {
-			return nil, fmt.Errorf("failed to open config file: %v", err)
+			return nil, err
 		}
-		defer f.Close()
-
-		d := yaml.NewDecoder(f)
-		if err := d.Decode(config); err != nil {
+		if err := yaml.Unmarshal(content, config); err != nil {
+			return nil, fmt.Errorf("failed to parse config file: %v", err)
+		}
+		// A misspelled setting would be silently ignored otherwise
+		unknown, err := unknownSettings(content)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse config file: %v", err)
+		}
+		if len(unknown) > 0 {
+			messages := make([]string, 0, len(unknown))
+			for _, err := range unknown {
+				messages = append(messages, err.Error())
+			}
+			return nil, fmt.Errorf("failed to parse config file: %v", strings.Join(messages, "; "))
+		}
+		if profile != "" {
+			if err := applyProfile(config, profile); err != nil {
+				return nil, fmt.Errorf("failed to parse config file: %v", err)
+			}
+		}
+		// Only the profile applied is in effect, the others may hold tokens
+		config.Profiles = nil
+		if err := expandEnv(config); err != nil {
 			return nil, fmt.Errorf("failed to parse config file: %v", err)
 		}
 	}
 
+	if profile != "" && configPath == "" {
+		return nil, fmt.Errorf("profile %v requires a config file", profile)
+	}
+
+	if err := loadCredentials(config); err != nil {
+		return nil, err
+	}
+
+	// The environment takes precedence over the config file, and the command-line over the environment
+	if err := applyEnvOverrides(config); err != nil {
+		return nil, fmt.Errorf("failed to parse environment: %v", err)
+	}
+
 	return config, nil
 }
 
+// configureLogging applies the log configuration to every logger
+func configureLogging(config *Config) error {
+	// Keep the tokens out of the logs and the errors
+	utils.AddSecrets(configSecrets(config)...)
+
+	// parse format, level and levels
+	if err := checkEnum("log.format", config.Log.Format, utils.LogFormatText, utils.LogFormatJSON); err != nil {
+		return err
+	}
+	level, err := utils.ParseLogLevel(config.Log.Level)
+	if err != nil {
+		return err
+	}
+	levels := make(map[string]slog.Level, len(config.Log.Levels))
+	for subsystem, s := range config.Log.Levels {
+		levels[subsystem], err = utils.ParseLogLevel(s)
+		if err != nil {
+			return fmt.Errorf("invalid level of subsystem %v: %v", subsystem, err)
+		}
+	}
+
+	// parse max_size, max_age and max_backups
+	if config.Log.MaxSize < 0 || config.Log.MaxAge < 0 || config.Log.MaxBackups < 0 {
+		return fmt.Errorf("max_size, max_age and max_backups must not be negative")
+	}
+	rotation := utils.RotationParam{
+		MaxSize:    int64(config.Log.MaxSize) * 1024 * 1024,
+		MaxAge:     config.Log.MaxAge,
+		MaxBackups: config.Log.MaxBackups,
+	}
+
+	// Keep the current file open if it's unchanged, so no record is lost while reloading
+	previousFile := logFile
+	var f *utils.RotatingFile
+	if config.Log.File != "" && logFile != nil && logFile.Path() == config.Log.File {
+		logFile.SetRotation(rotation)
+		f = logFile
+		previousFile = nil
+	}
+
+	var handler slog.Handler
+	switch config.Log.Output {
+	case logOutputDefault:
+		if config.Log.File != "" && f == nil {
+			f, err = utils.OpenRotatingFile(config.Log.File, rotation)
+			if err != nil {
+				return err
+			}
+		}
+		var w io.Writer = os.Stdout
+		if f != nil {
+			w = f
+		}
+		handler, err = utils.NewFormatHandler(w, config.Log.Format)
+		if err != nil {
+			if f != nil && f != logFile {
+				f.Close()
+			}
+			return err
+		}
+	case logOutputSyslog:
+		handler, err = utils.NewSyslogHandler("gitlabfs")
+	case logOutputJournald:
+		handler, err = utils.NewJournaldHandler("gitlabfs")
+	default:
+		return fmt.Errorf("output must be either \"%v\" or \"%v\", or empty to write the logs to file or stdout", logOutputSyslog, logOutputJournald)
+	}
+	if err != nil {
+		return err
+	}
+	if f == nil {
+		// The file is not used anymore
+		previousFile = logFile
+	}
+
+	previousHandler := logHandler
+	utils.ConfigureLogging(handler, level, levels)
+	logFile = f
+	logHandler = handler
+	if previousFile != nil {
+		previousFile.Close()
+	}
+	if closer, ok := previousHandler.(io.Closer); ok {
+		closer.Close()
+	}
+	return nil
+}
+
+// makeEffectiveConfig returns a function marshalling the configuration in effect, without its secrets
+func makeEffectiveConfig(config *Config) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		return yaml.Marshal(redactConfig(config))
+	}
+}
+
+// configSecrets returns the tokens of config
+func configSecrets(config *Config) []string {
+	secrets := append([]string{config.Gitlab.Token}, config.Gitlab.FallbackTokens...)
+	secrets = append(secrets, config.Gitlab.GroupIDs.Tokens()...)
+	for _, m := range config.Mounts {
+		secrets = append(secrets, m.GroupIDs.Tokens()...)
+	}
+	for _, deployToken := range config.Gitlab.DeployTokens {
+		secrets = append(secrets, deployToken.Token)
+	}
+	return secrets
+}
+
+// redactConfig returns a copy of config without its secrets
+func redactConfig(config *Config) Config {
+	c := *config
+	// The profiles are not redacted setting by setting, they have no business being shown
+	c.Profiles = nil
+	if c.Gitlab.Token != "" {
+		c.Gitlab.Token = "<redacted>"
+	}
+	if len(c.Gitlab.FallbackTokens) > 0 {
+		c.Gitlab.FallbackTokens = make([]string, len(config.Gitlab.FallbackTokens))
+		for i := range c.Gitlab.FallbackTokens {
+			c.Gitlab.FallbackTokens[i] = "<redacted>"
+		}
+	}
+	if len(c.Gitlab.DeployTokens) > 0 {
+		c.Gitlab.DeployTokens = make(map[string]DeployTokenConfig, len(config.Gitlab.DeployTokens))
+		for groupPath, deployToken := range config.Gitlab.DeployTokens {
+			c.Gitlab.DeployTokens[groupPath] = DeployTokenConfig{Username: deployToken.Username, Token: "<redacted>"}
+		}
+	}
+	c.Gitlab.GroupIDs = config.Gitlab.GroupIDs.redacted()
+	if len(c.Mounts) > 0 {
+		c.Mounts = append([]MountConfig{}, config.Mounts...)
+		for i := range c.Mounts {
+			c.Mounts[i].GroupIDs = config.Mounts[i].GroupIDs.redacted()
+		}
+	}
+	return c
+}
+
+func makeIgnoreFilePath(config *Config) string {
+	if config.Git.IgnoreFile != "" {
+		return config.Git.IgnoreFile
+	}
+	return filepath.Join(config.Git.CloneLocation, git.IgnoreFileName)
+}
+
+// makeMaxStoreSize returns the maximum size of the local copies in bytes, zero if it's not limited
+func makeMaxStoreSize(config *Config) (int64, error) {
+	if config.Git.MaxStoreSize == "" {
+		return 0, nil
+	}
+	size, err := parseSize(config.Git.MaxStoreSize)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("git.max_store_size must be a positive size, eg: \"50G\", got %q", config.Git.MaxStoreSize)
+	}
+	return size, nil
+}
+
+// parseSize parses a size in bytes, optionally followed by a binary unit, eg: 500M or 1.5T
+func parseSize(s string) (int64, error) {
+	s = strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B"), "I")
+	multiplier := float64(1)
+	for i, unit := range "KMGTP" {
+		if strings.HasSuffix(s, string(unit)) {
+			multiplier = float64(int64(1) << (10 * (i + 1)))
+			s = strings.TrimSuffix(s, string(unit))
+			break
+		}
+	}
+	value, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil {
+		return 0, err
+	}
+	return int64(value * multiplier), nil
+}
+
+func makeDaemonLogPath(config *Config) string {
+	if config.FS.DaemonLog != "" {
+		return config.FS.DaemonLog
+	}
+	// Default to a file next to the local clones
+	return filepath.Join(config.Git.CloneLocation, "gitlabfs"+profileSuffix(config)+".log")
+}
+
+func makeInodeTablePath(config *Config) (string, error) {
+	if config.FS.InodeTable != "" {
+		return config.FS.InodeTable, nil
+	}
+
+	// Default to a file next to the local clones of the gitlab instance
+	parsedGitlabURL, err := url.Parse(config.Gitlab.URL)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(config.Git.CloneLocation, parsedGitlabURL.Hostname()+profileSuffix(config)+".inodes"), nil
+}
+
+func makeMetadataDBPath(config *Config) (string, error) {
+	if config.FS.MetadataDB != "" {
+		return config.FS.MetadataDB, nil
+	}
+
+	// Default to a file next to the local clones of the gitlab instance
+	parsedGitlabURL, err := url.Parse(config.Gitlab.URL)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(config.Git.CloneLocation, parsedGitlabURL.Hostname()+profileSuffix(config)+".db"), nil
+}
+
+func makeLayoutConfig(config *Config) (*fs.LayoutParam, error) {
+	layout := config.FS.Layout
+	names := map[string]string{}
+	for key, name := range map[string]string{"groups": layout.Groups, "users": layout.Users, "all": layout.All, "by_id": layout.ByID, "me": layout.Me, "admin": layout.Admin} {
+		if name == "" {
+			continue
+		}
+		if name == "." || name == ".." || strings.Contains(name, "/") {
+			return nil, fmt.Errorf("layout.%v must be a valid folder name, got \"%v\"", key, name)
+		}
+		if other, ok := names[name]; ok {
+			return nil, fmt.Errorf("layout.%v and layout.%v must not have the same name", other, key)
+		}
+		names[name] = key
+	}
+
+	return &fs.LayoutParam{
+		GroupsDir: layout.Groups,
+		UsersDir:  layout.Users,
+		AllDir:    layout.All,
+		ByIDDir:   layout.ByID,
+		AdminDir:  layout.Admin,
+
+		CurrentUserLink: layout.Me,
+	}, nil
+}
+
+func makeOwnerConfig(config *Config) (uid uint32, gid uint32, err error) {
+	if config.FS.UID < 0 || config.FS.GID < 0 {
+		return 0, 0, fmt.Errorf("uid and gid must be positive, got %v and %v", config.FS.UID, config.FS.GID)
+	}
+	return uint32(config.FS.UID), uint32(config.FS.GID), nil
+}
+
+func makeProjectMode(config *Config) (string, error) {
+	// parse project_mode
+	if err := checkEnum("fs.project_mode", config.FS.ProjectMode, fs.ProjectModeSymlink, fs.ProjectModeDirectory, fs.ProjectModeBrowse); err != nil {
+		return "", err
+	}
+	return config.FS.ProjectMode, nil
+}
+
+func makeCloneTrigger(config *Config) (string, error) {
+	// parse clone_trigger
+	if err := checkEnum("git.clone_trigger", config.Git.CloneTrigger, fs.CloneTriggerLookup, fs.CloneTriggerReaddir, fs.CloneTriggerOpen); err != nil {
+		return "", err
+	}
+	// The content of the symlinked local copies is not visible to gitlabfs, resolving the symlink is the only trigger available
+	// The browsed projects are only cloned when they are pulled
+	if config.Git.CloneTrigger != fs.CloneTriggerLookup && config.FS.ProjectMode != fs.ProjectModeDirectory {
+		return "", fmt.Errorf("clone_trigger \"%v\" requires project_mode \"%v\"", config.Git.CloneTrigger, fs.ProjectModeDirectory)
+	}
+	return config.Git.CloneTrigger, nil
+}
+
 func makeGitlabConfig(config *Config) (*gitlab.GitlabClientParam, error) {
 	// parse pull_method
-	if config.Git.PullMethod != gitlab.PullMethodHTTP && config.Git.PullMethod != gitlab.PullMethodSSH {
-		return nil, fmt.Errorf("pull_method must be either \"%v\" or \"%v\"", gitlab.PullMethodHTTP, gitlab.PullMethodSSH)
+	if err := checkEnum("git.pull_method", config.Git.PullMethod, gitlab.PullMethodHTTP, gitlab.PullMethodSSH); err != nil {
+		return nil, err
+	}
+
+	// parse archived_project_handling
+	if err := checkEnum("gitlab.archived_project_handling", config.Gitlab.ArchivedProjectHandling, gitlab.ArchivedProjectShow, gitlab.ArchivedProjectHide, gitlab.ArchivedProjectIgnore); err != nil {
+		return nil, err
+	}
+
+	// parse new_project_visibility
+	if err := checkEnum("gitlab.new_project_visibility", config.Gitlab.NewProjectVisibility, gitlab.VisibilityPrivate, gitlab.VisibilityInternal, gitlab.VisibilityPublic); err != nil {
+		return nil, err
+	}
+
+	// parse refresh_interval and group_refresh_intervals
+	if config.Gitlab.RefreshInterval < 0 {
+		return nil, fmt.Errorf("refresh_interval must not be negative")
+	}
+	for gid, interval := range config.Gitlab.GroupRefreshIntervals {
+		if interval < 0 {
+			return nil, fmt.Errorf("the refresh interval of group %v must not be negative", gid)
+		}
+	}
+
+	// parse startup_worker_count
+	if config.Gitlab.StartupWorkerCount < 1 {
+		return nil, fmt.Errorf("startup_worker_count must be at least 1")
+	}
+
+	// parse the settings overridden by the groups
+	groupParams, refreshIntervals, err := makeGroupParams(config)
+	if err != nil {
+		return nil, err
+	}
+	// The refresh interval of a group entry takes precedence over group_refresh_intervals
+	groupRefreshIntervals := make(map[int]time.Duration, len(config.Gitlab.GroupRefreshIntervals)+len(refreshIntervals))
+	for gid, interval := range config.Gitlab.GroupRefreshIntervals {
+		groupRefreshIntervals[gid] = interval
+	}
+	for gid, interval := range refreshIntervals {
+		groupRefreshIntervals[gid] = interval
+	}
+
+	// parse deploy_tokens
+	deployTokens := make(map[string]gitlab.DeployToken, len(config.Gitlab.DeployTokens))
+	for groupPath, deployToken := range config.Gitlab.DeployTokens {
+		if deployToken.Username == "" || deployToken.Token == "" {
+			return nil, fmt.Errorf("the username and the token of the deploy token of group %v must be set", groupPath)
+		}
+		deployTokens[strings.Trim(groupPath, "/")] = gitlab.DeployToken{Username: deployToken.Username, Token: deployToken.Token}
+	}
+
+	// parse pinned_refs
+	pinnedRefs := make([]gitlab.PinnedRef, 0, len(config.Gitlab.PinnedRefs))
+	for i, pin := range config.Gitlab.PinnedRefs {
+		if _, err := path.Match(pin.Projects, ""); err != nil || pin.Projects == "" {
+			return nil, fmt.Errorf("invalid projects pattern %q of gitlab.pinned_refs[%v]", pin.Projects, i)
+		}
+		switch {
+		case pin.Branch != "" && pin.Tag == "":
+			pinnedRefs = append(pinnedRefs, gitlab.PinnedRef{Pattern: pin.Projects, Ref: "refs/heads/" + pin.Branch})
+		case pin.Tag != "" && pin.Branch == "":
+			pinnedRefs = append(pinnedRefs, gitlab.PinnedRef{Pattern: pin.Projects, Ref: "refs/tags/" + pin.Tag})
+		default:
+			return nil, fmt.Errorf("exactly one of the branch and the tag of gitlab.pinned_refs[%v] must be set", i)
+		}
+	}
+
+	// parse tls_min_version and tls_cipher_suites
+	tlsConfig, _, err := makeTLSConfig(config)
+	if err != nil {
+		return nil, err
 	}
 
 	return &gitlab.GitlabClientParam{
-		PullMethod:         config.Git.PullMethod,
-		IncludeCurrentUser: config.Gitlab.IncludeCurrentUser && config.Gitlab.Token != "",
+		PullMethod:              config.Git.PullMethod,
+		IncludeCurrentUser:      config.Gitlab.IncludeCurrentUser && config.Gitlab.hasToken(),
+		ArchivedProjectHandling: config.Gitlab.ArchivedProjectHandling,
+		NewProjectVisibility:    config.Gitlab.NewProjectVisibility,
+		SkipEmptyProjects:       config.Gitlab.SkipEmpty,
+		RefreshInterval:         config.Gitlab.RefreshInterval,
+		GroupRefreshIntervals:   groupRefreshIntervals,
+		PrefetchSubgroups:       config.Gitlab.PrefetchSubgroups,
+		StaleWhileRevalidate:    config.Gitlab.StaleWhileRevalidate,
+		GroupParams:             groupParams,
+		TLSConfig:               tlsConfig,
+		FallbackTokens:          config.Gitlab.FallbackTokens,
+		PinnedRefs:              pinnedRefs,
+		DeployTokens:            deployTokens,
 	}, nil
 }
 
@@ -111,92 +794,587 @@ func makeGitConfig(config *Config) (*git.GitClientParam, error) {
 	}
 
 	// parse on_clone
-	cloneMethod := 0
-	if config.Git.OnClone == "init" {
-		cloneMethod = git.CloneInit
-	} else if config.Git.OnClone == "clone" {
+	if err := checkEnum("git.on_clone", config.Git.OnClone, "init", "clone"); err != nil {
+		return nil, err
+	}
+	cloneMethod := git.CloneInit
+	if config.Git.OnClone == "clone" {
 		cloneMethod = git.CloneClone
-	} else {
-		return nil, fmt.Errorf("on_clone must be either \"init\" or \"clone\"")
+	}
+
+	// parse on_corruption
+	if err := checkEnum("git.on_corruption", config.Git.OnCorruption, "report", "reclone"); err != nil {
+		return nil, err
+	}
+
+	// parse max_clones_per_minute
+	if config.Git.MaxClonesPerMinute < 0 {
+		return nil, fmt.Errorf("max_clones_per_minute must not be negative")
+	}
+
+	// parse queue_overflow
+	if config.Git.QueueOverflow < 0 {
+		return nil, fmt.Errorf("queue_overflow must not be negative")
+	}
+
+	// parse history_size
+	if config.Git.HistorySize < 0 {
+		return nil, fmt.Errorf("history_size must not be negative")
+	}
+
+	// parse clone_mode and clone_group
+	var cloneMode os.FileMode
+	if config.Git.CloneMode != "" {
+		mode, err := strconv.ParseUint(config.Git.CloneMode, 8, 32)
+		if err != nil || mode > 0777 {
+			return nil, fmt.Errorf("git.clone_mode must be an octal mode, eg: \"0700\", got %q", config.Git.CloneMode)
+		}
+		if mode&0700 != 0700 {
+			return nil, fmt.Errorf("git.clone_mode must let the owner read, write and traverse the folders, eg: \"0700\", got %q", config.Git.CloneMode)
+		}
+		cloneMode = os.FileMode(mode)
+	}
+	cloneGID := -1
+	if config.Git.CloneGroup != "" {
+		group, err := user.LookupGroup(config.Git.CloneGroup)
+		if err != nil {
+			group, err = user.LookupGroupId(config.Git.CloneGroup)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("git.clone_group must be the name or the id of a group, got %q", config.Git.CloneGroup)
+		}
+		cloneGID, err = strconv.Atoi(group.Gid)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The tls policy of the gitlab api also applies to git over http
+	_, httpConfig, err := makeTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// parse worker_count
+	if config.Git.QueueWorkerCount < 1 {
+		return nil, fmt.Errorf("git.worker_count must be at least 1")
+	}
+
+	// parse pull_failures, only reported by the desktop notifications
+	if config.Notifications.PullFailures < 0 {
+		return nil, fmt.Errorf("notifications.pull_failures must not be negative")
+	}
+	pullFailureThreshold := 0
+	if config.Notifications.Desktop {
+		pullFailureThreshold = config.Notifications.PullFailures
 	}
 
 	return &git.GitClientParam{
 		CloneLocation:    config.Git.CloneLocation,
+		CloneMode:        cloneMode,
+		CloneGID:         cloneGID,
 		RemoteName:       config.Git.Remote,
 		RemoteURL:        parsedGitlabURL,
 		CloneMethod:      cloneMethod,
 		AutoPull:         config.Git.AutoPull,
 		PullDepth:        config.Git.Depth,
+		HTTPConfig:       httpConfig,
 		QueueSize:        config.Git.QueueSize,
 		QueueWorkerCount: config.Git.QueueWorkerCount,
+
+		QueueOverflowSize: config.Git.QueueOverflow,
+
+		MaxClonesPerMinute: config.Git.MaxClonesPerMinute,
+
+		ShutdownGracePeriod: config.Git.ShutdownGracePeriod,
+
+		HistorySize: config.Git.HistorySize,
+		HistoryFile: config.Git.HistoryFile,
+
+		PullFailureThreshold: pullFailureThreshold,
+
+		RecloneCorrupted: config.Git.OnCorruption == "reclone",
+
+		IgnoreFile: makeIgnoreFilePath(config),
 	}, nil
 }
 
 func main() {
-	configPath := flag.String("config", "", "The config file")
-	mountoptionsFlag := flag.String("o", "", "Filesystem mount options. See mount.fuse(8)")
-	debug := flag.Bool("debug", false, "Enable debug logging")
+	subcommands := map[string]func(args []string) error{
+		"mount":         mountFilesystem,
+		"umount":        unmountFilesystem,
+		"status":        printStatus,
+		"refresh":       refreshFilesystem,
+		"prefetch":      prefetchProjects,
+		"path":          resolveProject,
+		"gc":            collectGarbage,
+		"mirror":        mirrorProjects,
+		"inventory":     manageInventory,
+		"fsck":          verifyLocalCopies,
+		"dedupe":        dedupeLocalCopies,
+		"ctl":           controlInstance,
+		"check":         checkConfig,
+		"install-unit":  installUnit,
+		"config-schema": printConfigSchema,
+		"print-config":  printConfig,
+		"users":         serveUsers,
+		"version":       printVersion,
+	}
+	// Without a subcommand, mount the filesystem
+	subcommand, args := mountFilesystem, os.Args[1:]
+	if isMountHelper() {
+		subcommand = runMountHelper
+	} else if len(os.Args) > 1 {
+		if s, ok := subcommands[os.Args[1]]; ok {
+			subcommand, args = s, os.Args[2:]
+		}
+	}
+	if err := subcommand(args); err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+}
+
+// mountFilesystem implements the mount subcommand, the default when no subcommand is given
+func mountFilesystem(args []string) error {
+	flags := flag.NewFlagSet("mount", flag.ExitOnError)
+	configPath := flags.String("config", findConfig(), "The config file")
+	profile := flags.String("profile", "", "The profile of the config file to apply")
+	mountoptionsFlag := flags.String("o", "", "Filesystem mount options. See mount.fuse(8)")
+	debug := flags.Bool("debug", false, "Enable debug logging")
+	daemon := flags.Bool("daemon", false, "Run in the background once the filesystem is mounted")
+	superviseFlag := flags.Bool("supervise", false, "Mount the filesystem again when gitlabfs crashes or the filesystem hangs. Overrides fs.supervise")
+	dryRunFlag := flags.Bool("dry-run", false, "Print the tree that would be mounted and the location of the local copies, without mounting the filesystem")
+	applyConfigFlags := addConfigFlags(flags)
 
-	flag.Usage = func() {
+	flags.Usage = func() {
 		fmt.Println("USAGE:")
-		fmt.Printf("    %s MOUNTPOINT\n\n", os.Args[0])
+		fmt.Printf("    %s [mount] [-config CONFIG] [-profile PROFILE] MOUNTPOINT\n", os.Args[0])
+		fmt.Printf("    %s umount [-config CONFIG] [MOUNTPOINT...]\n", os.Args[0])
+		fmt.Printf("    %s status [-config CONFIG] [MOUNTPOINT...]\n", os.Args[0])
+		fmt.Printf("    %s refresh [-config CONFIG] [PATH...]\n", os.Args[0])
+		fmt.Printf("    %s prefetch [-config CONFIG] [PATH...]\n", os.Args[0])
+		fmt.Printf("    %s path [-config CONFIG] PROJECT\n", os.Args[0])
+		fmt.Printf("    %s gc [-config CONFIG]\n", os.Args[0])
+		fmt.Printf("    %s mirror [-config CONFIG] [-interval INTERVAL] [-once]\n", os.Args[0])
+		fmt.Printf("    %s inventory export|import [-config CONFIG]\n", os.Args[0])
+		fmt.Printf("    %s fsck [-config CONFIG] [-full]\n", os.Args[0])
+		fmt.Printf("    %s dedupe [-config CONFIG] [-dry-run]\n", os.Args[0])
+		fmt.Printf("    %s ctl [-config CONFIG] COMMAND\n", os.Args[0])
+		fmt.Printf("    %s check [-config CONFIG]\n", os.Args[0])
+		fmt.Printf("    %s install-unit [-config CONFIG]\n", os.Args[0])
+		fmt.Printf("    %s config-schema\n", os.Args[0])
+		fmt.Printf("    %s print-config [-config CONFIG] [-profile PROFILE]\n", os.Args[0])
+		fmt.Printf("    %s users [-mount-root MOUNT_ROOT] [-users-dir USERS_DIR]\n", os.Args[0])
+		fmt.Printf("    %s version\n\n", os.Args[0])
 		fmt.Println("OPTIONS:")
-		flag.PrintDefaults()
+		flags.PrintDefaults()
 	}
-	flag.Parse()
+	flags.Parse(args)
 
-	config, err := loadConfig(*configPath)
+	mountpointArg := flags.Arg(0)
+	if flags.NArg() >= 2 {
+		// Invoked by mount.fuse as "gitlabfs CONFIG MOUNTPOINT -o OPTIONS", eg: by the mount unit written by install-unit
+		// mount waits for us to exit, so fork in the background once the filesystem is mounted
+		*configPath = strings.TrimPrefix(flags.Arg(0), fstabSourcePrefix)
+		mountpointArg = flags.Arg(1)
+		flags.Parse(flags.Args()[2:])
+		*mountoptionsFlag = fstabMountoptions(*mountoptionsFlag)
+		*daemon = true
+	}
+
+	config, err := loadConfig(*configPath, *profile)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return err
 	}
+	if err := applyConfigFlags(config); err != nil {
+		return err
+	}
+	if err := configureLogging(config); err != nil {
+		return err
+	}
+	if *configPath == "" {
+		logger.Warn("no config file found, using the default settings. Pass -config or write $XDG_CONFIG_HOME/gitlabfs/config.yaml")
+	}
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "supervise" {
+			config.FS.Supervise = *superviseFlag
+		}
+	})
 
-	// Configure mountpoint
-	mountpoint := config.FS.Mountpoint
-	if flag.NArg() == 1 {
-		mountpoint = flag.Arg(0)
+	// The daemon log and the control socket stay next to the configured clone location, where the other subcommands find them
+	daemonLogPath := makeDaemonLogPath(config)
+	controlSocketPath, err := makeControlSocketPath(config)
+	if err != nil {
+		return err
+	}
+	// Keep the local copies in a temporary folder removed on unmount, created by the process serving the filesystems
+	if config.Git.Ephemeral && !*dryRunFlag && !(config.FS.Supervise && !isSupervisedChild()) {
+		removeCloneLocation, err := makeEphemeralCloneLocation(config)
+		if err != nil {
+			return err
+		}
+		defer removeCloneLocation()
+	}
+	// Unlock the encrypted local copies, locked again on exit by the process owning the filesystems
+	if !*dryRunFlag {
+		store, err := makeEncryptedStore(config)
+		if err != nil {
+			return err
+		}
+		if store != nil {
+			if _, err := store.unlock(); err != nil {
+				return err
+			}
+			if !isSupervisedChild() && !(*daemon && !isDaemonChild()) {
+				defer func() {
+					if err := store.lock(); err != nil {
+						logger.Error(err.Error())
+					}
+				}()
+			}
+		}
 	}
-	if mountpoint == "" {
-		fmt.Println("Mountpoint is not configured in config file and missing from command-line arguments")
-		flag.Usage()
+
+	// Configure the mounts
+	mounts, err := makeMounts(config, mountpointArg, *mountoptionsFlag)
+	if err != nil {
+		return err
+	}
+	if len(mounts) == 0 {
+		logger.Error("mountpoint is not configured in config file and missing from command-line arguments")
+		flags.Usage()
 		os.Exit(2)
 	}
+	for _, m := range mounts {
+		if err := checkScope(m, len(config.Mounts) > 0); err != nil {
+			return err
+		}
+		if err := checkMountoptions(m, len(config.Mounts) > 0); err != nil {
+			return err
+		}
+	}
+
+	// Only one instance manages the clone location, the process owning the filesystems holds the lock for as long as they are mounted
+	// The process forking in the background only checks it, so the error shows up on the terminal
+	if !*dryRunFlag && !isSupervisedChild() {
+		lockPath, err := makeInstanceLockPath(config)
+		if err != nil {
+			return err
+		}
+		mountpoints := make([]string, 0, len(mounts))
+		for _, m := range mounts {
+			mountpoint, _ := filepath.Abs(m.mountpoint)
+			mountpoints = append(mountpoints, mountpoint)
+		}
+		lock, err := acquireInstanceLock(lockPath, instanceInfo{Command: "mount", Mountpoints: mountpoints})
+		if err != nil {
+			return err
+		}
+		if *daemon && !isDaemonChild() {
+			lock.release()
+		} else {
+			defer lock.release()
+		}
+	}
+
+	// Serve the filesystems from a child process, mounted again when it crashes
+	if config.FS.Supervise && !*dryRunFlag && !isSupervisedChild() {
+		if *daemon && !isDaemonChild() {
+			return daemonize(daemonLogPath)
+		}
+		mountpoints := make([]string, 0, len(mounts))
+		for _, m := range mounts {
+			mountpoints = append(mountpoints, m.mountpoint)
+		}
+		return supervise(mountpoints, config.FS.RestartDelay)
+	}
+
+	// Create the gitlab client, shared by every mount
+	gitlabClientParam, err := makeGitlabConfig(config)
+	if err != nil {
+		return err
+	}
+	// The metadata database is only opened once the clone location is prepared, the fetches before are not recorded, eg: by a dry run
+	var metadataStore *metadata.Store
+	gitlabClientParam.OnGroupFetched = func(group *gitlab.Group, err error) {
+		metadataStore.RecordFetch(metadata.KindGroup, group.ID, group.FullPath, err)
+	}
+	gitlabClientParam.OnUserFetched = func(user *gitlab.User, err error) {
+		metadataStore.RecordFetch(metadata.KindUser, user.ID, user.Name, err)
+	}
+	gitlabClient, _ := gitlab.NewClient(config.Gitlab.URL, config.Gitlab.Token, *gitlabClientParam)
+
+	// Configure the layout
+	layoutParam, err := makeLayoutConfig(config)
+	if err != nil {
+		return err
+	}
+
+	if *dryRunFlag {
+		if err := dryRun(context.Background(), os.Stdout, mounts, gitlabClient, layoutParam); err != nil {
+			return err
+		}
+		return nil
+	}
 
-	// Configure mountoptions
-	mountoptions := config.FS.MountOptions
-	if *mountoptionsFlag != "" {
-		mountoptions = *mountoptionsFlag
+	// Configure the project mode
+	projectMode, err := makeProjectMode(config)
+	if err != nil {
+		return err
 	}
-	parsedMountoptions := make([]string, 0)
-	if mountoptions != "" {
-		parsedMountoptions = strings.Split(mountoptions, ",")
+
+	// Configure the owner of the filesystem
+	uid, gid, err := makeOwnerConfig(config)
+	if err != nil {
+		return err
 	}
 
-	// Create the git client
+	// Reported once every filesystem is mounted, or failed to
+	var ready sync.WaitGroup
+	ready.Add(len(mounts))
+
+	health := &healthChecker{
+		gitlab:                  gitlabClient,
+		stalledOperationTimeout: config.HTTP.StalledOperationTimeout,
+	}
+
+	// The clone location is shared by every mount, along with its git client
 	gitClientParam, err := makeGitConfig(config)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return err
+	}
+	if err := git.PrepareCloneLocation(*gitClientParam); err != nil {
+		return err
 	}
-	gitClient, _ := git.NewClient(*gitClientParam)
 
-	// Create the gitlab client
-	gitlabClientParam, err := makeGitlabConfig(config)
+	// The metadata database is shared by every mount
+	// The filesystem can still be used without it, eg: when another instance already holds it
+	metadataPath, err := makeMetadataDBPath(config)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return err
+	}
+	metadataStore, err = metadata.Open(metadataPath)
+	if err != nil {
+		logger.Error("failed to open the metadata database", "error", err)
 	}
-	gitlabClient, _ := gitlab.NewClient(config.Gitlab.URL, config.Gitlab.Token, *gitlabClientParam)
 
-	// Start the filesystem
-	err = fs.Start(
-		mountpoint,
-		parsedMountoptions,
-		&fs.FSParam{Git: gitClient, Gitlab: gitlabClient, RootGroupIds: config.Gitlab.GroupIDs, UserIds: config.Gitlab.UserIDs},
-		*debug,
-	)
+	// The size of the clone location is limited with the pinned projects of every mount
+	maxStoreSize, err := makeMaxStoreSize(config)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return err
+	}
+	gitClientParam.MaxStoreSize = maxStoreSize
+	for _, m := range mounts {
+		for _, pin := range m.config.Git.Pins {
+			gitClientParam.PinnedProjects = append(gitClientParam.PinnedProjects, strings.Trim(pin, "/"))
+		}
+	}
+	gitClientParam.OnRepeatedPullFailure = notifyPullFailure
+	gitClientParam.OnOperationDone = func(opType string, repo string, err error) {
+		metadataStore.RecordOperation(repo, err)
+	}
+	gitClient, err := git.NewClient(*gitClientParam)
+	if err != nil {
+		return err
+	}
+
+	// The config file is reloaded by every mount, the clients are reconfigured once
+	reloadConfig := makeConfigReloader(*configPath, *profile, applyConfigFlags, config, gitlabClient, gitClient)
+
+	params := make([]*fs.FSParam, 0, len(mounts))
+	// A project pinned by several mounts is kept by the first one
+	pinned := map[string]bool{}
+	var startPinKeepers []func(ctx context.Context)
+	for _, m := range mounts {
+		if err := prepareMountpoint(m.mountpoint, config.FS.CreateMountpoint); err != nil {
+			return err
+		}
+
+		pins, err := makePins(m.config, pinned)
+		if err != nil {
+			return err
+		}
+		if len(pins) > 0 {
+			pinInterval := m.config.Git.PinInterval
+			startPinKeepers = append(startPinKeepers, func(ctx context.Context) {
+				keepPinnedProjects(ctx, gitlabClient, gitClient, pins, pinInterval)
+			})
+		}
+
+		mountHealth := &mountHealth{
+			name:       m.name,
+			mountpoint: m.mountpoint,
+			git:        gitClient,
+		}
+		health.mounts = append(health.mounts, mountHealth)
+
+		cloneTrigger, err := makeCloneTrigger(m.config)
+		if err != nil {
+			return err
+		}
+
+		// Configure the inode table
+		inodeTablePath, err := makeInodeTablePath(m.config)
+		if err != nil {
+			return err
+		}
+
+		params = append(params, &fs.FSParam{
+			Git:                   gitClient,
+			Gitlab:                gitlabClient,
+			RootGroupIds:          m.config.Gitlab.GroupIDs.IDs(),
+			UserIds:               m.config.Gitlab.UserIDs,
+			StartupWorkerCount:    m.config.Gitlab.StartupWorkerCount,
+			DeferredMount:         m.config.FS.DeferredMount,
+			Layout:                *layoutParam,
+			ProjectMode:           projectMode,
+			CloneTrigger:          cloneTrigger,
+			CloneDenylist:         m.config.Git.CloneDenylist,
+			UID:                   uid,
+			GID:                   gid,
+			ReadWrite:             m.config.FS.ReadWrite,
+			CaseInsensitiveLookup: m.config.FS.CaseInsensitiveLookup,
+			AllowCloneRemoval:     m.config.FS.AllowCloneRemoval,
+			EffectiveConfig:       makeEffectiveConfig(m.config),
+			BuildInfo:             marshalBuildInfo,
+			Reloader:              makeReloader(reloadConfig, m, mountpointArg, *mountoptionsFlag),
+			InodeTablePath:        inodeTablePath,
+			AuditLogPath:          m.config.FS.AuditLog,
+			Metadata:              metadataStore,
+			CloneLocation:         config.Git.CloneLocation,
+			EntryTimeout:          config.FS.EntryTimeout,
+			AttrTimeout:           config.FS.AttrTimeout,
+			NegativeTimeout:       config.FS.NegativeTimeout,
+			CloneCacheTimeout:     config.FS.CloneCacheTimeout,
+			KernelCache:           config.FS.KernelCache,
+			OnMounted: func() {
+				mountHealth.mounted.Store(true)
+				ready.Done()
+			},
+		})
+	}
+
+	// Fork in the background
+	if *daemon && !isDaemonChild() {
+		if err := daemonize(daemonLogPath); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	go func() {
+		ready.Wait()
+		if config.FS.PIDFile != "" {
+			if err := writePIDFile(config.FS.PIDFile); err != nil {
+				logger.Error("failed to write the pid file", "error", err)
+			}
+		}
+		// The foreground process or the supervisor report a failure when none of the filesystems could be mounted
+		if isDaemonChild() && health.anyMounted() {
+			notifyDaemonReady()
+		}
+		// The root groups and users are resolved while mounting, the filesystem is fully usable by now
+		if err := sdNotify("READY=1"); err != nil {
+			logger.Warn("failed to report readiness to systemd", "error", err)
+		}
+		startWatchdog(health)
+	}()
+
+	if config.HTTP.Listen != "" {
+		startHTTPServer(config.HTTP.Listen, health)
+	}
+	if config.HTTP.PprofListen != "" {
+		startPprofServer(config.HTTP.PprofListen)
+	}
+	if config.Notifications.Desktop && config.Gitlab.hasToken() {
+		startTokenExpiryCheck(gitlabClient, config.Notifications.TokenExpiry)
+	}
+	// The filesystem can still be used without the control api, eg: when another instance already holds the socket
+	controlListener, err := startControlServer(controlSocketPath, health, params)
+	if err != nil {
+		logger.Error("failed to start the control api", "error", err)
+	}
+	// Apply the changes to the config file as soon as it's saved
+	var configWatcher io.Closer
+	if *configPath != "" {
+		// The files included since the start are not watched, they are only loaded when the config file is reloaded
+		configFiles := []string{*configPath}
+		if _, files, err := readConfigFiles(*configPath); err == nil {
+			configFiles = files
+		}
+		configWatcher, err = watchConfig(configFiles, func() {
+			for i, param := range params {
+				if err := param.Reload(); err != nil {
+					logger.Warn("failed to reload configuration", "mount", mounts[i].name, "error", err)
+				}
+			}
+		})
+		if err != nil {
+			logger.Error("failed to watch the config file, send SIGHUP to reload it", "error", err)
+		}
+	}
+
+	stopTracing, err := startTracing(config)
+	if err != nil {
+		return err
+	}
+
+	// Keep the pinned projects up to date for as long as the filesystems are mounted
+	pinCtx, stopPinKeepers := context.WithCancel(context.Background())
+	for _, start := range startPinKeepers {
+		go start(pinCtx)
+	}
+
+	// Start the filesystems
+	var wg sync.WaitGroup
+	errs := make([]error, len(mounts))
+	for i, m := range mounts {
+		wg.Add(1)
+		go func(i int, m *mount) {
+			defer wg.Done()
+			errs[i] = fs.Start(m.mountpoint, m.mountoptions, params[i], *debug)
+			health.mounts[i].mounted.Store(false)
+			if errs[i] != nil {
+				logger.Error("failed to mount", "mount", m.name, "error", errs[i])
+				// The filesystem will never be mounted, don't hold the others
+				ready.Done()
+			}
+		}(i, m)
+	}
+	wg.Wait()
+	stopPinKeepers()
+
+	if err := sdNotify("STOPPING=1"); err != nil {
+		logger.Warn("failed to report shutdown to systemd", "error", err)
+	}
+	if controlListener != nil {
+		controlListener.Close()
+	}
+	if configWatcher != nil {
+		configWatcher.Close()
+	}
+
+	if config.FS.PIDFile != "" {
+		os.Remove(config.FS.PIDFile)
+	}
+
+	// Let the queued git operations complete before exiting
+	logger.Info("waiting for the pending git operations to complete")
+	if err := gitClient.Close(); err != nil {
+		logger.Error("failed to complete the pending git operations", "error", err)
+	}
+	if err := metadataStore.Close(); err != nil {
+		logger.Error("failed to write the metadata database", "error", err)
+	}
+	if err := stopTracing(context.Background()); err != nil {
+		logger.Error("failed to export the pending traces", "error", err)
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			return errors.New("failed to mount every filesystem")
+		}
 	}
+	return nil
 }
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// writeConfigFile writes a config file named name in dir, and returns its path
+func writeConfigFile(t *testing.T, dir string, name string, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		profile string
+		check   func(t *testing.T, config *Config)
+		err     string
+	}{
+		{
+			name: "yaml",
+			file: "config.yaml",
+			content: `
+gitlab:
+  url: https://gitlab.example.com
+  token: secret-token
+  group_ids: [123, {id: 456, include_subgroups: false}]
+git:
+  clone_location: /tmp/clones
+  worker_count: 2
+`,
+			check: func(t *testing.T, config *Config) {
+				if config.Gitlab.URL != "https://gitlab.example.com" || config.Gitlab.Token != "secret-token" {
+					t.Errorf("unexpected gitlab settings: %+v", config.Gitlab)
+				}
+				if ids := config.Gitlab.GroupIDs.IDs(); !reflect.DeepEqual(ids, []int{123, 456}) {
+					t.Errorf("expected groups 123 and 456, got %v", ids)
+				}
+				if g := config.Gitlab.GroupIDs[1]; g.IncludeSubgroups == nil || *g.IncludeSubgroups {
+					t.Errorf("expected group 456 to exclude its subgroups, got %+v", g)
+				}
+				if config.Git.CloneLocation != "/tmp/clones" || config.Git.QueueWorkerCount != 2 {
+					t.Errorf("unexpected git settings: %+v", config.Git)
+				}
+			},
+		},
+		{
+			name: "defaults",
+			file: "config.yaml",
+			content: `
+gitlab:
+  url: https://gitlab.example.com
+`,
+			check: func(t *testing.T, config *Config) {
+				if config.Git.QueueWorkerCount != 5 || config.Log.Level != "info" || config.FS.RestartDelay != 5*time.Second {
+					t.Errorf("expected the defaults, got %+v", config)
+				}
+			},
+		},
+		{
+			name: "toml",
+			file: "config.toml",
+			content: `
+[gitlab]
+url = "https://gitlab.example.com"
+group_ids = [123]
+
+[git]
+clone_location = "/tmp/clones"
+`,
+			check: func(t *testing.T, config *Config) {
+				if config.Gitlab.URL != "https://gitlab.example.com" || config.Git.CloneLocation != "/tmp/clones" {
+					t.Errorf("unexpected settings: %+v", config)
+				}
+				if ids := config.Gitlab.GroupIDs.IDs(); !reflect.DeepEqual(ids, []int{123}) {
+					t.Errorf("expected group 123, got %v", ids)
+				}
+			},
+		},
+		{
+			name: "profile",
+			file: "config.yaml",
+			content: `
+gitlab:
+  url: https://gitlab.example.com
+  token: default-token
+profiles:
+  work:
+    gitlab:
+      token: work-token
+  home:
+    gitlab:
+      token: home-token
+`,
+			profile: "work",
+			check: func(t *testing.T, config *Config) {
+				if config.Gitlab.Token != "work-token" || config.Gitlab.URL != "https://gitlab.example.com" {
+					t.Errorf("expected the settings of the profile on top of the others, got %+v", config.Gitlab)
+				}
+				if config.Profiles != nil {
+					t.Errorf("expected the profiles to be dropped, got %v", config.Profiles)
+				}
+			},
+		},
+		{
+			name: "profiles dropped without a profile",
+			file: "config.yaml",
+			content: `
+profiles:
+  work:
+    gitlab:
+      token: work-token
+`,
+			check: func(t *testing.T, config *Config) {
+				if config.Profiles != nil || config.Gitlab.Token != "" {
+					t.Errorf("expected the profiles to be dropped, got %v", config.Profiles)
+				}
+			},
+		},
+		{
+			name: "unknown profile",
+			file: "config.yaml",
+			content: `
+profiles:
+  work: {}
+`,
+			profile: "home",
+			err:     "profile home is not defined, the profiles are: work",
+		},
+		{
+			name: "unknown setting",
+			file: "config.yaml",
+			content: `
+git:
+  worker_counts: 2
+`,
+			err: "worker_counts",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := writeConfigFile(t, t.TempDir(), test.file, test.content)
+			config, err := loadConfig(path, test.profile)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected an error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			test.check(t, config)
+		})
+	}
+}
+
+func TestRedactConfig(t *testing.T) {
+	config := &Config{
+		Gitlab: GitlabConfig{
+			Token:          "main-token",
+			FallbackTokens: []string{"fallback-token"},
+			GroupIDs:       GroupList{{ID: 123}, {ID: 456, Token: "group-token"}},
+			DeployTokens: map[string]DeployTokenConfig{
+				"group": {Username: "deployer", Token: "deploy-token"},
+			},
+		},
+		Mounts: []MountConfig{
+			{GroupIDs: GroupList{{ID: 789, Token: "mount-token"}}},
+		},
+		Profiles: map[string]yaml.MapSlice{
+			"work": {{Key: "gitlab", Value: yaml.MapSlice{{Key: "token", Value: "profile-token"}}}},
+		},
+	}
+
+	redacted := redactConfig(config)
+	out, err := yaml.Marshal(redacted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"main-token", "fallback-token", "group-token", "deploy-token", "mount-token", "profile-token"} {
+		if strings.Contains(string(out), secret) {
+			t.Errorf("%v is not redacted:\n%s", secret, out)
+		}
+	}
+	if !strings.Contains(string(out), "deployer") {
+		t.Errorf("expected the username of the deploy token to be kept:\n%s", out)
+	}
+
+	// The config itself is left untouched
+	if config.Gitlab.Token != "main-token" || config.Gitlab.FallbackTokens[0] != "fallback-token" ||
+		config.Gitlab.GroupIDs[1].Token != "group-token" || config.Gitlab.DeployTokens["group"].Token != "deploy-token" ||
+		config.Mounts[0].GroupIDs[0].Token != "mount-token" || config.Profiles == nil {
+		t.Errorf("expected the config to be left untouched, got %+v", config)
+	}
+}
@@ -0,0 +1,344 @@
+package metadata
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/badjware/gitlabfs/utils"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	KindGroup = "groups"
+	KindUser  = "users"
+)
+
+var (
+	projectsBucket   = []byte("projects")
+	localPathsBucket = []byte("local_paths")
+)
+
+// How long the recorded changes are held before being written together
+const flushDelay = time.Second
+
+var logger = utils.NewLogger("metadata")
+
+// Project is what is known of a project across the restarts
+type Project struct {
+	ID int `json:"id"`
+	// Where the project was last found in each filesystem, by mountpoint
+	Mounts map[string]ProjectMount `json:"mounts,omitempty"`
+	// Path of the local copy of the project
+	LocalPath string `json:"local_path,omitempty"`
+	// Last successful clone or pull of the local copy
+	SyncedAt time.Time `json:"synced_at,omitempty"`
+	// Error of the last clone or pull of the local copy, until one succeeds
+	Error   string    `json:"error,omitempty"`
+	ErrorAt time.Time `json:"error_at,omitempty"`
+}
+
+type ProjectMount struct {
+	// Path of the project relative to the mountpoint
+	Path  string `json:"path"`
+	Inode uint64 `json:"inode"`
+}
+
+// Fetch is the last fetch of the content of a group or a user
+type Fetch struct {
+	ID        int       `json:"id"`
+	FullPath  string    `json:"full_path,omitempty"`
+	FetchedAt time.Time `json:"fetched_at,omitempty"`
+	// Error of the last fetch, until one succeeds
+	Error   string    `json:"error,omitempty"`
+	ErrorAt time.Time `json:"error_at,omitempty"`
+}
+
+// Store is a database of the projects, the groups and the users found by gitlabfs, kept next to the local clones
+// The changes are written in the background, at most flushDelay after they are recorded
+// The methods of a nil store do nothing, so the filesystem can be used without it
+type Store struct {
+	db *bolt.DB
+
+	mux     sync.Mutex
+	pending []func(tx *bolt.Tx) error
+	timer   *time.Timer
+	closed  bool
+}
+
+func Open(path string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create metadata database directory: %v", err)
+	}
+	// Only one instance can open the database at a time
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open metadata database %v: %v", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{projectsBucket, localPathsBucket, []byte(KindGroup), []byte(KindUser)} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize metadata database %v: %v", path, err)
+	}
+	return &Store{db: db}, nil
+}
+
+// Close writes the pending changes and closes the database
+func (s *Store) Close() error {
+	if s == nil {
+		return nil
+	}
+	s.mux.Lock()
+	s.closed = true
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.mux.Unlock()
+
+	err := s.flush()
+	if closeErr := s.db.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// RecordProject records that the project is found at path in the filesystem mounted at mountpoint, with the inode, and that its local copy is at localPath
+func (s *Store) RecordProject(pid int, mountpoint string, path string, ino uint64, localPath string) {
+	s.record(func(tx *bolt.Tx) error {
+		var project Project
+		if _, err := get(tx, projectsBucket, pid, &project); err != nil {
+			return err
+		}
+		mount := ProjectMount{Path: path, Inode: ino}
+		if project.Mounts[mountpoint] == mount && project.LocalPath == localPath {
+			return nil
+		}
+
+		if project.LocalPath != localPath && project.LocalPath != "" {
+			if err := tx.Bucket(localPathsBucket).Delete([]byte(project.LocalPath)); err != nil {
+				return err
+			}
+		}
+		if err := tx.Bucket(localPathsBucket).Put([]byte(localPath), []byte(strconv.Itoa(pid))); err != nil {
+			return err
+		}
+		project.ID = pid
+		if project.Mounts == nil {
+			project.Mounts = map[string]ProjectMount{}
+		}
+		project.Mounts[mountpoint] = mount
+		project.LocalPath = localPath
+		return put(tx, projectsBucket, pid, project)
+	})
+}
+
+// SeedProject records where the project was found in the filesystems of another machine, eg: from an inventory, and that its local copy is at localPath
+// The mountpoints already known on this machine are left untouched
+func (s *Store) SeedProject(pid int, mounts map[string]ProjectMount, localPath string) {
+	s.record(func(tx *bolt.Tx) error {
+		var project Project
+		if _, err := get(tx, projectsBucket, pid, &project); err != nil {
+			return err
+		}
+		if project.LocalPath != localPath && project.LocalPath != "" {
+			if err := tx.Bucket(localPathsBucket).Delete([]byte(project.LocalPath)); err != nil {
+				return err
+			}
+		}
+		if err := tx.Bucket(localPathsBucket).Put([]byte(localPath), []byte(strconv.Itoa(pid))); err != nil {
+			return err
+		}
+		project.ID = pid
+		if project.Mounts == nil {
+			project.Mounts = map[string]ProjectMount{}
+		}
+		for mountpoint, mount := range mounts {
+			if _, ok := project.Mounts[mountpoint]; !ok {
+				project.Mounts[mountpoint] = mount
+			}
+		}
+		project.LocalPath = localPath
+		return put(tx, projectsBucket, pid, project)
+	})
+}
+
+// RecordOperation records the outcome of a clone or a pull of the local copy at localPath
+// The operations on a local copy of a project not recorded yet are ignored
+func (s *Store) RecordOperation(localPath string, opErr error) {
+	now := time.Now()
+	s.record(func(tx *bolt.Tx) error {
+		value := tx.Bucket(localPathsBucket).Get([]byte(localPath))
+		if value == nil {
+			return nil
+		}
+		pid, err := strconv.Atoi(string(value))
+		if err != nil {
+			return fmt.Errorf("failed to decode the project of %v: %v", localPath, err)
+		}
+		var project Project
+		if ok, err := get(tx, projectsBucket, pid, &project); err != nil || !ok {
+			return err
+		}
+
+		if opErr != nil {
+			project.Error = utils.Redact(opErr.Error())
+			project.ErrorAt = now
+		} else {
+			project.SyncedAt = now
+			project.Error = ""
+			project.ErrorAt = time.Time{}
+		}
+		return put(tx, projectsBucket, pid, project)
+	})
+}
+
+// RecordFetch records a fetch of the content of the group or the user with the id, depending on kind
+func (s *Store) RecordFetch(kind string, id int, fullPath string, fetchErr error) {
+	now := time.Now()
+	s.record(func(tx *bolt.Tx) error {
+		var fetch Fetch
+		if _, err := get(tx, []byte(kind), id, &fetch); err != nil {
+			return err
+		}
+		fetch.ID = id
+		if fullPath != "" {
+			fetch.FullPath = fullPath
+		}
+		if fetchErr != nil {
+			fetch.Error = utils.Redact(fetchErr.Error())
+			fetch.ErrorAt = now
+		} else {
+			fetch.FetchedAt = now
+			fetch.Error = ""
+			fetch.ErrorAt = time.Time{}
+		}
+		return put(tx, []byte(kind), id, fetch)
+	})
+}
+
+// Project returns what is known of the project with the id, or nil if nothing is
+func (s *Store) Project(pid int) (*Project, error) {
+	if s == nil {
+		return nil, nil
+	}
+	var project Project
+	var ok bool
+	err := s.db.View(func(tx *bolt.Tx) (err error) {
+		ok, err = get(tx, projectsBucket, pid, &project)
+		return err
+	})
+	if err != nil || !ok {
+		return nil, err
+	}
+	return &project, nil
+}
+
+// Projects returns what is known of every project
+func (s *Store) Projects() ([]Project, error) {
+	if s == nil {
+		return nil, nil
+	}
+	var projects []Project
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(projectsBucket).ForEach(func(_, value []byte) error {
+			var project Project
+			if err := json.Unmarshal(value, &project); err != nil {
+				return err
+			}
+			projects = append(projects, project)
+			return nil
+		})
+	})
+	return projects, err
+}
+
+// Fetch returns the last fetch of the group or the user with the id, depending on kind, or nil if it was never fetched
+func (s *Store) Fetch(kind string, id int) (*Fetch, error) {
+	if s == nil {
+		return nil, nil
+	}
+	var fetch Fetch
+	var ok bool
+	err := s.db.View(func(tx *bolt.Tx) (err error) {
+		ok, err = get(tx, []byte(kind), id, &fetch)
+		return err
+	})
+	if err != nil || !ok {
+		return nil, err
+	}
+	return &fetch, nil
+}
+
+// record queues the update to be written with the other changes recorded within flushDelay
+func (s *Store) record(update func(tx *bolt.Tx) error) {
+	if s == nil {
+		return
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.closed {
+		return
+	}
+	s.pending = append(s.pending, update)
+	if s.timer == nil {
+		s.timer = time.AfterFunc(flushDelay, func() {
+			if err := s.flush(); err != nil {
+				logger.Warn("failed to write the metadata database", "error", err)
+			}
+		})
+	}
+}
+
+// flush writes the pending changes in a single transaction
+// A change which cannot be written is skipped, so it does not prevent the others from being written
+func (s *Store) flush() error {
+	s.mux.Lock()
+	pending := s.pending
+	s.pending = nil
+	s.timer = nil
+	s.mux.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, update := range pending {
+			if err := update(tx); err != nil {
+				logger.Warn("failed to record metadata", "error", err)
+			}
+		}
+		return nil
+	})
+}
+
+// get decodes the value of the id in the bucket into v, and returns whether it was found
+func get(tx *bolt.Tx, bucket []byte, id int, v interface{}) (bool, error) {
+	value := tx.Bucket(bucket).Get([]byte(strconv.Itoa(id)))
+	if value == nil {
+		return false, nil
+	}
+	if err := json.Unmarshal(value, v); err != nil {
+		return false, fmt.Errorf("failed to decode %s %v: %v", bucket, id, err)
+	}
+	return true, nil
+}
+
+func put(tx *bolt.Tx, bucket []byte, id int, v interface{}) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(bucket).Put([]byte(strconv.Itoa(id)), value)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/badjware/gitlabfs/git"
+	"github.com/badjware/gitlabfs/gitlab"
+)
+
+// How often the pending git operations are checked for completion
+const mirrorPollInterval = time.Second
+
+// mirrorProjects implements the mirror subcommand
+// It keeps the local copies of every project of the config in sync without mounting the filesystem, eg: to back up a gitlab instance
+func mirrorProjects(args []string) error {
+	flags := flag.NewFlagSet("mirror", flag.ExitOnError)
+	configPath := flags.String("config", findConfig(), "The config file")
+	profile := flags.String("profile", "", "The profile of the config file to apply")
+	interval := flags.Duration("interval", time.Hour, "How long to wait between the passes")
+	once := flags.Bool("once", false, "Run a single pass and exit")
+	prune := flags.Bool("prune", true, "Remove the local copies of the projects no longer visible")
+	flags.Usage = func() {
+		fmt.Println("USAGE:")
+		fmt.Printf("    %s mirror [-config CONFIG] [-profile PROFILE] [-interval INTERVAL] [-once] [-prune=false]\n\n", os.Args[0])
+		fmt.Println("OPTIONS:")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *configPath == "" {
+		flags.Usage()
+		return errors.New("the config file is required, none was found in the default locations")
+	}
+	if *interval <= 0 && !*once {
+		return errors.New("the interval must be positive")
+	}
+	config, err := loadConfig(*configPath, *profile)
+	if err != nil {
+		return err
+	}
+	if err := configureLogging(config); err != nil {
+		return err
+	}
+
+	gitlabClientParam, err := makeGitlabConfig(config)
+	if err != nil {
+		return err
+	}
+	// The archived projects are part of the backup, and their local copy is never pruned
+	gitlabClientParam.ArchivedProjectHandling = gitlab.ArchivedProjectShow
+	gitlabClient, err := gitlab.NewClient(config.Gitlab.URL, config.Gitlab.Token, *gitlabClientParam)
+	if err != nil {
+		return err
+	}
+
+	lockEncryptedStore, err := unlockEncryptedStore(config)
+	if err != nil {
+		return err
+	}
+	defer lockEncryptedStore()
+
+	// The clone location is shared by every mount, so is the git client
+	gitClientParam, err := makeGitConfig(config)
+	if err != nil {
+		return err
+	}
+	if err := git.PrepareCloneLocation(*gitClientParam); err != nil {
+		return err
+	}
+	// A mount using the same clone location would clone and pull the same local copies
+	lockPath, err := makeInstanceLockPath(config)
+	if err != nil {
+		return err
+	}
+	lock, err := acquireInstanceLock(lockPath, instanceInfo{Command: "mirror"})
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+	// Every local copy is pulled on each pass
+	gitClientParam.AutoPull = true
+	gitClient, err := git.NewClient(*gitClientParam)
+	if err != nil {
+		return err
+	}
+	defer gitClient.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	groupIDs, userIDs := configuredNamespaces(config)
+	for {
+		err := mirrorPass(ctx, gitlabClient, gitClient, gitlabClientParam.IncludeCurrentUser, groupIDs, userIDs, *prune)
+		if *once {
+			return err
+		}
+		if err != nil {
+			logger.Error("failed to mirror the projects, trying again on the next pass", "error", err)
+		}
+
+		select {
+		case <-time.After(*interval):
+		case <-ctx.Done():
+			logger.Info("stopping the mirror, waiting for the pending git operations to complete")
+			return nil
+		}
+	}
+}
+
+// mirrorGitClient clones, pulls and removes the local copies of the mirrored projects
+type mirrorGitClient interface {
+	git.GitClonerPuller
+	localCopyRemover
+}
+
+// mirrorPass clones the projects that are not cloned yet, pulls the others, and removes the local copies of the projects no longer visible if prune is true
+// It returns once the git operations it dispatched are completed
+func mirrorPass(ctx context.Context, gitlabClient gitlab.GitlabFetcher, gitClient mirrorGitClient, includeCurrentUser bool, groupIDs []int, userIDs []int, prune bool) error {
+	start := time.Now()
+	visible, err := visibleProjects(ctx, gitlabClient, includeCurrentUser, groupIDs, userIDs)
+	if err != nil {
+		// A project we failed to list is not necessarily gone
+		return fmt.Errorf("%v, not mirroring any project", err)
+	}
+
+	dispatched := map[string]int{}
+	skipped := 0
+	for _, project := range visible {
+		_, op, err := gitClient.CloneOrPull(project.CloneURL, project.ID, project.DefaultBranch, project.PullDepth)
+		if err != nil {
+			// The operation is attempted again on the next pass, eg: when too many clones were started in the last minute
+			logger.Warn("failed to dispatch the git operation", "project", project.ID, "operation", op, "error", err)
+			skipped++
+			continue
+		}
+		if op != "" {
+			dispatched[op]++
+		}
+	}
+
+	removed, kept := 0, 0
+	if prune {
+		removed, kept, err = removeLocalCopies(gitClient, visible, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !waitForGitOperations(ctx, gitClient) {
+		return nil
+	}
+	logger.Info("mirrored the projects", "projects", len(visible), "cloned", dispatched[git.OperationClone], "pulled", dispatched[git.OperationPull], "skipped", skipped, "removed", removed, "kept", kept, "duration", time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// waitForGitOperations returns once the clones and the pulls of the git client are completed
+// It returns false if ctx is done first
+func waitForGitOperations(ctx context.Context, gitClient git.GitClonerPuller) bool {
+	ticker := time.NewTicker(mirrorPollInterval)
+	defer ticker.Stop()
+	for {
+		status := gitClient.Status()
+		if len(status.Queued) == 0 && len(status.Running) == 0 && status.Overflowed == 0 {
+			return true
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
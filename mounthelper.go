@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Names gitlabfs is invoked under by mount(8), eg: through a symlink in /sbin, for the filesystems of type gitlabfs or fuse.gitlabfs
+var mountHelperNames = []string{"mount.gitlabfs", "mount.fuse.gitlabfs"}
+
+// Prefix of the source of the filesystems of type fuse in /etc/fstab, eg: gitlabfs#/etc/gitlabfs/work.yaml
+const fstabSourcePrefix = "gitlabfs#"
+
+// Options of /etc/fstab meant for mount(8) and systemd, which are not mount options of the filesystem
+var fstabOnlyMountOptions = map[string]bool{
+	"defaults": true,
+	"auto":     true,
+	"noauto":   true,
+	"user":     true,
+	"nouser":   true,
+	"users":    true,
+	"owner":    true,
+	"group":    true,
+	"_netdev":  true,
+	"nofail":   true,
+}
+
+// isMountHelper returns whether gitlabfs was invoked by mount(8) as the mount helper of its filesystem type
+func isMountHelper() bool {
+	name := filepath.Base(os.Args[0])
+	for _, helperName := range mountHelperNames {
+		if name == helperName {
+			return true
+		}
+	}
+	return false
+}
+
+// runMountHelper mounts the filesystem as invoked by mount(8), as "mount.gitlabfs SOURCE MOUNTPOINT [-sfnv] [-o OPTIONS] [-t TYPE]"
+// The source is the config file, optionally prefixed like the sources of type fuse, eg: gitlabfs#/etc/gitlabfs/work.yaml
+func runMountHelper(args []string) error {
+	var positional []string
+	var mountoptions string
+	fake := false
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "-o" || arg == "-t":
+			if i+1 == len(args) {
+				return fmt.Errorf("%v requires a value", arg)
+			}
+			if arg == "-o" {
+				mountoptions = args[i+1]
+			}
+			i++
+		case strings.HasPrefix(arg, "-o"):
+			mountoptions = strings.TrimPrefix(arg, "-o")
+		case strings.HasPrefix(arg, "-t"):
+		case strings.HasPrefix(arg, "-") && len(arg) > 1:
+			// -s (sloppy), -n (no mtab) and -v (verbose) do not apply, -f (fake) stops before mounting
+			fake = fake || strings.Contains(arg, "f")
+		default:
+			positional = append(positional, arg)
+		}
+	}
+	if len(positional) != 2 {
+		fmt.Printf("USAGE:\n    %s CONFIG MOUNTPOINT [-o OPTIONS]\n", filepath.Base(os.Args[0]))
+		return errors.New("the config file and the mountpoint are required")
+	}
+	if fake {
+		return nil
+	}
+
+	mountArgs := []string{"-config", strings.TrimPrefix(positional[0], fstabSourcePrefix), "-daemon"}
+	if mountoptions = fstabMountoptions(mountoptions); mountoptions != "" {
+		mountArgs = append(mountArgs, "-o", mountoptions)
+	}
+	// mount waits for us to exit, so fork in the background once the filesystem is mounted
+	mountArgs = append(mountArgs, positional[1])
+	daemonArgs = append([]string{"mount"}, mountArgs...)
+	return mountFilesystem(mountArgs)
+}
+
+// fstabMountoptions returns the mount options passed by mount(8) without the options of /etc/fstab which are not mount options of the filesystem
+// The options for other programs, eg: x-systemd.automount, are left to checkMountoptions
+func fstabMountoptions(mountoptions string) string {
+	var kept []string
+	for _, option := range parseMountoptions(mountoptions) {
+		name, _, _ := strings.Cut(option, "=")
+		if fstabOnlyMountOptions[name] || name == "comment" {
+			continue
+		}
+		kept = append(kept, option)
+	}
+	return strings.Join(kept, ",")
+}
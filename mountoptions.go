@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Mount options which cannot be passed together, eg: because one undoes the other
+var conflictingMountOptions = [][2]string{
+	{"ro", "rw"},
+	{"nosuid", "suid"},
+	{"nodev", "dev"},
+	{"noexec", "exec"},
+	{"sync", "async"},
+	{"noatime", "atime"},
+	{"allow_other", "allow_root"},
+}
+
+// Mount options taking a number
+var numericMountOptions = []string{"max_read", "blksize"}
+
+// checkMountoptions checks the mount options of m before it's mounted
+// fusermount and the kernel reject the invalid options with an error which does not tell which option is invalid
+func checkMountoptions(m *mount, inMounts bool) error {
+	if err := checkMountoptionList(m.mountoptions, m.config.FS.ReadWrite); err != nil {
+		if inMounts {
+			return fmt.Errorf("invalid mount options of mount %v: %v", m.name, err)
+		}
+		return fmt.Errorf("invalid mount options: %v", err)
+	}
+	return nil
+}
+
+func checkMountoptionList(options []string, readWrite bool) error {
+	var known []string
+	for name := range knownMountOptions {
+		known = append(known, name)
+	}
+	sort.Strings(known)
+
+	passed := map[string]bool{}
+	for _, option := range options {
+		name, value, hasValue := strings.Cut(option, "=")
+		if name == "" {
+			return fmt.Errorf("empty mount option in %q, check for a stray comma", strings.Join(options, ","))
+		}
+		passed[name] = true
+
+		// The options for other programs, eg: x-systemd.automount, are ignored by fusermount
+		if knownMountOptions != nil && !strings.HasPrefix(name, "x-") {
+			takesValue, ok := knownMountOptions[name]
+			if !ok {
+				err := fmt.Errorf("unknown mount option %v", name)
+				if suggestion := suggest(name, known); suggestion != "" {
+					err = fmt.Errorf("%v, did you mean %v?", err, suggestion)
+				}
+				return err
+			}
+			if takesValue && !hasValue {
+				return fmt.Errorf("mount option %v requires a value, eg: %v=VALUE", name, name)
+			}
+			if !takesValue && hasValue {
+				return fmt.Errorf("mount option %v does not take a value, got %q", name, option)
+			}
+		}
+		for _, numeric := range numericMountOptions {
+			if name != numeric {
+				continue
+			}
+			if n, err := strconv.Atoi(value); err != nil || n <= 0 {
+				return fmt.Errorf("mount option %v must be a positive number, got %q", name, value)
+			}
+		}
+	}
+
+	for _, pair := range conflictingMountOptions {
+		if passed[pair[0]] && passed[pair[1]] {
+			return fmt.Errorf("mount options %v and %v cannot be used together", pair[0], pair[1])
+		}
+	}
+	if passed["ro"] && readWrite {
+		return fmt.Errorf("fs.read_write requires the filesystem to be writable, remove ro from the mount options or disable read_write")
+	}
+	for _, option := range []string{"allow_other", "allow_root"} {
+		if passed[option] {
+			if err := checkAllowOther(option); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckMountoptionList(t *testing.T) {
+	tests := []struct {
+		name      string
+		options   string
+		readWrite bool
+		err       string
+	}{
+		{name: "default options", options: defaultMountOptions},
+		{name: "options for other programs", options: "nosuid,x-systemd.automount"},
+		{name: "numeric option", options: "max_read=131072"},
+		{name: "empty option", options: "nosuid,,noexec", err: "empty mount option"},
+		{name: "invalid number", options: "max_read=0", err: "mount option max_read must be a positive number"},
+		{name: "conflicting options", options: "noexec,exec", err: "mount options noexec and exec cannot be used together"},
+		{name: "read only", options: "ro", readWrite: true, err: "fs.read_write requires the filesystem to be writable"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := checkMountoptionList(strings.Split(test.options, ","), test.readWrite)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected an error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/badjware/gitlabfs/utils"
+)
+
+// prepareMountpoint makes sure the filesystem can be mounted on mountpoint
+// A stale mount left by a crashed instance is unmounted, and the mountpoint is created if it's missing and create is true
+func prepareMountpoint(mountpoint string, create bool) error {
+	_, err := os.Stat(mountpoint)
+	if errors.Is(err, syscall.ENOTCONN) {
+		logger.Warn("found a stale mount, unmounting it", "mountpoint", mountpoint)
+		if err := unmountStale(mountpoint); err != nil {
+			return err
+		}
+		_, err = os.Stat(mountpoint)
+	}
+	if os.IsNotExist(err) && create {
+		logger.Info("creating mountpoint", "mountpoint", mountpoint)
+		if err := os.MkdirAll(mountpoint, 0755); err != nil {
+			return fmt.Errorf("failed to create mountpoint: %v", err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("invalid mountpoint: %v", err)
+	}
+	return nil
+}
+
+// unmountStale lazily unmounts the stale mount on mountpoint
+func unmountStale(mountpoint string) error {
+	if err := unmount(mountpoint, unmountStaleCommands); err != nil {
+		return fmt.Errorf("failed to unmount the stale mount in %v: %v", mountpoint, err)
+	}
+	return nil
+}
+
+// unmount unmounts the mount on mountpoint with the first of commands that succeeds
+func unmount(mountpoint string, commands [][]string) error {
+	var errs []error
+	for _, cmd := range commands {
+		args := append([]string{}, cmd[1:]...)
+		_, err := utils.ExecProcess(cmd[0], append(args, mountpoint)...)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Errorf("%v: %v", cmd[0], err))
+	}
+	return fmt.Errorf("%v", errs)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Mount options used when none are configured
+const defaultMountOptions = "nodev,nosuid"
+
+// The mount options accepted by fusermount, and whether they take a value
+var knownMountOptions = map[string]bool{
+	"rw":                  false,
+	"ro":                  false,
+	"suid":                false,
+	"nosuid":              false,
+	"dev":                 false,
+	"nodev":               false,
+	"exec":                false,
+	"noexec":              false,
+	"async":               false,
+	"sync":                false,
+	"dirsync":             false,
+	"atime":               false,
+	"noatime":             false,
+	"nodiratime":          false,
+	"relatime":            false,
+	"norelatime":          false,
+	"strictatime":         false,
+	"nostrictatime":       false,
+	"lazytime":            false,
+	"nolazytime":          false,
+	"allow_other":         false,
+	"allow_root":          false,
+	"auto_unmount":        false,
+	"default_permissions": false,
+	"blkdev":              false,
+	"blksize":             true,
+	"max_read":            true,
+	"fsname":              true,
+	"subtype":             true,
+	"context":             true,
+	"fscontext":           true,
+	"defcontext":          true,
+	"rootcontext":         true,
+}
+
+// The configuration of fusermount
+const fuseConfPath = "/etc/fuse.conf"
+
+// checkAllowOther checks that fusermount lets the user mount the filesystem with option, either allow_other or allow_root
+func checkAllowOther(option string) error {
+	if os.Geteuid() == 0 {
+		return nil
+	}
+	if f, err := os.Open(fuseConfPath); err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if strings.TrimSpace(scanner.Text()) == "user_allow_other" {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("mount option %v requires user_allow_other to be enabled in %v, or gitlabfs to run as root", option, fuseConfPath)
+}
+
+// The mounts of the process, see proc(5)
+const mountInfoPath = "/proc/self/mountinfo"
+
+// mountedFilesystem returns the type and the source of the filesystem mounted on path, eg: fuse.gocryptfs, and whether there is one
+// When several are mounted on path, the last one mounted is returned, the others are hidden below it
+func mountedFilesystem(path string) (fsType string, source string, mounted bool) {
+	path, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", "", false
+	}
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return "", "", false
+	}
+	f, err := os.Open(mountInfoPath)
+	if err != nil {
+		return "", "", false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// eg: 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+		fields := strings.Fields(scanner.Text())
+		sep := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep == -1 || sep+2 >= len(fields) || unescapeMountInfo(fields[4]) != path {
+			continue
+		}
+		fsType, source, mounted = fields[sep+1], unescapeMountInfo(fields[sep+2]), true
+	}
+	return fsType, source, mounted
+}
+
+// unescapeMountInfo returns the field of the mountinfo with its spaces, tabs, newlines and backslashes, escaped in octal, eg: \040
+func unescapeMountInfo(field string) string {
+	if !strings.Contains(field, "\\") {
+		return field
+	}
+	var b strings.Builder
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+4 <= len(field) {
+			if c, err := strconv.ParseUint(field[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(field[i])
+	}
+	return b.String()
+}
+
+// Commands tried in order to lazily unmount a stale mount, the equivalent of `fusermount -uz`
+var unmountStaleCommands = [][]string{
+	{"fusermount3", "-u", "-z"},
+	{"fusermount", "-u", "-z"},
+	{"umount", "-f"},
+}
+
+// Commands tried in order to unmount a filesystem, the equivalent of `fusermount -u`
+var unmountCommands = [][]string{
+	{"fusermount3", "-u"},
+	{"fusermount", "-u"},
+	{"umount"},
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckMountoptionListFusermount(t *testing.T) {
+	tests := []struct {
+		name    string
+		options string
+		err     string
+	}{
+		{name: "known options", options: "nodev,nosuid,fsname=gitlabfs,default_permissions"},
+		{name: "unknown option", options: "nosiud", err: "unknown mount option nosiud, did you mean nosuid?"},
+		{name: "missing value", options: "fsname", err: "mount option fsname requires a value"},
+		{name: "unexpected value", options: "nodev=1", err: "mount option nodev does not take a value"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := checkMountoptionList(strings.Split(test.options, ","), false)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected an error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestUnescapeMountInfo(t *testing.T) {
+	tests := []struct {
+		field string
+		out   string
+	}{
+		{field: "/mnt/clones", out: "/mnt/clones"},
+		{field: "/mnt/my\\040clones", out: "/mnt/my clones"},
+		{field: "/mnt/a\\011b\\134c", out: "/mnt/a\tb\\c"},
+		{field: "/mnt/trailing\\04", out: "/mnt/trailing\\04"},
+		{field: "/mnt/not\\999octal", out: "/mnt/not\\999octal"},
+	}
+	for _, test := range tests {
+		if out := unescapeMountInfo(test.field); out != test.out {
+			t.Errorf("unescapeMountInfo(%q): expected %q, got %q", test.field, test.out, out)
+		}
+	}
+}
+
+func TestMountedFilesystem(t *testing.T) {
+	if _, _, mounted := mountedFilesystem("/"); !mounted {
+		t.Errorf("expected a filesystem to be mounted on /")
+	}
+	if _, _, mounted := mountedFilesystem(t.TempDir()); mounted {
+		t.Errorf("expected no filesystem to be mounted on a new folder")
+	}
+}
@@ -0,0 +1,46 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"path/filepath"
+	"syscall"
+)
+
+// Mount options used when none are configured
+// The BSDs no longer support device files on any filesystem, nodev is rejected by mount_fusefs
+const defaultMountOptions = "nosuid"
+
+// The mount options differ between mount_fusefs and macfuse, they are left to them to validate
+var knownMountOptions map[string]bool
+
+func checkAllowOther(option string) error {
+	return nil
+}
+
+// mountedFilesystem returns whether a filesystem is mounted on path
+// Its type and its source are not known, they are left empty
+func mountedFilesystem(path string) (fsType string, source string, mounted bool) {
+	return "", "", isMountpoint(path)
+}
+
+// Commands tried in order to unmount a stale mount
+// fusermount is not available on macOS and the BSDs
+var unmountStaleCommands = [][]string{
+	{"umount", "-f"},
+}
+
+// Commands tried in order to unmount a filesystem
+var unmountCommands = [][]string{
+	{"umount"},
+}
+
+// isMountpoint returns whether a filesystem is mounted on path
+func isMountpoint(path string) bool {
+	var st, parent syscall.Stat_t
+	if syscall.Stat(path, &st) != nil || syscall.Stat(filepath.Dir(path), &parent) != nil {
+		return false
+	}
+	return st.Dev != parent.Dev
+}
@@ -0,0 +1,33 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckMountoptionListPassThrough(t *testing.T) {
+	// The options of mount_fusefs and macfuse are left to them to validate
+	for _, options := range []string{"nosuid,automounted", "intr,fsname=gitlabfs", "volname=gitlabfs"} {
+		if err := checkMountoptionList(strings.Split(options, ","), false); err != nil {
+			t.Errorf("expected the options %v to be accepted, got %v", options, err)
+		}
+	}
+}
+
+func TestDefaultMountOptions(t *testing.T) {
+	// mount_fusefs rejects nodev
+	for _, option := range strings.Split(defaultMountOptions, ",") {
+		if option == "nodev" {
+			t.Errorf("expected nodev to be left out of the default mount options")
+		}
+	}
+}
+
+func TestMountedFilesystem(t *testing.T) {
+	if _, _, mounted := mountedFilesystem(t.TempDir()); mounted {
+		t.Errorf("expected no filesystem to be mounted on a new folder")
+	}
+}
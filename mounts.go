@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+type MountConfig struct {
+	// Name of the mount, used to name the files of the mount in the clone location
+	// Default to the name of the mountpoint
+	Name         string `yaml:"name,omitempty"`
+	Mountpoint   string `yaml:"mountpoint,omitempty"`
+	MountOptions string `yaml:"mountoptions,omitempty"`
+
+	GroupIDs GroupList `yaml:"group_ids,omitempty"`
+	UserIDs  []int     `yaml:"user_ids,omitempty"`
+
+	ReadWrite *bool `yaml:"read_write,omitempty"`
+
+	// Overrides the settings of the git section, only the ones in mountGitSettings
+	Git map[string]interface{} `yaml:"git,omitempty"`
+}
+
+// mountGitSettings are the settings of the git section a mount can override
+// The others configure the git client, which is shared by every mount along with the clone location
+var mountGitSettings = []string{"clone_trigger", "clone_denylist", "pins", "pin_interval"}
+
+// mount is a filesystem to mount, along with the configuration that applies to it
+type mount struct {
+	name         string
+	mountpoint   string
+	mountoptions []string
+	config       *Config
+}
+
+func parseMountoptions(mountoptions string) []string {
+	parsedMountoptions := make([]string, 0)
+	if mountoptions != "" {
+		parsedMountoptions = strings.Split(mountoptions, ",")
+	}
+	return parsedMountoptions
+}
+
+// makeMounts returns the filesystems to mount
+// Without a mounts section, a single filesystem is mounted according to the top-level configuration
+func makeMounts(config *Config, mountpointArg string, mountoptionsFlag string) ([]*mount, error) {
+	if len(config.Mounts) == 0 {
+		mountpoint := config.FS.Mountpoint
+		if mountpointArg != "" {
+			mountpoint = mountpointArg
+		}
+		if mountpoint == "" {
+			return nil, nil
+		}
+		mountoptions := config.FS.MountOptions
+		if mountoptionsFlag != "" {
+			mountoptions = mountoptionsFlag
+		}
+		return []*mount{
+			{
+				name:         filepath.Base(mountpoint),
+				mountpoint:   mountpoint,
+				mountoptions: parseMountoptions(mountoptions),
+				config:       config,
+			},
+		}, nil
+	}
+
+	if mountpointArg != "" {
+		return nil, fmt.Errorf("the mountpoint cannot be passed as argument when the mounts are configured in the config file")
+	}
+
+	parsedGitlabURL, err := url.Parse(config.Gitlab.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	mounts := make([]*mount, 0, len(config.Mounts))
+	names := map[string]bool{}
+	for i, mountConfig := range config.Mounts {
+		if mountConfig.Mountpoint == "" {
+			return nil, fmt.Errorf("mounts[%v].mountpoint must be set", i)
+		}
+		name := mountConfig.Name
+		if name == "" {
+			name = filepath.Base(mountConfig.Mountpoint)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("mounts[%v] must have a unique name, got \"%v\"", i, name)
+		}
+		names[name] = true
+
+		// Derive the configuration of the mount from the top-level configuration
+		c := *config
+		c.Mounts = nil
+		c.FS.Mountpoint = mountConfig.Mountpoint
+		if mountConfig.MountOptions != "" {
+			c.FS.MountOptions = mountConfig.MountOptions
+		}
+		if mountoptionsFlag != "" {
+			c.FS.MountOptions = mountoptionsFlag
+		}
+		c.Gitlab.GroupIDs = mountConfig.GroupIDs
+		c.Gitlab.UserIDs = mountConfig.UserIDs
+		if mountConfig.ReadWrite != nil {
+			c.FS.ReadWrite = *mountConfig.ReadWrite
+		}
+		if err := checkMountGitConfig(mountConfig.Git); err != nil {
+			return nil, fmt.Errorf("mounts[%v].%v", i, err)
+		}
+		if err := mergeGitConfig(&c.Git, mountConfig.Git); err != nil {
+			return nil, fmt.Errorf("mounts[%v].git: %v", i, err)
+		}
+		// Every mount allocates its own inode numbers
+		if config.FS.InodeTable != "" {
+			c.FS.InodeTable = config.FS.InodeTable + "." + name
+		} else {
+			c.FS.InodeTable = filepath.Join(config.Git.CloneLocation, parsedGitlabURL.Hostname()+profileSuffix(config)+"."+name+".inodes")
+		}
+
+		mounts = append(mounts, &mount{
+			name:         name,
+			mountpoint:   c.FS.Mountpoint,
+			mountoptions: parseMountoptions(c.FS.MountOptions),
+			config:       &c,
+		})
+	}
+	return mounts, nil
+}
+
+// checkScope checks that the mount exposes some groups or users, rather than mounting an empty filesystem
+func checkScope(m *mount, inMounts bool) error {
+	c := m.config.Gitlab
+	if len(c.GroupIDs) > 0 || len(c.UserIDs) > 0 || (c.IncludeCurrentUser && c.hasToken()) {
+		return nil
+	}
+	if inMounts {
+		return fmt.Errorf("mount %v exposes nothing, set its group_ids to the ids of the groups to expose, its user_ids to the ids of the users, or gitlab.token with gitlab.include_current_user to expose your own projects", m.name)
+	}
+	return fmt.Errorf("nothing to expose, set gitlab.group_ids to the ids of the groups to expose, gitlab.user_ids to the ids of the users, or gitlab.token with gitlab.include_current_user to expose your own projects")
+}
+
+// checkMountGitConfig checks that the overrides of the git section of a mount are in mountGitSettings
+func checkMountGitConfig(overrides map[string]interface{}) error {
+	keys := make([]string, 0, len(overrides))
+	for key := range overrides {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !slices.Contains(mountGitSettings, key) {
+			return fmt.Errorf("git.%v cannot be overridden, the clone location and its git client are shared by every mount, only %v can be", key, strings.Join(mountGitSettings, ", "))
+		}
+	}
+	return nil
+}
+
+// mergeGitConfig applies the settings in overrides on top of gitConfig
+func mergeGitConfig(gitConfig *GitConfig, overrides map[string]interface{}) error {
+	if len(overrides) == 0 {
+		return nil
+	}
+	out, err := yaml.Marshal(overrides)
+	if err != nil {
+		return err
+	}
+	return yaml.UnmarshalStrict(out, gitConfig)
+}
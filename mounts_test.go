@@ -0,0 +1,81 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMakeMounts(t *testing.T) {
+	tests := []struct {
+		name   string
+		mounts []MountConfig
+		check  func(t *testing.T, mounts []*mount)
+		err    string
+	}{
+		{
+			name: "mount settings",
+			mounts: []MountConfig{
+				{Mountpoint: "/mnt/work", GroupIDs: GroupList{{ID: 123}}, Git: map[string]interface{}{"clone_trigger": "readdir", "pins": []string{"a/b"}, "pin_interval": "1h"}},
+				{Name: "ref", Mountpoint: "/mnt/reference", UserIDs: []int{456}},
+			},
+			check: func(t *testing.T, mounts []*mount) {
+				if mounts[0].name != "work" || mounts[1].name != "ref" {
+					t.Errorf("expected the mounts work and ref, got %v and %v", mounts[0].name, mounts[1].name)
+				}
+				if git := mounts[0].config.Git; git.CloneTrigger != "readdir" || !reflect.DeepEqual(git.Pins, []string{"a/b"}) || git.PinInterval != time.Hour {
+					t.Errorf("expected the git settings of the mount to be overridden, got %+v", git)
+				}
+				if git := mounts[1].config.Git; git.CloneTrigger != "lookup" || git.Pins != nil {
+					t.Errorf("expected the git settings of the top-level configuration, got %+v", git)
+				}
+				if ids := mounts[0].config.Gitlab.GroupIDs.IDs(); !reflect.DeepEqual(ids, []int{123}) || mounts[1].config.Gitlab.UserIDs[0] != 456 {
+					t.Errorf("expected the groups and the users of each mount, got %v and %v", ids, mounts[1].config.Gitlab.UserIDs)
+				}
+			},
+		},
+		{
+			name: "git client setting",
+			mounts: []MountConfig{
+				{Mountpoint: "/mnt/work", Git: map[string]interface{}{"clone_trigger": "readdir", "auto_pull": true}},
+			},
+			err: "mounts[0].git.auto_pull cannot be overridden",
+		},
+		{
+			name: "clone location",
+			mounts: []MountConfig{
+				{Mountpoint: "/mnt/work", Git: map[string]interface{}{"clone_location": "/tmp/other"}},
+			},
+			err: "mounts[0].git.clone_location cannot be overridden",
+		},
+		{
+			name: "duplicate name",
+			mounts: []MountConfig{
+				{Mountpoint: "/mnt/work"},
+				{Mountpoint: "/home/work"},
+			},
+			err: "mounts[1] must have a unique name",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := &Config{
+				Gitlab: GitlabConfig{URL: "https://gitlab.example.com"},
+				Git:    GitConfig{CloneLocation: "/tmp/clones", CloneTrigger: "lookup"},
+				Mounts: test.mounts,
+			}
+			mounts, err := makeMounts(config, "", "")
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected an error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			test.check(t, mounts)
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/badjware/gitlabfs/gitlab"
+)
+
+// How often the expiry of the token is checked
+const tokenExpiryCheckInterval = 24 * time.Hour
+
+type tokenExpiryFetcher interface {
+	FetchTokenExpiry(ctx context.Context) (time.Time, error)
+}
+
+// notify sends a desktop notification, failing to do so is only logged
+// Daemonized gitlabfs has no terminal, its errors otherwise go unnoticed until something breaks
+func notify(summary string, body string) {
+	if err := sendDesktopNotification(summary, body); err != nil {
+		logger.Warn("failed to send desktop notification", "summary", summary, "error", err)
+	}
+}
+
+// notifyPullFailure notifies that the pull of repo failed failures times in a row
+func notifyPullFailure(repo string, failures int, err error) {
+	notify("gitlabfs: failing to pull a project", fmt.Sprintf("The last %v pulls of %v failed: %v", failures, repo, err))
+}
+
+// startTokenExpiryCheck periodically notifies when the token expires in less than warnBefore
+func startTokenExpiryCheck(client tokenExpiryFetcher, warnBefore time.Duration) {
+	go func() {
+		for {
+			expiry, err := client.FetchTokenExpiry(context.Background())
+			if code := gitlab.StatusCode(err); code == http.StatusForbidden || code == http.StatusNotFound {
+				// The token is not a personal access token, or gitlab is too old to look it up
+				logger.Debug("cannot check the expiry of the token", "error", err)
+				return
+			} else if err != nil {
+				logger.Warn("failed to check the expiry of the token", "error", err)
+			} else if !expiry.IsZero() && time.Until(expiry) < warnBefore {
+				logger.Warn("the token is about to expire", "expires_at", expiry.Format("2006-01-02"))
+				notify("gitlabfs: the token is about to expire", fmt.Sprintf("The gitlab token expires on %v, replace it in the config file and reload gitlabfs", expiry.Format("2006-01-02")))
+			}
+			time.Sleep(tokenExpiryCheckInterval)
+		}
+	}()
+}
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/badjware/gitlabfs/utils"
+)
+
+// sendDesktopNotification shows a notification in the notification center
+func sendDesktopNotification(summary string, body string) error {
+	script := fmt.Sprintf("display notification %q with title %q", body, summary)
+	_, err := utils.ExecProcess("osascript", "-e", script)
+	return err
+}
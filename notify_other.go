@@ -0,0 +1,12 @@
+//go:build !darwin
+// +build !darwin
+
+package main
+
+import "github.com/badjware/gitlabfs/utils"
+
+// sendDesktopNotification shows a notification on the desktop of the user through notify-send, which talks to the notification daemon over d-bus
+func sendDesktopNotification(summary string, body string) error {
+	_, err := utils.ExecProcess("notify-send", "--app-name=gitlabfs", "--urgency=critical", summary, body)
+	return err
+}
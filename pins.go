@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/badjware/gitlabfs/git"
+	"github.com/badjware/gitlabfs/gitlab"
+)
+
+// makePins returns the full paths of the pinned projects of the config, without the ones already pinned by another mount in seen
+func makePins(config *Config, seen map[string]bool) ([]string, error) {
+	if len(config.Git.Pins) > 0 && config.Git.PinInterval <= 0 {
+		return nil, fmt.Errorf("git.pin_interval must be positive")
+	}
+	var pins []string
+	for _, pin := range config.Git.Pins {
+		projectPath := strings.Trim(pin, "/")
+		if projectPath == "" || !strings.Contains(projectPath, "/") {
+			return nil, fmt.Errorf("git.pins must be the full paths of projects, eg: gitlab-org/gitlab, got %q", pin)
+		}
+		if seen[projectPath] {
+			continue
+		}
+		seen[projectPath] = true
+		pins = append(pins, projectPath)
+	}
+	return pins, nil
+}
+
+// keepPinnedProjects clones the pinned projects right away and pulls them every interval, until ctx is done
+// They are pulled regardless of auto_pull, and whether they were accessed
+func keepPinnedProjects(ctx context.Context, gitlabClient gitlab.ProjectFetcher, gitClient git.GitClonerPuller, pins []string, interval time.Duration) {
+	logger.Info("keeping the pinned projects up to date", "projects", len(pins), "interval", interval)
+	for {
+		if cloned := pinPass(ctx, gitlabClient, gitClient, pins); cloned > 0 {
+			// A local copy initialized without cloning only gets its files on its first pull
+			if waitForGitOperations(ctx, gitClient) {
+				pinPass(ctx, gitlabClient, gitClient, pins)
+			}
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// pinPass dispatches the clone of the pinned projects that are not cloned yet and the pull of the others
+// It returns the number of clones dispatched
+func pinPass(ctx context.Context, gitlabClient gitlab.ProjectFetcher, gitClient git.GitClonerPuller, pins []string) int {
+	cloned := 0
+	for _, pin := range pins {
+		if ctx.Err() != nil {
+			return cloned
+		}
+		// The project may have been renamed or its default branch changed since the last pass
+		project, err := gitlabClient.FetchProjectByPath(ctx, pin)
+		if err != nil {
+			logger.Warn("failed to fetch the pinned project, trying again on the next pass", "project", pin, "error", err)
+			continue
+		}
+		_, op, err := gitClient.Pull(project.CloneURL, project.ID, project.DefaultBranch, project.PullDepth)
+		if errors.Is(err, git.ErrIgnoredLocalCopy) {
+			continue
+		}
+		if err != nil {
+			logger.Warn("failed to dispatch the git operation of the pinned project, trying again on the next pass", "project", pin, "operation", op, "error", err)
+			continue
+		}
+		if op == git.OperationClone {
+			cloned++
+		}
+	}
+	return cloned
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+)
+
+// startPprofServer serves the runtime profiles of net/http/pprof on listen in the background
+func startPprofServer(listen string) {
+	mux := http.NewServeMux()
+	// Index also serves the named profiles, eg: /debug/pprof/heap and /debug/pprof/goroutine
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	go func() {
+		logger.Info("serving pprof", "listen", listen)
+		if err := http.ListenAndServe(listen, mux); err != nil {
+			logger.Error("pprof listener failed", "listen", listen, "error", err)
+		}
+	}()
+}
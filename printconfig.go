@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/badjware/gitlabfs/utils"
+)
+
+// printConfig implements the print-config subcommand
+// It prints the configuration in effect once the defaults, the config file, the environment and the flags are applied, without its secrets
+func printConfig(args []string) error {
+	flags := flag.NewFlagSet("print-config", flag.ExitOnError)
+	configPath := flags.String("config", findConfig(), "The config file")
+	profile := flags.String("profile", "", "The profile of the config file to apply")
+	applyConfigFlags := addConfigFlags(flags)
+	flags.Usage = func() {
+		fmt.Println("USAGE:")
+		fmt.Printf("    %s print-config [-config CONFIG] [-profile PROFILE]\n\n", os.Args[0])
+		fmt.Println("OPTIONS:")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	config, err := loadConfig(*configPath, *profile)
+	if err != nil {
+		return err
+	}
+	if err := applyConfigFlags(config); err != nil {
+		return err
+	}
+	utils.AddSecrets(configSecrets(config)...)
+
+	if *configPath == "" {
+		fmt.Println("# No config file found, the default settings apply")
+	} else {
+		_, files, err := readConfigFiles(*configPath)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("# Config file: %v\n", files[0])
+		for _, f := range files[1:] {
+			fmt.Printf("# Included: %v\n", f)
+		}
+	}
+	if config.Profile != "" {
+		fmt.Printf("# Profile: %v\n", config.Profile)
+	}
+	out, err := makeEffectiveConfig(config)()
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprint(os.Stdout, utils.Redact(string(out)))
+	return err
+}
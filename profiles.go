@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// applyProfile applies the settings of the profile name on top of the top-level settings of config
+func applyProfile(config *Config, name string) error {
+	profile, ok := config.Profiles[name]
+	if !ok {
+		if len(config.Profiles) == 0 {
+			return fmt.Errorf("profile %v is not defined, the config file has no profiles", name)
+		}
+		names := make([]string, 0, len(config.Profiles))
+		for n := range config.Profiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("profile %v is not defined, the profiles are: %v", name, strings.Join(names, ", "))
+	}
+	if strings.ContainsAny(name, "/.") {
+		return errors.New("the name of a profile must not contain \"/\" or \".\"")
+	}
+
+	out, err := yaml.Marshal(profile)
+	if err != nil {
+		return err
+	}
+	if err := yaml.Unmarshal(out, config); err != nil {
+		return fmt.Errorf("profiles.%v: %v", name, err)
+	}
+	config.Profile = name
+	return nil
+}
+
+// profileSuffix returns the suffix of the files of the instance next to the local clones, eg: the inode table
+// The instances of the profiles of a same gitlab instance share the clone location, each one must have its own files
+func profileSuffix(config *Config) string {
+	if config.Profile == "" {
+		return ""
+	}
+	return "." + config.Profile
+}
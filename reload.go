@@ -0,0 +1,353 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/badjware/gitlabfs/fs"
+	"github.com/badjware/gitlabfs/git"
+	"github.com/badjware/gitlabfs/gitlab"
+	"gopkg.in/yaml.v2"
+)
+
+type gitlabReconfigurer interface {
+	Reconfigure(gitlabUrl string, gitlabToken string, p gitlab.GitlabClientParam) error
+}
+
+type gitReconfigurer interface {
+	Reconfigure(p git.GitClientParam)
+}
+
+// configReloader reloads the config file, applies the changes to the clients shared by the mounts and returns the new config
+type configReloader func() (*Config, error)
+
+// makeConfigReloader returns a function reloading the config file and applying the changes that do not require a remount
+// to config and to the clients. The flags of the command-line keep overriding the config file, through applyFlags
+// Every mount reloads the config file on its own, eg: on SIGHUP, once the first one applied the changes the others find none
+func makeConfigReloader(configPath string, profile string, applyFlags func(config *Config) error, config *Config, gitlabClient gitlabReconfigurer, gitClient gitReconfigurer) configReloader {
+	var mux sync.Mutex
+	return func() (*Config, error) {
+		mux.Lock()
+		defer mux.Unlock()
+
+		if configPath == "" {
+			return nil, errors.New("no config file to reload")
+		}
+		newConfig, err := loadConfig(configPath, profile)
+		if err != nil {
+			return nil, err
+		}
+		if err := applyFlags(newConfig); err != nil {
+			return nil, err
+		}
+
+		// The clone location of an ephemeral instance is its temporary folder
+		if config.Git.Ephemeral {
+			newConfig.Git.CloneLocation = config.Git.CloneLocation
+		}
+
+		changes := []struct {
+			key             string
+			changed         bool
+			requiresRestart bool
+		}{
+			{"log", !reflect.DeepEqual(config.Log, newConfig.Log), false},
+			{"fs", !reflect.DeepEqual(config.FS, newConfig.FS), true},
+			{"gitlab.url", config.Gitlab.URL != newConfig.Gitlab.URL, true},
+			{"gitlab.token", config.Gitlab.Token != newConfig.Gitlab.Token, false},
+			{"gitlab.fallback_tokens", !reflect.DeepEqual(config.Gitlab.FallbackTokens, newConfig.Gitlab.FallbackTokens), false},
+			{"gitlab.deploy_tokens", !reflect.DeepEqual(config.Gitlab.DeployTokens, newConfig.Gitlab.DeployTokens), false},
+			{"gitlab.include_current_user", config.Gitlab.IncludeCurrentUser != newConfig.Gitlab.IncludeCurrentUser, true},
+			{"gitlab.archived_project_handling", config.Gitlab.ArchivedProjectHandling != newConfig.Gitlab.ArchivedProjectHandling, false},
+			{"gitlab.new_project_visibility", config.Gitlab.NewProjectVisibility != newConfig.Gitlab.NewProjectVisibility, false},
+			{"gitlab.skip_empty", config.Gitlab.SkipEmpty != newConfig.Gitlab.SkipEmpty, false},
+			{"gitlab.refresh_interval", config.Gitlab.RefreshInterval != newConfig.Gitlab.RefreshInterval, false},
+			{"gitlab.group_refresh_intervals", !reflect.DeepEqual(config.Gitlab.GroupRefreshIntervals, newConfig.Gitlab.GroupRefreshIntervals), false},
+			{"gitlab.prefetch_subgroups", config.Gitlab.PrefetchSubgroups != newConfig.Gitlab.PrefetchSubgroups, false},
+			{"gitlab.stale_while_revalidate", config.Gitlab.StaleWhileRevalidate != newConfig.Gitlab.StaleWhileRevalidate, false},
+			{"gitlab.startup_worker_count", config.Gitlab.StartupWorkerCount != newConfig.Gitlab.StartupWorkerCount, true},
+			{"gitlab.pinned_refs", !reflect.DeepEqual(config.Gitlab.PinnedRefs, newConfig.Gitlab.PinnedRefs), false},
+			{"gitlab.tls_min_version", config.Gitlab.TLSMinVersion != newConfig.Gitlab.TLSMinVersion, true},
+			{"gitlab.tls_cipher_suites", !reflect.DeepEqual(config.Gitlab.TLSCipherSuites, newConfig.Gitlab.TLSCipherSuites), true},
+			{"git.clone_location", config.Git.CloneLocation != newConfig.Git.CloneLocation, true},
+			{"git.clone_mode", config.Git.CloneMode != newConfig.Git.CloneMode, true},
+			{"git.clone_group", config.Git.CloneGroup != newConfig.Git.CloneGroup, true},
+			{"git.remote", config.Git.Remote != newConfig.Git.Remote, false},
+			{"git.pull_method", config.Git.PullMethod != newConfig.Git.PullMethod, false},
+			{"git.on_clone", config.Git.OnClone != newConfig.Git.OnClone, false},
+			{"git.on_corruption", config.Git.OnCorruption != newConfig.Git.OnCorruption, false},
+			{"git.clone_trigger", config.Git.CloneTrigger != newConfig.Git.CloneTrigger, true},
+			{"git.auto_pull", config.Git.AutoPull != newConfig.Git.AutoPull, false},
+			{"git.depth", config.Git.Depth != newConfig.Git.Depth, false},
+			{"git.queue_size", config.Git.QueueSize != newConfig.Git.QueueSize, true},
+			{"git.queue_overflow", config.Git.QueueOverflow != newConfig.Git.QueueOverflow, true},
+			{"git.worker_count", config.Git.QueueWorkerCount != newConfig.Git.QueueWorkerCount, false},
+			{"git.max_clones_per_minute", config.Git.MaxClonesPerMinute != newConfig.Git.MaxClonesPerMinute, false},
+			{"git.clone_denylist", !reflect.DeepEqual(config.Git.CloneDenylist, newConfig.Git.CloneDenylist), false},
+			{"git.shutdown_grace_period", config.Git.ShutdownGracePeriod != newConfig.Git.ShutdownGracePeriod, false},
+			{"git.history_size", config.Git.HistorySize != newConfig.Git.HistorySize, true},
+			{"git.history_file", config.Git.HistoryFile != newConfig.Git.HistoryFile, true},
+			{"git.ignore_file", config.Git.IgnoreFile != newConfig.Git.IgnoreFile, true},
+			{"git.pins", !reflect.DeepEqual(config.Git.Pins, newConfig.Git.Pins), true},
+			{"git.pin_interval", config.Git.PinInterval != newConfig.Git.PinInterval, true},
+			{"git.max_store_size", config.Git.MaxStoreSize != newConfig.Git.MaxStoreSize, true},
+			{"git.ephemeral", config.Git.Ephemeral != newConfig.Git.Ephemeral, true},
+			{"git.ephemeral_dir", config.Git.EphemeralDir != newConfig.Git.EphemeralDir, true},
+			{"git.encrypted_store", config.Git.EncryptedStore != newConfig.Git.EncryptedStore, true},
+			{"git.encryption_passfile", config.Git.EncryptionPassfile != newConfig.Git.EncryptionPassfile, true},
+			{"git.encryption_extpass", config.Git.EncryptionExtpass != newConfig.Git.EncryptionExtpass, true},
+			{"http", !reflect.DeepEqual(config.HTTP, newConfig.HTTP), true},
+			{"tracing", !reflect.DeepEqual(config.Tracing, newConfig.Tracing), true},
+			{"notifications", !reflect.DeepEqual(config.Notifications, newConfig.Notifications), true},
+		}
+
+		diff := diffConfig(config, newConfig)
+
+		// Keep the current value of the settings that require a restart
+		newConfig.FS = config.FS
+		newConfig.Gitlab.URL = config.Gitlab.URL
+		newConfig.Gitlab.IncludeCurrentUser = config.Gitlab.IncludeCurrentUser
+		newConfig.Gitlab.StartupWorkerCount = config.Gitlab.StartupWorkerCount
+		newConfig.Gitlab.TLSMinVersion = config.Gitlab.TLSMinVersion
+		newConfig.Gitlab.TLSCipherSuites = config.Gitlab.TLSCipherSuites
+		newConfig.Git.CloneLocation = config.Git.CloneLocation
+		newConfig.Git.CloneMode = config.Git.CloneMode
+		newConfig.Git.CloneGroup = config.Git.CloneGroup
+		newConfig.Git.CloneTrigger = config.Git.CloneTrigger
+		newConfig.Git.QueueSize = config.Git.QueueSize
+		newConfig.Git.QueueOverflow = config.Git.QueueOverflow
+		newConfig.Git.HistorySize = config.Git.HistorySize
+		newConfig.Git.HistoryFile = config.Git.HistoryFile
+		newConfig.Git.Pins = config.Git.Pins
+		newConfig.Git.PinInterval = config.Git.PinInterval
+		newConfig.Git.MaxStoreSize = config.Git.MaxStoreSize
+		newConfig.Git.Ephemeral = config.Git.Ephemeral
+		newConfig.Git.EphemeralDir = config.Git.EphemeralDir
+		newConfig.Git.EncryptedStore = config.Git.EncryptedStore
+		newConfig.Git.EncryptionPassfile = config.Git.EncryptionPassfile
+		newConfig.Git.EncryptionExtpass = config.Git.EncryptionExtpass
+		newConfig.HTTP = config.HTTP
+		newConfig.Tracing = config.Tracing
+		newConfig.Notifications = config.Notifications
+
+		gitlabClientParam, err := makeGitlabConfig(newConfig)
+		if err != nil {
+			return nil, err
+		}
+		gitClientParam, err := makeGitConfig(newConfig)
+		if err != nil {
+			return nil, err
+		}
+		if err := configureLogging(newConfig); err != nil {
+			return nil, err
+		}
+
+		if err := gitlabClient.Reconfigure(newConfig.Gitlab.URL, newConfig.Gitlab.Token, *gitlabClientParam); err != nil {
+			return nil, err
+		}
+		gitClient.Reconfigure(*gitClientParam)
+		*config = *newConfig
+
+		for _, change := range changes {
+			if !change.changed {
+				continue
+			}
+			log := logger.Info
+			msg := "configuration changed, applied"
+			if change.requiresRestart {
+				log = logger.Warn
+				msg = "configuration changed, restart gitlabfs to apply"
+			}
+			// Log each setting under the key with its previous and new values, the secrets only as the key
+			logged := false
+			for _, d := range diff {
+				if d.key == change.key || strings.HasPrefix(d.key, change.key+".") {
+					log(msg, "key", d.key, "from", d.from, "to", d.to)
+					logged = true
+				}
+			}
+			if !logged {
+				log(msg, "key", change.key)
+			}
+		}
+
+		return newConfig, nil
+	}
+}
+
+// makeReloader returns a function reloading the config file and applying the changes to the mount m
+// mountpointArg and mountoptionsFlag are the mountpoint and the mount options passed on the command-line, if any
+func makeReloader(reload configReloader, m *mount, mountpointArg string, mountoptionsFlag string) fs.Reloader {
+	return func() (*fs.ReloadParam, error) {
+		prev := *m.config
+		newConfig, err := reload()
+		if err != nil {
+			return nil, err
+		}
+		mounts, err := makeMounts(newConfig, mountpointArg, mountoptionsFlag)
+		if err != nil {
+			return nil, err
+		}
+		var next *Config
+		for _, newMount := range mounts {
+			if newMount.name == m.name {
+				next = newMount.config
+			}
+		}
+		if next == nil {
+			return nil, fmt.Errorf("mount %v is no longer in the config file, restart gitlabfs to apply", m.name)
+		}
+
+		// The changes to the settings of the mounts section, the others are logged once by reload
+		if len(newConfig.Mounts) > 0 {
+			changes := []struct {
+				key             string
+				requiresRestart bool
+			}{
+				{"fs.mountpoint", true},
+				{"fs.mountoptions", true},
+				{"fs.read_write", true},
+				{"gitlab.group_ids", false},
+				{"gitlab.user_ids", false},
+				{"git.clone_trigger", true},
+				{"git.clone_denylist", false},
+				{"git.pins", true},
+				{"git.pin_interval", true},
+			}
+			diff := diffConfig(&prev, next)
+			for _, change := range changes {
+				for _, d := range diff {
+					if d.key != change.key && !strings.HasPrefix(d.key, change.key+".") {
+						continue
+					}
+					if change.requiresRestart {
+						logger.Warn("configuration of the mount changed, restart gitlabfs to apply", "mount", m.name, "key", d.key, "from", d.from, "to", d.to)
+					} else {
+						logger.Info("configuration of the mount changed, applied", "mount", m.name, "key", d.key, "from", d.from, "to", d.to)
+					}
+				}
+			}
+		}
+
+		// Keep the current value of the settings of the mount that require a restart
+		next.FS = prev.FS
+		next.Git.CloneTrigger = prev.Git.CloneTrigger
+		next.Git.Pins = prev.Git.Pins
+		next.Git.PinInterval = prev.Git.PinInterval
+		*m.config = *next
+
+		return &fs.ReloadParam{
+			RootGroupIds: next.Gitlab.GroupIDs.IDs(),
+			UserIds:      next.Gitlab.UserIDs,
+
+			CloneDenylist:   next.Git.CloneDenylist,
+			InvalidateCache: contentChanged(&prev, next),
+		}, nil
+	}
+}
+
+// contentChanged returns whether the settings applied when the groups and users are fetched differ between config and newConfig
+// The cached content of the groups and users is fetched again when they change
+func contentChanged(config *Config, newConfig *Config) bool {
+	return config.Gitlab.ArchivedProjectHandling != newConfig.Gitlab.ArchivedProjectHandling ||
+		config.Gitlab.SkipEmpty != newConfig.Gitlab.SkipEmpty ||
+		!reflect.DeepEqual(config.Gitlab.PinnedRefs, newConfig.Gitlab.PinnedRefs) ||
+		!reflect.DeepEqual(config.Gitlab.DeployTokens, newConfig.Gitlab.DeployTokens) ||
+		config.Git.PullMethod != newConfig.Git.PullMethod
+}
+
+// settingChange is a setting whose value changed
+type settingChange struct {
+	key  string
+	from string
+	to   string
+}
+
+// diffConfig returns the settings whose value differ between config and newConfig, without their secrets
+func diffConfig(config *Config, newConfig *Config) []settingChange {
+	prev, err := flattenConfig(config)
+	if err != nil {
+		return nil
+	}
+	next, err := flattenConfig(newConfig)
+	if err != nil {
+		return nil
+	}
+
+	var changes []settingChange
+	for _, s := range next {
+		if from, ok := lookupSetting(prev, s.key); !ok || from != s.value {
+			changes = append(changes, settingChange{key: s.key, from: from, to: s.value})
+		}
+	}
+	for _, s := range prev {
+		if _, ok := lookupSetting(next, s.key); !ok {
+			changes = append(changes, settingChange{key: s.key, from: s.value})
+		}
+	}
+	return changes
+}
+
+type flatSetting struct {
+	key   string
+	value string
+}
+
+// flattenConfig returns every setting of config by its dotted key, in the order of the config file, without its secrets
+func flattenConfig(config *Config) ([]flatSetting, error) {
+	out, err := yaml.Marshal(redactConfig(config))
+	if err != nil {
+		return nil, err
+	}
+	var root yaml.MapSlice
+	if err := yaml.Unmarshal(out, &root); err != nil {
+		return nil, err
+	}
+
+	var settings []flatSetting
+	var walk func(node yaml.MapSlice, prefix string)
+	walk = func(node yaml.MapSlice, prefix string) {
+		for _, item := range node {
+			key := prefix + fmt.Sprint(item.Key)
+			if m, ok := item.Value.(yaml.MapSlice); ok {
+				walk(m, key+".")
+				continue
+			}
+			settings = append(settings, flatSetting{key: key, value: formatSetting(item.Value)})
+		}
+	}
+	walk(root, "")
+	return settings, nil
+}
+
+func lookupSetting(settings []flatSetting, key string) (string, bool) {
+	for _, s := range settings {
+		if s.key == key {
+			return s.value, true
+		}
+	}
+	return "", false
+}
+
+// formatSetting returns the value of a setting in the yaml flow style, eg: "[1, {id: 2, depth: 1}]"
+func formatSetting(value interface{}) string {
+	switch v := value.(type) {
+	case yaml.MapSlice:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			items = append(items, fmt.Sprintf("%v: %v", item.Key, formatSetting(item.Value)))
+		}
+		return "{" + strings.Join(items, ", ") + "}"
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			items = append(items, formatSetting(item))
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	default:
+		return fmt.Sprint(v)
+	}
+}
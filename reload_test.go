@@ -0,0 +1,76 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/badjware/gitlabfs/git"
+	"github.com/badjware/gitlabfs/gitlab"
+)
+
+type fakeGitlabReconfigurer struct{}
+
+func (fakeGitlabReconfigurer) Reconfigure(gitlabUrl string, gitlabToken string, p gitlab.GitlabClientParam) error {
+	return nil
+}
+
+type fakeGitReconfigurer struct{}
+
+func (fakeGitReconfigurer) Reconfigure(p git.GitClientParam) {}
+
+func TestMountReloader(t *testing.T) {
+	dir := t.TempDir()
+	content := `
+git:
+  clone_location: ` + dir + `
+mounts:
+  - name: a
+    mountpoint: /mnt/a
+    group_ids: [1]
+  - name: b
+    mountpoint: /mnt/b
+    group_ids: [2]
+`
+	path := writeConfigFile(t, dir, "config.yaml", content)
+	config, err := loadConfig(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mounts, err := makeMounts(config, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	noFlags := func(config *Config) error { return nil }
+	reload := makeConfigReloader(path, "", noFlags, config, fakeGitlabReconfigurer{}, fakeGitReconfigurer{})
+	reloaders := []func() ([]int, bool){}
+	for _, m := range mounts {
+		reloader := makeReloader(reload, m, "", "")
+		reloaders = append(reloaders, func() ([]int, bool) {
+			param, err := reloader()
+			if err != nil {
+				t.Fatal(err)
+			}
+			return param.RootGroupIds, param.InvalidateCache
+		})
+	}
+
+	// The groups added to a mount are applied to it only
+	writeConfigFile(t, dir, "config.yaml", content+"    group_ids+: [3]\n")
+	if ids, _ := reloaders[0](); !reflect.DeepEqual(ids, []int{1}) {
+		t.Errorf("expected the groups of mount a to be kept, got %v", ids)
+	}
+	if ids, _ := reloaders[1](); !reflect.DeepEqual(ids, []int{2, 3}) {
+		t.Errorf("expected group 3 to be added to mount b, got %v", ids)
+	}
+
+	// Every mount refreshes its groups, not only the first one to reload
+	writeConfigFile(t, dir, "config.yaml", content+"    group_ids+: [3]\ngitlab:\n  archived_project_handling: hide\n")
+	for i, reloader := range reloaders {
+		if _, invalidate := reloader(); !invalidate {
+			t.Errorf("expected mount %v to refresh its groups", mounts[i].name)
+		}
+	}
+	if _, invalidate := reloaders[0](); invalidate {
+		t.Errorf("expected no refresh without a change")
+	}
+}
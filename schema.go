@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/badjware/gitlabfs/fs"
+	"github.com/badjware/gitlabfs/gitlab"
+	"github.com/badjware/gitlabfs/utils"
+)
+
+// durationPattern matches the durations accepted by time.ParseDuration
+const durationPattern = `^[-+]?(0|([0-9]*(\.[0-9]*)?(ns|us|µs|μs|ms|s|m|h))+)$`
+
+// settingEnums are the values allowed by the settings taking one of a fixed set of values, by setting
+var settingEnums = map[string][]string{
+	"log.format":                       {utils.LogFormatText, utils.LogFormatJSON},
+	"log.output":                       {logOutputDefault, logOutputSyslog, logOutputJournald},
+	"fs.project_mode":                  {fs.ProjectModeSymlink, fs.ProjectModeDirectory, fs.ProjectModeBrowse},
+	"gitlab.archived_project_handling": {gitlab.ArchivedProjectShow, gitlab.ArchivedProjectHide, gitlab.ArchivedProjectIgnore},
+	"gitlab.new_project_visibility":    {gitlab.VisibilityPrivate, gitlab.VisibilityInternal, gitlab.VisibilityPublic},
+	"git.pull_method":                  {gitlab.PullMethodHTTP, gitlab.PullMethodSSH},
+	"git.on_clone":                     {"init", "clone"},
+	"git.on_corruption":                {"report", "reclone"},
+	"git.clone_trigger":                {fs.CloneTriggerLookup, fs.CloneTriggerReaddir, fs.CloneTriggerOpen},
+	"gitlab.tls_min_version":           {"1.0", "1.1", "1.2", "1.3"},
+	"gitlab.tls_cipher_suites":         tlsCipherSuiteNames(),
+}
+
+// configSchema returns the json schema of the config file
+func configSchema() map[string]interface{} {
+	schema := typeSchema(reflect.TypeOf(Config{}), "")
+	schema["type"] = "object"
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["title"] = "gitlabfs configuration"
+	schema["properties"].(map[string]interface{})[includeKey] = map[string]interface{}{
+		"oneOf": []interface{}{
+			map[string]interface{}{"type": "string"},
+			map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+		},
+	}
+	return schema
+}
+
+// typeSchema returns the json schema of the values of type t, decoded into the setting at path
+func typeSchema(t reflect.Type, path string) map[string]interface{} {
+	switch t {
+	case reflect.TypeOf(time.Duration(0)):
+		// A duration is either a string like "5m" or a number of nanoseconds
+		return map[string]interface{}{"type": []string{"string", "integer"}, "pattern": durationPattern}
+	case reflect.TypeOf(GroupConfig{}):
+		group := structSchema(t, "gitlab")
+		group["required"] = []string{"id"}
+		return map[string]interface{}{"oneOf": []interface{}{map[string]interface{}{"type": "integer"}, group}}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return typeSchema(t.Elem(), path)
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		schema := map[string]interface{}{"type": "string"}
+		if values, ok := settingEnums[path]; ok {
+			schema["enum"] = values
+		}
+		return schema
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem(), path)}
+	case reflect.Map:
+		schema := map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem(), path)}
+		if t.Key().Kind() == reflect.Int {
+			schema["propertyNames"] = map[string]interface{}{"pattern": "^[0-9]+$"}
+		}
+		return schema
+	case reflect.Struct:
+		return structSchema(t, path)
+	default:
+		// Any value
+		return map[string]interface{}{}
+	}
+}
+
+// structSchema returns the json schema of a section of the config file, decoded into the struct t
+func structSchema(t reflect.Type, path string) map[string]interface{} {
+	properties := map[string]interface{}{}
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		key := name
+		if path != "" {
+			key = path + "." + name
+		}
+		switch key {
+		case "mounts.git":
+			// Overrides the settings of the git section
+			properties[name] = typeSchema(reflect.TypeOf(GitConfig{}), "git")
+		case "profiles":
+			// Applied on top of the top-level settings
+			properties[name] = map[string]interface{}{"type": "object", "additionalProperties": map[string]interface{}{"$ref": "#"}}
+		default:
+			properties[name] = typeSchema(t.Field(i).Type, key)
+			if t.Field(i).Type.Kind() == reflect.Slice {
+				// Appends to the list of the included files
+				properties[name+appendSuffix] = properties[name]
+			}
+		}
+	}
+	return map[string]interface{}{
+		// A section without any setting is null in yaml
+		"type":       []string{"object", "null"},
+		"properties": properties,
+		// Unknown settings are rejected when the config file is loaded
+		"additionalProperties": false,
+	}
+}
+
+// printConfigSchema implements the config-schema subcommand
+// It prints the json schema of the config file, to validate the config files before they are deployed
+func printConfigSchema(args []string) error {
+	out, err := json.MarshalIndent(configSchema(), "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(os.Stdout, string(out))
+	return err
+}
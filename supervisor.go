@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Set in the environment of the process serving the filesystems started by the supervisor
+const supervisedEnv = "_GITLABFS_SUPERVISED"
+
+const (
+	// How often the supervisor checks that the filesystems still answer
+	supervisorProbeInterval = 30 * time.Second
+	// How many checks in a row a filesystem can fail before it's considered hung
+	supervisorProbeFailures = 3
+	// How long the filesystems are given to unmount once they are stopped, before they are killed
+	supervisorStopTimeout = 30 * time.Second
+)
+
+// isSupervisedChild returns true if we are the process serving the filesystems started by the supervisor
+func isSupervisedChild() bool {
+	return os.Getenv(supervisedEnv) != ""
+}
+
+// supervise serves the filesystems from a child process, and mounts them again after restartDelay when it crashes or they hang
+// A filesystem unmounted cleanly stops the supervisor, so does a child which fails to mount them the first time
+func supervise(mountpoints []string, restartDelay time.Duration) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate the gitlabfs executable: %v", err)
+	}
+	args := os.Args[1:]
+	if daemonArgs != nil {
+		args = daemonArgs
+	}
+
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signalChan)
+
+	for started := false; ; started = true {
+		unmountStaleMounts(mountpoints)
+		logger.Info("starting the filesystems", "mountpoints", mountpoints)
+		stopped, err := superviseChild(executable, args, mountpoints, signalChan, !started)
+		if stopped {
+			unmountStaleMounts(mountpoints)
+			return nil
+		}
+		if !started && errors.Is(err, errNeverMounted) {
+			return err
+		}
+		if err == nil && !hasStaleMount(mountpoints) {
+			logger.Info("the filesystems were unmounted, stopping the supervisor")
+			return nil
+		}
+		if err == nil {
+			err = errors.New("the connection to the kernel was lost")
+		}
+		logger.Warn("the filesystems crashed, mounting them again", "error", err, "delay", restartDelay)
+		unmountStaleMounts(mountpoints)
+
+		select {
+		case sig := <-signalChan:
+			if sig != syscall.SIGHUP {
+				logger.Info("stopping", "signal", sig.String())
+				return nil
+			}
+		case <-time.After(restartDelay):
+		}
+	}
+}
+
+var errNeverMounted = errors.New("gitlabfs failed to mount the filesystems")
+
+// superviseChild runs the child serving the filesystems until it exits, and forwards it the signals
+// It returns whether the child was stopped by a signal, and the error it exited with
+// The child is killed when a filesystem stops answering. If first is true, the readiness of the child is reported like a daemon
+func superviseChild(executable string, args []string, mountpoints []string, signalChan <-chan os.Signal, first bool) (bool, error) {
+	// The child reports it is ready through this pipe, like the background process started by --daemon
+	r, w, err := os.Pipe()
+	if err != nil {
+		return false, fmt.Errorf("failed to create pipe: %v", err)
+	}
+	defer r.Close()
+
+	cmd := exec.Command(executable, args...)
+	cmd.Env = append(os.Environ(), supervisedEnv+"=1", daemonEnv+"=1")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{w}
+	// The signals of the terminal are for the supervisor, which forwards them
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		w.Close()
+		return false, fmt.Errorf("failed to start gitlabfs: %v", err)
+	}
+	w.Close()
+
+	ready := make(chan bool, 1)
+	go func() {
+		msg, _ := ioutil.ReadAll(r)
+		ready <- string(msg) == daemonReadyMsg
+	}()
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	ticker := time.NewTicker(supervisorProbeInterval)
+	defer ticker.Stop()
+	mounted, stopped := false, false
+	failures := map[string]int{}
+	for {
+		select {
+		case err := <-exited:
+			if ready != nil {
+				// The child may have exited right after reporting it was ready
+				mounted = <-ready
+			}
+			if !mounted {
+				return stopped, errNeverMounted
+			}
+			return stopped, err
+		case ok := <-ready:
+			mounted = ok
+			ready = nil
+			if mounted {
+				logger.Info("the filesystems are mounted", "pid", cmd.Process.Pid)
+				if first && isDaemonChild() {
+					notifyDaemonReady()
+				}
+			}
+		case sig := <-signalChan:
+			if sig != syscall.SIGHUP && !stopped {
+				stopped = true
+				time.AfterFunc(supervisorStopTimeout, func() { cmd.Process.Kill() })
+			}
+			cmd.Process.Signal(sig)
+		case <-ticker.C:
+			if !mounted || stopped {
+				continue
+			}
+			for _, mountpoint := range mountpoints {
+				if err := probeMount(mountpoint); err == nil {
+					failures[mountpoint] = 0
+					continue
+				} else if failures[mountpoint]++; errors.Is(err, syscall.ENOTCONN) || failures[mountpoint] >= supervisorProbeFailures {
+					logger.Warn("filesystem is not answering, killing gitlabfs", "mountpoint", mountpoint, "error", err, "pid", cmd.Process.Pid)
+					cmd.Process.Kill()
+					break
+				}
+			}
+		}
+	}
+}
+
+// hasStaleMount returns whether one of the mountpoints holds a mount whose filesystem is gone
+func hasStaleMount(mountpoints []string) bool {
+	for _, mountpoint := range mountpoints {
+		if _, err := os.Stat(mountpoint); errors.Is(err, syscall.ENOTCONN) {
+			return true
+		}
+	}
+	return false
+}
+
+// unmountStaleMounts lazily unmounts the mounts left behind on the mountpoints by a crashed child
+func unmountStaleMounts(mountpoints []string) {
+	for _, mountpoint := range mountpoints {
+		if _, err := os.Stat(mountpoint); !errors.Is(err, syscall.ENOTCONN) {
+			continue
+		}
+		logger.Warn("found a stale mount, unmounting it", "mountpoint", mountpoint)
+		if err := unmountStale(mountpoint); err != nil {
+			logger.Error("failed to unmount the stale mount", "mountpoint", mountpoint, "error", err)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends state to systemd, if gitlabfs was started by a unit of Type=notify
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// A leading @ denotes a socket in the abstract namespace
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("failed to connect to systemd: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("failed to notify systemd: %v", err)
+	}
+	return nil
+}
+
+// watchdogInterval returns how often systemd expects to be pinged, or 0 if the watchdog of the unit is disabled
+func watchdogInterval() time.Duration {
+	usec, err := strconv.Atoi(os.Getenv("WATCHDOG_USEC"))
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	// The watchdog is meant for another process, eg: the foreground process started with -daemon
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// startWatchdog pings the watchdog of systemd in the background for as long as the filesystems answer
+// A wedged filesystem stops the pings, so systemd restarts gitlabfs. A stuck git operation is only reported by the health endpoints,
+// a long clone would otherwise get gitlabfs restarted in the middle of it
+func startWatchdog(health *healthChecker) {
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+	logger.Info("pinging the systemd watchdog", "interval", interval/2)
+
+	go func() {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+		for range ticker.C {
+			report := health.responsive()
+			if report.Status != healthOK {
+				logger.Warn("not pinging the systemd watchdog, the filesystem does not answer", "checks", report.Checks)
+				continue
+			}
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				logger.Warn("failed to ping the systemd watchdog", "error", err)
+			}
+		}
+	}()
+}
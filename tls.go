@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// tlsVersions are the values of gitlab.tls_min_version, along with the value of http.sslVersion applying the same minimum to git
+var tlsVersions = map[string]struct {
+	version    uint16
+	gitVersion string
+}{
+	"1.0": {tls.VersionTLS10, "tlsv1.0"},
+	"1.1": {tls.VersionTLS11, "tlsv1.1"},
+	"1.2": {tls.VersionTLS12, "tlsv1.2"},
+	"1.3": {tls.VersionTLS13, "tlsv1.3"},
+}
+
+// opensslCipherSuites are the names of the cipher suites in openssl, used by git through libcurl, by cipher suite
+// The cipher suites of TLS 1.3 are not configurable
+var opensslCipherSuites = map[uint16]string{
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA:                  "AES128-SHA",
+	tls.TLS_RSA_WITH_AES_256_CBC_SHA:                  "AES256-SHA",
+	tls.TLS_RSA_WITH_AES_128_GCM_SHA256:               "AES128-GCM-SHA256",
+	tls.TLS_RSA_WITH_AES_256_GCM_SHA384:               "AES256-GCM-SHA384",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA:          "ECDHE-ECDSA-AES128-SHA",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA:          "ECDHE-ECDSA-AES256-SHA",
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA:            "ECDHE-RSA-AES128-SHA",
+	tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA:            "ECDHE-RSA-AES256-SHA",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256:       "ECDHE-ECDSA-AES128-GCM-SHA256",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384:       "ECDHE-ECDSA-AES256-GCM-SHA384",
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256:         "ECDHE-RSA-AES128-GCM-SHA256",
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384:         "ECDHE-RSA-AES256-GCM-SHA384",
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256: "ECDHE-ECDSA-CHACHA20-POLY1305",
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256:   "ECDHE-RSA-CHACHA20-POLY1305",
+}
+
+// tlsCipherSuiteNames returns the values of gitlab.tls_cipher_suites
+func tlsCipherSuiteNames() []string {
+	names := make([]string, 0, len(opensslCipherSuites))
+	for id := range opensslCipherSuites {
+		names = append(names, tls.CipherSuiteName(id))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// makeTLSConfig returns the tls config of the gitlab api client, and the git configuration applying the same policy to git over http
+// Both are nil when the default policy applies
+func makeTLSConfig(config *Config) (*tls.Config, []string, error) {
+	if config.Gitlab.TLSMinVersion == "" && len(config.Gitlab.TLSCipherSuites) == 0 {
+		return nil, nil, nil
+	}
+	tlsConfig := &tls.Config{}
+	var gitConfig []string
+
+	// parse tls_min_version
+	if config.Gitlab.TLSMinVersion != "" {
+		versions := make([]string, 0, len(tlsVersions))
+		for v := range tlsVersions {
+			versions = append(versions, v)
+		}
+		sort.Strings(versions)
+		if err := checkEnum("gitlab.tls_min_version", config.Gitlab.TLSMinVersion, versions...); err != nil {
+			return nil, nil, err
+		}
+		v := tlsVersions[config.Gitlab.TLSMinVersion]
+		tlsConfig.MinVersion = v.version
+		gitConfig = append(gitConfig, "http.sslVersion="+v.gitVersion)
+	}
+
+	// parse tls_cipher_suites
+	if len(config.Gitlab.TLSCipherSuites) > 0 {
+		if tlsConfig.MinVersion == tls.VersionTLS13 {
+			return nil, nil, fmt.Errorf("gitlab.tls_cipher_suites has no effect with a tls_min_version of 1.3, the cipher suites of TLS 1.3 are not configurable")
+		}
+		ids := map[string]uint16{}
+		for id := range opensslCipherSuites {
+			ids[tls.CipherSuiteName(id)] = id
+		}
+		opensslNames := make([]string, 0, len(config.Gitlab.TLSCipherSuites))
+		for _, name := range config.Gitlab.TLSCipherSuites {
+			id, ok := ids[name]
+			if !ok {
+				if err := checkEnum("gitlab.tls_cipher_suites", name, tlsCipherSuiteNames()...); err != nil {
+					return nil, nil, err
+				}
+			}
+			tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+			opensslNames = append(opensslNames, opensslCipherSuites[id])
+		}
+		gitConfig = append(gitConfig, "http.sslCipherList="+strings.Join(opensslNames, ":"))
+	}
+	return tlsConfig, gitConfig, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// tomlToYAML converts a toml document to yaml, so it is decoded like a yaml config file
+func tomlToYAML(content []byte) ([]byte, error) {
+	var doc map[string]interface{}
+	meta, err := toml.Decode(string(content), &doc)
+	if err != nil {
+		return nil, err
+	}
+
+	// The position of the keys in the document, to keep their order
+	// The keys of the elements of an array are listed without their index, they are ordered by their first use
+	positions := map[string]int{}
+	for i, key := range meta.Keys() {
+		if _, ok := positions[key.String()]; !ok {
+			positions[key.String()] = i
+		}
+	}
+	return yaml.Marshal(tomlToYAMLValue(doc, nil, positions))
+}
+
+// tomlToYAMLValue converts a value decoded from a toml document at path to the value of a yaml document
+// The dates and times are kept as strings, the config has no setting taking one
+func tomlToYAMLValue(value interface{}, path toml.Key, positions map[string]int) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		position := func(key string) int {
+			if p, ok := positions[append(path[:len(path):len(path)], key).String()]; ok {
+				return p
+			}
+			// The keys of the inline tables in arrays are not listed
+			return len(positions)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if pi, pj := position(keys[i]), position(keys[j]); pi != pj {
+				return pi < pj
+			}
+			return strings.Compare(keys[i], keys[j]) < 0
+		})
+
+		doc := make(yaml.MapSlice, 0, len(keys))
+		for _, key := range keys {
+			doc = append(doc, yaml.MapItem{Key: configKey(key), Value: tomlToYAMLValue(v[key], append(path[:len(path):len(path)], key), positions)})
+		}
+		return doc
+	case []map[string]interface{}:
+		array := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			array = append(array, tomlToYAMLValue(item, path, positions))
+		}
+		return array
+	case []interface{}:
+		array := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			array = append(array, tomlToYAMLValue(item, path, positions))
+		}
+		return array
+	case time.Time:
+		// The local dates and times are decoded in a zone named after their type
+		switch v.Location().String() {
+		case "datetime-local":
+			return v.Format("2006-01-02T15:04:05.999999999")
+		case "date-local":
+			return v.Format("2006-01-02")
+		case "time-local":
+			return v.Format("15:04:05.999999999")
+		}
+		return v.Format(time.RFC3339Nano)
+	default:
+		return v
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTomlToYAML(t *testing.T) {
+	tests := []struct {
+		name string
+		toml string
+		yaml string
+		err  string
+	}{
+		{
+			name: "key values",
+			toml: "a = 1\nb = \"x\"\nc = true\nd = 1.5\n",
+			yaml: "a: 1\nb: x\nc: true\nd: 1.5\n",
+		},
+		{
+			name: "tables",
+			toml: "[git]\nclone_location = '/tmp/clones'\ndepth = 0x10\n\n[gitlab]\nurl = \"https://gitlab.example.com\"\n",
+			yaml: "git:\n  clone_location: /tmp/clones\n  depth: 16\ngitlab:\n  url: https://gitlab.example.com\n",
+		},
+		{
+			name: "dotted keys",
+			toml: "git.depth = 1\ngit.remote = \"origin\"\n",
+			yaml: "git:\n  depth: 1\n  remote: origin\n",
+		},
+		{
+			name: "array of tables",
+			toml: "[[mounts]]\nname = \"a\"\n[[mounts]]\nname = \"b\"\n",
+			yaml: "mounts:\n- name: a\n- name: b\n",
+		},
+		{
+			name: "arrays and inline tables",
+			toml: "group_ids = [123, { id = 456, include_subgroups = false }, ]\n",
+			yaml: "group_ids:\n- 123\n- id: 456\n  include_subgroups: false\n",
+		},
+		{
+			name: "strings",
+			toml: "a = \"caf\\u00e9\"\nb = 'C:\\path'\nc = \"\"\"\nmulti\nline\"\"\"\n",
+			yaml: "a: café\nb: C:\\path\nc: |-\n  multi\n  line\n",
+		},
+		{
+			name: "order of the keys",
+			toml: "[gitlab]\nurl = \"https://gitlab.example.com\"\n[git]\nremote = \"origin\"\ndepth = 1\n",
+			yaml: "gitlab:\n  url: https://gitlab.example.com\ngit:\n  remote: origin\n  depth: 1\n",
+		},
+		{
+			name: "comments",
+			toml: "# comment\na = 1 # trailing\n",
+			yaml: "a: 1\n",
+		},
+		{
+			name: "dates are strings",
+			toml: "d = 1979-05-27\n",
+			yaml: "d: \"1979-05-27\"\n",
+		},
+		{
+			name: "integers with underscores",
+			toml: "a = 1_000\n",
+			yaml: "a: 1000\n",
+		},
+		{
+			name: "duplicate key",
+			toml: "a = 1\na = 2\n",
+			err:  "line 2 (last key \"a\"): Key 'a' has already been defined",
+		},
+		{
+			name: "duplicate table",
+			toml: "[a]\n[a]\n",
+			err:  "line 2: Key 'a' has already been defined",
+		},
+		{
+			name: "missing value",
+			toml: "a =\n",
+			err:  "expected value",
+		},
+		{
+			name: "invalid utf-8",
+			toml: "a = \"\xff\"\n",
+			err:  "invalid UTF-8",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out, err := tomlToYAML([]byte(test.toml))
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected an error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(out) != test.yaml {
+				t.Errorf("expected:\n%v\ngot:\n%v", test.yaml, string(out))
+			}
+		})
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// Folder where the units of the system manager are installed
+const systemUnitDir = "/etc/systemd/system"
+
+var serviceUnitTemplate = template.Must(template.New("service").Parse(`[Unit]
+Description=FUSE filesystem for gitlab groups and projects ({{.Name}})
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+Type=notify
+ExecStart={{.Executable}} -config {{.Config}}{{if .Profile}} -profile {{.Profile}}{{end}}
+# gitlabfs stops pinging the watchdog when the filesystem stops answering, systemd then restarts it
+WatchdogSec=60
+Restart=on-failure
+
+[Install]
+WantedBy=default.target
+`))
+
+var mountUnitTemplate = template.Must(template.New("mount").Parse(`[Unit]
+Description=FUSE filesystem for gitlab groups and projects ({{.Name}})
+Wants=network-online.target
+After=network-online.target
+
+[Mount]
+# Mounted by mount.fuse, which runs gitlabfs as {{.User}}
+What={{.Executable}}#{{.Config}}
+Where={{.Mountpoint}}
+Type=fuse
+Options={{.Options}}
+`))
+
+var automountUnitTemplate = template.Must(template.New("automount").Parse(`[Unit]
+Description=Mount the FUSE filesystem for gitlab groups and projects ({{.Name}}) on first access
+
+[Automount]
+Where={{.Mountpoint}}
+
+[Install]
+WantedBy=multi-user.target
+`))
+
+type unitParam struct {
+	Name       string
+	Executable string
+	Config     string
+	Profile    string
+	Mountpoint string
+	User       string
+	Options    string
+}
+
+// installUnit implements the install-unit subcommand
+// It writes a user service mounting the filesystem on login, along with a pair of automount and mount units of the system manager mounting it on first access
+func installUnit(args []string) error {
+	flags := flag.NewFlagSet("install-unit", flag.ExitOnError)
+	configPath := flags.String("config", findConfig(), "The config file")
+	profile := flags.String("profile", "", "The profile of the config file to apply")
+	userDir := flags.String("user-dir", "", "Folder where the user service is written. Default to $XDG_CONFIG_HOME/systemd/user")
+	systemDir := flags.String("system-dir", systemUnitDir, "Folder where the automount and mount units are written")
+	flags.Usage = func() {
+		fmt.Println("USAGE:")
+		fmt.Printf("    %s install-unit [-config CONFIG]\n\n", os.Args[0])
+		fmt.Println("OPTIONS:")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *configPath == "" {
+		flags.Usage()
+		return errors.New("the config file is required, none was found in the default locations")
+	}
+	config, err := loadConfig(*configPath, *profile)
+	if err != nil {
+		return err
+	}
+
+	param, err := makeUnitParam(config, *configPath)
+	if err != nil {
+		return err
+	}
+	if *userDir == "" {
+		configHome, err := os.UserConfigDir()
+		if err != nil {
+			return err
+		}
+		*userDir = filepath.Join(configHome, "systemd", "user")
+	}
+
+	serviceName := serviceUnitName(param.Name)
+	if err := writeUnit(filepath.Join(*userDir, serviceName), serviceUnitTemplate, param); err != nil {
+		return err
+	}
+	logger.Info("wrote user service", "path", filepath.Join(*userDir, serviceName))
+
+	if param.Mountpoint == "" && param.Profile != "" {
+		// mount.fuse only passes the config file and the mount options to gitlabfs
+		logger.Warn("not writing the automount unit, the profiles are not supported by the mount units")
+	} else if param.Mountpoint == "" {
+		logger.Warn("not writing the automount unit, it requires a single mountpoint configured at the top level of the config file")
+	} else {
+		// The automount of the filesystem is only supported by the system manager, its units cannot be installed as a user service
+		// If we can't write them there, leave them next to the user service for an administrator to install
+		unitName := systemdEscapePath(param.Mountpoint)
+		dir := *systemDir
+		err := writeUnit(filepath.Join(dir, unitName+".mount"), mountUnitTemplate, param)
+		if errors.Is(err, os.ErrPermission) {
+			logger.Warn("cannot write the automount unit in the system units, copy it there as root",
+				"path", dir, "error", err)
+			dir = filepath.Join(*userDir, "gitlabfs-system")
+			err = writeUnit(filepath.Join(dir, unitName+".mount"), mountUnitTemplate, param)
+		}
+		if err != nil {
+			return err
+		}
+		if err := writeUnit(filepath.Join(dir, unitName+".automount"), automountUnitTemplate, param); err != nil {
+			return err
+		}
+		logger.Info("wrote automount unit", "path", filepath.Join(dir, unitName+".automount"))
+	}
+
+	fmt.Println("To mount the filesystem on login, run:")
+	fmt.Printf("    systemctl --user daemon-reload && systemctl --user enable --now '%v'\n", serviceName)
+	if param.Mountpoint != "" {
+		fmt.Println("Or, to mount the filesystem on first access instead, run as root:")
+		fmt.Printf("    systemctl daemon-reload && systemctl enable --now '%v.automount'\n", systemdEscapePath(param.Mountpoint))
+	}
+	return nil
+}
+
+func makeUnitParam(config *Config, configPath string) (*unitParam, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate the gitlabfs executable: %v", err)
+	}
+	if resolved, err := filepath.EvalSymlinks(executable); err == nil {
+		executable = resolved
+	}
+	configPath, err = filepath.Abs(configPath)
+	if err != nil {
+		return nil, err
+	}
+	currentUser, err := user.Current()
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up the current user: %v", err)
+	}
+
+	param := &unitParam{
+		Name:       strings.TrimSuffix(filepath.Base(configPath), filepath.Ext(configPath)) + strings.ReplaceAll(profileSuffix(config), ".", "-"),
+		Executable: executable,
+		Config:     configPath,
+		Profile:    config.Profile,
+		User:       currentUser.Username,
+	}
+	if len(config.Mounts) == 0 && config.FS.Mountpoint != "" && config.Profile == "" {
+		param.Mountpoint, err = filepath.Abs(config.FS.Mountpoint)
+		if err != nil {
+			return nil, err
+		}
+		options := []string{"setuid=" + currentUser.Username}
+		options = append(options, parseMountoptions(config.FS.MountOptions)...)
+		param.Options = strings.Join(options, ",")
+	}
+	return param, nil
+}
+
+func writeUnit(path string, t *template.Template, param *unitParam) error {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, param); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create unit directory: %w", err)
+	}
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("failed to write unit: %w", err)
+	}
+	return nil
+}
+
+// serviceUnitName returns the name of the user service of the config named name
+func serviceUnitName(name string) string {
+	return "gitlabfs-" + strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || strings.ContainsRune(":_.-", r) {
+			return r
+		}
+		return '_'
+	}, name) + ".service"
+}
+
+// systemdEscape escapes s for use in the name of a unit, like systemd-escape
+func systemdEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '/':
+			b.WriteByte('-')
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == ':', c == '_', c == '.' && i > 0:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		}
+	}
+	return b.String()
+}
+
+// systemdEscapePath escapes path for use in the name of a mount unit, like systemd-escape --path
+func systemdEscapePath(path string) string {
+	path = strings.Trim(filepath.Clean(path), "/")
+	if path == "" {
+		return "-"
+	}
+	return systemdEscape(path)
+}
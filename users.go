@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The accounts listed in the users database
+const passwdPath = "/etc/passwd"
+
+// How long the filesystem of a user is given to unmount once it's stopped, before it's killed
+const userStopTimeout = 30 * time.Second
+
+// userInstance is a user served by the users subcommand, along with its config file
+type userInstance struct {
+	name   string
+	uid    uint32
+	gid    uint32
+	groups []uint32
+	home   string
+	config string
+}
+
+// serveUsers implements the users subcommand
+// It runs as a system service and mounts the filesystem of every user having a config file, each one under its own folder of the mount root
+func serveUsers(args []string) error {
+	flags := flag.NewFlagSet("users", flag.ExitOnError)
+	mountRoot := flags.String("mount-root", "/mnt/gitlabfs", "The folder holding the mountpoint of each user, named after the user")
+	usersDir := flags.String("users-dir", "/etc/gitlabfs/users.d", "The folder holding the config file of each user, named after the user, eg: alice.yaml")
+	homes := flags.Bool("homes", true, "Also serve the users having a config file in their home, in ~/.config/gitlabfs")
+	minUID := flags.Int("min-uid", 1000, "The lowest uid of the users served from their home")
+	restartDelay := flags.Duration("restart-delay", 10*time.Second, "How long to wait before restarting the filesystem of a user when it exits")
+	rescanInterval := flags.Duration("rescan-interval", time.Minute, "How often to look for the users added or removed, 0 to only look on SIGHUP")
+	flags.Usage = func() {
+		fmt.Println("USAGE:")
+		fmt.Printf("    %s users [-mount-root MOUNT_ROOT] [-users-dir USERS_DIR]\n\n", os.Args[0])
+		fmt.Println("OPTIONS:")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	// Without a config file, only the environment configures the logs of the service
+	config, err := loadConfig("", "")
+	if err != nil {
+		return err
+	}
+	if err := configureLogging(config); err != nil {
+		return err
+	}
+	if os.Geteuid() != 0 {
+		return errors.New("the users subcommand must run as root, to mount the filesystems of the other users")
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate the gitlabfs executable: %v", err)
+	}
+	if err := os.MkdirAll(*mountRoot, 0755); err != nil {
+		return fmt.Errorf("failed to create mount root: %v", err)
+	}
+
+	s := &userSupervisor{
+		executable:   executable,
+		mountRoot:    *mountRoot,
+		restartDelay: *restartDelay,
+		running:      map[string]*runningUser{},
+	}
+	scan := func() {
+		users, err := scanUsers(*usersDir, *homes, *minUID)
+		if err != nil {
+			logger.Error("failed to look for the users to serve", "error", err)
+			return
+		}
+		s.apply(users)
+	}
+	scan()
+	if err := sdNotify("READY=1"); err != nil {
+		logger.Warn("failed to report readiness to systemd", "error", err)
+	}
+
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	var rescan <-chan time.Time
+	if *rescanInterval > 0 {
+		ticker := time.NewTicker(*rescanInterval)
+		defer ticker.Stop()
+		rescan = ticker.C
+	}
+	for {
+		select {
+		case <-rescan:
+			scan()
+			continue
+		case sig := <-signalChan:
+			if sig == syscall.SIGHUP {
+				logger.Info("looking for the users added or removed", "signal", sig.String())
+				scan()
+				continue
+			}
+			logger.Info("stopping the filesystems of every user", "signal", sig.String())
+		}
+		break
+	}
+
+	if err := sdNotify("STOPPING=1"); err != nil {
+		logger.Warn("failed to report shutdown to systemd", "error", err)
+	}
+	s.apply(nil)
+	s.wg.Wait()
+	return nil
+}
+
+// scanUsers returns the users having a config file in usersDir, or in their home if homes is true
+// A config file in usersDir takes precedence over the one in the home of the user
+func scanUsers(usersDir string, homes bool, minUID int) ([]userInstance, error) {
+	configs := map[string]string{}
+	entries, err := os.ReadDir(usersDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read users dir: %v", err)
+	}
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if _, ok := configFormats[ext]; entry.IsDir() || !ok && ext != ".yaml" {
+			continue
+		}
+		name := strings.TrimSuffix(entry.Name(), ext)
+		if other, ok := configs[name]; ok {
+			logger.Warn("ignoring the config file of a user which has another one", "user", name, "config", filepath.Join(usersDir, entry.Name()), "other_config", other)
+			continue
+		}
+		configs[name] = filepath.Join(usersDir, entry.Name())
+	}
+
+	if homes {
+		accounts, err := listAccounts(minUID)
+		if err != nil {
+			return nil, err
+		}
+		for _, account := range accounts {
+			if _, ok := configs[account.name]; ok {
+				continue
+			}
+			for _, name := range []string{"config.yaml", "config.toml", "config.json"} {
+				path := filepath.Join(account.home, ".config", "gitlabfs", name)
+				if _, err := os.Stat(path); err == nil {
+					configs[account.name] = path
+					break
+				}
+			}
+		}
+	}
+
+	users := make([]userInstance, 0, len(configs))
+	for name, config := range configs {
+		u, err := lookupUserInstance(name)
+		if err != nil {
+			logger.Warn("ignoring the config file of an unknown user", "user", name, "config", config, "error", err)
+			continue
+		}
+		u.config = config
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].name < users[j].name })
+	return users, nil
+}
+
+type account struct {
+	name string
+	home string
+}
+
+// listAccounts returns the accounts of the users database with a uid of at least minUID
+func listAccounts(minUID int) ([]account, error) {
+	f, err := os.Open(passwdPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the users: %v", err)
+	}
+	defer f.Close()
+
+	var accounts []account
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// name:password:uid:gid:gecos:home:shell
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) < 7 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		uid, err := strconv.Atoi(fields[2])
+		if err != nil || uid < minUID || fields[5] == "" {
+			continue
+		}
+		accounts = append(accounts, account{name: fields[0], home: fields[5]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list the users: %v", err)
+	}
+	return accounts, nil
+}
+
+func lookupUserInstance(name string) (userInstance, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return userInstance{}, err
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return userInstance{}, err
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return userInstance{}, err
+	}
+	instance := userInstance{
+		name: u.Username,
+		uid:  uint32(uid),
+		gid:  uint32(gid),
+		home: u.HomeDir,
+	}
+	groupIDs, err := u.GroupIds()
+	if err != nil {
+		return userInstance{}, err
+	}
+	for _, g := range groupIDs {
+		if id, err := strconv.ParseUint(g, 10, 32); err == nil {
+			instance.groups = append(instance.groups, uint32(id))
+		}
+	}
+	return instance, nil
+}
+
+// userSupervisor runs the filesystem of each user served, and restarts it when it exits
+type userSupervisor struct {
+	executable   string
+	mountRoot    string
+	restartDelay time.Duration
+
+	mux     sync.Mutex
+	running map[string]*runningUser
+	wg      sync.WaitGroup
+
+	// Serializes the output of the filesystems
+	outputMux sync.Mutex
+}
+
+type runningUser struct {
+	user   userInstance
+	cancel context.CancelFunc
+}
+
+// apply stops the filesystems of the users which are no longer served, or whose account or config file changed, and starts the others
+func (s *userSupervisor) apply(users []userInstance) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	served := map[string]userInstance{}
+	for _, u := range users {
+		served[u.name] = u
+	}
+	for name, r := range s.running {
+		if u, ok := served[name]; !ok || !reflect.DeepEqual(u, r.user) {
+			r.cancel()
+			delete(s.running, name)
+		}
+	}
+	for _, u := range users {
+		if _, ok := s.running[u.name]; ok {
+			continue
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		s.running[u.name] = &runningUser{user: u, cancel: cancel}
+		s.wg.Add(1)
+		go s.supervise(ctx, u)
+	}
+}
+
+// supervise runs the filesystem of u until ctx is done
+func (s *userSupervisor) supervise(ctx context.Context, u userInstance) {
+	defer s.wg.Done()
+
+	mountpoint := filepath.Join(s.mountRoot, u.name)
+	for {
+		err := s.prepareUserMountpoint(mountpoint, u)
+		if err == nil {
+			logger.Info("starting the filesystem of user", "user", u.name, "config", u.config, "mountpoint", mountpoint)
+			err = s.run(ctx, mountpoint, u)
+		}
+		if ctx.Err() != nil {
+			logger.Info("stopped the filesystem of user", "user", u.name)
+			// A filesystem killed before it unmounted leaves a stale mount
+			if _, err := os.Stat(mountpoint); errors.Is(err, syscall.ENOTCONN) {
+				if err := unmountStale(mountpoint); err != nil {
+					logger.Warn("failed to unmount the filesystem of user", "user", u.name, "error", err)
+				}
+			}
+			return
+		}
+		logger.Warn("the filesystem of user exited, restarting it", "user", u.name, "error", err, "delay", s.restartDelay)
+		select {
+		case <-ctx.Done():
+			logger.Info("stopped the filesystem of user", "user", u.name)
+			return
+		case <-time.After(s.restartDelay):
+		}
+	}
+}
+
+// run runs gitlabfs as u, with the config file of u, until it exits or ctx is done
+func (s *userSupervisor) run(ctx context.Context, mountpoint string, u userInstance) error {
+	cmd := exec.CommandContext(ctx, s.executable, "mount", "-config", u.config, mountpoint)
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(syscall.SIGTERM)
+	}
+	cmd.WaitDelay = userStopTimeout
+	cmd.Dir = u.home
+	// The environment of the service is not the one of the user
+	path := os.Getenv("PATH")
+	if path == "" {
+		path = "/usr/local/bin:/usr/bin:/bin"
+	}
+	cmd.Env = []string{
+		"HOME=" + u.home,
+		"USER=" + u.name,
+		"LOGNAME=" + u.name,
+		"PATH=" + path,
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: u.uid, Gid: u.gid, Groups: u.groups},
+		// The signals of the terminal are for the service, which stops the filesystems itself
+		Setpgid: true,
+	}
+	output := &prefixWriter{prefix: "[" + u.name + "] ", w: os.Stdout, mux: &s.outputMux}
+	defer output.flush()
+	cmd.Stdout = output
+	cmd.Stderr = output
+	return cmd.Run()
+}
+
+// prepareUserMountpoint creates the mountpoint of u, only accessible to u
+func (s *userSupervisor) prepareUserMountpoint(mountpoint string, u userInstance) error {
+	info, err := os.Stat(mountpoint)
+	if errors.Is(err, syscall.ENOTCONN) {
+		logger.Warn("found a stale mount, unmounting it", "user", u.name, "mountpoint", mountpoint)
+		if err := unmountStale(mountpoint); err != nil {
+			return err
+		}
+		info, err = os.Stat(mountpoint)
+	}
+	if os.IsNotExist(err) {
+		if err := os.Mkdir(mountpoint, 0700); err != nil {
+			return fmt.Errorf("failed to create mountpoint: %v", err)
+		}
+		info, err = os.Stat(mountpoint)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid mountpoint: %v", err)
+	}
+	// fusermount requires the user to own the mountpoint
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && (stat.Uid != u.uid || stat.Gid != u.gid) {
+		if err := os.Chown(mountpoint, int(u.uid), int(u.gid)); err != nil {
+			return fmt.Errorf("failed to change the owner of the mountpoint: %v", err)
+		}
+	}
+	return nil
+}
+
+// prefixWriter writes each line written to it to w, prefixed with prefix
+type prefixWriter struct {
+	prefix string
+	w      io.Writer
+	mux    *sync.Mutex
+	buf    []byte
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.buf = append(p.buf, b...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i == -1 {
+			return len(b), nil
+		}
+		p.writeLine(p.buf[:i+1])
+		p.buf = p.buf[i+1:]
+	}
+}
+
+// flush writes the last line, if it's not terminated
+func (p *prefixWriter) flush() {
+	if len(p.buf) > 0 {
+		p.writeLine(append(p.buf, '\n'))
+		p.buf = nil
+	}
+}
+
+func (p *prefixWriter) writeLine(line []byte) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	p.w.Write(append([]byte(p.prefix), line...))
+}
+
+// Ensure we are implementing the io.Writer interface
+var _ = (io.Writer)((*prefixWriter)(nil))
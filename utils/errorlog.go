@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"sync"
+	"time"
+)
+
+type LoggedError struct {
+	Time  time.Time `yaml:"time"`
+	Error string    `yaml:"error"`
+}
+
+// ErrorLog keeps the most recent errors in memory
+type ErrorLog struct {
+	mux     sync.Mutex
+	size    int
+	entries []LoggedError
+}
+
+func NewErrorLog(size int) *ErrorLog {
+	return &ErrorLog{
+		size:    size,
+		entries: make([]LoggedError, 0, size),
+	}
+}
+
+func (l *ErrorLog) Add(err error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	if len(l.entries) >= l.size {
+		// Drop the oldest error
+		l.entries = append(l.entries[:0], l.entries[1:]...)
+	}
+	l.entries = append(l.entries, LoggedError{
+		Time:  time.Now(),
+		Error: Redact(err.Error()),
+	})
+}
+
+// Entries returns the errors in the log, from the oldest to the most recent
+func (l *ErrorLog) Entries() []LoggedError {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	entries := make([]LoggedError, len(l.entries))
+	copy(entries, l.entries)
+	return entries
+}
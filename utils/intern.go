@@ -0,0 +1,15 @@
+package utils
+
+import "sync"
+
+var interned sync.Map
+
+// Intern returns a string equal to s, shared with the other calls passing an equal string
+// Only meant for the values taking few distinct values across many objects, eg: the default branch of the projects, the strings are never released
+func Intern(s string) string {
+	if v, ok := interned.Load(s); ok {
+		return v.(string)
+	}
+	v, _ := interned.LoadOrStore(s, s)
+	return v.(string)
+}
@@ -0,0 +1,133 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"unicode"
+)
+
+// Socket of the native protocol of the systemd journal
+const journaldSocket = "/run/systemd/journal/socket"
+
+// journaldHandler sends the records to the systemd journal, with every attribute as a field of the entry
+type journaldHandler struct {
+	conn *net.UnixConn
+	tag  string
+
+	// Fields added with WithAttrs, already encoded
+	fields []byte
+	// Prefix of the name of the fields, from WithGroup
+	prefix string
+}
+
+// NewJournaldHandler returns a handler sending the records to the systemd journal, tagged with tag
+func NewJournaldHandler(tag string) (slog.Handler, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journaldSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the systemd journal: %v", err)
+	}
+	return &journaldHandler{conn: conn, tag: tag}, nil
+}
+
+func (h *journaldHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return true
+}
+
+func (h *journaldHandler) Handle(ctx context.Context, record slog.Record) error {
+	var buf bytes.Buffer
+	writeJournaldField(&buf, "MESSAGE", record.Message)
+	writeJournaldField(&buf, "PRIORITY", journaldPriority(record.Level))
+	writeJournaldField(&buf, "SYSLOG_IDENTIFIER", h.tag)
+	buf.Write(h.fields)
+	record.Attrs(func(a slog.Attr) bool {
+		h.appendAttr(&buf, h.prefix, a)
+		return true
+	})
+	_, err := h.conn.Write(buf.Bytes())
+	return err
+}
+
+func (h *journaldHandler) appendAttr(buf *bytes.Buffer, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "_"
+		}
+		for _, ga := range a.Value.Group() {
+			h.appendAttr(buf, prefix, ga)
+		}
+		return
+	}
+	writeJournaldField(buf, journaldFieldName(prefix+a.Key), a.Value.String())
+}
+
+func (h *journaldHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var buf bytes.Buffer
+	buf.Write(h.fields)
+	for _, a := range attrs {
+		h.appendAttr(&buf, h.prefix, a)
+	}
+	return &journaldHandler{conn: h.conn, tag: h.tag, fields: buf.Bytes(), prefix: h.prefix}
+}
+
+func (h *journaldHandler) WithGroup(name string) slog.Handler {
+	return &journaldHandler{conn: h.conn, tag: h.tag, fields: h.fields, prefix: h.prefix + name + "_"}
+}
+
+// Close disconnects from the systemd journal
+func (h *journaldHandler) Close() error {
+	return h.conn.Close()
+}
+
+// journaldPriority maps level to the syslog priority used by the journal
+func journaldPriority(level slog.Level) string {
+	switch {
+	case level >= slog.LevelError:
+		return "3"
+	case level >= slog.LevelWarn:
+		return "4"
+	case level >= slog.LevelInfo:
+		return "6"
+	default:
+		return "7"
+	}
+}
+
+// journaldFieldName turns key into a valid field name, made of uppercase letters, digits and underscores
+func journaldFieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return unicode.ToUpper(r)
+		}
+		return '_'
+	}, key)
+	// The fields starting with an underscore are reserved to the journal
+	return strings.TrimLeft(name, "_")
+}
+
+func writeJournaldField(buf *bytes.Buffer, name string, value string) {
+	if name == "" {
+		return
+	}
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(buf, "%s=%s\n", name, value)
+		return
+	}
+	// Values spanning multiple lines are prefixed by their size instead
+	buf.WriteString(name)
+	buf.WriteByte('\n')
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+// Ensure we are implementing the slog.Handler interface
+var _ = (slog.Handler)((*journaldHandler)(nil))
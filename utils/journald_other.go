@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package utils
+
+import (
+	"errors"
+	"log/slog"
+)
+
+// NewJournaldHandler always fails, the systemd journal is only available on linux
+func NewJournaldHandler(tag string) (slog.Handler, error) {
+	return nil, errors.New("the systemd journal is only available on linux")
+}
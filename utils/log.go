@@ -0,0 +1,116 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync/atomic"
+)
+
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// loggingConfig is the configuration shared by every logger, swapped as a whole when logging is reconfigured
+type loggingConfig struct {
+	handler slog.Handler
+	level   slog.Level
+	// Level of specific subsystems, overriding level
+	levels map[string]slog.Level
+}
+
+var logging atomic.Pointer[loggingConfig]
+
+func init() {
+	logging.Store(&loggingConfig{
+		handler: slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}),
+		level:   slog.LevelInfo,
+	})
+}
+
+// NewFormatHandler returns a handler writing the records to w in format
+func NewFormatHandler(w io.Writer, format string) (slog.Handler, error) {
+	// The level is filtered by the loggers, let everything through the handler
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+	switch format {
+	case LogFormatText:
+		return slog.NewTextHandler(w, opts), nil
+	case LogFormatJSON:
+		return slog.NewJSONHandler(w, opts), nil
+	default:
+		return nil, fmt.Errorf("log format must be either \"%v\" or \"%v\"", LogFormatText, LogFormatJSON)
+	}
+}
+
+// ConfigureLogging replaces the handler and the levels of every logger, including the loggers already created
+func ConfigureLogging(handler slog.Handler, level slog.Level, levels map[string]slog.Level) {
+	logging.Store(&loggingConfig{
+		handler: handler,
+		level:   level,
+		levels:  levels,
+	})
+}
+
+// ParseLogLevel parses one of "debug", "info", "warn" or "error"
+func ParseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return level, fmt.Errorf("log level must be either \"debug\", \"info\", \"warn\" or \"error\", got %q", s)
+	}
+	return level, nil
+}
+
+// NewLogger returns the logger of subsystem
+// Its records are tagged with the subsystem and filtered by the level configured for it
+func NewLogger(subsystem string) *slog.Logger {
+	return slog.New(&subsystemHandler{subsystem: subsystem})
+}
+
+// subsystemHandler sends the records of a subsystem to the handler currently configured
+type subsystemHandler struct {
+	subsystem string
+	// Applied in order to the handler currently configured, see WithAttrs and WithGroup
+	wrappers []func(slog.Handler) slog.Handler
+}
+
+func (h *subsystemHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	config := logging.Load()
+	if subsystemLevel, ok := config.levels[h.subsystem]; ok {
+		return level >= subsystemLevel
+	}
+	return level >= config.level
+}
+
+func (h *subsystemHandler) Handle(ctx context.Context, record slog.Record) error {
+	handler := logging.Load().handler.WithAttrs([]slog.Attr{slog.String("subsystem", h.subsystem)})
+	for _, wrap := range h.wrappers {
+		handler = wrap(handler)
+	}
+	return handler.Handle(ctx, redactRecord(record))
+}
+
+func (h *subsystemHandler) with(wrap func(slog.Handler) slog.Handler) *subsystemHandler {
+	return &subsystemHandler{
+		subsystem: h.subsystem,
+		wrappers:  append(append([]func(slog.Handler) slog.Handler{}, h.wrappers...), wrap),
+	}
+}
+
+func (h *subsystemHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	attrs = redactAttrs(attrs)
+	return h.with(func(handler slog.Handler) slog.Handler {
+		return handler.WithAttrs(attrs)
+	})
+}
+
+func (h *subsystemHandler) WithGroup(name string) slog.Handler {
+	return h.with(func(handler slog.Handler) slog.Handler {
+		return handler.WithGroup(name)
+	})
+}
+
+// Ensure we are implementing the slog.Handler interface
+var _ = (slog.Handler)((*subsystemHandler)(nil))
@@ -1,9 +1,15 @@
 package utils
 
 import (
-	"fmt"
+	"context"
+	"os"
 	"os/exec"
 	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
@@ -11,15 +17,43 @@ const (
 	stderr = "stderr"
 )
 
+var logger = NewLogger("exec")
+
+var tracer = otel.Tracer("github.com/badjware/gitlabfs/utils")
+
 func ExecProcessInDir(workdir string, command string, args ...string) (string, error) {
-	cmd := exec.Command(command, args...)
+	return ExecProcessInDirContext(context.Background(), workdir, command, args...)
+}
+
+// ExecProcessInDirContext is like ExecProcessInDir, but the process is killed if the context is done before it exits
+func ExecProcessInDirContext(ctx context.Context, workdir string, command string, args ...string) (string, error) {
+	return ExecProcessInDirContextEnv(ctx, workdir, nil, command, args...)
+}
+
+// ExecProcessInDirContextEnv is like ExecProcessInDirContext, with env added to the environment of the process
+// The environment is neither logged nor traced, unlike the arguments, so it can hold secrets
+func ExecProcessInDirContextEnv(ctx context.Context, workdir string, env []string, command string, args ...string) (string, error) {
+	ctx, span := tracer.Start(ctx, "exec "+command, trace.WithAttributes(
+		attribute.String("process.command", command),
+		attribute.StringSlice("process.command_args", args),
+		attribute.String("process.working_directory", workdir),
+	))
+	defer span.End()
+
+	cmd := exec.CommandContext(ctx, command, args...)
 	if workdir != "" {
 		cmd.Dir = workdir
 	}
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
 
 	// Run the command
-	fmt.Printf("%v %v\n", command, strings.Join(args, " "))
+	logger.Debug("running command", "command", command, "args", strings.Join(args, " "), "workdir", workdir)
 	output, err := cmd.Output()
+	if err != nil {
+		span.SetStatus(codes.Error, Redact(err.Error()))
+	}
 
 	return strings.TrimSpace(string(output)), err
 }
@@ -27,3 +61,7 @@ func ExecProcessInDir(workdir string, command string, args ...string) (string, e
 func ExecProcess(command string, args ...string) (string, error) {
 	return ExecProcessInDir("", command, args...)
 }
+
+func ExecProcessContext(ctx context.Context, command string, args ...string) (string, error) {
+	return ExecProcessInDirContext(ctx, "", command, args...)
+}
@@ -0,0 +1,168 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Layout of the timestamp appended to the name of the rotated log files
+const rotatedTimeLayout = "20060102-150405"
+
+// RotationParam configures when a RotatingFile is rotated and how many rotated files are kept
+type RotationParam struct {
+	// Size of the file after which it is rotated, in bytes. If zero, the file is not rotated on size
+	MaxSize int64
+	// Age of the file after which it is rotated. If zero, the file is not rotated on age
+	MaxAge time.Duration
+	// Number of rotated files kept, the oldest ones are deleted. If zero, every rotated file is kept
+	MaxBackups int
+}
+
+// RotatingFile is a file that is appended to and is renamed with a timestamp once it grows too large or too old
+type RotatingFile struct {
+	path string
+
+	mux    sync.Mutex
+	param  RotationParam
+	file   *os.File
+	size   int64
+	openAt time.Time
+}
+
+// OpenRotatingFile opens the file at path for appending, creating it and its directory if needed
+func OpenRotatingFile(path string, param RotationParam) (*RotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create log directory: %v", err)
+	}
+	f := &RotatingFile{
+		path:  path,
+		param: param,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Path returns the path of the file
+func (f *RotatingFile) Path() string {
+	return f.path
+}
+
+// SetRotation replaces the rotation params of the file
+func (f *RotatingFile) SetRotation(param RotationParam) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	f.param = param
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat log file: %v", err)
+	}
+	f.file = file
+	f.size = info.Size()
+	// The age of an existing file starts from its last modification, so restarts don't postpone its rotation forever
+	f.openAt = time.Now()
+	if f.size > 0 {
+		f.openAt = info.ModTime()
+	}
+	return nil
+}
+
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	if f.size > 0 && f.shouldRotate(int64(len(p))) {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *RotatingFile) shouldRotate(writeSize int64) bool {
+	if f.param.MaxSize > 0 && f.size+writeSize > f.param.MaxSize {
+		return true
+	}
+	if f.param.MaxAge > 0 && time.Since(f.openAt) > f.param.MaxAge {
+		return true
+	}
+	return false
+}
+
+// rotate renames the current file with a timestamp, opens a new one and deletes the rotated files over MaxBackups
+func (f *RotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return fmt.Errorf("failed to close log file: %v", err)
+	}
+	f.file = nil
+
+	rotatedPath := f.path + "." + time.Now().Format(rotatedTimeLayout)
+	if _, err := os.Stat(rotatedPath); err == nil {
+		// Rotated twice within the same second, don't overwrite the previous one
+		rotatedPath = fmt.Sprintf("%v.%v", rotatedPath, time.Now().UnixNano())
+	}
+	if err := os.Rename(f.path, rotatedPath); err != nil {
+		return fmt.Errorf("failed to rotate log file: %v", err)
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	f.removeOldBackups()
+	return nil
+}
+
+func (f *RotatingFile) removeOldBackups() {
+	if f.param.MaxBackups <= 0 {
+		return
+	}
+	backups, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return
+	}
+	rotated := backups[:0]
+	prefix := f.path + "."
+	for _, backup := range backups {
+		if _, err := time.Parse(rotatedTimeLayout, strings.SplitN(strings.TrimPrefix(backup, prefix), ".", 2)[0]); err == nil {
+			rotated = append(rotated, backup)
+		}
+	}
+	// The timestamps sort chronologically
+	sort.Strings(rotated)
+	for len(rotated) > f.param.MaxBackups {
+		os.Remove(rotated[0])
+		rotated = rotated[1:]
+	}
+}
+
+// Close closes the file, every write afterward fails
+func (f *RotatingFile) Close() error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
@@ -0,0 +1,123 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRotatingFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		param   RotationParam
+		writes  []string
+		content string
+		backups int
+	}{
+		{
+			name:    "no rotation",
+			writes:  []string{"aaaa\n", "bbbb\n", "cccc\n"},
+			content: "aaaa\nbbbb\ncccc\n",
+		},
+		{
+			name:    "rotated on size",
+			param:   RotationParam{MaxSize: 10},
+			writes:  []string{"aaaa\n", "bbbb\n", "cccc\n"},
+			content: "cccc\n",
+			backups: 1,
+		},
+		{
+			name:    "write larger than the size",
+			param:   RotationParam{MaxSize: 4},
+			writes:  []string{"aaaa\n", "bbbb\n"},
+			content: "bbbb\n",
+			backups: 1,
+		},
+		{
+			name:    "oldest backups removed",
+			param:   RotationParam{MaxSize: 5, MaxBackups: 2},
+			writes:  []string{"aaaa\n", "bbbb\n", "cccc\n", "dddd\n"},
+			content: "dddd\n",
+			backups: 2,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "logs", "gitlabfs.log")
+			f, err := OpenRotatingFile(path, test.param)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			for _, w := range test.writes {
+				if _, err := f.Write([]byte(w)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			content, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(content) != test.content {
+				t.Errorf("expected %q, got %q", test.content, string(content))
+			}
+			backups, err := filepath.Glob(path + ".*")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(backups) != test.backups {
+				t.Errorf("expected %v backups, got %v", test.backups, backups)
+			}
+			for _, backup := range backups {
+				timestamp := strings.SplitN(strings.TrimPrefix(backup, path+"."), ".", 2)[0]
+				if _, err := time.Parse(rotatedTimeLayout, timestamp); err != nil {
+					t.Errorf("expected the backup %v to be named after its rotation time", backup)
+				}
+			}
+		})
+	}
+}
+
+func TestRotatingFileAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gitlabfs.log")
+	if err := os.WriteFile(path, []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The age of an existing file starts from its last modification
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := OpenRotatingFile(path, RotationParam{MaxAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte("new\n")); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "new\n" {
+		t.Errorf("expected the old file to be rotated, got %q", string(content))
+	}
+}
+
+func TestRotatingFileClosed(t *testing.T) {
+	f, err := OpenRotatingFile(filepath.Join(t.TempDir(), "gitlabfs.log"), RotationParam{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("a\n")); err != os.ErrClosed {
+		t.Errorf("expected the write to fail once closed, got %v", err)
+	}
+}
@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"log/syslog"
+	"strings"
+	"sync"
+)
+
+// syslogHandler sends the records to syslog, with the priority matching their level
+type syslogHandler struct {
+	// Shared by the handlers derived with WithAttrs and WithGroup
+	shared *syslogWriter
+	// Formats the records in buf, without the time and the level already recorded by syslog
+	inner slog.Handler
+}
+
+type syslogWriter struct {
+	mux    sync.Mutex
+	buf    bytes.Buffer
+	writer *syslog.Writer
+}
+
+// NewSyslogHandler returns a handler sending the records to the local syslog daemon, tagged with tag
+func NewSyslogHandler(tag string) (slog.Handler, error) {
+	writer, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to syslog: %v", err)
+	}
+	shared := &syslogWriter{writer: writer}
+	return &syslogHandler{
+		shared: shared,
+		inner: slog.NewTextHandler(&shared.buf, &slog.HandlerOptions{
+			Level: slog.LevelDebug,
+			ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+				if len(groups) == 0 && (a.Key == slog.TimeKey || a.Key == slog.LevelKey) {
+					return slog.Attr{}
+				}
+				return a
+			},
+		}),
+	}, nil
+}
+
+func (h *syslogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return true
+}
+
+func (h *syslogHandler) Handle(ctx context.Context, record slog.Record) error {
+	h.shared.mux.Lock()
+	defer h.shared.mux.Unlock()
+
+	h.shared.buf.Reset()
+	if err := h.inner.Handle(ctx, record); err != nil {
+		return err
+	}
+	msg := strings.TrimSuffix(h.shared.buf.String(), "\n")
+	switch {
+	case record.Level >= slog.LevelError:
+		return h.shared.writer.Err(msg)
+	case record.Level >= slog.LevelWarn:
+		return h.shared.writer.Warning(msg)
+	case record.Level >= slog.LevelInfo:
+		return h.shared.writer.Info(msg)
+	default:
+		return h.shared.writer.Debug(msg)
+	}
+}
+
+func (h *syslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &syslogHandler{shared: h.shared, inner: h.inner.WithAttrs(attrs)}
+}
+
+func (h *syslogHandler) WithGroup(name string) slog.Handler {
+	return &syslogHandler{shared: h.shared, inner: h.inner.WithGroup(name)}
+}
+
+// Close disconnects from syslog
+func (h *syslogHandler) Close() error {
+	return h.shared.writer.Close()
+}
+
+// Ensure we are implementing the slog.Handler interface
+var _ = (slog.Handler)((*syslogHandler)(nil))
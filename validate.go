@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// unknownSettings returns an error for each setting of the config file content which does not exist, eg: because it's misspelled or misplaced
+func unknownSettings(content []byte) ([]error, error) {
+	var root yaml.MapSlice
+	if err := yaml.Unmarshal(content, &root); err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	var walk func(node interface{}, t reflect.Type, path string)
+	walk = func(node interface{}, t reflect.Type, path string) {
+		switch t.Kind() {
+		case reflect.Ptr:
+			walk(node, t.Elem(), path)
+		case reflect.Slice:
+			items, ok := node.([]interface{})
+			if !ok {
+				return
+			}
+			for i, item := range items {
+				walk(item, t.Elem(), fmt.Sprintf("%v[%v]", path, i))
+			}
+		case reflect.Struct:
+			settings, ok := node.(yaml.MapSlice)
+			if !ok {
+				return
+			}
+			fields := map[string]reflect.Type{}
+			keys := make([]string, 0, t.NumField())
+			for i := 0; i < t.NumField(); i++ {
+				key := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+				fields[key] = t.Field(i).Type
+				keys = append(keys, key)
+			}
+			for _, setting := range settings {
+				key := fmt.Sprint(setting.Key)
+				settingPath := key
+				if path != "" {
+					settingPath = path + "." + key
+				}
+				fieldType, ok := fields[key]
+				if !ok {
+					err := fmt.Errorf("%v is not a setting", settingPath)
+					if suggestion := suggest(key, keys); suggestion != "" {
+						err = fmt.Errorf("%v, did you mean %v?", err, suggestion)
+					}
+					errs = append(errs, err)
+					continue
+				}
+				walk(setting.Value, fieldType, settingPath)
+			}
+		}
+	}
+	walk(root, reflect.TypeOf(Config{}), "")
+	// The profiles are kept as is until one is applied, check them like the top-level settings
+	for _, item := range root {
+		if item.Key != "profiles" {
+			continue
+		}
+		profiles, _ := item.Value.(yaml.MapSlice)
+		for _, profile := range profiles {
+			walk(profile.Value, reflect.TypeOf(Config{}), fmt.Sprintf("profiles.%v", profile.Key))
+		}
+	}
+	return errs, nil
+}
+
+// checkEnum checks that the setting key is one of the allowed values, and suggests the closest one if it's not
+func checkEnum(key string, value string, allowed ...string) error {
+	for _, a := range allowed {
+		if value == a {
+			return nil
+		}
+	}
+	quoted := make([]string, 0, len(allowed))
+	for _, a := range allowed {
+		quoted = append(quoted, fmt.Sprintf("%q", a))
+	}
+	err := fmt.Errorf("%v must be either %v or %v, got %q", key, strings.Join(quoted[:len(quoted)-1], ", "), quoted[len(quoted)-1], value)
+	if suggestion := suggest(value, allowed); suggestion != "" {
+		err = fmt.Errorf("%v, did you mean %q?", err, suggestion)
+	}
+	return err
+}
+
+// suggest returns the candidate closest to s, or an empty string if none is close enough to be a typo of s
+func suggest(s string, candidates []string) string {
+	// Allow about one typo every three letters
+	best, bestDistance := "", len(s)/3+1
+	for _, candidate := range candidates {
+		if candidate == "" {
+			continue
+		}
+		if d := editDistance(strings.ToLower(s), strings.ToLower(candidate)); d < bestDistance {
+			best, bestDistance = candidate, d
+		}
+	}
+	return best
+}
+
+// editDistance returns the levenshtein distance between a and b
+func editDistance(a string, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
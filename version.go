@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/badjware/gitlabfs/git"
+	"gopkg.in/yaml.v2"
+)
+
+// Version of gitlabfs, set at build time with -ldflags "-X main.version=..."
+// If empty, the version of the module is used instead, eg: when installed with go install
+var version = ""
+
+type buildInfo struct {
+	Version   string       `yaml:"version"`
+	Commit    string       `yaml:"commit"`
+	GoVersion string       `yaml:"go_version"`
+	Platform  string       `yaml:"platform"`
+	GoGitlab  string       `yaml:"go_gitlab"`
+	GoFuse    string       `yaml:"go_fuse"`
+	Git       *git.GitInfo `yaml:"git"`
+	GitError  string       `yaml:"git_error,omitempty"`
+}
+
+// makeBuildInfo returns the version of gitlabfs, of its main dependencies and of the git binary it runs
+func makeBuildInfo(ctx context.Context) buildInfo {
+	info := buildInfo{
+		Version:   version,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if info.Version == "" {
+			info.Version = bi.Main.Version
+		}
+		for _, dep := range bi.Deps {
+			switch dep.Path {
+			case "github.com/xanzy/go-gitlab":
+				info.GoGitlab = dep.Version
+			case "github.com/hanwen/go-fuse/v2":
+				info.GoFuse = dep.Version
+			}
+		}
+		modified := false
+		for _, setting := range bi.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				info.Commit = setting.Value
+			case "vcs.modified":
+				modified = setting.Value == "true"
+			}
+		}
+		if modified && info.Commit != "" {
+			info.Commit += "-dirty"
+		}
+	}
+
+	gitInfo, err := git.DetectGit(ctx)
+	if err != nil {
+		info.GitError = err.Error()
+	}
+	info.Git = gitInfo
+	return info
+}
+
+// marshalBuildInfo returns the build info of gitlabfs, as exposed in the administrative folder
+func marshalBuildInfo() ([]byte, error) {
+	return yaml.Marshal(makeBuildInfo(context.Background()))
+}
+
+// printVersion implements the version subcommand
+func printVersion(args []string) error {
+	out, err := marshalBuildInfo()
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprint(os.Stdout, string(out))
+	return err
+}
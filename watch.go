@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// How long the config file must be left untouched before it's reloaded
+// Editors write a file in several steps, it's only reloaded once they are done
+const configWatchDelay = 500 * time.Millisecond
+
+// watchConfig calls reload whenever one of the config files at paths changes, until the returned watcher is closed
+// paths are the config file and the files it includes
+func watchConfig(paths []string, reload func()) (io.Closer, error) {
+	watched := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		path, err := filepath.Abs(p)
+		if err != nil {
+			return nil, err
+		}
+		watched[path] = true
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to watch config file: %v", err)
+	}
+	// Editors commonly replace the file rather than write it, watch its folder so the new file is seen
+	dirs := map[string]bool{}
+	for path := range watched {
+		if dirs[filepath.Dir(path)] {
+			continue
+		}
+		dirs[filepath.Dir(path)] = true
+		if err := watcher.Add(filepath.Dir(path)); err != nil {
+			watcher.Close()
+			return nil, fmt.Errorf("failed to watch config file: %v", err)
+		}
+	}
+
+	go func() {
+		var settled <-chan time.Time
+		var changed string
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if watched[event.Name] && event.Op&(fsnotify.Write|fsnotify.Create) != 0 {
+					settled = time.After(configWatchDelay)
+					changed = event.Name
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logger.Warn("failed to watch config file", "error", err)
+			case <-settled:
+				settled = nil
+				if _, err := os.Stat(changed); err != nil {
+					// Removed since, wait for it to be written again
+					continue
+				}
+				logger.Info("config file changed, reloading configuration", "config", changed)
+				reload()
+			}
+		}
+	}()
+	return watcher, nil
+}